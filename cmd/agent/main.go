@@ -2,31 +2,38 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
-	"github.com/noahjeana/k8s-exposer/internal/agent"
-	"github.com/noahjeana/k8s-exposer/pkg/types"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"github.com/noahjeana/k8s-exposer/pkg/agent"
 )
 
 func main() {
-	// Parse environment variables
-	serverAddr := getEnv("SERVER_ADDR", "10.0.0.1:9090")
-	clusterDomain := getEnv("CLUSTER_DOMAIN", "neverup.at")
-	logLevel := getEnv("LOG_LEVEL", "INFO")
-	syncInterval := getEnvDuration("SYNC_INTERVAL", 30*time.Second)
+	// Load the optional config file, environment variables take precedence
+	cfg, err := agent.LoadSettings(os.Getenv("AGENT_CONFIG"), os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load configuration:", err)
+		os.Exit(1)
+	}
 
 	// Setup logger
-	logger := setupLogger(logLevel)
+	logger, err := setupLogger(cfg.LogLevel, cfg.LogFormat, cfg.LogOutput)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set up logger:", err)
+		os.Exit(1)
+	}
+
 	logger.Info("Starting k8s-exposer agent",
-		"server_addr", serverAddr,
-		"cluster_domain", clusterDomain,
-		"sync_interval", syncInterval)
+		"server_addr", cfg.ServerAddr,
+		"cluster_domain", cfg.ClusterDomain,
+		"sync_interval", cfg.SyncInterval.Duration,
+		"target_strategy", cfg.TargetStrategy,
+		"namespaces", cfg.WatchNamespaces)
 
 	// Create context that listens for shutdown signals
 	ctx, cancel := context.WithCancel(context.Background())
@@ -41,99 +48,25 @@ func main() {
 		cancel()
 	}()
 
-	// Initialize Kubernetes client (in-cluster config)
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		logger.Error("Failed to get in-cluster config", "error", err)
-		os.Exit(1)
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
+	// Initialize the agent with the in-cluster Kubernetes client
+	a, err := agent.New(agent.Config{
+		Settings: cfg,
+		Logger:   logger,
+	})
 	if err != nil {
-		logger.Error("Failed to create Kubernetes client", "error", err)
+		logger.Error("Failed to initialize agent", "error", err)
 		os.Exit(1)
 	}
 
 	logger.Info("Kubernetes client initialized")
 
-	// Create channel for service updates
-	serviceUpdateCh := make(chan []types.ExposedService, 10)
-
-	// Create server client
-	serverClient := agent.NewServerClient(serverAddr, logger)
-
-	// Start server client in background
-	go func() {
-		if err := serverClient.Run(ctx, serviceUpdateCh); err != nil && err != context.Canceled {
-			logger.Error("Server client stopped with error", "error", err)
-			cancel()
-		}
-	}()
-
-	// Create service watcher
-	watcher := agent.NewServiceWatcher(clientset, func(services []types.ExposedService) {
-		logger.Info("Service change detected", "count", len(services))
-		select {
-		case serviceUpdateCh <- services:
-		case <-ctx.Done():
-		}
-	}, logger)
-
-	// Start periodic sync
-	go func() {
-		ticker := time.NewTicker(syncInterval)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				logger.Debug("Performing periodic service discovery")
-				services, err := agent.DiscoverServices(ctx, clientset, logger)
-				if err != nil {
-					logger.Error("Periodic discovery failed", "error", err)
-					continue
-				}
-				select {
-				case serviceUpdateCh <- services:
-				case <-ctx.Done():
-					return
-				}
-			}
-		}
-	}()
-
-	// Start service watcher (blocks until context is canceled)
-	logger.Info("Starting service watcher")
-	if err := watcher.StartWithRetry(ctx); err != nil && err != context.Canceled {
-		logger.Error("Service watcher failed", "error", err)
+	if err := a.Run(ctx); err != nil {
+		logger.Error("Agent stopped with error", "error", err)
 		os.Exit(1)
 	}
-
-	// Cleanup
-	logger.Info("Shutting down gracefully")
-	serverClient.Close()
-	logger.Info("Agent stopped")
-}
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
-func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
-	if value := os.Getenv(key); value != "" {
-		if duration, err := time.ParseDuration(value); err == nil {
-			return duration
-		}
-	}
-	return defaultValue
 }
 
-func setupLogger(level string) *slog.Logger {
+func setupLogger(level, format, output string) (*slog.Logger, error) {
 	var logLevel slog.Level
 	switch level {
 	case "DEBUG":
@@ -152,6 +85,34 @@ func setupLogger(level string) *slog.Logger {
 		Level: logLevel,
 	}
 
-	handler := slog.NewJSONHandler(os.Stdout, opts)
-	return slog.New(handler).With("component", "agent")
+	w, err := openLogOutput(output)
+	if err != nil {
+		return nil, err
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(handler).With("component", "agent"), nil
+}
+
+// openLogOutput returns the log destination: stdout, stderr or a file path.
+// Files are opened in append mode so external rotation (copytruncate) works.
+func openLogOutput(output string) (io.Writer, error) {
+	switch output {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	default:
+		file, err := os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		return file, nil
+	}
 }
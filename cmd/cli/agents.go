@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+var agentsCmd = &cobra.Command{
+	Use:   "agents",
+	Short: "List connected agents",
+	Long:  "List agents currently connected to the server",
+	RunE:  runAgents,
+}
+
+var resyncCmd = &cobra.Command{
+	Use:   "resync [agent-id]",
+	Short: "Ask agents to re-send their services",
+	Long:  "Request a full service resync from one agent, or from all connected agents if no ID is given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runResync,
+}
+
+func init() {
+	rootCmd.AddCommand(agentsCmd)
+	rootCmd.AddCommand(resyncCmd)
+}
+
+func runAgents(cmd *cobra.Command, args []string) error {
+	c := newClient()
+	agents, err := c.ListAgents()
+	if err != nil {
+		return fmt.Errorf("failed to list agents: %w", err)
+	}
+
+	if jsonOutput {
+		return printJSON(agents)
+	}
+
+	if len(agents) == 0 {
+		color.Yellow("No agents connected")
+		return nil
+	}
+
+	header := []string{"ID", "REMOTE ADDR", "INTERFACE", "CONNECTED AT"}
+	rows := make([][]string, 0, len(agents))
+	for _, agent := range agents {
+		rows = append(rows, []string{agent.ID, agent.RemoteAddr, valueOrDash(agent.Interface), agent.ConnectedAt})
+	}
+
+	widths := columnWidths(header, rows)
+	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+	fmt.Println(cyan(formatRow(header, widths)))
+	for _, row := range rows {
+		fmt.Println(formatRow(row, widths))
+	}
+
+	return nil
+}
+
+func runResync(cmd *cobra.Command, args []string) error {
+	c := newClient()
+
+	var ids []string
+	if len(args) == 1 {
+		ids = args
+	} else {
+		agents, err := c.ListAgents()
+		if err != nil {
+			return fmt.Errorf("failed to list agents: %w", err)
+		}
+		for _, agent := range agents {
+			ids = append(ids, agent.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		color.Yellow("No agents connected")
+		return nil
+	}
+
+	green := color.New(color.FgGreen, color.Bold).SprintFunc()
+	for _, id := range ids {
+		if err := c.Resync(id); err != nil {
+			return fmt.Errorf("resync of agent %s failed: %w", id, err)
+		}
+		fmt.Printf("%s Resync requested from agent %s\n", green("✓"), id)
+	}
+
+	return nil
+}
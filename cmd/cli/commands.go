@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/fatih/color"
-	"github.com/noahjeana/k8s-exposer/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -28,27 +27,43 @@ var versionCmd = &cobra.Command{
 	Run:   runVersion,
 }
 
+var syncAsync bool
+
 func init() {
+	syncCmd.Flags().BoolVar(&syncAsync, "async", false, "Return immediately instead of waiting for the reconciliation")
 	rootCmd.AddCommand(syncCmd)
 	rootCmd.AddCommand(metricsCmd)
 	rootCmd.AddCommand(versionCmd)
 }
 
 func runSync(cmd *cobra.Command, args []string) error {
-	c := client.NewClient(serverURL)
-	
-	if err := c.Sync(); err != nil {
+	c := newClient()
+	green := color.New(color.FgGreen, color.Bold).SprintFunc()
+
+	if syncAsync {
+		if err := c.SyncAsync(); err != nil {
+			return fmt.Errorf("sync failed: %w", err)
+		}
+		fmt.Printf("%s Reconciliation started, see the last reconciliation in 'k8s-exposer top'\n", green("✓"))
+		return nil
+	}
+
+	completed, err := c.Sync()
+	if err != nil {
 		return fmt.Errorf("sync failed: %w", err)
 	}
 
-	green := color.New(color.FgGreen, color.Bold).SprintFunc()
-	fmt.Printf("%s Reconciliation triggered successfully\n", green("✓"))
+	if !completed {
+		fmt.Printf("%s Reconciliation still running, see the last reconciliation in 'k8s-exposer top'\n", green("✓"))
+		return nil
+	}
+	fmt.Printf("%s Reconciliation completed successfully\n", green("✓"))
 
 	return nil
 }
 
 func runMetrics(cmd *cobra.Command, args []string) error {
-	c := client.NewClient(serverURL)
+	c := newClient()
 	
 	metrics, err := c.GetMetrics()
 	if err != nil {
@@ -109,4 +124,18 @@ func runVersion(cmd *cobra.Command, args []string) {
 	fmt.Printf("Version: %s\n", version)
 	fmt.Printf("Commit: %s\n", commit)
 	fmt.Printf("Built: %s\n", date)
+
+	// Server version is best-effort, the CLI version is still useful offline
+	c := newClient()
+	serverVersion, err := c.GetVersion()
+	if err != nil {
+		fmt.Printf("\nk8s-exposer server: unavailable (%v)\n", err)
+		return
+	}
+
+	fmt.Printf("\nk8s-exposer server\n")
+	fmt.Printf("Version: %s\n", serverVersion.Version)
+	fmt.Printf("Commit: %s\n", serverVersion.Commit)
+	fmt.Printf("Built: %s\n", serverVersion.Date)
+	fmt.Printf("Go Version: %s\n", serverVersion.GoVersion)
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/noahjeana/k8s-exposer/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that the deployment is wired up",
+	Long: `Run a one-shot check of the whole setup: server reachability and
+readiness, connected agents, exposed services, the last reconciliation
+(HAProxy, firewall, DNS) and whether service domains resolve.
+
+Prints a checklist with a hint for every problem and exits non-zero if a
+check failed.`,
+	RunE: runDoctor,
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// Results of a doctor check
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// doctorCheck is the result of one doctor check
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// dnsLookupTimeout bounds the resolution of each service domain
+const dnsLookupTimeout = 3 * time.Second
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	c := newClient()
+	checks := runDoctorChecks(c, net.DefaultResolver.LookupHost)
+
+	failed := 0
+	for _, check := range checks {
+		if check.Status == checkFail {
+			failed++
+		}
+	}
+
+	if jsonOutput {
+		if err := printJSON(checks); err != nil {
+			return err
+		}
+	} else {
+		printDoctorChecks(checks)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// runDoctorChecks runs all checks against the server. Checks depending on an
+// unreachable server are skipped.
+func runDoctorChecks(c *client.Client, lookupHost func(context.Context, string) ([]string, error)) []doctorCheck {
+	var checks []doctorCheck
+
+	version, err := c.GetVersion()
+	if err != nil {
+		return append(checks, doctorCheck{
+			Name:   "Server",
+			Status: checkFail,
+			Detail: err.Error(),
+			Hint:   fmt.Sprintf("Check that k8s-exposer-server is running and its API is reachable at %s (--server)", serverURL),
+		})
+	}
+	checks = append(checks, doctorCheck{
+		Name:   "Server",
+		Status: checkPass,
+		Detail: fmt.Sprintf("reachable, version %s", version.Version),
+	})
+
+	checks = append(checks, checkReadiness(c))
+	checks = append(checks, checkAgents(c))
+
+	services, servicesCheck := checkServices(c)
+	checks = append(checks, servicesCheck)
+	checks = append(checks, checkReconcile(c)...)
+	if len(services) > 0 {
+		checks = append(checks, checkDNS(services, lookupHost))
+	}
+
+	return checks
+}
+
+// checkReadiness checks that the WireGuard interface is up
+func checkReadiness(c *client.Client) doctorCheck {
+	check := doctorCheck{Name: "WireGuard"}
+
+	readiness, err := c.GetReadiness()
+	if err != nil {
+		check.Status = checkFail
+		check.Detail = err.Error()
+		return check
+	}
+
+	wg := readiness.WireGuard
+	switch {
+	case readiness.Ready():
+		check.Status = checkPass
+		check.Detail = fmt.Sprintf("interface %s is up", wg.Name)
+	case !wg.Exists:
+		check.Status = checkFail
+		check.Detail = fmt.Sprintf("interface %s does not exist", wg.Name)
+		check.Hint = "Bring up the tunnel (wg-quick up) or set EXPOSER_WIREGUARD_INTERFACE"
+	default:
+		check.Status = checkFail
+		check.Detail = fmt.Sprintf("interface %s is down", wg.Name)
+		check.Hint = "Check the tunnel with 'wg show' and 'ip link'"
+	}
+	if wg.Error != "" {
+		check.Detail += ": " + wg.Error
+	}
+	return check
+}
+
+// checkAgents checks that at least one agent is connected
+func checkAgents(c *client.Client) doctorCheck {
+	check := doctorCheck{Name: "Agents"}
+
+	agents, err := c.ListAgents()
+	switch {
+	case err != nil:
+		check.Status = checkFail
+		check.Detail = err.Error()
+	case len(agents) == 0:
+		check.Status = checkFail
+		check.Detail = "no agent connected"
+		check.Hint = "Check the agent logs and that SERVER_ADDR reaches the server's EXPOSER_LISTEN_ADDR over WireGuard"
+	default:
+		check.Status = checkPass
+		check.Detail = fmt.Sprintf("%d connected", len(agents))
+	}
+	return check
+}
+
+// checkServices checks that at least one service is exposed
+func checkServices(c *client.Client) ([]client.Service, doctorCheck) {
+	check := doctorCheck{Name: "Services"}
+
+	services, err := c.ListServices()
+	switch {
+	case err != nil:
+		check.Status = checkFail
+		check.Detail = err.Error()
+	case len(services) == 0:
+		check.Status = checkWarn
+		check.Detail = "no service exposed"
+		check.Hint = "Annotate a service with expose.neverup.at/subdomain and expose.neverup.at/ports"
+	default:
+		check.Status = checkPass
+		check.Detail = fmt.Sprintf("%d exposed", len(services))
+	}
+	return services, check
+}
+
+// checkReconcile checks the HAProxy, firewall and DNS stages of the last
+// reconciliation
+func checkReconcile(c *client.Client) []doctorCheck {
+	status, err := c.GetReconcileStatus()
+	if err != nil {
+		check := doctorCheck{Name: "Reconcile", Status: checkFail, Detail: err.Error()}
+		var apiErr *client.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.StatusCode {
+			case http.StatusNotFound:
+				check.Status = checkWarn
+				check.Detail = "no reconciliation has run yet"
+				check.Hint = "Wait for the first agent update or run 'k8s-exposer sync'"
+			case http.StatusServiceUnavailable:
+				check.Status = checkWarn
+				check.Detail = "automation not available"
+				check.Hint = "Check the server logs for preflight errors"
+			}
+		}
+		return []doctorCheck{check}
+	}
+
+	var checks []doctorCheck
+
+	reconcile := doctorCheck{Name: "Reconcile", Status: checkPass}
+	reconcile.Detail = fmt.Sprintf("last run %s ago, %d services, %d domains",
+		time.Since(status.Time).Round(time.Second), status.Services, status.Domains)
+	if !status.Success && status.Stage == "validate" {
+		reconcile.Status = checkFail
+		reconcile.Detail = status.Error
+		reconcile.Hint = "Fix the service annotations named in the error"
+	}
+	checks = append(checks, reconcile)
+
+	haproxy := doctorCheck{Name: "HAProxy", Status: checkPass, Detail: "domain mappings and config applied"}
+	switch {
+	case !status.Success && status.Stage == "haproxy":
+		haproxy.Status = checkFail
+		haproxy.Detail = status.Error
+		haproxy.Hint = "Check that HAProxy is running and HAPROXY_SOCKET, HAPROXY_MAP and HAPROXY_CONFIG are writable"
+	case !status.Success:
+		haproxy.Status = checkWarn
+		haproxy.Detail = "not reached by the last reconciliation"
+	}
+	checks = append(checks, haproxy)
+
+	firewall := doctorCheck{Name: "Firewall", Status: checkPass, Detail: "no errors (or disabled)"}
+	if status.FirewallError != "" {
+		firewall.Status = checkFail
+		firewall.Detail = status.FirewallError
+		firewall.Hint = "Check HETZNER_CLOUD_TOKEN and HETZNER_FIREWALL_ID"
+	}
+	checks = append(checks, firewall)
+
+	dns := doctorCheck{Name: "DNS records", Status: checkPass, Detail: "no errors (or disabled)"}
+	if status.DNSError != "" {
+		dns.Status = checkFail
+		dns.Detail = status.DNSError
+		dns.Hint = "Check DNS_PROVIDER, DNS_API_TOKEN and DNS_ZONE_ID"
+	}
+	checks = append(checks, dns)
+
+	return checks
+}
+
+// checkDNS checks that the domains of the exposed services resolve
+func checkDNS(services []client.Service, lookupHost func(context.Context, string) ([]string, error)) doctorCheck {
+	check := doctorCheck{Name: "DNS resolution"}
+
+	var resolved int
+	var unresolved []string
+	for _, svc := range services {
+		// Catch-all services have no domain of their own
+		if svc.FQDN == "" || strings.HasPrefix(svc.FQDN, "*") {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		_, err := lookupHost(ctx, svc.FQDN)
+		cancel()
+		if err != nil {
+			unresolved = append(unresolved, svc.FQDN)
+			continue
+		}
+		resolved++
+	}
+
+	if len(unresolved) > 0 {
+		check.Status = checkWarn
+		check.Detail = fmt.Sprintf("%d domain(s) do not resolve: %s", len(unresolved), strings.Join(unresolved, ", "))
+		check.Hint = "Point the domains (or a wildcard record) at the server, or set DNS_PROVIDER"
+		return check
+	}
+	check.Status = checkPass
+	check.Detail = fmt.Sprintf("%d domain(s) resolve", resolved)
+	return check
+}
+
+// printDoctorChecks prints the checks as a checklist
+func printDoctorChecks(checks []doctorCheck) {
+	green := color.New(color.FgGreen, color.Bold).SprintFunc()
+	yellow := color.New(color.FgYellow, color.Bold).SprintFunc()
+	red := color.New(color.FgRed, color.Bold).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	fmt.Println(cyan("=== k8s-exposer Doctor ==="))
+	fmt.Println()
+
+	counts := make(map[string]int)
+	for _, check := range checks {
+		counts[check.Status]++
+
+		symbol := green("✓")
+		switch check.Status {
+		case checkWarn:
+			symbol = yellow("!")
+		case checkFail:
+			symbol = red("✗")
+		}
+		fmt.Printf("%s %-15s %s\n", symbol, check.Name, check.Detail)
+		if check.Hint != "" {
+			fmt.Printf("  %-15s → %s\n", "", check.Hint)
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("%d passed, %d warnings, %d failed\n", counts[checkPass], counts[checkWarn], counts[checkFail])
+}
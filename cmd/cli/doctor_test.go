@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/client"
+)
+
+// doctorServer serves the endpoints used by the doctor. A nil agents or
+// reconcile value makes the endpoint answer like a fresh server.
+func doctorServer(t *testing.T, ready bool, agents []client.Agent, reconcile *client.ReconcileStatus) *httptest.Server {
+	t.Helper()
+	reply := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/version", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, client.Version{Version: "v1.2.3"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ready {
+			reply(w, http.StatusOK, client.Readiness{Status: "ready", WireGuard: client.InterfaceStatus{Name: "wg0", Exists: true, Up: true}})
+			return
+		}
+		reply(w, http.StatusServiceUnavailable, client.Readiness{Status: "not ready", WireGuard: client.InterfaceStatus{Name: "wg0", Exists: true}})
+	})
+	mux.HandleFunc("/api/v1/agents", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, map[string]interface{}{"agents": agents, "count": len(agents)})
+	})
+	mux.HandleFunc("/api/v1/services", func(w http.ResponseWriter, r *http.Request) {
+		services := []client.Service{
+			{Name: "web", Namespace: "prod", FQDN: "web.example.com"},
+			{Name: "app", Namespace: "prod", FQDN: "app.example.com"},
+			{Name: "fallback", Namespace: "prod", FQDN: "*.example.com"},
+		}
+		reply(w, http.StatusOK, map[string]interface{}{"services": services, "count": len(services)})
+	})
+	mux.HandleFunc("/api/v1/reconcile/status", func(w http.ResponseWriter, r *http.Request) {
+		if reconcile == nil {
+			reply(w, http.StatusNotFound, map[string]string{"error": "no reconciliation has run yet"})
+			return
+		}
+		reply(w, http.StatusOK, reconcile)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// lookupOnly resolves the given hosts and fails for any other
+func lookupOnly(hosts ...string) func(context.Context, string) ([]string, error) {
+	return func(ctx context.Context, host string) ([]string, error) {
+		for _, h := range hosts {
+			if h == host {
+				return []string{"203.0.113.1"}, nil
+			}
+		}
+		return nil, errors.New("no such host")
+	}
+}
+
+// statuses maps check names to their status
+func statuses(checks []doctorCheck) map[string]string {
+	result := make(map[string]string)
+	for _, check := range checks {
+		result[check.Name] = check.Status
+	}
+	return result
+}
+
+func TestDoctorHealthy(t *testing.T) {
+	srv := doctorServer(t, true,
+		[]client.Agent{{ID: "10.0.0.2", RemoteAddr: "10.0.0.2:41234"}},
+		&client.ReconcileStatus{Time: time.Now(), Success: true, Services: 3, Domains: 2})
+
+	checks := runDoctorChecks(client.NewClient(srv.URL), lookupOnly("web.example.com", "app.example.com"))
+
+	want := []string{"Server", "WireGuard", "Agents", "Services", "Reconcile", "HAProxy", "Firewall", "DNS records", "DNS resolution"}
+	if len(checks) != len(want) {
+		t.Fatalf("got %d checks, want %d: %+v", len(checks), len(want), checks)
+	}
+	for i, check := range checks {
+		if check.Name != want[i] {
+			t.Errorf("check %d is %q, want %q", i, check.Name, want[i])
+		}
+		if check.Status != checkPass {
+			t.Errorf("%s: status %s (%s), want pass", check.Name, check.Status, check.Detail)
+		}
+	}
+}
+
+func TestDoctorReportsProblems(t *testing.T) {
+	srv := doctorServer(t, false, nil, &client.ReconcileStatus{
+		Time:          time.Now(),
+		Success:       false,
+		Stage:         "haproxy",
+		Error:         "failed to reload HAProxy",
+		FirewallError: "firewall API returned status 401",
+	})
+
+	checks := runDoctorChecks(client.NewClient(srv.URL), lookupOnly("web.example.com"))
+
+	want := map[string]string{
+		"Server":         checkPass,
+		"WireGuard":      checkFail,
+		"Agents":         checkFail,
+		"Services":       checkPass,
+		"Reconcile":      checkPass,
+		"HAProxy":        checkFail,
+		"Firewall":       checkFail,
+		"DNS records":    checkPass,
+		"DNS resolution": checkWarn,
+	}
+	got := statuses(checks)
+	for name, status := range want {
+		if got[name] != status {
+			t.Errorf("%s: status %q, want %q", name, got[name], status)
+		}
+	}
+
+	failed := 0
+	for _, check := range checks {
+		if check.Status == checkFail {
+			failed++
+			if check.Hint == "" {
+				t.Errorf("%s: failed check has no hint", check.Name)
+			}
+		}
+	}
+	if failed != 4 {
+		t.Errorf("got %d failed checks, want 4", failed)
+	}
+}
+
+func TestDoctorWithoutReconciliation(t *testing.T) {
+	srv := doctorServer(t, true, []client.Agent{{ID: "10.0.0.2"}}, nil)
+
+	checks := runDoctorChecks(client.NewClient(srv.URL), lookupOnly("web.example.com", "app.example.com"))
+
+	got := statuses(checks)
+	if got["Reconcile"] != checkWarn {
+		t.Errorf("Reconcile: status %q, want warn", got["Reconcile"])
+	}
+	if _, ok := got["HAProxy"]; ok {
+		t.Error("HAProxy checked without a reconciliation")
+	}
+}
+
+func TestDoctorUnreachableServer(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	checks := runDoctorChecks(client.NewClient(url), lookupOnly())
+
+	if len(checks) != 1 {
+		t.Fatalf("got %d checks, want only the server check: %+v", len(checks), checks)
+	}
+	if checks[0].Name != "Server" || checks[0].Status != checkFail || checks[0].Hint == "" {
+		t.Errorf("unexpected check %+v", checks[0])
+	}
+}
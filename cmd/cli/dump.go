@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+var dumpOutput string
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Save a snapshot of the server state",
+	Long: `Save services, allocated ports, listeners, connected agents, the last
+reconcile result and the HAProxy mappings as JSON, e.g. to attach to a bug
+report. Secrets are redacted by the server. Requires the server's
+EXPOSER_API_TOKEN.`,
+	RunE: runDump,
+}
+
+func init() {
+	dumpCmd.Flags().StringVarP(&dumpOutput, "output", "o", "", `Output file (default k8s-exposer-dump-<time>.json, "-" for stdout)`)
+	rootCmd.AddCommand(dumpCmd)
+}
+
+func runDump(cmd *cobra.Command, args []string) error {
+	c := newClient()
+
+	dump, err := c.Dump()
+	if err != nil {
+		return fmt.Errorf("failed to get dump: %w", err)
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, dump, "", "  "); err != nil {
+		return fmt.Errorf("failed to format dump: %w", err)
+	}
+	out.WriteString("\n")
+
+	if dumpOutput == "-" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return err
+	}
+
+	path := dumpOutput
+	if path == "" {
+		path = fmt.Sprintf("k8s-exposer-dump-%s.json", time.Now().Format("20060102-150405"))
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write dump: %w", err)
+	}
+
+	green := color.New(color.FgGreen, color.Bold).SprintFunc()
+	fmt.Printf("%s Dump saved to %s\n", green("✓"), path)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var haproxyDryRun bool
+
+var haproxyCmd = &cobra.Command{
+	Use:   "haproxy",
+	Short: "Inspect the HAProxy integration",
+}
+
+var haproxyConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Print the HAProxy config",
+	Long: `Print the HAProxy config file written by the server, or with --dry-run
+the config the server would generate from the current services without
+writing it. The config contains the stats credentials, so this requires the
+server's API token (--token).`,
+	RunE: runHAProxyConfig,
+}
+
+func init() {
+	haproxyConfigCmd.Flags().BoolVar(&haproxyDryRun, "dry-run", false, "Render the config from the current services instead of reading the written file")
+	haproxyCmd.AddCommand(haproxyConfigCmd)
+	rootCmd.AddCommand(haproxyCmd)
+}
+
+func runHAProxyConfig(cmd *cobra.Command, args []string) error {
+	c := newClient()
+
+	config, err := c.GetHAProxyConfig(haproxyDryRun)
+	if err != nil {
+		return fmt.Errorf("failed to get HAProxy config: %w", err)
+	}
+
+	if jsonOutput {
+		return printJSON(config)
+	}
+
+	// Printed as is so the output can be redirected into a file or diffed
+	fmt.Print(config.Config)
+	if !strings.HasSuffix(config.Config, "\n") {
+		fmt.Println()
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/noahjeana/k8s-exposer/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -11,6 +13,9 @@ var (
 	// Global flags
 	serverURL string
 	jsonOutput bool
+	skipVersionCheck bool
+	apiToken string
+	requestTimeout time.Duration
 	
 	// Version info
 	version = "1.0.0"
@@ -35,11 +40,27 @@ Examples:
   k8s-exposer sync               # Force reconciliation
   k8s-exposer services get app   # Get service details`,
 	SilenceUsage: true,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if !skipVersionCheck {
+			checkVersionSkew(os.Stderr)
+		}
+	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&serverURL, "server", "http://localhost:8090", "k8s-exposer server URL")
 	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Output as JSON")
+	rootCmd.PersistentFlags().StringVar(&apiToken, "token", os.Getenv("EXPOSER_API_TOKEN"), "API token for protected endpoints (default $EXPOSER_API_TOKEN)")
+	rootCmd.PersistentFlags().BoolVar(&skipVersionCheck, "skip-version-check", false, "Skip the server/CLI version compatibility check")
+	rootCmd.PersistentFlags().DurationVar(&requestTimeout, "timeout", 0, "Timeout of each API request (default 10s, 30s for sync)")
+}
+
+// newClient creates an API client for --server with the --token and --timeout
+func newClient() *client.Client {
+	c := client.NewClient(serverURL)
+	c.SetToken(apiToken)
+	c.SetTimeout(requestTimeout)
+	return c
 }
 
 func main() {
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/fatih/color"
 	"github.com/noahjeana/k8s-exposer/pkg/client"
@@ -30,19 +32,57 @@ var servicesGetCmd = &cobra.Command{
 	RunE:  runServicesGet,
 }
 
+var servicesDescribeCmd = &cobra.Command{
+	Use:   "describe <name>",
+	Short: "Show full details, allocated ports, traffic and backend status for a service",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runServicesDescribe,
+}
+
+var servicesDrainCmd = &cobra.Command{
+	Use:   "drain <name>",
+	Short: "Refuse new connections to a service while keeping its ports bound",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runServicesDrain,
+}
+
+var servicesUndrainCmd = &cobra.Command{
+	Use:   "undrain <name>",
+	Short: "Accept new connections to a drained service again",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runServicesUndrain,
+}
+
+var (
+	servicesSort   string
+	servicesOutput string
+)
+
 func init() {
 	rootCmd.AddCommand(servicesCmd)
 	servicesCmd.AddCommand(servicesListCmd)
 	servicesCmd.AddCommand(servicesGetCmd)
+	servicesCmd.AddCommand(servicesDrainCmd)
+	servicesCmd.AddCommand(servicesUndrainCmd)
+	servicesCmd.AddCommand(servicesDescribeCmd)
+
+	for _, cmd := range []*cobra.Command{servicesCmd, servicesListCmd} {
+		cmd.Flags().StringVar(&servicesSort, "sort", "name", "Sort by: name, namespace, subdomain, port")
+		cmd.Flags().StringVarP(&servicesOutput, "output", "o", "", "Output format: wide")
+	}
 }
 
 func runServicesList(cmd *cobra.Command, args []string) error {
-	c := client.NewClient(serverURL)
+	c := newClient()
 	services, err := c.ListServices()
 	if err != nil {
 		return fmt.Errorf("failed to list services: %w", err)
 	}
 
+	if err := sortServices(services, servicesSort); err != nil {
+		return err
+	}
+
 	if jsonOutput {
 		return printJSON(services)
 	}
@@ -52,27 +92,38 @@ func runServicesList(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	// Print table
-	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
-	fmt.Printf("%s\n", cyan("NAME         NAMESPACE    SUBDOMAIN         TARGET IP      PORTS"))
-	fmt.Println("─────────────────────────────────────────────────────────────────────────")
+	wide := servicesOutput == "wide"
+	if servicesOutput != "" && !wide {
+		return fmt.Errorf("unknown output format %q (supported: wide)", servicesOutput)
+	}
 
+	header := []string{"NAME", "NAMESPACE", "SUBDOMAIN", "TARGET IP", "PORTS"}
+	if wide {
+		header = append(header, "NODE IP", "FQDN")
+	}
+
+	rows := make([][]string, 0, len(services))
 	for _, svc := range services {
-		ports := ""
-		for i, p := range svc.Ports {
-			if i > 0 {
-				ports += ", "
-			}
-			ports += fmt.Sprintf("%d→%d/%s", p.Port, p.TargetPort, p.Protocol)
+		ports := make([]string, 0, len(svc.Ports))
+		for _, p := range svc.Ports {
+			ports = append(ports, fmt.Sprintf("%d→%d/%s", p.Port, p.TargetPort, p.Protocol))
 		}
-		
-		fmt.Printf("%-12s %-12s %-17s %-14s %s\n",
-			svc.Name,
-			svc.Namespace,
-			svc.Subdomain,
-			svc.TargetIP,
-			ports,
-		)
+
+		row := []string{svc.Name, svc.Namespace, svc.Subdomain, svc.TargetIP, strings.Join(ports, ", ")}
+		if wide {
+			row = append(row, valueOrDash(svc.NodeIP), valueOrDash(svc.FQDN))
+		}
+		rows = append(rows, row)
+	}
+
+	// Print table
+	widths := columnWidths(header, rows)
+	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+	fmt.Println(cyan(formatRow(header, widths)))
+	fmt.Println(strings.Repeat("─", totalWidth(widths)))
+
+	for _, row := range rows {
+		fmt.Println(formatRow(row, widths))
 	}
 
 	fmt.Printf("\nTotal: %d services\n", len(services))
@@ -80,8 +131,91 @@ func runServicesList(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// sortServices sorts services in place by the given key
+func sortServices(services []client.Service, by string) error {
+	var less func(a, b client.Service) bool
+	switch by {
+	case "", "name":
+		less = func(a, b client.Service) bool { return a.Name < b.Name }
+	case "namespace":
+		less = func(a, b client.Service) bool {
+			if a.Namespace != b.Namespace {
+				return a.Namespace < b.Namespace
+			}
+			return a.Name < b.Name
+		}
+	case "subdomain":
+		less = func(a, b client.Service) bool { return a.Subdomain < b.Subdomain }
+	case "port":
+		less = func(a, b client.Service) bool { return firstPort(a) < firstPort(b) }
+	default:
+		return fmt.Errorf("unknown sort key %q (supported: name, namespace, subdomain, port)", by)
+	}
+
+	sort.SliceStable(services, func(i, j int) bool { return less(services[i], services[j]) })
+	return nil
+}
+
+// firstPort returns the first exposed port of a service, or 0 if it has none
+func firstPort(svc client.Service) int32 {
+	if len(svc.Ports) == 0 {
+		return 0
+	}
+	return svc.Ports[0].Port
+}
+
+// columnWidths computes the display width of each column from header and rows
+func columnWidths(header []string, rows [][]string) []int {
+	widths := make([]int, len(header))
+	for i, h := range header {
+		widths[i] = len([]rune(h))
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if w := len([]rune(cell)); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	return widths
+}
+
+// formatRow pads cells to the column widths, leaving the last column unpadded
+func formatRow(cells []string, widths []int) string {
+	var b strings.Builder
+	for i, cell := range cells {
+		if i > 0 {
+			b.WriteString("  ")
+		}
+		if i == len(cells)-1 {
+			b.WriteString(cell)
+			break
+		}
+		b.WriteString(cell)
+		b.WriteString(strings.Repeat(" ", widths[i]-len([]rune(cell))))
+	}
+	return b.String()
+}
+
+// totalWidth returns the full table width including column separators
+func totalWidth(widths []int) int {
+	total := 0
+	for _, w := range widths {
+		total += w
+	}
+	return total + 2*(len(widths)-1)
+}
+
+// valueOrDash returns "-" for empty values
+func valueOrDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
 func runServicesGet(cmd *cobra.Command, args []string) error {
-	c := client.NewClient(serverURL)
+	c := newClient()
 	service, err := c.GetService(args[0])
 	if err != nil {
 		return fmt.Errorf("failed to get service: %w", err)
@@ -101,6 +235,9 @@ func runServicesGet(cmd *cobra.Command, args []string) error {
 	if service.FQDN != "" {
 		fmt.Printf("%s: %s\n", cyan("FQDN"), green(service.FQDN))
 	}
+	if len(service.SourceRanges) > 0 {
+		fmt.Printf("%s: %s\n", cyan("Source Ranges"), strings.Join(service.SourceRanges, ", "))
+	}
 	fmt.Printf("%s: %s\n", cyan("Target IP"), service.TargetIP)
 	
 	fmt.Printf("\n%s:\n", cyan("Ports"))
@@ -111,8 +248,133 @@ func runServicesGet(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// serviceDescription aggregates everything known about a single service
+type serviceDescription struct {
+	Service *client.Service        `json:"service"`
+	Metrics *client.ServiceStats  `json:"metrics,omitempty"`
+	Backend *client.BackendStatus `json:"backend,omitempty"`
+}
+
+func runServicesDescribe(cmd *cobra.Command, args []string) error {
+	c := newClient()
+	service, err := c.GetService(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to get service: %w", err)
+	}
+
+	// Metrics and backend state are best effort
+	metrics, metricsErr := c.GetServiceStats(args[0])
+	backend, backendErr := c.GetServiceBackend(args[0])
+	desc := serviceDescription{Service: service, Metrics: metrics, Backend: backend}
+
+	if jsonOutput {
+		return printJSON(desc)
+	}
+
+	green := color.New(color.FgGreen, color.Bold).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+
+	fmt.Printf("%s: %s\n", cyan("Name"), green(service.Name))
+	fmt.Printf("%s: %s\n", cyan("Namespace"), service.Namespace)
+	fmt.Printf("%s: %s\n", cyan("Subdomain"), service.Subdomain)
+	fmt.Printf("%s: %s\n", cyan("FQDN"), valueOrDash(service.FQDN))
+	if len(service.Aliases) > 0 {
+		fmt.Printf("%s: %s\n", cyan("Aliases"), strings.Join(service.Aliases, ", "))
+	}
+	fmt.Printf("%s: %s\n", cyan("Target IP"), service.TargetIP)
+	fmt.Printf("%s: %s\n", cyan("Node IP"), valueOrDash(service.NodeIP))
+	fmt.Printf("%s: %s\n", cyan("Interface"), valueOrDash(service.Interface))
+	fmt.Printf("%s: %s\n", cyan("Agent"), valueOrDash(service.AgentID))
+
+	fmt.Printf("\n%s:\n", cyan("Ports"))
+	for _, p := range service.Ports {
+		allocated := "-"
+		for _, a := range service.Allocations {
+			if a.RequestedPort == p.Port && a.Protocol == p.Protocol {
+				allocated = fmt.Sprint(a.AllocatedPort)
+			}
+		}
+		fmt.Printf("  • %d → %d (%s), allocated %s\n", p.Port, p.TargetPort, p.Protocol, allocated)
+	}
+	if service.StrictPort {
+		fmt.Println("  Strict: ports are never moved to a fallback port")
+	}
+
+	fmt.Printf("\n%s:\n", cyan("Limits"))
+	fmt.Printf("  Max connections: %s\n", limitOrUnlimited(service.MaxConnections))
+	fmt.Printf("  HAProxy maxconn: %s\n", limitOrUnlimited(service.MaxConn))
+	fmt.Printf("  Server first:    %t\n", service.ServerFirst)
+	fmt.Printf("  Drained:         %t\n", service.Drained)
+
+	fmt.Printf("\n%s:\n", cyan("Backend"))
+	if backendErr != nil {
+		fmt.Printf("  %s\n", red(fmt.Sprintf("unavailable: %v", backendErr)))
+	} else {
+		status := desc.Backend.Status
+		if status == "UP" {
+			status = green(status)
+		} else {
+			status = red(status)
+		}
+		fmt.Printf("  %s: %s\n", desc.Backend.Backend, status)
+		if desc.Backend.Error != "" {
+			fmt.Printf("  %s\n", red(desc.Backend.Error))
+		}
+	}
+	if service.HealthCheck != nil {
+		check := "GET " + service.HealthCheck.Path
+		if service.HealthCheck.ExpectStatus != 0 {
+			check += fmt.Sprintf(" (expect %d)", service.HealthCheck.ExpectStatus)
+		}
+		fmt.Printf("  Health check: %s\n", check)
+	}
+
+	fmt.Printf("\n%s:\n", cyan("Traffic"))
+	if metricsErr != nil {
+		fmt.Printf("  %s\n", red(fmt.Sprintf("unavailable: %v", metricsErr)))
+	} else {
+		m := desc.Metrics
+		fmt.Printf("  Bytes in/out:       %d / %d\n", m.BytesIn, m.BytesOut)
+		fmt.Printf("  Connections:        %d active, %d total\n", m.ActiveConnections, m.TotalConnections)
+		fmt.Printf("  Rejected / errors:  %d / %d\n", m.Rejected, m.Errors)
+	}
+
+	return nil
+}
+
+// limitOrUnlimited formats a connection limit where 0 means unlimited
+func limitOrUnlimited(n int32) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(n)
+}
+
 func printJSON(v interface{}) error {
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
 	return enc.Encode(v)
 }
+
+func runServicesDrain(cmd *cobra.Command, args []string) error {
+	c := newClient()
+	if err := c.DrainService(args[0]); err != nil {
+		return fmt.Errorf("failed to drain service: %w", err)
+	}
+
+	green := color.New(color.FgGreen, color.Bold).SprintFunc()
+	fmt.Printf("%s Service %s drained, new connections are refused\n", green("✓"), args[0])
+	return nil
+}
+
+func runServicesUndrain(cmd *cobra.Command, args []string) error {
+	c := newClient()
+	if err := c.UndrainService(args[0]); err != nil {
+		return fmt.Errorf("failed to undrain service: %w", err)
+	}
+
+	green := color.New(color.FgGreen, color.Bold).SprintFunc()
+	fmt.Printf("%s Service %s accepts new connections again\n", green("✓"), args[0])
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/client"
+)
+
+// testServices returns services in an order matching none of the sort keys
+func testServices() []client.Service {
+	return []client.Service{
+		{Name: "web", Namespace: "prod", Subdomain: "www", Ports: []client.PortMapping{{Port: 8080}}},
+		{Name: "api", Namespace: "staging", Subdomain: "backend", Ports: []client.PortMapping{{Port: 443}}},
+		{Name: "db", Namespace: "prod", Subdomain: "postgres", Ports: []client.PortMapping{{Port: 5432}}},
+		{Name: "empty", Namespace: "dev", Subdomain: "a"},
+	}
+}
+
+func TestSortServices(t *testing.T) {
+	tests := []struct {
+		by   string
+		want []string
+	}{
+		{"", []string{"api", "db", "empty", "web"}},
+		{"name", []string{"api", "db", "empty", "web"}},
+		{"namespace", []string{"empty", "db", "web", "api"}},
+		{"subdomain", []string{"empty", "api", "db", "web"}},
+		{"port", []string{"empty", "api", "db", "web"}},
+	}
+	for _, tt := range tests {
+		services := testServices()
+		if err := sortServices(services, tt.by); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, svc := range services {
+			names = append(names, svc.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("sort by %q: expected %v, got %v", tt.by, tt.want, names)
+		}
+	}
+
+	if err := sortServices(testServices(), "age"); err == nil {
+		t.Error("expected an error for an unknown sort key")
+	}
+}
+
+func TestColumnWidths(t *testing.T) {
+	header := []string{"NAME", "SUBDOMAIN", "PORTS"}
+	rows := [][]string{
+		{"a-very-long-service-name", "web", "8080→80/tcp"},
+		{"db", "postgres-primary", "5432→5432/tcp, 5433→5433/tcp"},
+	}
+
+	widths := columnWidths(header, rows)
+	// Multi-byte characters count as one column
+	if want := []int{24, 16, 28}; !reflect.DeepEqual(widths, want) {
+		t.Fatalf("expected widths %v, got %v", want, widths)
+	}
+	if total := totalWidth(widths); total != 24+16+28+4 {
+		t.Errorf("unexpected total width %d", total)
+	}
+
+	// Cells are padded to their column, the last column is not
+	if got, want := formatRow(rows[0], widths), "a-very-long-service-name  web               8080→80/tcp"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got, want := formatRow(header, widths), "NAME                      SUBDOMAIN         PORTS"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+// captureStdout returns what f writes to stdout
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	out := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// describeAPI serves the service, metrics and backend endpoints for "game"
+func describeAPI(t *testing.T) {
+	t.Helper()
+	responses := map[string]string{
+		"/api/v1/services/game": `{"name":"game","namespace":"default","subdomain":"play","target_ip":"10.42.0.5",
+			"fqdn":"play.example.com","ports":[{"port":27015,"target_port":27015,"protocol":"udp"}],
+			"max_connections":100,"health_check":{"path":"/healthz","expect_status":200},
+			"allocations":[{"requested_port":27015,"allocated_port":30001,"protocol":"udp"}]}`,
+		"/api/v1/services/game/metrics": `{"bytes_in":1024,"bytes_out":2048,"active_connections":2,"total_connections":7,"rejected":1,"errors":0}`,
+		"/api/v1/services/game/backend": `{"name":"game","backend":"backend_27015","status":"UP"}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	oldServer, oldJSON := serverURL, jsonOutput
+	t.Cleanup(func() { serverURL, jsonOutput = oldServer, oldJSON })
+	serverURL = srv.URL
+}
+
+func TestServicesDescribe(t *testing.T) {
+	describeAPI(t)
+	jsonOutput = false
+
+	out := captureStdout(t, func() error { return runServicesDescribe(servicesDescribeCmd, []string{"game"}) })
+	for _, want := range []string{
+		"FQDN: play.example.com",
+		"27015 → 27015 (udp), allocated 30001",
+		"Max connections: 100",
+		"HAProxy maxconn: unlimited",
+		"backend_27015: UP",
+		"Health check: GET /healthz (expect 200)",
+		"Bytes in/out:       1024 / 2048",
+		"Connections:        2 active, 7 total",
+		"Rejected / errors:  1 / 0",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestServicesDescribeJSON(t *testing.T) {
+	describeAPI(t)
+	jsonOutput = true
+
+	out := captureStdout(t, func() error { return runServicesDescribe(servicesDescribeCmd, []string{"game"}) })
+	var desc serviceDescription
+	if err := json.Unmarshal([]byte(out), &desc); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out, err)
+	}
+	if desc.Service.Allocations[0].AllocatedPort != 30001 || desc.Metrics.TotalConnections != 7 || desc.Backend.Status != "UP" {
+		t.Errorf("unexpected description %+v", desc)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/fatih/color"
-	"github.com/noahjeana/k8s-exposer/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -20,7 +19,7 @@ func init() {
 }
 
 func runStatus(cmd *cobra.Command, args []string) error {
-	c := client.NewClient(serverURL)
+	c := newClient()
 	
 	health, err := c.GetHealth()
 	if err != nil {
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/noahjeana/k8s-exposer/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Live view of services, connections and server resources",
+	Long:  "Continuously poll the server and show services, traffic, memory and the last reconciliation until interrupted",
+	RunE:  runTop,
+}
+
+var topInterval time.Duration
+
+func init() {
+	rootCmd.AddCommand(topCmd)
+	topCmd.Flags().DurationVar(&topInterval, "interval", 2*time.Second, "Refresh interval")
+}
+
+// topFrame is the data shown in a single refresh of the top view
+type topFrame struct {
+	Time           time.Time
+	Metrics        *client.Metrics
+	MetricsErr     error
+	Services       []client.Service
+	ServicesErr    error
+	Stats          map[string]*client.ServiceStats // service name -> traffic counters
+	StatsAvailable bool
+	Reconcile      *client.ReconcileStatus
+	ReconcileErr   error
+}
+
+func runTop(cmd *cobra.Command, args []string) error {
+	if topInterval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := newClient()
+	ticker := time.NewTicker(topInterval)
+	defer ticker.Stop()
+
+	var services serviceCache
+	for {
+		frame := collectTopFrame(c, &services)
+		// Clear the screen and move the cursor home before each frame
+		fmt.Print("\033[H\033[2J")
+		renderTop(os.Stdout, frame)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// serviceCache keeps the last service list so unchanged lists are not
+// transferred again
+type serviceCache struct {
+	services []client.Service
+	etag     string
+}
+
+// list returns the current service list, reusing the cached one while the
+// server reports it unchanged
+func (sc *serviceCache) list(c *client.Client) ([]client.Service, error) {
+	services, etag, err := c.ListServicesIfChanged(sc.etag)
+	if errors.Is(err, client.ErrNotModified) {
+		return sc.services, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc.services, sc.etag = services, etag
+	return services, nil
+}
+
+// collectTopFrame fetches everything shown in one frame, recording errors
+// instead of failing so the view keeps refreshing while the server is down
+func collectTopFrame(c *client.Client, services *serviceCache) topFrame {
+	frame := topFrame{
+		Time:           time.Now(),
+		Stats:          make(map[string]*client.ServiceStats),
+		StatsAvailable: true,
+	}
+
+	frame.Metrics, frame.MetricsErr = c.GetMetrics()
+	frame.Services, frame.ServicesErr = services.list(c)
+	frame.Reconcile, frame.ReconcileErr = c.GetReconcileStatus()
+
+	for _, svc := range frame.Services {
+		stats, err := c.GetServiceStats(svc.Name)
+		if errors.Is(err, client.ErrStatsNotAvailable) {
+			frame.StatsAvailable = false
+			break
+		}
+		if err != nil {
+			continue
+		}
+		frame.Stats[svc.Name] = stats
+	}
+
+	return frame
+}
+
+// renderTop writes a single frame of the top view
+func renderTop(w io.Writer, frame topFrame) {
+	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+
+	fmt.Fprintf(w, "%s  %s  %s\n", cyan("k8s-exposer top"), serverURL, frame.Time.Format("15:04:05"))
+	fmt.Fprintln(w)
+
+	// Server resources
+	if frame.MetricsErr != nil {
+		fmt.Fprintf(w, "Metrics:    %s\n", red(fmt.Sprintf("unavailable: %v", frame.MetricsErr)))
+	} else {
+		m := frame.Metrics
+		fmt.Fprintf(w, "Services:   %s    Ports: %s    Active connections: %s\n",
+			metricValue(m.Services, "total"),
+			metricValue(m.Services, "total_ports"),
+			totalActiveConnections(frame))
+		fmt.Fprintf(w, "Memory:     %s MB allocated, %s MB system    Goroutines: %s\n",
+			metricValue(m.Memory, "alloc_mb"),
+			metricValue(m.Memory, "sys_mb"),
+			metricValue(m.Runtime, "goroutines"))
+	}
+
+	// Last reconciliation
+	switch {
+	case frame.ReconcileErr != nil:
+		fmt.Fprintf(w, "Reconcile:  %s\n", reconcileUnavailable(frame.ReconcileErr))
+	case frame.Reconcile.Success:
+		fmt.Fprintf(w, "Reconcile:  ok %s ago (took %s)\n",
+			frame.Time.Sub(frame.Reconcile.Time).Round(time.Second),
+			frame.Reconcile.Duration.Round(time.Millisecond))
+	default:
+		fmt.Fprintf(w, "Reconcile:  %s %s ago (%s: %s)\n",
+			red("failed"),
+			frame.Time.Sub(frame.Reconcile.Time).Round(time.Second),
+			frame.Reconcile.Stage,
+			frame.Reconcile.Error)
+	}
+	fmt.Fprintln(w)
+
+	// Per-service traffic
+	if frame.ServicesErr != nil {
+		fmt.Fprintln(w, red(fmt.Sprintf("Services unavailable: %v", frame.ServicesErr)))
+		return
+	}
+	if len(frame.Services) == 0 {
+		fmt.Fprintln(w, "No services exposed")
+		return
+	}
+
+	header := []string{"NAME", "NAMESPACE", "SUBDOMAIN", "PORTS", "ACTIVE", "TOTAL", "IN", "OUT", "REJECTED", "ERRORS"}
+	rows := make([][]string, 0, len(frame.Services))
+	for _, svc := range frame.Services {
+		row := []string{svc.Name, svc.Namespace, svc.Subdomain, fmt.Sprint(len(svc.Ports))}
+		if stats, ok := frame.Stats[svc.Name]; ok {
+			row = append(row,
+				fmt.Sprint(stats.ActiveConnections),
+				fmt.Sprint(stats.TotalConnections),
+				formatBytes(stats.BytesIn),
+				formatBytes(stats.BytesOut),
+				fmt.Sprint(stats.Rejected),
+				fmt.Sprint(stats.Errors))
+		} else {
+			row = append(row, "-", "-", "-", "-", "-", "-")
+		}
+		rows = append(rows, row)
+	}
+
+	widths := columnWidths(header, rows)
+	fmt.Fprintln(w, cyan(formatRow(header, widths)))
+	for _, row := range rows {
+		fmt.Fprintln(w, formatRow(row, widths))
+	}
+
+	if !frame.StatsAvailable {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Per-service traffic is not available on this server")
+	}
+}
+
+// metricValue formats a numeric value of a metrics section, "-" if missing
+func metricValue(section map[string]interface{}, key string) string {
+	if v, ok := section[key].(float64); ok {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return "-"
+}
+
+// totalActiveConnections sums the active connections of all services, "-"
+// if per-service traffic is not available
+func totalActiveConnections(frame topFrame) string {
+	if !frame.StatsAvailable || len(frame.Stats) == 0 {
+		return "-"
+	}
+	var total int64
+	for _, stats := range frame.Stats {
+		total += stats.ActiveConnections
+	}
+	return fmt.Sprint(total)
+}
+
+// reconcileUnavailable describes why no reconcile result is shown
+func reconcileUnavailable(err error) string {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		return strings.TrimSpace(apiErr.Message)
+	}
+	return fmt.Sprintf("unavailable: %v", err)
+}
+
+// formatBytes formats a byte count with a binary unit suffix
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/noahjeana/k8s-exposer/pkg/client"
+)
+
+func TestRenderTop(t *testing.T) {
+	color.NoColor = true
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	frame := topFrame{
+		Time: now,
+		Metrics: &client.Metrics{
+			Services: map[string]interface{}{"total": 2.0, "total_ports": 3.0},
+			Memory:   map[string]interface{}{"alloc_mb": 12.0, "sys_mb": 30.0},
+			Runtime:  map[string]interface{}{"goroutines": 42.0},
+		},
+		Services: []client.Service{
+			{Name: "web", Namespace: "prod", Subdomain: "www", Ports: []client.PortMapping{{Port: 8080}}},
+			{Name: "game", Namespace: "prod", Subdomain: "mc", Ports: []client.PortMapping{{Port: 25565}, {Port: 25565}}},
+		},
+		Stats: map[string]*client.ServiceStats{
+			"web":  {ActiveConnections: 3, TotalConnections: 10, BytesIn: 2048, BytesOut: 512, Rejected: 1},
+			"game": {ActiveConnections: 2, TotalConnections: 5, BytesIn: 3 << 20, Errors: 4},
+		},
+		StatsAvailable: true,
+		Reconcile:      &client.ReconcileStatus{Time: now.Add(-90 * time.Second), Duration: 250 * time.Millisecond, Success: true},
+	}
+
+	var out bytes.Buffer
+	renderTop(&out, frame)
+	for _, want := range []string{
+		"k8s-exposer top",
+		"15:04:05",
+		"Services:   2    Ports: 3    Active connections: 5",
+		"Memory:     12 MB allocated, 30 MB system    Goroutines: 42",
+		"Reconcile:  ok 1m30s ago (took 250ms)",
+		"NAME  NAMESPACE  SUBDOMAIN  PORTS  ACTIVE  TOTAL  IN      OUT   REJECTED  ERRORS",
+		"web   prod       www        1      3       10     2.0KiB  512B  1         0",
+		"game  prod       mc         2      2       5      3.0MiB  0B    0         4",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in frame:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRenderTopDegrades(t *testing.T) {
+	color.NoColor = true
+	frame := topFrame{
+		Time:         time.Now(),
+		MetricsErr:   errors.New("connection refused"),
+		Services:     []client.Service{{Name: "web", Namespace: "prod", Subdomain: "www"}},
+		Stats:        map[string]*client.ServiceStats{},
+		ReconcileErr: &client.APIError{StatusCode: 404, Message: "no reconciliation yet"},
+	}
+
+	var out bytes.Buffer
+	renderTop(&out, frame)
+	for _, want := range []string{
+		"Metrics:    unavailable: connection refused",
+		"Reconcile:  no reconciliation yet",
+		"Per-service traffic is not available on this server",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in frame:\n%s", want, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "web") || !strings.Contains(out.String(), " -") {
+		t.Errorf("expected the service without traffic columns:\n%s", out.String())
+	}
+}
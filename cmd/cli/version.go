@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// versionCheckTimeout bounds the version skew check, so commands against an
+// unreachable server are not held up by it
+const versionCheckTimeout = time.Second
+
+// checkVersionSkew warns on w when the server's major/minor version differs
+// from the CLI's. The check is best-effort and gives up after versionCheckTimeout.
+func checkVersionSkew(w io.Writer) {
+	c := newClient()
+	c.SetTimeout(versionCheckTimeout)
+	serverVersion, err := c.GetVersion()
+	if err != nil {
+		// Server unreachable or too old to report its version
+		return
+	}
+
+	if versionsCompatible(version, serverVersion.Version) {
+		return
+	}
+
+	yellow := color.New(color.FgYellow).SprintFunc()
+	fmt.Fprintf(w, "%s CLI version %s differs from server version %s, output may be incomplete (use --skip-version-check to silence)\n",
+		yellow("Warning:"), version, serverVersion.Version)
+}
+
+// versionsCompatible reports whether two versions share major and minor.
+// Unparseable versions (e.g. dev builds) are treated as compatible.
+func versionsCompatible(a, b string) bool {
+	aMajor, aMinor, okA := parseMajorMinor(a)
+	bMajor, bMinor, okB := parseMajorMinor(b)
+	if !okA || !okB {
+		return true
+	}
+	return aMajor == bMajor && aMinor == bMinor
+}
+
+// parseMajorMinor extracts major and minor from a version like "v1.2.3"
+func parseMajorMinor(v string) (int, int, bool) {
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVersionsCompatible(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"1.2.3", "1.2.0", true},
+		{"v1.2.3", "1.2.9", true},
+		{"1.2.3", "1.3.0", false},
+		{"1.2.3", "2.2.3", false},
+		{"dev", "1.2.3", true},
+		{"1.2.3", "", true},
+	}
+	for _, tt := range tests {
+		if got := versionsCompatible(tt.a, tt.b); got != tt.want {
+			t.Errorf("versionsCompatible(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheckVersionSkew(t *testing.T) {
+	oldServer, oldVersion := serverURL, version
+	defer func() { serverURL, version = oldServer, oldVersion }()
+	version = "1.2.0"
+
+	tests := []struct {
+		name          string
+		serverVersion string
+		warn          bool
+	}{
+		{"matching", "1.2.5", false},
+		{"mismatching", "1.3.0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"version":%q}`, tt.serverVersion)
+			}))
+			defer srv.Close()
+			serverURL = srv.URL
+
+			var out bytes.Buffer
+			checkVersionSkew(&out)
+			if warned := strings.Contains(out.String(), "differs from server version "+tt.serverVersion); warned != tt.warn {
+				t.Errorf("expected warning %v, got %q", tt.warn, out.String())
+			}
+		})
+	}
+
+	// An unreachable server is not an error
+	srv := httptest.NewServer(http.NotFoundHandler())
+	serverURL = srv.URL
+	srv.Close()
+	var out bytes.Buffer
+	checkVersionSkew(&out)
+	if out.Len() != 0 {
+		t.Errorf("unexpected output for an unreachable server: %q", out.String())
+	}
+}
@@ -3,19 +3,28 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
-	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/noahjeana/k8s-exposer/internal/api"
 	"github.com/noahjeana/k8s-exposer/internal/automation"
+	"github.com/noahjeana/k8s-exposer/internal/automation/dns"
+	"github.com/noahjeana/k8s-exposer/internal/automation/firewall"
+	"github.com/noahjeana/k8s-exposer/internal/automation/haproxy"
 	"github.com/noahjeana/k8s-exposer/internal/protocol"
-	"github.com/noahjeana/k8s-exposer/internal/server"
-	"github.com/noahjeana/k8s-exposer/pkg/types"
+	"github.com/noahjeana/k8s-exposer/pkg/server"
+)
+
+var (
+	// Version info (set via ldflags)
+	version = "1.0.0"
+	commit  = "dev"
+	date    = "unknown"
 )
 
 func main() {
@@ -23,26 +32,114 @@ func main() {
 	listenAddr := getEnv("EXPOSER_LISTEN_ADDR", "10.0.0.1:9090")
 	apiListenAddr := getEnv("EXPOSER_API_LISTEN_ADDR", "0.0.0.0:8090")
 	logLevel := getEnv("EXPOSER_LOG_LEVEL", "INFO")
+	logFormat := getEnv("LOG_FORMAT", "json")
+	logOutput := getEnv("LOG_OUTPUT", "stdout")
 	wireguardInterface := getEnv("EXPOSER_WIREGUARD_INTERFACE", "wg0")
 	portRangeStart := getEnvInt32("EXPOSER_PORT_RANGE_START", 30000)
 	portRangeEnd := getEnvInt32("EXPOSER_PORT_RANGE_END", 32767)
+	udpPortRangeStart := getEnvInt32("EXPOSER_UDP_PORT_RANGE_START", portRangeStart)
+	udpPortRangeEnd := getEnvInt32("EXPOSER_UDP_PORT_RANGE_END", portRangeEnd)
+	tcpBindAddr := getEnv("EXPOSER_TCP_BIND_ADDR", "0.0.0.0")
+	udpBindAddr := getEnv("EXPOSER_UDP_BIND_ADDR", "0.0.0.0")
+	udpReadBuffer := int(getEnvInt32("EXPOSER_UDP_READ_BUFFER", 0))
+	udpWriteBuffer := int(getEnvInt32("EXPOSER_UDP_WRITE_BUFFER", 0))
+	firstByteTimeout := getEnvDuration("EXPOSER_TCP_FIRST_BYTE_TIMEOUT", 0)
+	dialAttempts := int(getEnvInt32("EXPOSER_DIAL_ATTEMPTS", server.DefaultDialAttempts))
+	dialRetryDelay := getEnvDuration("EXPOSER_DIAL_RETRY_DELAY", server.DefaultDialRetryDelay)
+	dialDeadline := getEnvDuration("EXPOSER_DIAL_DEADLINE", server.DefaultDialDeadline)
+	shutdownGracePeriod := getEnvDuration("EXPOSER_SHUTDOWN_GRACE_PERIOD", 30*time.Second)
+	maxMessageSize := getEnvInt32("EXPOSER_MAX_MESSAGE_SIZE", protocol.DefaultMaxMessageSize)
+	apiToken := getEnv("EXPOSER_API_TOKEN", "")
+	agentSyncInterval := getEnv("AGENT_SYNC_INTERVAL", "")
+	maxAgentConns := int(getEnvInt32("EXPOSER_MAX_AGENT_CONNECTIONS", server.DefaultMaxAgentConns))
+	maxAgentConnsPerIP := int(getEnvInt32("EXPOSER_MAX_AGENT_CONNECTIONS_PER_IP", server.DefaultMaxAgentConnsPerIP))
+	agentConnRate := int(getEnvInt32("EXPOSER_AGENT_CONNECTION_RATE", server.DefaultAgentConnRate))
+	maxServices := int(getEnvInt32("MAX_SERVICES", server.DefaultMaxServices))
 
 	// Automation configuration
 	domain := getEnv("DOMAIN", "neverup.at")
 	haproxySocket := getEnv("HAPROXY_SOCKET", "/var/run/haproxy.sock")
+	haproxySocketTimeout := getEnvDuration("HAPROXY_SOCKET_TIMEOUT", haproxy.DefaultSocketTimeout)
 	haproxyMap := getEnv("HAPROXY_MAP", "/etc/haproxy/domains.map")
 	haproxyConfig := getEnv("HAPROXY_CONFIG", "/etc/haproxy/haproxy.cfg")
+	haproxyReloadCommand := getEnv("HAPROXY_RELOAD_COMMAND", "")
+	haproxyReloadInterval := getEnvDuration("HAPROXY_RELOAD_INTERVAL", automation.DefaultHAProxyReloadInterval)
+	haproxyMaintenancePage := getEnv("HAPROXY_MAINTENANCE_PAGE", "")
+	haproxyACMEBackend := getEnv("HAPROXY_ACME_BACKEND", haproxy.DefaultACMEBackend)
+	if !getEnvBool("HAPROXY_ACME_ENABLED", true) {
+		haproxyACMEBackend = ""
+	}
+	haproxyBackendHost := getEnv("HAPROXY_BACKEND_HOST", haproxy.DefaultBackendHost)
+	haproxyStats := haproxy.StatsConfig{
+		Port:     int(getEnvInt32("HAPROXY_STATS_PORT", 8404)),
+		User:     getEnv("HAPROXY_STATS_USER", ""),
+		Password: getEnv("HAPROXY_STATS_PASSWORD", ""),
+	}
 	firewallToken := getEnv("HETZNER_CLOUD_TOKEN", "")
 	firewallID := getEnv("HETZNER_FIREWALL_ID", "")
 	reconcileInterval := getEnvDuration("RECONCILE_INTERVAL", 30*time.Second)
+	agentWait := getEnvDuration("RECONCILE_AGENT_WAIT", 30*time.Second)
+	reconcileDebounce := getEnvDuration("RECONCILE_DEBOUNCE", automation.DefaultReconcileDebounce)
+	requireApproval := getEnvBool("RECONCILE_REQUIRE_APPROVAL", false)
+	historySize := int(getEnvInt32("RECONCILE_HISTORY_SIZE", automation.DefaultHistorySize))
+	requireHAProxy := getEnvBool("HAPROXY_REQUIRED", false)
+	haproxyWait := automation.ReadinessWait{
+		Attempts: int(getEnvInt32("HAPROXY_WAIT_ATTEMPTS", automation.DefaultWaitAttempts)),
+		Delay:    getEnvDuration("HAPROXY_WAIT_DELAY", automation.DefaultWaitDelay),
+		Backoff:  getEnv("HAPROXY_WAIT_BACKOFF", automation.BackoffLinear),
+	}
+	haproxyWaitFail := getEnvBool("HAPROXY_WAIT_FAIL", false)
+	requireFirewall := getEnvBool("FIREWALL_REQUIRED", false)
+	firewallBreakerThreshold := getEnvInt32("FIREWALL_BREAKER_THRESHOLD", automation.DefaultFirewallBreakerThreshold)
+	firewallBreakerCooldown := getEnvDuration("FIREWALL_BREAKER_COOLDOWN", automation.DefaultFirewallBreakerCooldown)
+	firewallTimeouts := firewall.Timeouts{
+		Dial:           getEnvDuration("FIREWALL_DIAL_TIMEOUT", 5*time.Second),
+		TLSHandshake:   getEnvDuration("FIREWALL_TLS_HANDSHAKE_TIMEOUT", 5*time.Second),
+		ResponseHeader: getEnvDuration("FIREWALL_RESPONSE_HEADER_TIMEOUT", 10*time.Second),
+		Request:        getEnvDuration("FIREWALL_REQUEST_TIMEOUT", 10*time.Second),
+	}
+	firewallStaticRules := getEnv("FIREWALL_STATIC_RULES", "")
+	dnsConfig := dns.Config{
+		Provider: getEnv("DNS_PROVIDER", "none"),
+		Token:    getEnv("DNS_API_TOKEN", ""),
+		ZoneID:   getEnv("DNS_ZONE_ID", ""),
+		TTL:      int(getEnvInt32("DNS_TTL", 300)),
+		Timeout:  getEnvDuration("DNS_REQUEST_TIMEOUT", 10*time.Second),
+	}
+	dnsTarget := getEnv("DNS_TARGET", "")
 
 	// Setup logger
-	logger := setupLogger(logLevel)
+	logger, err := setupLogger(logLevel, logFormat, logOutput)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set up logger:", err)
+		os.Exit(1)
+	}
 	logger.Info("Starting k8s-exposer server",
+		"version", version,
+		"commit", commit,
 		"listen_addr", listenAddr,
 		"api_listen_addr", apiListenAddr,
 		"wireguard_interface", wireguardInterface,
-		"port_range", fmt.Sprintf("%d-%d", portRangeStart, portRangeEnd))
+		"port_range", fmt.Sprintf("%d-%d", portRangeStart, portRangeEnd),
+		"udp_port_range", fmt.Sprintf("%d-%d", udpPortRangeStart, udpPortRangeEnd))
+
+	staticRules, err := firewall.ParseStaticRules(firewallStaticRules)
+	if err != nil {
+		logger.Error("Invalid FIREWALL_STATIC_RULES", "error", err)
+		os.Exit(1)
+	}
+
+	dnsProvider, err := dns.NewProvider(dnsConfig)
+	if err != nil {
+		logger.Error("Invalid DNS configuration", "error", err)
+		os.Exit(1)
+	}
+	if dnsConfig.Enabled() {
+		if err := dns.ValidateTarget(dnsTarget); err != nil {
+			logger.Error("Invalid DNS_TARGET", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// Create context that listens for shutdown signals
 	ctx, cancel := context.WithCancel(context.Background())
@@ -57,131 +154,77 @@ func main() {
 		cancel()
 	}()
 
-	// Initialize forwarder
-	forwarder := server.NewForwarder(wireguardInterface, logger)
-	defer forwarder.Close()
-
-	// Initialize service registry
-	registry := server.NewServiceRegistry(portRangeStart, portRangeEnd, forwarder, logger)
-	defer registry.Close()
-
-	// Initialize automation controller
-	automationConfig := automation.Config{
-		HAProxySocket:     haproxySocket,
-		HAProxyMap:        haproxyMap,
-		HAProxyConfig:     haproxyConfig,
-		FirewallToken:     firewallToken,
-		FirewallID:        firewallID,
-		Domain:            domain,
-		ReconcileInterval: reconcileInterval,
-	}
-	automationController := automation.NewController(automationConfig, logger)
-
-	// Start automation controller in background
-	go func() {
-		logger.Info("Starting automation controller")
-		if err := automationController.Run(ctx, func() []types.ExposedService {
-			return registry.GetServices()
-		}); err != nil && err != context.Canceled {
-			logger.Error("Automation controller failed", "error", err)
-		}
-	}()
-
-	// Start new API server in background
-	apiServer := api.NewServer(registry, automationController, logger)
-	go func() {
-		logger.Info("Starting API server", "addr", apiListenAddr)
-		if err := apiServer.Start(apiListenAddr); err != nil {
-			logger.Error("API server failed", "error", err)
-			cancel() // Stop the whole server if API fails
-		}
-	}()
-
-	// Start listening for agent connections
-	listener, err := net.Listen("tcp", listenAddr)
+	srv, err := server.New(server.Config{
+		ListenAddr:         listenAddr,
+		APIListenAddr:      apiListenAddr,
+		WireGuardInterface: wireguardInterface,
+		PortRangeStart:     portRangeStart,
+		PortRangeEnd:       portRangeEnd,
+		UDPPortRangeStart:  udpPortRangeStart,
+		UDPPortRangeEnd:    udpPortRangeEnd,
+		Listener: server.ListenerConfig{
+			TCPBindIP:        tcpBindAddr,
+			UDPBindIP:        udpBindAddr,
+			FirstByteTimeout: firstByteTimeout,
+			UDPReadBuffer:    udpReadBuffer,
+			UDPWriteBuffer:   udpWriteBuffer,
+		},
+		DialAttempts:        dialAttempts,
+		DialRetryDelay:      dialRetryDelay,
+		DialDeadline:        dialDeadline,
+		ShutdownGracePeriod: shutdownGracePeriod,
+		MaxMessageSize:      int(maxMessageSize),
+		AgentSyncInterval:   agentSyncInterval,
+		APIToken:            apiToken,
+		MaxAgentConns:       maxAgentConns,
+		MaxAgentConnsPerIP:  maxAgentConnsPerIP,
+		AgentConnRate:       agentConnRate,
+		MaxServices:         maxServices,
+		Automation: server.AutomationConfig{
+			HAProxySocket:            haproxySocket,
+			HAProxySocketTimeout:     haproxySocketTimeout,
+			HAProxyMap:               haproxyMap,
+			HAProxyConfig:            haproxyConfig,
+			HAProxyStats:             haproxyStats,
+			HAProxyMaintenancePage:   haproxyMaintenancePage,
+			HAProxyACMEBackend:       haproxyACMEBackend,
+			HAProxyBackendHost:       haproxyBackendHost,
+			HAProxyReloadCommand:     haproxyReloadCommand,
+			HAProxyReloadInterval:    haproxyReloadInterval,
+			HAProxyWait:              haproxyWait,
+			FirewallToken:            firewallToken,
+			FirewallID:               firewallID,
+			FirewallTimeouts:         firewallTimeouts,
+			FirewallStaticRules:      staticRules,
+			DNSProvider:              dnsProvider,
+			DNSTarget:                dnsTarget,
+			Domain:                   domain,
+			ReconcileInterval:        reconcileInterval,
+			AgentWait:                agentWait,
+			ReconcileDebounce:        reconcileDebounce,
+			RequireApproval:          requireApproval,
+			HistorySize:              historySize,
+			FirewallBreakerThreshold: int(firewallBreakerThreshold),
+			FirewallBreakerCooldown:  firewallBreakerCooldown,
+			RequireHAProxy:           requireHAProxy,
+			RequireFirewall:          requireFirewall,
+		},
+		StopOnHAProxyNotReady: haproxyWaitFail,
+		BuildInfo: server.BuildInfo{
+			Version: version,
+			Commit:  commit,
+			Date:    date,
+		},
+		Logger: logger,
+	})
 	if err != nil {
-		logger.Error("Failed to start listener", "error", err)
+		logger.Error("Failed to set up server", "error", err)
 		os.Exit(1)
 	}
-	defer listener.Close()
-
-	logger.Info("Server listening for agent connections", "addr", listenAddr)
-
-	// Accept connections in a goroutine
-	connCh := make(chan net.Conn)
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					logger.Error("Failed to accept connection", "error", err)
-					continue
-				}
-			}
-			connCh <- conn
-		}
-	}()
-
-	// Main loop
-	for {
-		select {
-		case <-ctx.Done():
-			logger.Info("Shutting down gracefully")
-			return
-
-		case conn := <-connCh:
-			logger.Info("Agent connected", "remote", conn.RemoteAddr())
-			go handleAgentConnection(ctx, conn, registry, logger)
-		}
-	}
-}
-
-func handleAgentConnection(ctx context.Context, conn net.Conn, registry *server.ServiceRegistry, logger *slog.Logger) {
-	defer conn.Close()
 
-	logger = logger.With("agent", conn.RemoteAddr())
-	logger.Info("Handling agent connection")
-
-	for {
-		select {
-		case <-ctx.Done():
-			logger.Info("Context canceled, closing agent connection")
-			return
-		default:
-		}
-
-		// Receive message
-		msg, err := protocol.ReceiveMessage(conn)
-		if err != nil {
-			logger.Error("Failed to receive message", "error", err)
-			return
-		}
-
-		// Process message
-		switch msg.Type {
-		case types.MessageTypeServiceUpdate:
-			logger.Info("Received service update", "count", len(msg.Services))
-			if err := registry.Update(msg.Services); err != nil {
-				logger.Error("Failed to update registry", "error", err)
-			}
-
-		case types.MessageTypeServiceDelete:
-			logger.Info("Received service delete", "count", len(msg.Services))
-			for _, svc := range msg.Services {
-				if err := registry.RemoveService(svc.Subdomain); err != nil {
-					logger.Error("Failed to remove service", "subdomain", svc.Subdomain, "error", err)
-				}
-			}
-
-		case types.MessageTypeHeartbeat:
-			logger.Debug("Received heartbeat")
-
-		default:
-			logger.Warn("Received unknown message type", "type", msg.Type)
-		}
+	if err := srv.Run(ctx); err != nil {
+		logger.Error("Server stopped with error", "error", err)
+		os.Exit(1)
 	}
 }
 
@@ -201,6 +244,15 @@ func getEnvInt32(key string, defaultValue int32) int32 {
 	return defaultValue
 }
 
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
+
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if duration, err := time.ParseDuration(value); err == nil {
@@ -210,7 +262,7 @@ func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
-func setupLogger(level string) *slog.Logger {
+func setupLogger(level, format, output string) (*slog.Logger, error) {
 	var logLevel slog.Level
 	switch level {
 	case "DEBUG":
@@ -229,6 +281,34 @@ func setupLogger(level string) *slog.Logger {
 		Level: logLevel,
 	}
 
-	handler := slog.NewJSONHandler(os.Stdout, opts)
-	return slog.New(handler).With("component", "server")
+	w, err := openLogOutput(output)
+	if err != nil {
+		return nil, err
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(handler).With("component", "server"), nil
+}
+
+// openLogOutput returns the log destination: stdout, stderr or a file path.
+// Files are opened in append mode so external rotation (copytruncate) works.
+func openLogOutput(output string) (io.Writer, error) {
+	switch output {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	default:
+		file, err := os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		return file, nil
+	}
 }
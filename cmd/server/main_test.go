@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupLoggerTextFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	logger, err := setupLogger("DEBUG", "text", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := logger.Handler().(*slog.TextHandler); !ok {
+		t.Fatalf("expected a text handler, got %T", logger.Handler())
+	}
+	logger.Debug("hello", "key", "value")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("log file not created: %v", err)
+	}
+	if line := string(data); !strings.Contains(line, "msg=hello") || !strings.Contains(line, "component=server") {
+		t.Errorf("unexpected log line %q", line)
+	}
+}
+
+func TestSetupLoggerDefaults(t *testing.T) {
+	logger, err := setupLogger("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := logger.Handler().(*slog.JSONHandler); !ok {
+		t.Fatalf("expected a JSON handler by default, got %T", logger.Handler())
+	}
+
+	// JSON lines are appended to an existing file
+	path := filepath.Join(t.TempDir(), "server.log")
+	if err := os.WriteFile(path, []byte("{\"msg\":\"earlier\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger, err = setupLogger("INFO", "json", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("later")
+	logger.Debug("filtered")
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected the earlier and the new line, got %q", data)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil || record["msg"] != "later" {
+		t.Errorf("unexpected JSON line %q (%v)", lines[1], err)
+	}
+
+	if _, err := setupLogger("INFO", "json", filepath.Join(t.TempDir(), "missing", "server.log")); err == nil {
+		t.Error("expected an error for an unwritable log path")
+	}
+}
@@ -2,8 +2,10 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"reflect"
 	"sync"
 	"time"
 
@@ -15,21 +17,97 @@ import (
 type ServerClient struct {
 	serverAddr      string
 	conn            *protocol.Connection
-	heartbeatTicker *time.Ticker
+	stopHeartbeat   context.CancelFunc // Stops the heartbeat of the current connection
+	heartbeats      sync.WaitGroup     // Running heartbeat goroutines
 	logger          *slog.Logger
 	mu              sync.Mutex
 	lastServices    []types.ExposedService
+	onStatus        func([]types.PortAllocation)
+	onRejected      func([]types.ServiceError)
+	onResync        func()
+	onConfig        func(*types.AgentConfig)
+	agentID         string // Reported in every message (empty = server uses the remote IP)
+
+	// Link check of the current connection, reports failures on linkDown
+	pingInterval  time.Duration
+	pingTimeout   time.Duration
+	keepalive     *protocol.Keepalive
+	stopKeepalive context.CancelFunc
+	linkDown      chan error
 }
 
 // NewServerClient creates a new server client
 func NewServerClient(serverAddr string, logger *slog.Logger) *ServerClient {
 	return &ServerClient{
-		serverAddr: serverAddr,
-		conn:       protocol.NewConnection(serverAddr, logger),
-		logger:     logger,
+		serverAddr:   serverAddr,
+		conn:         protocol.NewConnection(serverAddr, logger),
+		logger:       logger,
+		pingInterval: protocol.DefaultPingInterval,
+		pingTimeout:  protocol.DefaultPingTimeout,
+		linkDown:     make(chan error, 1),
 	}
 }
 
+// SetAgentID sets the ID the server tells this agent apart from others by
+func (c *ServerClient) SetAgentID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.agentID = id
+}
+
+// send sends a message to the server, tagged with the agent ID
+func (c *ServerClient) send(msg *types.Message) error {
+	c.mu.Lock()
+	msg.AgentID = c.agentID
+	c.mu.Unlock()
+	return c.conn.Send(msg)
+}
+
+// SetPing sets how often the link to the server is checked with a ping and
+// how long a pong may take before the agent reconnects. An interval of 0
+// disables the link check. The check only starts once the server advertised
+// ping support in a service status.
+func (c *ServerClient) SetPing(interval, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pingInterval = interval
+	c.pingTimeout = timeout
+}
+
+// SetMaxMessageSize sets the size limit for messages exchanged with the server
+func (c *ServerClient) SetMaxMessageSize(size int) {
+	c.conn.SetMaxMessageSize(size)
+}
+
+// SetStatusHandler registers a callback for port allocations reported by the server
+func (c *ServerClient) SetStatusHandler(handler func([]types.PortAllocation)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onStatus = handler
+}
+
+// SetRejectionHandler registers a callback receiving the services the server
+// rejected from the last update (empty once all were accepted)
+func (c *ServerClient) SetRejectionHandler(handler func([]types.ServiceError)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRejected = handler
+}
+
+// SetResyncHandler registers a callback invoked when the server requests a full resync
+func (c *ServerClient) SetResyncHandler(handler func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onResync = handler
+}
+
+// SetConfigHandler registers a callback applying runtime settings pushed by the server
+func (c *ServerClient) SetConfigHandler(handler func(*types.AgentConfig)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onConfig = handler
+}
+
 // Connect connects to the server and starts the heartbeat
 func (c *ServerClient) Connect(ctx context.Context) error {
 	c.logger.Info("Connecting to server", "addr", c.serverAddr)
@@ -38,8 +116,12 @@ func (c *ServerClient) Connect(ctx context.Context) error {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
 
-	// Start heartbeat
+	// Start heartbeat, the link check starts once the server supports it
 	c.startHeartbeat(ctx)
+	c.stopLinkCheck()
+
+	// Start receiving server messages
+	go c.receiveLoop(ctx)
 
 	return nil
 }
@@ -50,9 +132,11 @@ func (c *ServerClient) SendUpdate(services []types.ExposedService) error {
 	c.lastServices = services
 	c.mu.Unlock()
 
+	full := true
 	msg := &types.Message{
 		Type:     types.MessageTypeServiceUpdate,
 		Services: services,
+		Full:     &full,
 	}
 
 	c.logger.Info("Sending service update", "count", len(services))
@@ -75,21 +159,51 @@ func (c *ServerClient) SendUpdate(services []types.ExposedService) error {
 		}
 	}
 
-	if err := c.conn.Send(msg); err != nil {
+	if err := c.send(msg); err != nil {
+		updatesSentTotal.WithLabelValues("error").Inc()
 		return fmt.Errorf("failed to send update: %w", err)
 	}
 
+	updatesSentTotal.WithLabelValues("success").Inc()
 	c.logger.Info("Service update sent successfully")
 	return nil
 }
 
+// Flush sends services as a final update before shutdown unless they equal
+// the last update sent, giving up after timeout
+func (c *ServerClient) Flush(services []types.ExposedService, timeout time.Duration) error {
+	if !c.IsConnected() {
+		return fmt.Errorf("not connected to server")
+	}
+
+	c.mu.Lock()
+	unchanged := reflect.DeepEqual(c.lastServices, services)
+	c.mu.Unlock()
+	if unchanged {
+		c.logger.Debug("Services unchanged, skipping final update")
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SendUpdate(services)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out sending final update after %s", timeout)
+	}
+}
+
 // SendHeartbeat sends a heartbeat message to the server
 func (c *ServerClient) SendHeartbeat() error {
 	msg := &types.Message{
 		Type: types.MessageTypeHeartbeat,
 	}
 
-	if err := c.conn.Send(msg); err != nil {
+	if err := c.send(msg); err != nil {
 		return fmt.Errorf("failed to send heartbeat: %w", err)
 	}
 
@@ -97,21 +211,28 @@ func (c *ServerClient) SendHeartbeat() error {
 	return nil
 }
 
-// startHeartbeat starts the heartbeat ticker
+// startHeartbeat starts the heartbeat of the current connection, stopping
+// the one of a previous connection
 func (c *ServerClient) startHeartbeat(ctx context.Context) {
-	if c.heartbeatTicker != nil {
-		c.heartbeatTicker.Stop()
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	c.heartbeatTicker = time.NewTicker(30 * time.Second)
+	if c.stopHeartbeat != nil {
+		c.stopHeartbeat()
+	}
+	heartbeatCtx, cancel := context.WithCancel(ctx)
+	c.stopHeartbeat = cancel
 
+	c.heartbeats.Add(1)
 	go func() {
+		defer c.heartbeats.Done()
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-ctx.Done():
-				c.heartbeatTicker.Stop()
+			case <-heartbeatCtx.Done():
 				return
-			case <-c.heartbeatTicker.C:
+			case <-ticker.C:
 				if err := c.SendHeartbeat(); err != nil {
 					c.logger.Warn("Failed to send heartbeat", "error", err)
 				}
@@ -120,24 +241,155 @@ func (c *ServerClient) startHeartbeat(ctx context.Context) {
 	}()
 }
 
+// stopLinkCheck stops the link check of a previous connection
+func (c *ServerClient) stopLinkCheck() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopKeepalive != nil {
+		c.stopKeepalive()
+		c.stopKeepalive = nil
+		c.keepalive = nil
+	}
+	// A failure of the previous connection's check is outdated
+	select {
+	case <-c.linkDown:
+	default:
+	}
+}
+
+// startKeepalive starts checking the link of the current connection unless
+// the check is disabled or already running
+func (c *ServerClient) startKeepalive(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pingInterval <= 0 || c.keepalive != nil {
+		return
+	}
+
+	keepalive := protocol.NewKeepalive(c.pingInterval, c.pingTimeout, c.send)
+	keepaliveCtx, cancel := context.WithCancel(ctx)
+	c.keepalive = keepalive
+	c.stopKeepalive = cancel
+
+	go func() {
+		err := keepalive.Run(keepaliveCtx)
+		if keepaliveCtx.Err() != nil {
+			return
+		}
+		if errors.Is(err, protocol.ErrPingTimeout) {
+			pingTimeoutsTotal.Inc()
+		}
+		c.logger.Warn("Server link check failed", "error", err)
+		select {
+		case c.linkDown <- err:
+		default:
+		}
+	}()
+}
+
+// receiveLoop handles messages sent by the server until the connection fails
+func (c *ServerClient) receiveLoop(ctx context.Context) {
+	for {
+		msg, err := c.conn.Receive()
+		if errors.Is(err, protocol.ErrInvalidMessage) {
+			// The frame was read completely, skip it and keep the connection
+			c.logger.Warn("Ignoring invalid message from server", "error", err)
+			continue
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			default:
+				// Send path detects the broken connection and reconnects
+				c.logger.Debug("Stopped receiving server messages", "error", err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case types.MessageTypeServiceStatus:
+			c.logger.Debug("Received service status", "allocations", len(msg.Allocations), "rejected", len(msg.Errors))
+			for _, rejection := range msg.Errors {
+				c.logger.Warn("Server rejected service",
+					"name", rejection.Name,
+					"namespace", rejection.Namespace,
+					"subdomain", rejection.Subdomain,
+					"reason", rejection.Reason)
+			}
+			c.mu.Lock()
+			handler := c.onStatus
+			onRejected := c.onRejected
+			c.mu.Unlock()
+			if handler != nil {
+				handler(msg.Allocations)
+			}
+			if onRejected != nil {
+				onRejected(msg.Errors)
+			}
+			if msg.Ping {
+				c.startKeepalive(ctx)
+			}
+		case types.MessageTypeResync:
+			c.logger.Info("Server requested full resync")
+			c.mu.Lock()
+			handler := c.onResync
+			c.mu.Unlock()
+			if handler != nil {
+				handler()
+			}
+		case types.MessageTypePong:
+			c.mu.Lock()
+			keepalive := c.keepalive
+			c.mu.Unlock()
+			if keepalive != nil {
+				keepalive.HandlePong(msg)
+			}
+		case types.MessageTypeConfig:
+			c.logger.Info("Received configuration from server", "sync_interval", msg.Config.SyncInterval)
+			c.mu.Lock()
+			handler := c.onConfig
+			c.mu.Unlock()
+			if handler != nil {
+				handler(msg.Config)
+			}
+		default:
+			c.logger.Warn("Received unexpected message type", "type", msg.Type)
+		}
+	}
+}
+
 // Close closes the connection to the server
 func (c *ServerClient) Close() error {
-	if c.heartbeatTicker != nil {
-		c.heartbeatTicker.Stop()
+	c.mu.Lock()
+	if c.stopHeartbeat != nil {
+		c.stopHeartbeat()
+		c.stopHeartbeat = nil
+	}
+	if c.stopKeepalive != nil {
+		c.stopKeepalive()
+		c.stopKeepalive = nil
 	}
+	c.mu.Unlock()
 	return c.conn.Close()
 }
 
 // Reconnect attempts to reconnect to the server
 func (c *ServerClient) Reconnect(ctx context.Context) error {
 	c.logger.Info("Reconnecting to server")
+	reconnectsTotal.Inc()
 
 	if err := c.conn.Reconnect(ctx); err != nil {
 		return fmt.Errorf("failed to reconnect: %w", err)
 	}
 
-	// Restart heartbeat
+	// Restart heartbeat, the link check starts once the server supports it
 	c.startHeartbeat(ctx)
+	c.stopLinkCheck()
+
+	// Restart receiving server messages
+	go c.receiveLoop(ctx)
 
 	// Resend last known services
 	c.mu.Lock()
@@ -160,7 +412,7 @@ func (c *ServerClient) IsConnected() bool {
 }
 
 // Run runs the client with automatic reconnection
-func (c *ServerClient) Run(ctx context.Context, onServicesChange <-chan []types.ExposedService) error {
+func (c *ServerClient) Run(ctx context.Context, updates *SnapshotBox) error {
 	// Initial connection
 	if err := c.Connect(ctx); err != nil {
 		c.logger.Error("Failed to connect to server", "error", err)
@@ -175,7 +427,19 @@ func (c *ServerClient) Run(ctx context.Context, onServicesChange <-chan []types.
 		case <-ctx.Done():
 			return ctx.Err()
 
-		case services := <-onServicesChange:
+		case err := <-c.linkDown:
+			// The server stopped answering pings, the connection is dead even
+			// if writes still succeed
+			c.logger.Warn("Lost link to server, reconnecting", "error", err)
+			if err := c.Reconnect(ctx); err != nil {
+				c.logger.Error("Failed to reconnect after link loss", "error", err)
+			}
+
+		case <-updates.Ready():
+			services, ok := updates.Take()
+			if !ok {
+				continue
+			}
 			if err := c.SendUpdate(services); err != nil {
 				c.logger.Error("Failed to send service update", "error", err)
 				// Try to reconnect
@@ -0,0 +1,334 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// startStatusServer starts a server answering every service update with a
+// status reporting allocations
+func startStatusServer(t *testing.T, allocations []types.PortAllocation) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := protocol.ReceiveMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg.Type == types.MessageTypeServiceUpdate {
+				protocol.SendMessage(conn, &types.Message{Type: types.MessageTypeServiceStatus, Allocations: allocations})
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestStatusHandlerReceivesAllocations(t *testing.T) {
+	allocations := []types.PortAllocation{{
+		Name: "web", Namespace: "default", Subdomain: "web",
+		RequestedPort: 8080, AllocatedPort: 30000, Protocol: "tcp",
+	}}
+	client := NewServerClient(startStatusServer(t, allocations), testLogger())
+	received := make(chan []types.PortAllocation, 1)
+	client.SetStatusHandler(func(got []types.PortAllocation) { received <- got })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.SendUpdate([]types.ExposedService{{
+		Name: "web", Namespace: "default", Subdomain: "web", TargetIP: "10.0.0.1",
+		Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if !reflect.DeepEqual(got, allocations) {
+			t.Errorf("expected allocations %+v, got %+v", allocations, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("status handler not called")
+	}
+}
+
+func TestResyncHandlerCalled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		protocol.SendMessage(conn, &types.Message{Type: types.MessageTypeResync})
+		// Keep the connection open until the client goes away
+		protocol.ReceiveMessage(conn)
+	}()
+
+	client := NewServerClient(ln.Addr().String(), testLogger())
+	resynced := make(chan struct{}, 1)
+	client.SetResyncHandler(func() { resynced <- struct{}{} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	select {
+	case <-resynced:
+	case <-time.After(2 * time.Second):
+		t.Fatal("resync handler not called")
+	}
+}
+
+func TestFlushSendsChangedServices(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	updates := make(chan []types.ExposedService, 4)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := protocol.ReceiveMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg.Type == types.MessageTypeServiceUpdate {
+				updates <- msg.Services
+			}
+		}
+	}()
+
+	client := NewServerClient(ln.Addr().String(), testLogger())
+	if err := client.Flush(nil, time.Second); err == nil {
+		t.Error("expected flush to fail while not connected")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	initial := []types.ExposedService{{
+		Name: "web", Namespace: "default", Subdomain: "web", TargetIP: "10.0.0.1",
+		Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}},
+	}}
+	if err := client.SendUpdate(initial); err != nil {
+		t.Fatal(err)
+	}
+	<-updates
+
+	if err := client.Flush(initial, time.Second); err != nil {
+		t.Fatalf("flush unchanged: %v", err)
+	}
+	select {
+	case got := <-updates:
+		t.Fatalf("unexpected update for unchanged services: %+v", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	changed := []types.ExposedService{{
+		Name: "api", Namespace: "default", Subdomain: "api", TargetIP: "10.0.0.2",
+		Ports: []types.PortMapping{{Port: 9090, TargetPort: 90, Protocol: "tcp"}},
+	}}
+	if err := client.Flush(changed, time.Second); err != nil {
+		t.Fatalf("flush changed: %v", err)
+	}
+	select {
+	case got := <-updates:
+		if !reflect.DeepEqual(got, changed) {
+			t.Errorf("expected final update %+v, got %+v", changed, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("final update not received")
+	}
+}
+
+// fakeServer speaks the agent protocol, answering updates with a status and
+// optionally pings with pongs
+type fakeServer struct {
+	addr        string
+	advertise   bool        // Advertise ping support in service status messages
+	answerPings atomic.Bool // Answer pings with pongs
+	conns       atomic.Int32
+	pings       atomic.Int32
+	updates     atomic.Int32
+}
+
+func startFakeServer(t *testing.T, advertise bool) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &fakeServer{addr: ln.Addr().String(), advertise: advertise}
+	s.answerPings.Store(true)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		msg, err := protocol.ReceiveMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case types.MessageTypeServiceUpdate:
+			s.updates.Add(1)
+			protocol.SendMessage(conn, &types.Message{Type: types.MessageTypeServiceStatus, Ping: s.advertise})
+		case types.MessageTypePing:
+			s.pings.Add(1)
+			if s.answerPings.Load() {
+				protocol.SendMessage(conn, protocol.Pong(msg))
+			}
+		}
+	}
+}
+
+// runClient runs an agent client against addr sending one service
+func runClient(t *testing.T, addr string) {
+	t.Helper()
+	client := NewServerClient(addr, testLogger())
+	client.SetPing(20*time.Millisecond, 100*time.Millisecond)
+
+	updates := NewSnapshotBox()
+	updates.Put([]types.ExposedService{{Name: "web", Namespace: "default", Subdomain: "web"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx, updates)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		client.Close()
+	})
+}
+
+func TestLinkCheckReconnectsWhenPongsStop(t *testing.T) {
+	server := startFakeServer(t, true)
+	runClient(t, server.addr)
+
+	waitFor(t, 2*time.Second, "pings", func() bool { return server.pings.Load() >= 3 })
+	if got := server.conns.Load(); got != 1 {
+		t.Fatalf("agent reconnected while pongs were answered (%d connections)", got)
+	}
+
+	// A server that stops answering is treated as dead
+	server.answerPings.Store(false)
+	waitFor(t, 5*time.Second, "reconnect", func() bool { return server.conns.Load() >= 2 })
+
+	// The services are sent again on the new connection
+	waitFor(t, 2*time.Second, "resent services", func() bool { return server.updates.Load() >= 2 })
+}
+
+func TestLinkCheckWaitsForServerSupport(t *testing.T) {
+	server := startFakeServer(t, false)
+	runClient(t, server.addr)
+
+	waitFor(t, 2*time.Second, "service update", func() bool { return server.updates.Load() >= 1 })
+	time.Sleep(200 * time.Millisecond)
+	if got := server.pings.Load(); got != 0 {
+		t.Errorf("agent sent %d pings to a server without ping support", got)
+	}
+}
+
+func TestHeartbeatStopsWithConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					if _, err := protocol.ReceiveMessage(conn); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	client := NewServerClient(ln.Addr().String(), testLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.Reconnect(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reconnects replace the heartbeat and Close stops the last one, all
+	// while the agent's context is still running
+	client.Close()
+	stopped := make(chan struct{})
+	go func() {
+		client.heartbeats.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("heartbeats kept running after Close")
+	}
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the agent configuration. It is read from an optional YAML file
+// (AGENT_CONFIG) with environment variables taking precedence.
+type Config struct {
+	ServerAddr           string          `json:"server_addr"`
+	ClusterDomain        string          `json:"cluster_domain"`
+	LogLevel             string          `json:"log_level"`
+	LogFormat            string          `json:"log_format"`
+	LogOutput            string          `json:"log_output"`
+	SyncInterval         metav1.Duration `json:"sync_interval"`
+	WriteAllocatedPorts  bool            `json:"write_allocated_ports"`
+	ReportFailures       bool            `json:"report_discovery_failures"`
+	MaxMessageSize       int             `json:"max_message_size"`
+	TargetStrategy       string          `json:"target_strategy"`
+	WatchNamespaces      []string        `json:"watch_namespaces"`
+	MetricsAddr          string          `json:"metrics_addr"`
+	MaxPorts             int             `json:"max_ports_per_service"`
+	DiscoveryConcurrency int             `json:"discovery_concurrency"`
+	ShutdownFlushTimeout metav1.Duration `json:"shutdown_flush_timeout"`
+	AgentID              string          `json:"agent_id"` // Empty = the cluster ID, see ClusterID
+	PingInterval         metav1.Duration `json:"ping_interval"`
+	PingTimeout          metav1.Duration `json:"ping_timeout"`
+}
+
+// DefaultConfig returns the configuration used when neither a file nor
+// environment variables set a value
+func DefaultConfig() Config {
+	return Config{
+		ServerAddr:           "10.0.0.1:9090",
+		ClusterDomain:        "neverup.at",
+		LogLevel:             "INFO",
+		LogFormat:            "json",
+		LogOutput:            "stdout",
+		SyncInterval:         metav1.Duration{Duration: 30 * time.Second},
+		MaxMessageSize:       protocol.DefaultMaxMessageSize,
+		TargetStrategy:       "pod-ip",
+		MetricsAddr:          ":8081",
+		MaxPorts:             DefaultMaxPorts,
+		DiscoveryConcurrency: DefaultDiscoveryConcurrency,
+		ShutdownFlushTimeout: metav1.Duration{Duration: 5 * time.Second},
+		PingInterval:         metav1.Duration{Duration: protocol.DefaultPingInterval},
+		PingTimeout:          metav1.Duration{Duration: protocol.DefaultPingTimeout},
+	}
+}
+
+// LoadConfig returns the defaults overridden by the YAML file at path (if
+// path is not empty) and then by the environment variables found by lookup.
+// The result is validated.
+func LoadConfig(path string, lookup func(string) (string, bool)) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(lookup); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides the settings whose environment variable is set and not empty
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	env := func(key string) (string, bool) {
+		value, ok := lookup(key)
+		return value, ok && value != ""
+	}
+
+	texts := map[string]*string{
+		"SERVER_ADDR":        &c.ServerAddr,
+		"CLUSTER_DOMAIN":     &c.ClusterDomain,
+		"LOG_LEVEL":          &c.LogLevel,
+		"LOG_FORMAT":         &c.LogFormat,
+		"LOG_OUTPUT":         &c.LogOutput,
+		"TARGET_STRATEGY":    &c.TargetStrategy,
+		"AGENT_METRICS_ADDR": &c.MetricsAddr,
+		"AGENT_ID":           &c.AgentID,
+	}
+	for key, field := range texts {
+		if value, ok := env(key); ok {
+			*field = value
+		}
+	}
+
+	bools := map[string]*bool{
+		"WRITE_ALLOCATED_PORTS":     &c.WriteAllocatedPorts,
+		"REPORT_DISCOVERY_FAILURES": &c.ReportFailures,
+	}
+	for key, field := range bools {
+		if value, ok := env(key); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*field = parsed
+		}
+	}
+
+	ints := map[string]*int{
+		"MAX_MESSAGE_SIZE":      &c.MaxMessageSize,
+		"MAX_PORTS_PER_SERVICE": &c.MaxPorts,
+		"DISCOVERY_CONCURRENCY": &c.DiscoveryConcurrency,
+	}
+	for key, field := range ints {
+		if value, ok := env(key); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*field = parsed
+		}
+	}
+
+	durations := map[string]*metav1.Duration{
+		"SYNC_INTERVAL":          &c.SyncInterval,
+		"SHUTDOWN_FLUSH_TIMEOUT": &c.ShutdownFlushTimeout,
+		"PING_INTERVAL":          &c.PingInterval,
+		"PING_TIMEOUT":           &c.PingTimeout,
+	}
+	for key, field := range durations {
+		if value, ok := env(key); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			field.Duration = parsed
+		}
+	}
+
+	if value, ok := env("WATCH_NAMESPACES"); ok {
+		c.WatchNamespaces = splitList(value)
+	}
+	return nil
+}
+
+// Validate checks the settings the agent cannot start without
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ServerAddr); err != nil {
+		return fmt.Errorf("server_addr: %w", err)
+	}
+	if c.ClusterDomain == "" {
+		return fmt.Errorf("cluster_domain cannot be empty")
+	}
+	if c.SyncInterval.Duration <= 0 {
+		return fmt.Errorf("sync_interval must be positive")
+	}
+	if c.ShutdownFlushTimeout.Duration < 0 {
+		return fmt.Errorf("shutdown_flush_timeout cannot be negative")
+	}
+	if c.PingInterval.Duration < 0 {
+		return fmt.Errorf("ping_interval cannot be negative")
+	}
+	if c.PingInterval.Duration > 0 && c.PingTimeout.Duration <= 0 {
+		return fmt.Errorf("ping_timeout must be positive")
+	}
+	if c.MaxMessageSize < 0 || c.MaxPorts < 0 || c.DiscoveryConcurrency < 0 {
+		return fmt.Errorf("max_message_size, max_ports_per_service and discovery_concurrency cannot be negative")
+	}
+	if _, err := ParseTargetStrategy(c.TargetStrategy); err != nil {
+		return err
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "json", "text":
+	default:
+		return fmt.Errorf("invalid log_format %q (expected json or text)", c.LogFormat)
+	}
+	return nil
+}
+
+// splitList returns the comma-separated, non-empty entries of value
+func splitList(value string) []string {
+	var values []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			values = append(values, entry)
+		}
+	}
+	return values
+}
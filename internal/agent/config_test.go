@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file to a temporary directory
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// envLookup returns a lookup function over a fixed environment
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoadConfigFileAndEnv(t *testing.T) {
+	path := writeConfig(t, `
+server_addr: 10.0.0.5:9090
+cluster_domain: example.com
+sync_interval: 1m
+log_format: text
+write_allocated_ports: true
+watch_namespaces: [team-a, team-b]
+discovery_concurrency: 4
+`)
+
+	cfg, err := LoadConfig(path, envLookup(map[string]string{
+		"SYNC_INTERVAL":    "10s",
+		"WATCH_NAMESPACES": "team-c",
+		"LOG_FORMAT":       "", // Empty variables keep the file's value
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ServerAddr != "10.0.0.5:9090" || cfg.ClusterDomain != "example.com" {
+		t.Errorf("file values not applied: %+v", cfg)
+	}
+	if !cfg.WriteAllocatedPorts || cfg.DiscoveryConcurrency != 4 || cfg.LogFormat != "text" {
+		t.Errorf("file values not applied: %+v", cfg)
+	}
+	if cfg.SyncInterval.Duration != 10*time.Second {
+		t.Errorf("expected SYNC_INTERVAL to override the file, got %v", cfg.SyncInterval.Duration)
+	}
+	if !reflect.DeepEqual(cfg.WatchNamespaces, []string{"team-c"}) {
+		t.Errorf("expected WATCH_NAMESPACES to override the file, got %v", cfg.WatchNamespaces)
+	}
+	// Settings set nowhere keep their defaults
+	if cfg.MetricsAddr != DefaultConfig().MetricsAddr || cfg.TargetStrategy != "pod-ip" {
+		t.Errorf("defaults not kept: %+v", cfg)
+	}
+}
+
+func TestLoadConfigEnvOnly(t *testing.T) {
+	cfg, err := LoadConfig("", envLookup(map[string]string{"SERVER_ADDR": "server:9090", "REPORT_DISCOVERY_FAILURES": "true"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerAddr != "server:9090" || !cfg.ReportFailures {
+		t.Errorf("environment not applied: %+v", cfg)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want string
+	}{
+		{"unknown field", "sync_intervall: 1m\n", nil, "unknown field"},
+		{"invalid value", "sync_interval: -1s\n", nil, "sync_interval must be positive"},
+		{"invalid env", "", map[string]string{"MAX_PORTS_PER_SERVICE": "many"}, "invalid MAX_PORTS_PER_SERVICE"},
+		{"invalid strategy", "target_strategy: random\n", nil, "random"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tt.file), envLookup(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
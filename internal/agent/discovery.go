@@ -2,49 +2,246 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/noahjeana/k8s-exposer/pkg/types"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
-	SubdomainAnnotation = "expose.neverup.at/subdomain"
-	PortsAnnotation     = "expose.neverup.at/ports"
+	SubdomainAnnotation      = "expose.neverup.at/subdomain"
+	PortsAnnotation          = "expose.neverup.at/ports"
+	TargetAnnotation         = "expose.neverup.at/target"
+	DisabledAnnotation       = "expose.neverup.at/disabled"
+	MaxConnectionsAnnotation = "expose.neverup.at/max-connections"
+	ServerFirstAnnotation    = "expose.neverup.at/server-first"
+	HealthCheckAnnotation    = "expose.neverup.at/healthcheck"
+	MaxConnAnnotation        = "expose.neverup.at/maxconn"
+	NodeFallbackAnnotation   = "expose.neverup.at/node-fallback"
+	TLSAnnotation            = "expose.neverup.at/tls"
+	ForceHTTPSAnnotation     = "expose.neverup.at/force-https"
+	StrictPortAnnotation     = "expose.neverup.at/strict-port"
+	MaintenanceAnnotation    = "expose.neverup.at/maintenance-page"
+	AliasesAnnotation        = "expose.neverup.at/aliases"
+	SourceRangesAnnotation   = "expose.neverup.at/source-ranges"
+	AffinityAnnotation       = "expose.neverup.at/session-affinity"
 )
 
-// DiscoverServices discovers all services with exposure annotations
-func DiscoverServices(ctx context.Context, clientset kubernetes.Interface, logger *slog.Logger) ([]types.ExposedService, error) {
-	// List all services across all namespaces
-	serviceList, err := clientset.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+// DefaultAffinityTTL is the session affinity TTL of services annotated with
+// "true", matching kube-proxy's ClientIP affinity timeout
+const DefaultAffinityTTL = 3 * time.Hour
+
+// errServiceDisabled is returned for exposed services that are temporarily disabled
+var errServiceDisabled = errors.New("exposure disabled via annotation")
+
+// Target strategies selectable via the target annotation
+const (
+	TargetPod      = "pod"      // First ready pod IP (default)
+	TargetExternal = "external" // LoadBalancer ingress IP/hostname or ExternalName host
+	TargetNode     = "node"     // Node IP of the first ready pod with the NodePort
+	TargetCluster  = "cluster"  // Service ClusterIP, for setups routing the service CIDR over WireGuard
+)
+
+// DiscoveryOptions configures service discovery
+type DiscoveryOptions struct {
+	DefaultTarget string           // Target strategy for services without target annotation (default pod)
+	Reporter      *FailureReporter // Reports discovery failures back to Kubernetes (optional)
+	Namespaces    []string         // Only discover services in these namespaces (empty = cluster-wide)
+	MaxPorts      int              // Maximum number of ports per service (0 = unlimited)
+	Concurrency   int              // Parallel per-service endpoint lookups (0 = DefaultDiscoveryConcurrency)
+}
+
+// DefaultMaxPorts is the default upper bound on ports per service
+const DefaultMaxPorts = 32
+
+// DefaultDiscoveryConcurrency is the default number of services resolved in parallel
+const DefaultDiscoveryConcurrency = 8
+
+// Endpoint lookups of services younger than endpointsRetryWindow are retried
+// up to endpointsRetries times, starting at endpointsRetryDelay and doubling
+const (
+	endpointsRetryWindow = 2 * time.Minute
+	endpointsRetryDelay  = 500 * time.Millisecond
+	endpointsRetries     = 3
+)
+
+// forbiddenNamespaces remembers namespaces already reported as forbidden so
+// they are only logged once
+var forbiddenNamespaces sync.Map
+
+// ParseTargetStrategy parses the agent-wide default target strategy
+// ("pod-ip" or "cluster-ip")
+func ParseTargetStrategy(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "pod-ip", TargetPod:
+		return TargetPod, nil
+	case "cluster-ip", TargetCluster:
+		return TargetCluster, nil
+	default:
+		return "", fmt.Errorf("invalid target strategy %q (expected pod-ip or cluster-ip)", value)
+	}
+}
+
+// serviceTarget is the resolved forwarding destination of a service
+type serviceTarget struct {
+	ip     string
+	ips    []string // All ready pod IPs (pod target with several ready pods)
+	nodeIP string
+	port   int32
+	ports  map[string]int32 // Target port per service port name
+}
+
+// portFor returns the target port of a service port, falling back to the
+// target port of the first service port
+func (t *serviceTarget) portFor(servicePort *corev1.ServicePort) int32 {
+	if servicePort != nil {
+		if port, ok := t.ports[servicePort.Name]; ok {
+			return port
+		}
+	}
+	return t.port
+}
+
+// DiscoverServices discovers all services with exposure annotations. Failures
+// are reported back to Kubernetes when a reporter is configured.
+func DiscoverServices(ctx context.Context, clientset kubernetes.Interface, opts DiscoveryOptions, logger *slog.Logger) ([]types.ExposedService, error) {
+	reporter := opts.Reporter
+
+	services, err := listServices(ctx, clientset, opts.Namespaces, logger)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list services: %w", err)
+		discoveriesTotal.WithLabelValues("error").Inc()
+		return nil, err
 	}
 
+	results := extractServices(ctx, clientset, services, opts)
+
 	var exposedServices []types.ExposedService
-	for _, svc := range serviceList.Items {
-		exposedSvc, err := extractServiceInfo(clientset, &svc)
+	var wildcard *types.ExposedService
+	for i, svc := range services {
+		exposedSvc, err := results[i].service, results[i].err
+		if errors.Is(err, errServiceDisabled) {
+			logger.Info("Skipping disabled service", "name", svc.Name, "namespace", svc.Namespace)
+			continue
+		}
 		if err != nil {
 			// Skip services without annotations or with invalid configuration
 			logger.Debug("Skipping service", "name", svc.Name, "namespace", svc.Namespace, "error", err)
+			reporter.Report(ctx, &svc, err)
 			continue
 		}
 		if exposedSvc != nil {
+			// Only one service may act as catch-all
+			if exposedSvc.Subdomain == types.WildcardSubdomain {
+				if wildcard != nil {
+					logger.Warn("Skipping service, wildcard subdomain already claimed",
+						"name", svc.Name,
+						"namespace", svc.Namespace,
+						"claimed_by", wildcard.Namespace+"/"+wildcard.Name)
+					reporter.Report(ctx, &svc, fmt.Errorf("wildcard subdomain already claimed by %s/%s", wildcard.Namespace, wildcard.Name))
+					continue
+				}
+				wildcard = exposedSvc
+			}
+			reporter.Clear(ctx, &svc)
 			exposedServices = append(exposedServices, *exposedSvc)
 		}
 	}
 
 	logger.Info("Discovered exposed services", "count", len(exposedServices))
+	discoveriesTotal.WithLabelValues("success").Inc()
+	discoveredServices.Set(float64(len(exposedServices)))
 	return exposedServices, nil
 }
 
+// extractResult is the outcome of extracting a single service
+type extractResult struct {
+	service *types.ExposedService
+	err     error
+}
+
+// extractServices runs extractServiceInfo for all services with at most
+// opts.Concurrency lookups in flight. Results keep the order of services so
+// wildcard conflicts and reports stay deterministic.
+func extractServices(ctx context.Context, clientset kubernetes.Interface, services []corev1.Service, opts DiscoveryOptions) []extractResult {
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = DefaultDiscoveryConcurrency
+	}
+	if workers > len(services) {
+		workers = len(services)
+	}
+
+	results := make([]extractResult, len(services))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				svc, err := extractServiceInfo(ctx, clientset, &services[i], opts)
+				results[i] = extractResult{service: svc, err: err}
+			}
+		}()
+	}
+
+	for i := range services {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// listServices lists services across all namespaces, or only in the given
+// namespaces while skipping those the agent is not allowed to read
+func listServices(ctx context.Context, clientset kubernetes.Interface, namespaces []string, logger *slog.Logger) ([]corev1.Service, error) {
+	if len(namespaces) == 0 {
+		serviceList, err := clientset.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list services: %w", err)
+		}
+		return serviceList.Items, nil
+	}
+
+	var services []corev1.Service
+	for _, namespace := range namespaces {
+		serviceList, err := clientset.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+		if apierrors.IsForbidden(err) {
+			logForbiddenNamespace(namespace, err, logger)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list services in namespace %s: %w", namespace, err)
+		}
+		forbiddenNamespaces.Delete(namespace)
+		services = append(services, serviceList.Items...)
+	}
+	return services, nil
+}
+
+// logForbiddenNamespace warns about a namespace the agent may not read, once
+// until access is granted again
+func logForbiddenNamespace(namespace string, err error, logger *slog.Logger) {
+	if _, logged := forbiddenNamespaces.LoadOrStore(namespace, struct{}{}); logged {
+		return
+	}
+	logger.Warn("Skipping namespace, access forbidden", "namespace", namespace, "error", err)
+}
+
 // extractServiceInfo extracts exposed service information from a Kubernetes service
-func extractServiceInfo(clientset kubernetes.Interface, svc *corev1.Service) (*types.ExposedService, error) {
+func extractServiceInfo(ctx context.Context, clientset kubernetes.Interface, svc *corev1.Service, opts DiscoveryOptions) (*types.ExposedService, error) {
 	// Check if service has required annotations
 	subdomain, hasSubdomain := svc.Annotations[SubdomainAnnotation]
 	portsAnnotation, hasPorts := svc.Annotations[PortsAnnotation]
@@ -53,43 +250,172 @@ func extractServiceInfo(clientset kubernetes.Interface, svc *corev1.Service) (*t
 		return nil, nil // Not an exposed service
 	}
 
+	// Disabled services are treated as not exposed, keeping their annotations intact
+	if disabled, _ := strconv.ParseBool(svc.Annotations[DisabledAnnotation]); disabled {
+		return nil, errServiceDisabled
+	}
+
 	// Parse ports annotation
-	requestedPorts, err := parsePorts(portsAnnotation)
+	requestedPorts, err := parsePorts(portsAnnotation, opts.MaxPorts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse ports annotation: %w", err)
 	}
+	if err := validateRequestedPorts(svc, requestedPorts); err != nil {
+		return nil, err
+	}
 
-	// Get endpoints to find pod IPs (pod IPs are routable over WireGuard, ClusterIPs are not)
-	endpoints, err := clientset.CoreV1().Endpoints(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get endpoints: %w", err)
+	// Parse optional connection limit
+	var maxConnections int32
+	if value, ok := svc.Annotations[MaxConnectionsAnnotation]; ok {
+		parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid max-connections annotation %q", value)
+		}
+		maxConnections = int32(parsed)
 	}
 
-	// Get first ready pod IP from endpoints
-	var podIP string
-	if len(endpoints.Subsets) > 0 && len(endpoints.Subsets[0].Addresses) > 0 {
-		podIP = endpoints.Subsets[0].Addresses[0].IP
+	// Parse optional HAProxy per-backend connection limit
+	var maxConn int32
+	if value, ok := svc.Annotations[MaxConnAnnotation]; ok {
+		parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid maxconn annotation %q", value)
+		}
+		maxConn = int32(parsed)
 	}
-	
-	if podIP == "" {
-		return nil, fmt.Errorf("no ready pods found for service")
+
+	// Protocols where the backend sends the first bytes (SSH, SMTP, ...)
+	var serverFirst bool
+	if value, ok := svc.Annotations[ServerFirstAnnotation]; ok {
+		serverFirst, err = strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid server-first annotation %q", value)
+		}
+	}
+
+	// Parse optional HTTP health check
+	var healthCheck *types.HealthCheck
+	if value, ok := svc.Annotations[HealthCheckAnnotation]; ok {
+		healthCheck, err = parseHealthCheck(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse healthcheck annotation: %w", err)
+		}
+	}
+
+	// Optional fallback to NodeIP:NodePort when the pod IP is unreachable
+	var nodeFallback bool
+	if value, ok := svc.Annotations[NodeFallbackAnnotation]; ok {
+		nodeFallback, err = strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid node-fallback annotation %q", value)
+		}
+	}
+
+	// Services that need a certificate for HTTPS on their domain
+	var tls bool
+	if value, ok := svc.Annotations[TLSAnnotation]; ok {
+		tls, err = strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls annotation %q", value)
+		}
+	}
+
+	// Plain HTTP requests are redirected to HTTPS unless disabled
+	forceHTTPS := true
+	if value, ok := svc.Annotations[ForceHTTPSAnnotation]; ok {
+		forceHTTPS, err = strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid force-https annotation %q", value)
+		}
+	}
+
+	// Services that must keep their exact ports instead of being moved to a
+	// fallback port on conflict
+	var strictPort bool
+	if value, ok := svc.Annotations[StrictPortAnnotation]; ok {
+		strictPort, err = strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid strict-port annotation %q", value)
+		}
+	}
+
+	// Friendly maintenance page instead of a bare 503 while the backend is down
+	var maintenancePage bool
+	if value, ok := svc.Annotations[MaintenanceAnnotation]; ok {
+		maintenancePage, err = strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance-page annotation %q", value)
+		}
+	}
+
+	// Pin clients to one backend by source IP, "true" or a TTL
+	var sessionAffinity string
+	if value, ok := svc.Annotations[AffinityAnnotation]; ok {
+		sessionAffinity, err = parseAffinity(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Additional subdomains routed to the same backend, validated with the service
+	var aliases []string
+	for _, alias := range strings.Split(svc.Annotations[AliasesAnnotation], ",") {
+		if alias = strings.ToLower(strings.TrimSpace(alias)); alias != "" {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	// Source CIDRs the firewall opens the ports to, validated with the service
+	var sourceRanges []string
+	for _, cidr := range strings.Split(svc.Annotations[SourceRangesAnnotation], ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			sourceRanges = append(sourceRanges, cidr)
+		}
+	}
+
+	// Resolve where traffic should be forwarded to
+	target, err := resolveTarget(ctx, clientset, svc, opts.DefaultTarget)
+	if err != nil {
+		return nil, err
 	}
-	
+
+	if nodeFallback {
+		nodeIP, err := endpointNodeIP(ctx, clientset, svc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve node fallback: %w", err)
+		}
+		target.nodeIP = nodeIP
+	}
+
 	var ports []types.PortMapping
-	
-	// Map requested external ports to endpoint ports
+
+	// Map requested external ports to the resolved target port
+	// unless the annotation specifies one explicitly
 	for _, requestedPort := range requestedPorts {
-		// Use the first endpoint port as the target (most services have only one port)
-		if len(endpoints.Subsets) > 0 && len(endpoints.Subsets[0].Ports) > 0 {
-			endpointPort := endpoints.Subsets[0].Ports[0].Port
-			
-			ports = append(ports, types.PortMapping{
-				Port:       requestedPort.Port, // External port (e.g., 8080)
-				TargetPort: endpointPort,        // Pod port from endpoint (e.g., 80)
-				Protocol:   requestedPort.Protocol,
-			})
-			break // Only process first requested port for now
+		servicePort := servicePortFor(svc, requestedPort)
+		targetPort := target.portFor(servicePort)
+		if requestedPort.TargetPort != 0 {
+			targetPort = requestedPort.TargetPort
+		}
+		// ExternalName services without ports forward to the exposed port
+		if targetPort == 0 {
+			targetPort = requestedPort.Port
 		}
+		// The node fallback uses the node port of the service port exposed
+		var nodePort int32
+		if nodeFallback {
+			if servicePort == nil || servicePort.NodePort == 0 {
+				return nil, fmt.Errorf("node-fallback requires a node port allocated for port %d/%s", requestedPort.Port, requestedPort.Protocol)
+			}
+			nodePort = servicePort.NodePort
+		}
+		ports = append(ports, types.PortMapping{
+			Port:          requestedPort.Port,          // External port (e.g., 8080)
+			TargetPort:    targetPort,                  // Target port (e.g., pod port 80)
+			UDPTargetPort: requestedPort.UDPTargetPort, // Separate target of the UDP half (0 = same)
+			NodePort:      nodePort,                    // NodePort for the node fallback (0 = none)
+			Protocol:      requestedPort.Protocol,
+		})
 	}
 
 	if len(ports) == 0 {
@@ -97,12 +423,25 @@ func extractServiceInfo(clientset kubernetes.Interface, svc *corev1.Service) (*t
 	}
 
 	exposedSvc := &types.ExposedService{
-		Name:      svc.Name,
-		Namespace: svc.Namespace,
-		Subdomain: subdomain,
-		Ports:     ports,
-		TargetIP:  podIP, // Use pod IP for direct routing over WireGuard
-		NodeIP:    podIP,
+		Name:            svc.Name,
+		Namespace:       svc.Namespace,
+		Subdomain:       subdomain,
+		Ports:           ports,
+		TargetIP:        target.ip,
+		TargetIPs:       target.ips,
+		NodeIP:          target.nodeIP,
+		MaxConnections:  maxConnections,
+		ServerFirst:     serverFirst,
+		HealthCheck:     healthCheck,
+		MaxConn:         maxConn,
+		NodeFallback:    nodeFallback,
+		TLS:             tls,
+		AllowHTTP:       !forceHTTPS,
+		StrictPort:      strictPort,
+		MaintenancePage: maintenancePage,
+		Aliases:         aliases,
+		SourceRanges:    sourceRanges,
+		SessionAffinity: sessionAffinity,
 	}
 
 	// Validate the service
@@ -113,13 +452,29 @@ func extractServiceInfo(clientset kubernetes.Interface, svc *corev1.Service) (*t
 	return exposedSvc, nil
 }
 
-// parsePorts parses the ports annotation (format: "25565/tcp,25565/udp,80/tcp")
-func parsePorts(portsAnnotation string) ([]types.PortMapping, error) {
+// parsePorts parses the ports annotation (format: "25565/tcp,25565/udp,80/tcp"),
+// rejecting annotations with more than maxPorts entries (0 = unlimited)
+func parsePorts(portsAnnotation string, maxPorts int) ([]types.PortMapping, error) {
 	if portsAnnotation == "" {
 		return nil, fmt.Errorf("ports annotation is empty")
 	}
 
 	portStrings := strings.Split(portsAnnotation, ",")
+
+	// Check the count before parsing so a typo can never turn into hundreds of listeners
+	if maxPorts > 0 {
+		count := 0
+		for _, portStr := range portStrings {
+			if strings.TrimSpace(portStr) != "" {
+				count++
+			}
+		}
+		if count > maxPorts {
+			servicePortsRejectedTotal.Inc()
+			return nil, fmt.Errorf("ports annotation lists %d ports, at most %d allowed per service", count, maxPorts)
+		}
+	}
+
 	var ports []types.PortMapping
 
 	for _, portStr := range portStrings {
@@ -131,13 +486,20 @@ func parsePorts(portsAnnotation string) ([]types.PortMapping, error) {
 		// Split by '/' to get port and protocol
 		parts := strings.Split(portStr, "/")
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid port format: %q (expected format: port/protocol)", portStr)
+			return nil, fmt.Errorf("invalid port format: %q (expected format: port/protocol or port:target/protocol)", portStr)
+		}
+
+		// Split by ':' to get an optional target port, tcp+udp mappings may
+		// name a separate UDP target port (port:target:udp-target/tcp+udp)
+		portParts := strings.Split(parts[0], ":")
+		if len(portParts) > 3 {
+			return nil, fmt.Errorf("invalid port format: %q (expected format: port/protocol or port:target/protocol)", portStr)
 		}
 
 		// Parse port number
-		portNum, err := strconv.ParseInt(parts[0], 10, 32)
+		portNum, err := strconv.ParseInt(portParts[0], 10, 32)
 		if err != nil {
-			return nil, fmt.Errorf("invalid port number: %q", parts[0])
+			return nil, fmt.Errorf("invalid port number: %q", portParts[0])
 		}
 
 		protocol := strings.ToLower(parts[1])
@@ -147,6 +509,22 @@ func parsePorts(portsAnnotation string) ([]types.PortMapping, error) {
 			Protocol: protocol,
 		}
 
+		// Parse optional target ports
+		for i, targetStr := range portParts[1:] {
+			targetNum, err := strconv.ParseInt(targetStr, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target port number: %q", targetStr)
+			}
+			if targetNum < 1 || targetNum > 65535 {
+				return nil, fmt.Errorf("invalid port mapping %q: target port must be between 1 and 65535, got %d", portStr, targetNum)
+			}
+			if i == 0 {
+				port.TargetPort = int32(targetNum)
+			} else {
+				port.UDPTargetPort = int32(targetNum)
+			}
+		}
+
 		// Validate port mapping
 		if err := port.Validate(); err != nil {
 			return nil, fmt.Errorf("invalid port mapping %q: %w", portStr, err)
@@ -161,3 +539,358 @@ func parsePorts(portsAnnotation string) ([]types.PortMapping, error) {
 
 	return ports, nil
 }
+
+// servicePortFor returns the service port a requested port exposes: the one
+// declaring the requested port, preferring a matching protocol, or else the
+// one declaring or targeting its explicit target port. It returns nil if the
+// service declares no such port.
+func servicePortFor(svc *corev1.Service, requested types.PortMapping) *corev1.ServicePort {
+	// tcp+udp mappings are matched by their TCP half
+	protocol := corev1.ProtocolTCP
+	if requested.Protocol == "udp" {
+		protocol = corev1.ProtocolUDP
+	}
+
+	var match *corev1.ServicePort
+	for i := range svc.Spec.Ports {
+		servicePort := &svc.Spec.Ports[i]
+		if servicePort.Port != requested.Port {
+			continue
+		}
+		if servicePort.Protocol == protocol || (servicePort.Protocol == "" && protocol == corev1.ProtocolTCP) {
+			return servicePort
+		}
+		if match == nil {
+			match = servicePort
+		}
+	}
+	if match != nil || requested.TargetPort == 0 {
+		return match
+	}
+
+	for i := range svc.Spec.Ports {
+		servicePort := &svc.Spec.Ports[i]
+		if servicePort.Port == requested.TargetPort ||
+			(servicePort.TargetPort.Type == intstr.Int && servicePort.TargetPort.IntVal == requested.TargetPort) {
+			return servicePort
+		}
+	}
+	return nil
+}
+
+// validateRequestedPorts checks that every requested port maps to a port
+// declared on the service, see servicePortFor. Explicit targets of services
+// with named target ports are resolved per pod and cannot be checked here.
+// Services without declared ports (e.g. ExternalName) are not checked.
+func validateRequestedPorts(svc *corev1.Service, requested []types.PortMapping) error {
+	if len(svc.Spec.Ports) == 0 {
+		return nil
+	}
+
+	namedTargets := false
+	var declared []string
+	for _, servicePort := range svc.Spec.Ports {
+		declared = append(declared, fmt.Sprint(servicePort.Port))
+		if servicePort.TargetPort.Type == intstr.String {
+			namedTargets = true
+		}
+	}
+
+	for _, port := range requested {
+		if servicePortFor(svc, port) != nil || (port.TargetPort != 0 && namedTargets) {
+			continue
+		}
+		return fmt.Errorf("requested port %d/%s is not declared on the service (declared ports: %s)",
+			port.Port, port.Protocol, strings.Join(declared, ", "))
+	}
+	return nil
+}
+
+// parseHealthCheck parses the healthcheck annotation: "path" or "path:status"
+// (e.g., "/healthz:200")
+func parseHealthCheck(value string) (*types.HealthCheck, error) {
+	value = strings.TrimSpace(value)
+	healthCheck := &types.HealthCheck{Path: value}
+
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		status, err := strconv.ParseInt(value[i+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expected status: %q", value[i+1:])
+		}
+		healthCheck.Path = value[:i]
+		healthCheck.ExpectStatus = int32(status)
+	}
+
+	if err := healthCheck.Validate(); err != nil {
+		return nil, err
+	}
+	return healthCheck, nil
+}
+
+// parseAffinity parses the session-affinity annotation ("true", "false" or a
+// TTL such as "30m") into the TTL of the service, empty if disabled
+func parseAffinity(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		if !enabled {
+			return "", nil
+		}
+		return DefaultAffinityTTL.String(), nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return "", fmt.Errorf("invalid session-affinity annotation %q (expected true, false or a TTL)", value)
+	}
+	if ttl == 0 {
+		return "", nil
+	}
+	return ttl.String(), nil
+}
+
+// targetStrategy returns the target strategy for a service
+func targetStrategy(svc *corev1.Service, defaultTarget string) (string, error) {
+	strategy, ok := svc.Annotations[TargetAnnotation]
+	if !ok || strategy == "" {
+		// ExternalName services have no endpoints, so the external host is the only option
+		if svc.Spec.Type == corev1.ServiceTypeExternalName {
+			return TargetExternal, nil
+		}
+		if defaultTarget != "" {
+			return defaultTarget, nil
+		}
+		return TargetPod, nil
+	}
+
+	strategy = strings.ToLower(strings.TrimSpace(strategy))
+	switch strategy {
+	case TargetPod, TargetExternal, TargetNode, TargetCluster:
+	default:
+		return "", fmt.Errorf("invalid target %q (expected %s, %s, %s or %s)", strategy, TargetPod, TargetExternal, TargetNode, TargetCluster)
+	}
+
+	if svc.Spec.Type == corev1.ServiceTypeExternalName && strategy != TargetExternal {
+		return "", fmt.Errorf("target %q not supported for ExternalName services", strategy)
+	}
+	return strategy, nil
+}
+
+// resolveTarget resolves the forwarding destination according to the service's target strategy
+func resolveTarget(ctx context.Context, clientset kubernetes.Interface, svc *corev1.Service, defaultTarget string) (*serviceTarget, error) {
+	strategy, err := targetStrategy(svc, defaultTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strategy {
+	case TargetExternal:
+		return externalTarget(svc)
+	case TargetNode:
+		return nodeTarget(ctx, clientset, svc)
+	case TargetCluster:
+		return clusterTarget(svc)
+	default:
+		return podTarget(ctx, clientset, svc)
+	}
+}
+
+// podTarget resolves the first ready pod IP and port from the service endpoints
+func podTarget(ctx context.Context, clientset kubernetes.Interface, svc *corev1.Service) (*serviceTarget, error) {
+	// Get endpoints to find pod IPs (pod IPs are routable over WireGuard, ClusterIPs are not)
+	endpoints, err := readyEndpoints(ctx, clientset, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get first ready pod IP from endpoints
+	subset := endpoints.Subsets[0]
+
+	// Use the first endpoint port as the target (most services have only one port)
+	if len(subset.Ports) == 0 {
+		return nil, fmt.Errorf("no valid ports found for service")
+	}
+
+	// Endpoint ports carry the service port names and the resolved
+	// (possibly named) target ports
+	ports := make(map[string]int32, len(subset.Ports))
+	for _, endpointPort := range subset.Ports {
+		ports[endpointPort.Name] = endpointPort.Port
+	}
+
+	podIP := subset.Addresses[0].IP
+	target := &serviceTarget{
+		ip:     podIP, // Use pod IP for direct routing over WireGuard
+		nodeIP: podIP,
+		port:   subset.Ports[0].Port,
+		ports:  ports,
+	}
+
+	// The server balances connections across all ready pods of the subset
+	if len(subset.Addresses) > 1 {
+		for _, address := range subset.Addresses {
+			target.ips = append(target.ips, address.IP)
+		}
+	}
+	return target, nil
+}
+
+// clusterTarget resolves the service ClusterIP and port, leaving load
+// balancing across pods to kube-proxy
+func clusterTarget(svc *corev1.Service) (*serviceTarget, error) {
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == corev1.ClusterIPNone {
+		return nil, fmt.Errorf("target %q requires a service with a ClusterIP", TargetCluster)
+	}
+	if len(svc.Spec.Ports) == 0 {
+		return nil, fmt.Errorf("no valid ports found for service")
+	}
+
+	return &serviceTarget{
+		ip:    svc.Spec.ClusterIP,
+		port:  svc.Spec.Ports[0].Port,
+		ports: specPorts(svc),
+	}, nil
+}
+
+// externalTarget resolves the ExternalName host or the LoadBalancer ingress address
+func externalTarget(svc *corev1.Service) (*serviceTarget, error) {
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		if svc.Spec.ExternalName == "" {
+			return nil, fmt.Errorf("ExternalName service has no external name")
+		}
+		// ExternalName services have no port mapping, forward to the service
+		// port if declared and to the exposed port otherwise (port 0)
+		var port int32
+		if len(svc.Spec.Ports) > 0 {
+			port = svc.Spec.Ports[0].Port
+		}
+		return &serviceTarget{ip: svc.Spec.ExternalName, port: port, ports: specPorts(svc)}, nil
+	}
+
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil, fmt.Errorf("target %q requires a LoadBalancer or ExternalName service, got %s", TargetExternal, svc.Spec.Type)
+	}
+	if len(svc.Spec.Ports) == 0 {
+		return nil, fmt.Errorf("no valid ports found for service")
+	}
+
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		addr := ingress.IP
+		if addr == "" {
+			addr = ingress.Hostname
+		}
+		if addr != "" {
+			return &serviceTarget{ip: addr, port: svc.Spec.Ports[0].Port, ports: specPorts(svc)}, nil
+		}
+	}
+	return nil, fmt.Errorf("no load balancer ingress address assigned yet")
+}
+
+// nodeTarget resolves the node IP hosting the first ready pod together with the NodePort
+func nodeTarget(ctx context.Context, clientset kubernetes.Interface, svc *corev1.Service) (*serviceTarget, error) {
+	if svc.Spec.Type != corev1.ServiceTypeNodePort && svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil, fmt.Errorf("target %q requires a NodePort or LoadBalancer service, got %s", TargetNode, svc.Spec.Type)
+	}
+	if len(svc.Spec.Ports) == 0 || svc.Spec.Ports[0].NodePort == 0 {
+		return nil, fmt.Errorf("service has no node port allocated")
+	}
+
+	nodeIP, err := endpointNodeIP(ctx, clientset, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make(map[string]int32, len(svc.Spec.Ports))
+	for _, servicePort := range svc.Spec.Ports {
+		if servicePort.NodePort != 0 {
+			ports[servicePort.Name] = servicePort.NodePort
+		}
+	}
+
+	return &serviceTarget{
+		ip:     nodeIP,
+		nodeIP: nodeIP,
+		port:   svc.Spec.Ports[0].NodePort,
+		ports:  ports,
+	}, nil
+}
+
+// specPorts maps the service port names to the declared service ports
+func specPorts(svc *corev1.Service) map[string]int32 {
+	ports := make(map[string]int32, len(svc.Spec.Ports))
+	for _, servicePort := range svc.Spec.Ports {
+		ports[servicePort.Name] = servicePort.Port
+	}
+	return ports
+}
+
+// endpointNodeIP returns the IP of the node hosting the first ready pod
+func endpointNodeIP(ctx context.Context, clientset kubernetes.Interface, svc *corev1.Service) (string, error) {
+	endpoints, err := readyEndpoints(ctx, clientset, svc)
+	if err != nil {
+		return "", err
+	}
+
+	nodeName := endpoints.Subsets[0].Addresses[0].NodeName
+	if nodeName == nil || *nodeName == "" {
+		return "", fmt.Errorf("endpoint has no node assigned")
+	}
+
+	node, err := clientset.CoreV1().Nodes().Get(ctx, *nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get node %s: %w", *nodeName, err)
+	}
+
+	nodeIP := nodeInternalIP(node)
+	if nodeIP == "" {
+		return "", fmt.Errorf("node %s has no internal IP", *nodeName)
+	}
+	return nodeIP, nil
+}
+
+// readyEndpoints returns the endpoints of a service with at least one ready
+// address. Endpoints are populated shortly after a service is created, so
+// for new services the lookup is retried with backoff instead of skipping
+// the service until the next sync. Waiting stops when ctx is cancelled.
+func readyEndpoints(ctx context.Context, clientset kubernetes.Interface, svc *corev1.Service) (*corev1.Endpoints, error) {
+	delay := endpointsRetryDelay
+	for attempt := 0; ; attempt++ {
+		endpoints, err := clientset.CoreV1().Endpoints(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get endpoints: %w", err)
+		}
+		if err == nil && len(endpoints.Subsets) > 0 && len(endpoints.Subsets[0].Addresses) > 0 {
+			return endpoints, nil
+		}
+
+		if attempt == endpointsRetries || time.Since(svc.CreationTimestamp.Time) > endpointsRetryWindow {
+			if err != nil {
+				return nil, fmt.Errorf("failed to get endpoints: %w", err)
+			}
+			return nil, fmt.Errorf("no ready pods found for service")
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("waiting for endpoints: %w", ctx.Err())
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// nodeInternalIP returns the internal IP of a node, falling back to its external IP
+func nodeInternalIP(node *corev1.Node) string {
+	var externalIP string
+	for _, addr := range node.Status.Addresses {
+		switch addr.Type {
+		case corev1.NodeInternalIP:
+			return addr.Address
+		case corev1.NodeExternalIP:
+			if externalIP == "" {
+				externalIP = addr.Address
+			}
+		}
+	}
+	return externalIP
+}
@@ -0,0 +1,757 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testLogger discards all log output
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// annotatedService returns a service exposing port 8080 under name as subdomain
+func annotatedService(name string, svcType corev1.ServiceType, annotations map[string]string) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Annotations: map[string]string{
+				SubdomainAnnotation: name,
+				PortsAnnotation:     "8080/tcp",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:  svcType,
+			Ports: []corev1.ServicePort{{Port: 8080, TargetPort: intstr.FromInt32(80)}},
+		},
+	}
+	for key, value := range annotations {
+		svc.Annotations[key] = value
+	}
+	return svc
+}
+
+// readyEndpointsFor returns endpoints with one ready address on node
+func readyEndpointsFor(name, ip string, port int32, node string) *corev1.Endpoints {
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: ip, NodeName: &node}},
+			Ports:     []corev1.EndpointPort{{Port: port}},
+		}},
+	}
+}
+
+// testNode returns a node with an internal IP
+func testNode(name, ip string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+// discover runs discovery against a fake cluster with the given objects
+func discover(t *testing.T, clientset *fake.Clientset) []types.ExposedService {
+	t.Helper()
+	return discoverWith(t, clientset, DiscoveryOptions{})
+}
+
+// discoverWith runs discovery with the given options
+func discoverWith(t *testing.T, clientset *fake.Clientset, opts DiscoveryOptions) []types.ExposedService {
+	t.Helper()
+	services, err := DiscoverServices(context.Background(), clientset, opts, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return services
+}
+
+func TestServiceTypeTargets(t *testing.T) {
+	externalName := annotatedService("external", corev1.ServiceTypeExternalName, nil)
+	externalName.Spec.ExternalName = "db.example.com"
+
+	portless := annotatedService("portless", corev1.ServiceTypeExternalName, nil)
+	portless.Spec.ExternalName = "db.example.com"
+	portless.Spec.Ports = nil
+
+	lbIP := annotatedService("lb", corev1.ServiceTypeLoadBalancer, map[string]string{TargetAnnotation: TargetExternal})
+	lbIP.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.0.2.10"}}
+
+	lbHost := annotatedService("lb-host", corev1.ServiceTypeLoadBalancer, map[string]string{TargetAnnotation: TargetExternal})
+	lbHost.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}
+
+	nodePort := annotatedService("nodeport", corev1.ServiceTypeNodePort, map[string]string{TargetAnnotation: TargetNode})
+	nodePort.Spec.Ports[0].NodePort = 30080
+
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		wantIP     string
+		wantPort   int32
+		wantReject bool
+	}{
+		{"pod", []runtime.Object{annotatedService("pod", corev1.ServiceTypeClusterIP, nil), readyEndpointsFor("pod", "10.42.0.5", 80, "node-1")}, "10.42.0.5", 80, false},
+		{"external name", []runtime.Object{externalName}, "db.example.com", 8080, false},
+		{"external name without ports", []runtime.Object{portless}, "db.example.com", 8080, false},
+		{"load balancer IP", []runtime.Object{lbIP}, "192.0.2.10", 8080, false},
+		{"load balancer hostname", []runtime.Object{lbHost}, "lb.example.com", 8080, false},
+		{"node port", []runtime.Object{nodePort, readyEndpointsFor("nodeport", "10.42.0.6", 80, "node-1"), testNode("node-1", "10.0.0.1")}, "10.0.0.1", 30080, false},
+		{"load balancer without ingress", []runtime.Object{annotatedService("pending", corev1.ServiceTypeLoadBalancer, map[string]string{TargetAnnotation: TargetExternal})}, "", 0, true},
+		{"node target on cluster IP service", []runtime.Object{annotatedService("cip", corev1.ServiceTypeClusterIP, map[string]string{TargetAnnotation: TargetNode})}, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := discover(t, fake.NewSimpleClientset(tt.objects...))
+			if tt.wantReject {
+				if len(services) != 0 {
+					t.Fatalf("expected the service to be skipped, got %+v", services)
+				}
+				return
+			}
+			if len(services) != 1 {
+				t.Fatalf("expected one service, got %d", len(services))
+			}
+			svc := services[0]
+			if svc.TargetIP != tt.wantIP || svc.Ports[0].TargetPort != tt.wantPort {
+				t.Errorf("expected target %s:%d, got %s:%d", tt.wantIP, tt.wantPort, svc.TargetIP, svc.Ports[0].TargetPort)
+			}
+		})
+	}
+}
+
+func TestDisabledAnnotation(t *testing.T) {
+	svc := annotatedService("web", corev1.ServiceTypeClusterIP, nil)
+	clientset := fake.NewSimpleClientset(svc, readyEndpointsFor("web", "10.42.0.5", 80, "node-1"))
+	ctx := context.Background()
+
+	setDisabled := func(value string) {
+		t.Helper()
+		svc.Annotations[DisabledAnnotation] = value
+		if _, err := clientset.CoreV1().Services("default").Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := discover(t, clientset); len(got) != 1 {
+		t.Fatalf("expected the service to be exposed, got %d services", len(got))
+	}
+
+	setDisabled("true")
+	if got := discover(t, clientset); len(got) != 0 {
+		t.Fatalf("disabled service still discovered: %+v", got)
+	}
+	if svc.Annotations[SubdomainAnnotation] != "web" || svc.Annotations[PortsAnnotation] != "8080/tcp" {
+		t.Error("disabling changed the exposure annotations")
+	}
+
+	setDisabled("false")
+	if got := discover(t, clientset); len(got) != 1 || got[0].Subdomain != "web" {
+		t.Fatalf("re-enabled service not discovered: %+v", got)
+	}
+}
+
+func TestMaxConnectionsAnnotation(t *testing.T) {
+	tests := []struct {
+		value      string
+		want       int32
+		wantReject bool
+	}{
+		{"", 0, false},
+		{"100", 100, false},
+		{" 5 ", 5, false},
+		{"-1", 0, true},
+		{"many", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			annotations := map[string]string{}
+			if tt.value != "" {
+				annotations[MaxConnectionsAnnotation] = tt.value
+			}
+			services := discover(t, fake.NewSimpleClientset(
+				annotatedService("web", corev1.ServiceTypeClusterIP, annotations),
+				readyEndpointsFor("web", "10.42.0.5", 80, "node-1"),
+			))
+			if tt.wantReject {
+				if len(services) != 0 {
+					t.Fatalf("expected the service to be skipped, got %+v", services)
+				}
+				return
+			}
+			if len(services) != 1 || services[0].MaxConnections != tt.want {
+				t.Fatalf("expected a limit of %d, got %+v", tt.want, services)
+			}
+		})
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		annotation string
+		want       []types.PortMapping
+		wantErr    bool
+	}{
+		{"8080/tcp", []types.PortMapping{{Port: 8080, Protocol: "tcp"}}, false},
+		{"443:8443/tcp", []types.PortMapping{{Port: 443, TargetPort: 8443, Protocol: "tcp"}}, false},
+		{"443:8443/TCP, 27015/udp", []types.PortMapping{
+			{Port: 443, TargetPort: 8443, Protocol: "tcp"},
+			{Port: 27015, Protocol: "udp"},
+		}, false},
+		{"443:8443:9443/tcp", nil, true},
+		{"443:0/tcp", nil, true},
+		{"443:70000/tcp", nil, true},
+		{"0:8443/tcp", nil, true},
+		{"443:https/tcp", nil, true},
+		{"443", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.annotation, func(t *testing.T) {
+			got, err := parsePorts(tt.annotation, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTargetPortOverride(t *testing.T) {
+	svc := annotatedService("web", corev1.ServiceTypeClusterIP, map[string]string{PortsAnnotation: "443:8443/tcp"})
+	svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Port: 443, TargetPort: intstr.FromInt32(8443)})
+	services := discover(t, fake.NewSimpleClientset(svc, readyEndpointsFor("web", "10.42.0.5", 80, "node-1")))
+	if len(services) != 1 {
+		t.Fatalf("expected one service, got %d", len(services))
+	}
+	if port := services[0].Ports[0]; port.Port != 443 || port.TargetPort != 8443 {
+		t.Errorf("expected 443 forwarded to 8443 instead of the endpoint port, got %d to %d", port.Port, port.TargetPort)
+	}
+}
+
+func TestParseHealthCheck(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *types.HealthCheck
+		wantErr bool
+	}{
+		{"/healthz", &types.HealthCheck{Path: "/healthz"}, false},
+		{"/healthz:200", &types.HealthCheck{Path: "/healthz", ExpectStatus: 200}, false},
+		{" /ready?full=1:204 ", &types.HealthCheck{Path: "/ready?full=1", ExpectStatus: 204}, false},
+		{"healthz", nil, true},
+		{"/health z", nil, true},
+		{"/healthz:ok", nil, true},
+		{"/healthz:700", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseHealthCheck(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeFallbackAnnotation(t *testing.T) {
+	svc := annotatedService("web", corev1.ServiceTypeNodePort, map[string]string{NodeFallbackAnnotation: "true"})
+	svc.Spec.Ports[0].NodePort = 30080
+	services := discover(t, fake.NewSimpleClientset(svc, readyEndpointsFor("web", "10.42.0.5", 80, "node-1"), testNode("node-1", "10.0.0.1")))
+	if len(services) != 1 {
+		t.Fatalf("expected one service, got %d", len(services))
+	}
+	got := services[0]
+	if !got.NodeFallback || got.NodeIP != "10.0.0.1" || got.Ports[0].NodePort != 30080 {
+		t.Errorf("expected fallback to 10.0.0.1:30080, got %+v", got)
+	}
+	if got.TargetIP != "10.42.0.5" || got.Ports[0].TargetPort != 80 {
+		t.Errorf("expected the pod as primary target, got %s:%d", got.TargetIP, got.Ports[0].TargetPort)
+	}
+
+	// A service without a node port cannot fall back and is skipped
+	clusterIP := annotatedService("cip", corev1.ServiceTypeClusterIP, map[string]string{NodeFallbackAnnotation: "true"})
+	if services := discover(t, fake.NewSimpleClientset(clusterIP, readyEndpointsFor("cip", "10.42.0.6", 80, "node-1"))); len(services) != 0 {
+		t.Errorf("expected the service to be skipped, got %+v", services)
+	}
+
+	// The fallback uses the node port of the exposed service port
+	multi := annotatedService("multi", corev1.ServiceTypeNodePort, map[string]string{NodeFallbackAnnotation: "true", PortsAnnotation: "9090/tcp"})
+	multi.Spec.Ports = append(multi.Spec.Ports, corev1.ServicePort{Port: 9090, NodePort: 30090})
+	multi.Spec.Ports[0].NodePort = 30080
+	services = discover(t, fake.NewSimpleClientset(multi, readyEndpointsFor("multi", "10.42.0.7", 80, "node-1"), testNode("node-1", "10.0.0.1")))
+	if len(services) != 1 || services[0].Ports[0].NodePort != 30090 {
+		t.Errorf("expected node port 30090 of port 9090, got %+v", services)
+	}
+
+	// Another port's node port is no fallback for a port without one
+	multi.Spec.Ports[1].NodePort = 0
+	if services := discover(t, fake.NewSimpleClientset(multi, readyEndpointsFor("multi", "10.42.0.7", 80, "node-1"), testNode("node-1", "10.0.0.1"))); len(services) != 0 {
+		t.Errorf("expected the service to be skipped, got %+v", services)
+	}
+}
+
+func TestClusterIPTarget(t *testing.T) {
+	withClusterIP := func(name string, annotations map[string]string) *corev1.Service {
+		svc := annotatedService(name, corev1.ServiceTypeClusterIP, annotations)
+		svc.Spec.ClusterIP = "10.43.0.10"
+		return svc
+	}
+	headless := annotatedService("headless", corev1.ServiceTypeClusterIP, map[string]string{TargetAnnotation: TargetCluster})
+	headless.Spec.ClusterIP = corev1.ClusterIPNone
+
+	clientset := fake.NewSimpleClientset(
+		withClusterIP("annotated", map[string]string{TargetAnnotation: TargetCluster}),
+		withClusterIP("pod", map[string]string{TargetAnnotation: TargetPod}),
+		readyEndpointsFor("pod", "10.42.0.5", 80, "node-1"),
+		withClusterIP("default", nil),
+		readyEndpointsFor("default", "10.42.0.6", 80, "node-1"),
+		headless,
+	)
+	targets := func(opts DiscoveryOptions) map[string]string {
+		got := make(map[string]string)
+		for _, svc := range discoverWith(t, clientset, opts) {
+			got[svc.Name] = fmt.Sprintf("%s:%d", svc.TargetIP, svc.Ports[0].TargetPort)
+		}
+		return got
+	}
+
+	// The annotation selects the ClusterIP and service port, headless services are skipped
+	want := map[string]string{"annotated": "10.43.0.10:8080", "pod": "10.42.0.5:80", "default": "10.42.0.6:80"}
+	if got := targets(DiscoveryOptions{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// The agent-wide default applies to services without target annotation only
+	want["default"] = "10.43.0.10:8080"
+	if got := targets(DiscoveryOptions{DefaultTarget: TargetCluster}); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestParseTargetStrategy(t *testing.T) {
+	for value, want := range map[string]string{"": TargetPod, "pod-ip": TargetPod, "Cluster-IP": TargetCluster, "cluster": TargetCluster} {
+		if got, err := ParseTargetStrategy(value); err != nil || got != want {
+			t.Errorf("ParseTargetStrategy(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseTargetStrategy("node-ip"); err == nil {
+		t.Error("expected an unknown strategy to be rejected")
+	}
+}
+
+func TestNamespaceScopedDiscovery(t *testing.T) {
+	inNamespace := func(name, namespace string) []runtime.Object {
+		svc := annotatedService(name, corev1.ServiceTypeClusterIP, nil)
+		svc.Namespace = namespace
+		endpoints := readyEndpointsFor(name, "10.42.0.5", 80, "node-1")
+		endpoints.Namespace = namespace
+		return []runtime.Object{svc, endpoints}
+	}
+	var objects []runtime.Object
+	objects = append(objects, inNamespace("web", "team-a")...)
+	objects = append(objects, inNamespace("api", "team-b")...)
+	objects = append(objects, inNamespace("db", "secret")...)
+	clientset := fake.NewSimpleClientset(objects...)
+
+	// The agent may not read the secret namespace
+	clientset.PrependReactor("list", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "secret" {
+			return true, nil, apierrors.NewForbidden(corev1.Resource("services"), "", errors.New("no access"))
+		}
+		return false, nil, nil
+	})
+
+	names := func(opts DiscoveryOptions) []string {
+		var got []string
+		for _, svc := range discoverWith(t, clientset, opts) {
+			got = append(got, svc.Name)
+		}
+		sort.Strings(got)
+		return got
+	}
+	if got := names(DiscoveryOptions{Namespaces: []string{"team-a"}}); !reflect.DeepEqual(got, []string{"web"}) {
+		t.Errorf("expected only team-a services, got %v", got)
+	}
+	// Forbidden namespaces are skipped instead of failing discovery
+	if got := names(DiscoveryOptions{Namespaces: []string{"team-a", "secret", "team-b"}}); !reflect.DeepEqual(got, []string{"api", "web"}) {
+		t.Errorf("expected team-a and team-b services, got %v", got)
+	}
+}
+
+func TestMultiplePorts(t *testing.T) {
+	svc := annotatedService("game", corev1.ServiceTypeClusterIP, map[string]string{PortsAnnotation: "25565/tcp,25565/udp,8080:9090/tcp"})
+	svc.Spec.Ports = append(svc.Spec.Ports,
+		corev1.ServicePort{Port: 25565, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Port: 25565, Protocol: corev1.ProtocolUDP})
+	services := discover(t, fake.NewSimpleClientset(svc, readyEndpointsFor("game", "10.42.0.5", 25565, "node-1")))
+	if len(services) != 1 {
+		t.Fatalf("expected one service, got %d", len(services))
+	}
+	want := []types.PortMapping{
+		{Port: 25565, TargetPort: 25565, Protocol: "tcp"},
+		{Port: 25565, TargetPort: 25565, Protocol: "udp"},
+		{Port: 8080, TargetPort: 9090, Protocol: "tcp"},
+	}
+	if !reflect.DeepEqual(services[0].Ports, want) {
+		t.Errorf("expected every requested port, got %+v", services[0].Ports)
+	}
+}
+
+func TestTLSAnnotation(t *testing.T) {
+	services := discover(t, fake.NewSimpleClientset(
+		annotatedService("secure", corev1.ServiceTypeClusterIP, map[string]string{TLSAnnotation: "true"}),
+		readyEndpointsFor("secure", "10.42.0.5", 80, "node-1"),
+		annotatedService("plain", corev1.ServiceTypeClusterIP, nil),
+		readyEndpointsFor("plain", "10.42.0.6", 80, "node-1"),
+		annotatedService("invalid", corev1.ServiceTypeClusterIP, map[string]string{TLSAnnotation: "maybe"}),
+		readyEndpointsFor("invalid", "10.42.0.7", 80, "node-1"),
+	))
+	got := map[string]bool{}
+	for _, svc := range services {
+		got[svc.Name] = svc.TLS
+	}
+	if len(got) != 2 || !got["secure"] || got["plain"] {
+		t.Errorf("expected secure with TLS, plain without and invalid skipped, got %v", got)
+	}
+}
+
+func TestForceHTTPSAnnotation(t *testing.T) {
+	services := discover(t, fake.NewSimpleClientset(
+		annotatedService("hook", corev1.ServiceTypeClusterIP, map[string]string{ForceHTTPSAnnotation: "false"}),
+		readyEndpointsFor("hook", "10.42.0.5", 80, "node-1"),
+		annotatedService("web", corev1.ServiceTypeClusterIP, nil),
+		readyEndpointsFor("web", "10.42.0.6", 80, "node-1"),
+		annotatedService("forced", corev1.ServiceTypeClusterIP, map[string]string{ForceHTTPSAnnotation: "true"}),
+		readyEndpointsFor("forced", "10.42.0.7", 80, "node-1"),
+		annotatedService("invalid", corev1.ServiceTypeClusterIP, map[string]string{ForceHTTPSAnnotation: "sometimes"}),
+		readyEndpointsFor("invalid", "10.42.0.8", 80, "node-1"),
+	))
+	got := map[string]bool{}
+	for _, svc := range services {
+		got[svc.Name] = svc.AllowHTTP
+	}
+	if len(got) != 3 || !got["hook"] || got["web"] || got["forced"] {
+		t.Errorf("expected only hook to allow plain HTTP and invalid skipped, got %v", got)
+	}
+}
+
+func TestStrictPortAnnotation(t *testing.T) {
+	services := discover(t, fake.NewSimpleClientset(
+		annotatedService("game", corev1.ServiceTypeClusterIP, map[string]string{StrictPortAnnotation: "true"}),
+		readyEndpointsFor("game", "10.42.0.5", 80, "node-1"),
+		annotatedService("web", corev1.ServiceTypeClusterIP, nil),
+		readyEndpointsFor("web", "10.42.0.6", 80, "node-1"),
+		annotatedService("invalid", corev1.ServiceTypeClusterIP, map[string]string{StrictPortAnnotation: "always"}),
+		readyEndpointsFor("invalid", "10.42.0.7", 80, "node-1"),
+	))
+	got := map[string]bool{}
+	for _, svc := range services {
+		got[svc.Name] = svc.StrictPort
+	}
+	if len(got) != 2 || !got["game"] || got["web"] {
+		t.Errorf("expected only game with a strict port and invalid skipped, got %v", got)
+	}
+}
+
+func TestMaintenancePageAnnotation(t *testing.T) {
+	services := discover(t, fake.NewSimpleClientset(
+		annotatedService("shop", corev1.ServiceTypeClusterIP, map[string]string{MaintenanceAnnotation: "true", HealthCheckAnnotation: "/healthz"}),
+		readyEndpointsFor("shop", "10.42.0.5", 80, "node-1"),
+		annotatedService("web", corev1.ServiceTypeClusterIP, map[string]string{HealthCheckAnnotation: "/healthz"}),
+		readyEndpointsFor("web", "10.42.0.6", 80, "node-1"),
+		// Without a health check HAProxy never sees the backend down
+		annotatedService("unchecked", corev1.ServiceTypeClusterIP, map[string]string{MaintenanceAnnotation: "true"}),
+		readyEndpointsFor("unchecked", "10.42.0.7", 80, "node-1"),
+		annotatedService("invalid", corev1.ServiceTypeClusterIP, map[string]string{MaintenanceAnnotation: "soon", HealthCheckAnnotation: "/healthz"}),
+		readyEndpointsFor("invalid", "10.42.0.8", 80, "node-1"),
+	))
+	got := map[string]bool{}
+	for _, svc := range services {
+		got[svc.Name] = svc.MaintenancePage
+	}
+	if len(got) != 2 || !got["shop"] || got["web"] {
+		t.Errorf("expected only shop with a maintenance page and unchecked and invalid skipped, got %v", got)
+	}
+}
+
+func TestAliasesAnnotation(t *testing.T) {
+	services := discover(t, fake.NewSimpleClientset(
+		annotatedService("app", corev1.ServiceTypeClusterIP, map[string]string{AliasesAnnotation: "www, WWW.App ,"}),
+		readyEndpointsFor("app", "10.42.0.5", 80, "node-1"),
+		annotatedService("invalid", corev1.ServiceTypeClusterIP, map[string]string{AliasesAnnotation: "not_valid"}),
+		readyEndpointsFor("invalid", "10.42.0.6", 80, "node-1"),
+	))
+	if len(services) != 1 {
+		t.Fatalf("expected the service with an invalid alias to be skipped, got %d services", len(services))
+	}
+	if want := []string{"www", "www.app"}; !reflect.DeepEqual(services[0].Aliases, want) {
+		t.Errorf("expected aliases %v, got %v", want, services[0].Aliases)
+	}
+}
+
+func TestMaxPortsPerService(t *testing.T) {
+	game := annotatedService("game", corev1.ServiceTypeClusterIP, map[string]string{PortsAnnotation: "25565/tcp, 25565/udp, 8080/tcp"})
+	game.Spec.Ports = append(game.Spec.Ports, corev1.ServicePort{Port: 25565})
+	portRange := annotatedService("range", corev1.ServiceTypeClusterIP, map[string]string{PortsAnnotation: "7000/udp,7001/udp,7002/udp,7003/udp"})
+	for port := int32(7000); port <= 7003; port++ {
+		portRange.Spec.Ports = append(portRange.Spec.Ports, corev1.ServicePort{Port: port, Protocol: corev1.ProtocolUDP})
+	}
+	clientset := fake.NewSimpleClientset(
+		game, readyEndpointsFor("game", "10.42.0.5", 25565, "node-1"),
+		portRange, readyEndpointsFor("range", "10.42.0.6", 7000, "node-1"),
+	)
+
+	// Services at the limit are discovered, services over it are rejected
+	services := discoverWith(t, clientset, DiscoveryOptions{MaxPorts: 3})
+	if len(services) != 1 || services[0].Name != "game" || len(services[0].Ports) != 3 {
+		t.Fatalf("expected only game with all 3 ports, got %+v", services)
+	}
+	if _, err := parsePorts("7000/udp,7001/udp,7002/udp,7003/udp", 3); err == nil ||
+		err.Error() != "ports annotation lists 4 ports, at most 3 allowed per service" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// Without a limit every service is discovered
+	if services := discoverWith(t, clientset, DiscoveryOptions{}); len(services) != 2 {
+		t.Errorf("expected both services without a limit, got %d", len(services))
+	}
+}
+
+func TestRequestedPortsMatchSpec(t *testing.T) {
+	named := annotatedService("named", corev1.ServiceTypeClusterIP, nil)
+	named.Spec.Ports[0].TargetPort = intstr.FromString("http")
+	external := annotatedService("external", corev1.ServiceTypeExternalName, nil)
+	external.Spec.ExternalName = "db.example.com"
+	external.Spec.Ports = nil
+
+	tests := []struct {
+		name       string
+		svc        *corev1.Service
+		annotation string
+		wantErr    bool
+	}{
+		{"declared port", annotatedService("web", corev1.ServiceTypeClusterIP, nil), "8080/tcp", false},
+		{"undeclared port", annotatedService("web", corev1.ServiceTypeClusterIP, nil), "9090/tcp", true},
+		{"target matches target port", annotatedService("web", corev1.ServiceTypeClusterIP, nil), "9090:80/tcp", false},
+		{"target matches service port", annotatedService("web", corev1.ServiceTypeClusterIP, nil), "9090:8080/tcp", false},
+		{"target matches nothing", annotatedService("web", corev1.ServiceTypeClusterIP, nil), "9090:3000/tcp", true},
+		{"named target port", named, "9090:3000/tcp", false},
+		{"no declared ports", external, "5432/tcp", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports, err := parsePorts(tt.annotation, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = validateRequestedPorts(tt.svc, ports)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// Mismatching services are skipped by discovery
+	mismatch := annotatedService("typo", corev1.ServiceTypeClusterIP, map[string]string{PortsAnnotation: "8081/tcp"})
+	services := discover(t, fake.NewSimpleClientset(
+		mismatch, readyEndpointsFor("typo", "10.42.0.5", 80, "node-1"),
+		annotatedService("web", corev1.ServiceTypeClusterIP, nil), readyEndpointsFor("web", "10.42.0.6", 80, "node-1"),
+	))
+	if len(services) != 1 || services[0].Name != "web" {
+		t.Errorf("expected only web to be discovered, got %+v", services)
+	}
+}
+
+func TestPerPortTargets(t *testing.T) {
+	svc := annotatedService("web", corev1.ServiceTypeNodePort, map[string]string{PortsAnnotation: "80/tcp,443/tcp"})
+	svc.Spec.ClusterIP = "10.43.0.10"
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080), NodePort: 30080},
+		{Name: "https", Port: 443, TargetPort: intstr.FromString("tls"), NodePort: 30443},
+	}
+	endpoints := readyEndpointsFor("web", "10.42.0.5", 0, "node-1")
+	// Endpoint ports are listed in no particular order
+	endpoints.Subsets[0].Ports = []corev1.EndpointPort{{Name: "https", Port: 8443}, {Name: "http", Port: 8080}}
+	clientset := fake.NewSimpleClientset(svc, endpoints, testNode("node-1", "192.168.1.10"))
+
+	// Each requested port forwards to the target port of its service port,
+	// named target ports resolve through the endpoint port of the same name
+	for target, want := range map[string][]int32{
+		TargetPod:     {8080, 8443},
+		TargetCluster: {80, 443},
+		TargetNode:    {30080, 30443},
+	} {
+		svc.Annotations[TargetAnnotation] = target
+		if err := clientset.Tracker().Update(corev1.SchemeGroupVersion.WithResource("services"), svc, "default"); err != nil {
+			t.Fatal(err)
+		}
+		services := discover(t, clientset)
+		if len(services) != 1 || len(services[0].Ports) != 2 {
+			t.Fatalf("%s: expected one service with both ports, got %+v", target, services)
+		}
+		got := []int32{services[0].Ports[0].TargetPort, services[0].Ports[1].TargetPort}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected target ports %v, got %v", target, want, got)
+		}
+	}
+}
+
+func TestEndpointsAppearAfterService(t *testing.T) {
+	svc := annotatedService("fresh", corev1.ServiceTypeClusterIP, nil)
+	svc.CreationTimestamp = metav1.Now()
+	clientset := fake.NewSimpleClientset(svc)
+
+	// The endpoints controller populates the endpoints shortly after the service
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		clientset.CoreV1().Endpoints("default").Create(context.Background(), readyEndpointsFor("fresh", "10.42.0.5", 80, "node-1"), metav1.CreateOptions{})
+	}()
+
+	services := discover(t, clientset)
+	if len(services) != 1 || services[0].TargetIP != "10.42.0.5" {
+		t.Fatalf("expected the new service to be discovered once its endpoints appear, got %+v", services)
+	}
+
+	// Old services without endpoints are skipped right away
+	stale := annotatedService("stale", corev1.ServiceTypeClusterIP, nil)
+	start := time.Now()
+	if services := discover(t, fake.NewSimpleClientset(stale)); len(services) != 0 {
+		t.Errorf("expected the service without endpoints to be skipped, got %+v", services)
+	}
+	if elapsed := time.Since(start); elapsed > endpointsRetryDelay {
+		t.Errorf("lookup of an old service was retried (%s)", elapsed)
+	}
+}
+
+func TestEndpointsRetryStopsOnCancel(t *testing.T) {
+	svc := annotatedService("fresh", corev1.ServiceTypeClusterIP, nil)
+	svc.CreationTimestamp = metav1.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := readyEndpoints(ctx, fake.NewSimpleClientset(svc), svc)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait to end with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > endpointsRetryDelay {
+		t.Errorf("retry kept waiting after cancellation (%s)", elapsed)
+	}
+}
+
+// slowEndpoints delays endpoint lookups outside the fake clientset's lock and
+// tracks how many are in flight
+type slowEndpoints struct {
+	kubernetes.Interface
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (s *slowEndpoints) CoreV1() corev1client.CoreV1Interface {
+	return slowCoreV1{s.Interface.CoreV1(), s}
+}
+
+type slowCoreV1 struct {
+	corev1client.CoreV1Interface
+	tracker *slowEndpoints
+}
+
+func (c slowCoreV1) Endpoints(namespace string) corev1client.EndpointsInterface {
+	return slowEndpointsClient{c.CoreV1Interface.Endpoints(namespace), c.tracker}
+}
+
+type slowEndpointsClient struct {
+	corev1client.EndpointsInterface
+	tracker *slowEndpoints
+}
+
+func (e slowEndpointsClient) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Endpoints, error) {
+	e.tracker.mu.Lock()
+	e.tracker.inFlight++
+	if e.tracker.inFlight > e.tracker.peak {
+		e.tracker.peak = e.tracker.inFlight
+	}
+	e.tracker.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	e.tracker.mu.Lock()
+	e.tracker.inFlight--
+	e.tracker.mu.Unlock()
+	return e.EndpointsInterface.Get(ctx, name, opts)
+}
+
+func TestDiscoveryConcurrencyBounded(t *testing.T) {
+	var objects []runtime.Object
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("svc-%02d", i)
+		objects = append(objects,
+			annotatedService(name, corev1.ServiceTypeClusterIP, nil),
+			readyEndpointsFor(name, fmt.Sprintf("10.42.0.%d", i+1), 80, "node-1"))
+	}
+
+	discoverSlow := func(concurrency int) ([]types.ExposedService, int) {
+		t.Helper()
+		clientset := &slowEndpoints{Interface: fake.NewSimpleClientset(objects...)}
+		services, err := DiscoverServices(context.Background(), clientset, DiscoveryOptions{Concurrency: concurrency}, testLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return services, clientset.peak
+	}
+
+	serial, peak := discoverSlow(1)
+	if len(serial) != 40 {
+		t.Fatalf("expected 40 services, got %d", len(serial))
+	}
+	if peak != 1 {
+		t.Errorf("expected serial lookups, got %d in flight", peak)
+	}
+
+	parallel, peak := discoverSlow(4)
+	if peak > 4 {
+		t.Errorf("expected at most 4 lookups in flight, got %d", peak)
+	}
+	if !reflect.DeepEqual(parallel, serial) {
+		t.Error("parallel discovery returned different results than serial discovery")
+	}
+}
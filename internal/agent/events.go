@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// StatusAnnotation reports why a service could not be exposed
+const StatusAnnotation = "expose.neverup.at/status"
+
+// Event reasons recorded on services skipped during discovery
+const (
+	reasonDiscoveryFailed = "ExposeFailed"
+	eventComponent        = "k8s-exposer-agent"
+)
+
+// FailureReporter surfaces discovery failures on the Kubernetes service
+// objects via a status annotation and a Warning event
+type FailureReporter struct {
+	clientset kubernetes.Interface
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	rejected map[string]string // "namespace/name" -> reason the server rejected it
+}
+
+// NewFailureReporter creates a new failure reporter
+func NewFailureReporter(clientset kubernetes.Interface, logger *slog.Logger) *FailureReporter {
+	return &FailureReporter{
+		clientset: clientset,
+		logger:    logger,
+		rejected:  make(map[string]string),
+	}
+}
+
+// Report records a discovery failure for a service. Unchanged failures are
+// skipped so periodic discovery does not flood the event stream.
+func (r *FailureReporter) Report(ctx context.Context, svc *corev1.Service, cause error) {
+	if r == nil {
+		return
+	}
+
+	message := cause.Error()
+	if svc.Annotations[StatusAnnotation] == message {
+		return
+	}
+
+	if err := patchAnnotation(ctx, r.clientset, svc.Namespace, svc.Name, StatusAnnotation, &message); err != nil {
+		r.logger.Warn("Failed to write status annotation", "name", svc.Name, "namespace", svc.Namespace, "error", err)
+	}
+	if err := r.recordEvent(ctx, svc, message); err != nil {
+		r.logger.Warn("Failed to record event", "name", svc.Name, "namespace", svc.Namespace, "error", err)
+	}
+}
+
+// Clear removes a previously reported failure once the service is exposed again
+func (r *FailureReporter) Clear(ctx context.Context, svc *corev1.Service) {
+	if r == nil {
+		return
+	}
+	if _, ok := svc.Annotations[StatusAnnotation]; !ok {
+		return
+	}
+
+	// Server rejections are cleared once the server accepts the service
+	r.mu.Lock()
+	_, rejected := r.rejected[svc.Namespace+"/"+svc.Name]
+	r.mu.Unlock()
+	if rejected {
+		return
+	}
+
+	if err := patchAnnotation(ctx, r.clientset, svc.Namespace, svc.Name, StatusAnnotation, nil); err != nil {
+		r.logger.Warn("Failed to clear status annotation", "name", svc.Name, "namespace", svc.Namespace, "error", err)
+	}
+}
+
+// SetRejected reports the services the server rejected from the last update
+// and clears the failures of previously rejected services that were accepted
+func (r *FailureReporter) SetRejected(ctx context.Context, rejections []types.ServiceError) {
+	if r == nil {
+		return
+	}
+
+	current := make(map[string]string, len(rejections))
+	for _, rejection := range rejections {
+		current[rejection.Namespace+"/"+rejection.Name] = rejection.Reason
+	}
+
+	r.mu.Lock()
+	previous := r.rejected
+	r.rejected = current
+	r.mu.Unlock()
+
+	for key, reason := range current {
+		if previous[key] == reason {
+			continue
+		}
+		if svc := r.getService(ctx, key); svc != nil {
+			r.Report(ctx, svc, fmt.Errorf("rejected by server: %s", reason))
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		if svc := r.getService(ctx, key); svc != nil {
+			r.Clear(ctx, svc)
+		}
+	}
+}
+
+// getService fetches a service by "namespace/name", nil if it is gone
+func (r *FailureReporter) getService(ctx context.Context, key string) *corev1.Service {
+	namespace, name, _ := strings.Cut(key, "/")
+	svc, err := r.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		r.logger.Debug("Failed to get rejected service", "name", name, "namespace", namespace, "error", err)
+		return nil
+	}
+	return svc
+}
+
+// recordEvent creates a Warning event on the service
+func (r *FailureReporter) recordEvent(ctx context.Context, svc *corev1.Service, message string) error {
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: svc.Name + ".",
+			Namespace:    svc.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "Service",
+			Name:            svc.Name,
+			Namespace:       svc.Namespace,
+			UID:             svc.UID,
+			ResourceVersion: svc.ResourceVersion,
+		},
+		Reason:         reasonDiscoveryFailed,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := r.clientset.CoreV1().Events(svc.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create event: %w", err)
+	}
+	return nil
+}
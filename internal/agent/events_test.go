@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReportMalformedPorts(t *testing.T) {
+	ctx := context.Background()
+	svc := annotatedService("web", corev1.ServiceTypeClusterIP, map[string]string{PortsAnnotation: "http/tcp"})
+	clientset := fake.NewSimpleClientset(svc, readyEndpointsFor("web", "10.42.0.5", 80, "node-1"))
+	reporter := NewFailureReporter(clientset, testLogger())
+
+	discoverReported := func() {
+		t.Helper()
+		if _, err := DiscoverServices(ctx, clientset, DiscoveryOptions{Reporter: reporter}, testLogger()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := func() []corev1.Event {
+		t.Helper()
+		list, err := clientset.CoreV1().Events("default").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list.Items
+	}
+
+	discoverReported()
+	list := events()
+	if len(list) != 1 {
+		t.Fatalf("expected one event, got %d", len(list))
+	}
+	event := list[0]
+	if event.Type != corev1.EventTypeWarning || event.Reason != reasonDiscoveryFailed ||
+		event.InvolvedObject.Kind != "Service" || event.InvolvedObject.Name != "web" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	current, err := clientset.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Annotations[StatusAnnotation] != event.Message || event.Message == "" {
+		t.Errorf("expected status annotation %q, got %q", event.Message, current.Annotations[StatusAnnotation])
+	}
+
+	// The same failure is not reported again
+	discoverReported()
+	if len(events()) != 1 {
+		t.Errorf("unchanged failure recorded again, %d events", len(events()))
+	}
+
+	// Fixing the annotation clears the status
+	current.Annotations[PortsAnnotation] = "8080/tcp"
+	if _, err := clientset.CoreV1().Services("default").Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	discoverReported()
+	current, _ = clientset.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if status, exists := current.Annotations[StatusAnnotation]; exists {
+		t.Errorf("status annotation %q kept after the service was fixed", status)
+	}
+}
+
+func TestReportServerRejections(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(annotatedService("web", corev1.ServiceTypeClusterIP, nil))
+	reporter := NewFailureReporter(clientset, testLogger())
+	status := func() (string, bool) {
+		t.Helper()
+		value, exists := mustGetService(t, clientset, "web").Annotations[StatusAnnotation]
+		return value, exists
+	}
+
+	reporter.SetRejected(ctx, []types.ServiceError{{Name: "web", Namespace: "default", Subdomain: "web", Reason: "subdomain taken"}})
+	if value, _ := status(); value != "rejected by server: subdomain taken" {
+		t.Errorf("expected the rejection in the status annotation, got %q", value)
+	}
+
+	// A clean discovery does not clear a rejection the server still reports
+	reporter.Clear(ctx, mustGetService(t, clientset, "web"))
+	if _, exists := status(); !exists {
+		t.Error("rejection cleared by discovery while the server still rejects the service")
+	}
+
+	// Accepting the service clears the rejection
+	reporter.SetRejected(ctx, nil)
+	if value, exists := status(); exists {
+		t.Errorf("status annotation %q kept after the server accepted the service", value)
+	}
+}
+
+// mustGetService fetches a service from the default namespace
+func mustGetService(t *testing.T, clientset *fake.Clientset, name string) *corev1.Service {
+	t.Helper()
+	svc, err := clientset.CoreV1().Services("default").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
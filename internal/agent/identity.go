@@ -0,0 +1,20 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ClusterID returns the UID of the kube-system namespace. It lives as long
+// as the cluster, so it is the default agent ID: it survives agent restarts
+// and tells clusters apart that reach the server through the same IP.
+func ClusterID(ctx context.Context, clientset kubernetes.Interface) (string, error) {
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, metav1.NamespaceSystem, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the kube-system namespace: %w", err)
+	}
+	return string(ns.UID), nil
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	discoveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_exposer_agent_discoveries_total",
+		Help: "Total number of service discovery runs by result",
+	}, []string{"result"})
+
+	discoveredServices = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_exposer_agent_services",
+		Help: "Number of exposed services found by the last successful discovery",
+	})
+
+	reconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_exposer_agent_reconnects_total",
+		Help: "Total number of reconnects to the server",
+	})
+
+	pingTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_exposer_agent_ping_timeouts_total",
+		Help: "Total number of pings the server did not answer in time",
+	})
+
+	updatesCoalescedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_exposer_agent_updates_coalesced_total",
+		Help: "Total number of service snapshots replaced by a newer one before being sent",
+	})
+
+	servicePortsRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_exposer_service_ports_rejected_total",
+		Help: "Total number of services rejected for listing too many ports",
+	})
+
+	updatesSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_exposer_agent_updates_sent_total",
+		Help: "Total number of service updates sent to the server by result",
+	}, []string{"result"})
+
+	watchErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_exposer_agent_watch_errors_total",
+		Help: "Total number of dropped service watches by reason, recovered by the informer",
+	}, []string{"reason"})
+
+	watcherRestartsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_exposer_agent_watcher_restarts_total",
+		Help: "Total number of full service watcher restarts after a failure",
+	})
+)
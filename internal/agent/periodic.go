@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// PeriodicSync runs discovery on an interval the server can change at
+// runtime through pushed configuration
+type PeriodicSync struct {
+	interval  time.Duration
+	intervals chan time.Duration
+	sync      func(ctx context.Context)
+	logger    *slog.Logger
+}
+
+// NewPeriodicSync creates a periodic sync calling sync every interval
+func NewPeriodicSync(interval time.Duration, sync func(ctx context.Context), logger *slog.Logger) *PeriodicSync {
+	return &PeriodicSync{
+		interval:  interval,
+		intervals: make(chan time.Duration, 1),
+		sync:      sync,
+		logger:    logger,
+	}
+}
+
+// ApplyConfig takes the sync interval of a configuration pushed by the server,
+// to be registered with ServerClient.SetConfigHandler
+func (s *PeriodicSync) ApplyConfig(cfg *types.AgentConfig) {
+	if cfg.SyncInterval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(cfg.SyncInterval)
+	if err != nil {
+		s.logger.Warn("Ignoring invalid sync interval from server", "sync_interval", cfg.SyncInterval, "error", err)
+		return
+	}
+
+	// Only the latest interval matters
+	select {
+	case <-s.intervals:
+	default:
+	}
+	s.intervals <- interval
+}
+
+// Run calls sync on every tick until ctx is canceled
+func (s *PeriodicSync) Run(ctx context.Context) {
+	interval := s.interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case next := <-s.intervals:
+			if next != interval {
+				s.logger.Info("Sync interval changed by server", "old", interval, "new", next)
+				interval = next
+				ticker.Reset(interval)
+			}
+		case <-ticker.C:
+			s.sync(ctx)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// writeFrame writes a raw length-prefixed frame, bypassing message validation
+func writeFrame(conn net.Conn, data []byte) {
+	binary.Write(conn, binary.BigEndian, uint32(len(data)))
+	conn.Write(data)
+}
+
+func TestPushedSyncIntervalAppliesWithoutReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				// Undecodable and invalid messages are skipped by the agent,
+				// the valid config after them arrives on the same connection
+				writeFrame(conn, []byte("not json"))
+				writeFrame(conn, []byte(`{"type":"config","config":{"sync_interval":"1ms"}}`))
+				protocol.SendMessage(conn, &types.Message{Type: types.MessageTypeConfig, Config: &types.AgentConfig{SyncInterval: "1s"}})
+				for {
+					if _, err := protocol.ReceiveMessage(conn); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	synced := make(chan struct{}, 1)
+	periodic := NewPeriodicSync(time.Hour, func(ctx context.Context) {
+		select {
+		case synced <- struct{}{}:
+		default:
+		}
+	}, testLogger())
+
+	client := NewServerClient(ln.Addr().String(), testLogger())
+	client.SetConfigHandler(periodic.ApplyConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go periodic.Run(ctx)
+
+	select {
+	case <-synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pushed sync interval not applied")
+	}
+	if !client.IsConnected() {
+		t.Error("client disconnected after receiving config")
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected a single connection, got %d", n)
+	}
+}
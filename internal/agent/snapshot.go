@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// SnapshotBox holds the most recent service list until the sender takes it.
+// Putting a new list replaces one that was not sent yet, so a slow or
+// disconnected server only ever receives the freshest snapshot.
+type SnapshotBox struct {
+	mu       sync.Mutex
+	services []types.ExposedService
+	pending  bool
+	ready    chan struct{}
+}
+
+// NewSnapshotBox creates an empty snapshot box
+func NewSnapshotBox() *SnapshotBox {
+	return &SnapshotBox{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Put stores a service list, replacing any list not taken yet
+func (b *SnapshotBox) Put(services []types.ExposedService) {
+	b.mu.Lock()
+	if b.pending {
+		updatesCoalescedTotal.Inc()
+	}
+	b.services = services
+	b.pending = true
+	b.mu.Unlock()
+
+	select {
+	case b.ready <- struct{}{}:
+	default:
+		// Already signaled, the sender will take the new list
+	}
+}
+
+// Ready returns a channel signaled when a list is waiting to be taken
+func (b *SnapshotBox) Ready() <-chan struct{} {
+	return b.ready
+}
+
+// Take returns the waiting list, false if there is none
+func (b *SnapshotBox) Take() ([]types.ExposedService, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.pending {
+		return nil, false
+	}
+	services := b.services
+	b.services = nil
+	b.pending = false
+	return services, true
+}
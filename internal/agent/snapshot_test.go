@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// snapshot returns a service list identified by the name of its service
+func snapshot(i int) []types.ExposedService {
+	return []types.ExposedService{{
+		Name: fmt.Sprintf("web-%d", i), Namespace: "default", Subdomain: "web", TargetIP: "10.0.0.1",
+		Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}},
+	}}
+}
+
+func TestSnapshotBoxKeepsLatest(t *testing.T) {
+	box := NewSnapshotBox()
+	if _, ok := box.Take(); ok {
+		t.Fatal("expected an empty box")
+	}
+
+	for i := 0; i < 100; i++ {
+		box.Put(snapshot(i))
+	}
+	select {
+	case <-box.Ready():
+	default:
+		t.Fatal("box not signaled")
+	}
+	services, ok := box.Take()
+	if !ok || services[0].Name != "web-99" {
+		t.Fatalf("expected the latest snapshot, got %+v", services)
+	}
+	if _, ok := box.Take(); ok {
+		t.Error("snapshot taken twice")
+	}
+	select {
+	case <-box.Ready():
+		t.Error("box signaled without a waiting snapshot")
+	default:
+	}
+}
+
+func TestRunSendsLatestSnapshot(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := protocol.ReceiveMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg.Type == types.MessageTypeServiceUpdate {
+				received <- msg.Services[0].Name
+			}
+		}
+	}()
+
+	// Updates pile up before the client is running
+	box := NewSnapshotBox()
+	for i := 0; i < 50; i++ {
+		box.Put(snapshot(i))
+	}
+
+	client := NewServerClient(ln.Addr().String(), testLogger())
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx, box)
+
+	select {
+	case name := <-received:
+		if name != "web-49" {
+			t.Errorf("expected only the latest snapshot to be sent, got %s", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update sent")
+	}
+	select {
+	case name := <-received:
+		t.Errorf("superseded snapshot %s sent", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
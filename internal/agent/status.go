@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AllocatedPortsAnnotation reports the external ports allocated by the server
+const AllocatedPortsAnnotation = "expose.neverup.at/allocated-ports"
+
+// WriteAllocatedPorts writes the server's port allocations back to the
+// Kubernetes services as an annotation (format: "8080:30000/tcp,...")
+func WriteAllocatedPorts(ctx context.Context, clientset kubernetes.Interface, allocations []types.PortAllocation, logger *slog.Logger) {
+	// Group allocations per service
+	byService := make(map[string][]types.PortAllocation)
+	for _, a := range allocations {
+		key := a.Namespace + "/" + a.Name
+		byService[key] = append(byService[key], a)
+	}
+
+	for key, allocs := range byService {
+		namespace, name := allocs[0].Namespace, allocs[0].Name
+		value := formatAllocations(allocs)
+
+		if err := patchAnnotation(ctx, clientset, namespace, name, AllocatedPortsAnnotation, &value); err != nil {
+			logger.Warn("Failed to write allocated ports annotation", "service", key, "error", err)
+			continue
+		}
+	}
+}
+
+// patchAnnotation sets a service annotation if it changed, a nil value removes it
+func patchAnnotation(ctx context.Context, clientset kubernetes.Interface, namespace, name, key string, value *string) error {
+	svc, err := clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get service: %w", err)
+	}
+
+	// Skip unchanged values to avoid triggering another watch event
+	current, exists := svc.Annotations[key]
+	if (value == nil && !exists) || (value != nil && exists && current == *value) {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{
+				key: value,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := clientset.CoreV1().Services(namespace).Patch(ctx, name, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch service: %w", err)
+	}
+	return nil
+}
+
+// formatAllocations renders allocations as "requested:allocated/protocol" entries
+func formatAllocations(allocations []types.PortAllocation) string {
+	entries := make([]string, 0, len(allocations))
+	for _, a := range allocations {
+		entries = append(entries, fmt.Sprintf("%d:%d/%s", a.RequestedPort, a.AllocatedPort, a.Protocol))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWriteAllocatedPorts(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(annotatedService("game", corev1.ServiceTypeClusterIP, nil))
+	allocations := []types.PortAllocation{
+		{Name: "game", Namespace: "default", Subdomain: "game", RequestedPort: 27015, AllocatedPort: 30001, Protocol: "udp"},
+		{Name: "game", Namespace: "default", Subdomain: "game", RequestedPort: 8080, AllocatedPort: 30000, Protocol: "tcp"},
+		// Services that no longer exist are skipped
+		{Name: "gone", Namespace: "default", Subdomain: "gone", RequestedPort: 9090, AllocatedPort: 9090, Protocol: "tcp"},
+	}
+
+	WriteAllocatedPorts(ctx, clientset, allocations, testLogger())
+
+	svc, err := clientset.CoreV1().Services("default").Get(ctx, "game", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := svc.Annotations[AllocatedPortsAnnotation], "27015:30001/udp,8080:30000/tcp"; got != want {
+		t.Errorf("expected annotation %q, got %q", want, got)
+	}
+	if svc.Annotations[SubdomainAnnotation] != "game" {
+		t.Errorf("other annotations were replaced: %v", svc.Annotations)
+	}
+
+	// Unchanged allocations are not patched again
+	patched := len(patches(clientset))
+	WriteAllocatedPorts(ctx, clientset, allocations[:2], testLogger())
+	if len(patches(clientset)) != patched {
+		t.Error("unchanged allocations were patched again")
+	}
+}
+
+// patches returns the patch actions clientset received
+func patches(clientset *fake.Clientset) []k8stesting.Action {
+	var actions []k8stesting.Action
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "patch" {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
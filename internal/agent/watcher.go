@@ -2,11 +2,16 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/noahjeana/k8s-exposer/pkg/types"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
@@ -17,6 +22,8 @@ import (
 type ServiceWatcher struct {
 	clientset kubernetes.Interface
 	onChange  func([]types.ExposedService)
+	opts      DiscoveryOptions
+	synced    atomic.Bool
 	logger    *slog.Logger
 }
 
@@ -29,16 +36,23 @@ func NewServiceWatcher(clientset kubernetes.Interface, onChange func([]types.Exp
 	}
 }
 
+// SetDiscoveryOptions sets the options used for service discovery
+func (w *ServiceWatcher) SetDiscoveryOptions(opts DiscoveryOptions) {
+	w.opts = opts
+}
+
+// HasSynced reports whether the informer caches of the running watcher are synced
+func (w *ServiceWatcher) HasSynced() bool {
+	return w.synced.Load()
+}
+
 // Start starts watching services
 func (w *ServiceWatcher) Start(ctx context.Context) error {
 	w.logger.Info("Starting service watcher")
 
-	// Create informer factory
-	factory := informers.NewSharedInformerFactory(w.clientset, 30*time.Second)
-	serviceInformer := factory.Core().V1().Services().Informer()
-
-	// Add event handlers
-	serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	// Create informer factories
+	factories := w.informerFactories(ctx)
+	handler := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			w.logger.Debug("Service added")
 			w.handleChange(ctx)
@@ -51,17 +65,30 @@ func (w *ServiceWatcher) Start(ctx context.Context) error {
 			w.logger.Debug("Service deleted")
 			w.handleChange(ctx)
 		},
-	})
+	}
 
-	// Start informer
-	factory.Start(ctx.Done())
+	// Add event handlers and start informers
+	var synced []cache.InformerSynced
+	for _, factory := range factories {
+		serviceInformer := factory.Core().V1().Services().Informer()
+		// Transient watch errors are handled by the informer reconnecting,
+		// without restarting the watcher and relisting every namespace
+		if err := serviceInformer.SetWatchErrorHandlerWithContext(w.handleWatchError); err != nil {
+			w.logger.Warn("Failed to set watch error handler", "error", err)
+		}
+		serviceInformer.AddEventHandler(handler)
+		synced = append(synced, serviceInformer.HasSynced)
+		factory.Start(ctx.Done())
+	}
 
 	// Wait for cache sync
 	w.logger.Info("Waiting for informer cache to sync")
-	if !cache.WaitForCacheSync(ctx.Done(), serviceInformer.HasSynced) {
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
 		return ctx.Err()
 	}
 	w.logger.Info("Informer cache synced")
+	w.synced.Store(true)
+	defer w.synced.Store(false)
 
 	// Initial discovery
 	w.handleChange(ctx)
@@ -71,9 +98,29 @@ func (w *ServiceWatcher) Start(ctx context.Context) error {
 	return ctx.Err()
 }
 
+// informerFactories returns a cluster-wide informer factory, or one per
+// configured namespace the agent is allowed to list services in
+func (w *ServiceWatcher) informerFactories(ctx context.Context) []informers.SharedInformerFactory {
+	if len(w.opts.Namespaces) == 0 {
+		return []informers.SharedInformerFactory{informers.NewSharedInformerFactory(w.clientset, 30*time.Second)}
+	}
+
+	var factories []informers.SharedInformerFactory
+	for _, namespace := range w.opts.Namespaces {
+		// An informer on a forbidden namespace would never sync, probe access first
+		_, err := w.clientset.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{Limit: 1})
+		if apierrors.IsForbidden(err) {
+			logForbiddenNamespace(namespace, err, w.logger)
+			continue
+		}
+		factories = append(factories, informers.NewSharedInformerFactoryWithOptions(w.clientset, 30*time.Second, informers.WithNamespace(namespace)))
+	}
+	return factories
+}
+
 // handleChange handles service changes by discovering all exposed services and calling the onChange callback
 func (w *ServiceWatcher) handleChange(ctx context.Context) {
-	services, err := DiscoverServices(ctx, w.clientset, w.logger)
+	services, err := DiscoverServices(ctx, w.clientset, w.opts, w.logger)
 	if err != nil {
 		w.logger.Error("Failed to discover services", "error", err)
 		return
@@ -82,16 +129,40 @@ func (w *ServiceWatcher) handleChange(ctx context.Context) {
 	w.onChange(services)
 }
 
+// handleWatchError logs a dropped watch of a service informer. The informer
+// re-establishes the watch itself with backoff, resuming from its last
+// resource version, so the cache survives API server restarts.
+func (w *ServiceWatcher) handleWatchError(ctx context.Context, r *cache.Reflector, err error) {
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// The API server closed the watch, e.g. on its timeout or a restart
+		watchErrorsTotal.WithLabelValues("closed").Inc()
+		w.logger.Debug("Service watch closed, reconnecting", "reflector", r.TypeDescription(), "error", err)
+	case apierrors.IsResourceExpired(err), apierrors.IsGone(err):
+		watchErrorsTotal.WithLabelValues("expired").Inc()
+		w.logger.Info("Service watch expired, relisting", "reflector", r.TypeDescription(), "error", err)
+	case apierrors.IsUnauthorized(err), apierrors.IsForbidden(err):
+		// Not transient, but restarting the watcher would not help either
+		watchErrorsTotal.WithLabelValues("denied").Inc()
+		w.logger.Error("Service watch denied, check the agent's credentials and RBAC", "reflector", r.TypeDescription(), "error", err)
+	default:
+		watchErrorsTotal.WithLabelValues("error").Inc()
+		w.logger.Warn("Service watch failed, reconnecting", "reflector", r.TypeDescription(), "error", err)
+	}
+}
+
 // parseServiceAnnotations parses service annotations and returns an ExposedService
-func (w *ServiceWatcher) parseServiceAnnotations(svc *corev1.Service) (*types.ExposedService, error) {
-	return extractServiceInfo(w.clientset, svc)
+func (w *ServiceWatcher) parseServiceAnnotations(ctx context.Context, svc *corev1.Service) (*types.ExposedService, error) {
+	return extractServiceInfo(ctx, w.clientset, svc, w.opts)
 }
 
-// StartWithRetry starts the service watcher with retry logic
+// StartWithRetry starts the service watcher and restarts it if it fails.
+// Dropped watches do not fail the watcher, they are handled by the informers.
 func (w *ServiceWatcher) StartWithRetry(ctx context.Context) error {
 	return wait.PollUntilContextCancel(ctx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
 		err := w.Start(ctx)
-		if err != nil && err != context.Canceled {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			watcherRestartsTotal.Inc()
 			w.logger.Error("Service watcher failed, retrying", "error", err)
 			return false, nil // Retry
 		}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcherSurvivesWatchError(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		annotatedService("web", corev1.ServiceTypeClusterIP, nil),
+		readyEndpointsFor("web", "10.42.0.5", 80, "node-1"),
+	)
+
+	// The first service watch fails like one cut by an API server restart
+	var watches atomic.Int32
+	clientset.PrependWatchReactor("services", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		if watches.Add(1) == 1 {
+			return true, nil, apierrors.NewInternalError(errors.New("apiserver is shutting down"))
+		}
+		return false, nil, nil
+	})
+
+	var changes atomic.Int32
+	var last atomic.Value
+	watcher := NewServiceWatcher(clientset, func(services []types.ExposedService) {
+		last.Store(services)
+		changes.Add(1)
+	}, testLogger())
+
+	errorsBefore := testutil.ToFloat64(watchErrorsTotal.WithLabelValues("error"))
+	restartsBefore := testutil.ToFloat64(watcherRestartsTotal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- watcher.StartWithRetry(ctx)
+	}()
+
+	waitFor(t, 5*time.Second, "the initial discovery", func() bool { return changes.Load() > 0 })
+	waitFor(t, 10*time.Second, "the informer to re-establish the watch", func() bool { return watches.Load() >= 2 })
+
+	if got := testutil.ToFloat64(watchErrorsTotal.WithLabelValues("error")) - errorsBefore; got != 1 {
+		t.Errorf("recorded %v watch errors, want 1", got)
+	}
+	if got := testutil.ToFloat64(watcherRestartsTotal) - restartsBefore; got != 0 {
+		t.Errorf("watcher restarted %v times after a transient watch error", got)
+	}
+	if !watcher.HasSynced() {
+		t.Error("watcher lost its synced cache")
+	}
+
+	// The recovered watch delivers new services without a restart
+	seen := changes.Load()
+	if _, err := clientset.CoreV1().Endpoints("default").Create(ctx, readyEndpointsFor("game", "10.42.0.6", 80, "node-1"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	game := annotatedService("game", corev1.ServiceTypeClusterIP, nil)
+	if _, err := clientset.CoreV1().Services("default").Create(ctx, game, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "the new service to be discovered", func() bool {
+		return changes.Load() > seen && len(last.Load().([]types.ExposedService)) == 2
+	})
+
+	select {
+	case err := <-done:
+		t.Fatalf("watcher stopped: %v", err)
+	default:
+	}
+	if got := testutil.ToFloat64(watcherRestartsTotal) - restartsBefore; got != 0 {
+		t.Errorf("watcher restarted %v times", got)
+	}
+
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// dumpEnvPrefixes select the server's environment variables included in a dump
+var dumpEnvPrefixes = []string{"EXPOSER_", "HAPROXY_", "FIREWALL_", "RECONCILE_", "DNS_", "HETZNER_", "AGENT_", "LOG_", "DOMAIN"}
+
+// secretMarkers identify environment variables whose values are redacted
+var secretMarkers = []string{"TOKEN", "PASSWORD", "SECRET", "KEY"}
+
+// redacted replaces the values of secrets in a dump
+const redacted = "[redacted]"
+
+// handleDebugDump returns a snapshot of the server state for support bundles
+func (s *Server) handleDebugDump(w http.ResponseWriter, r *http.Request) {
+	services := s.registry.GetServices()
+
+	agents := make([]map[string]interface{}, 0)
+	for _, agent := range s.agents.List() {
+		agents = append(agents, map[string]interface{}{
+			"id":           agent.ID,
+			"remote_addr":  agent.RemoteAddr,
+			"interface":    agent.Interface,
+			"connected_at": agent.ConnectedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	dump := map[string]interface{}{
+		"time": time.Now().UTC().Format(time.RFC3339),
+		"version": map[string]string{
+			"version": s.buildInfo.Version,
+			"commit":  s.buildInfo.Commit,
+			"date":    s.buildInfo.Date,
+		},
+		"services":    services,
+		"allocations": s.registry.GetAllocations(services),
+		"listeners":   s.registry.Listeners(),
+		"agents":      agents,
+		"environment": dumpEnvironment(os.Environ()),
+	}
+
+	// Automation state is best effort, a dump is most useful when things fail
+	errs := make(map[string]string)
+	if s.automation != nil {
+		if result, ok := s.automation.LastResult(); ok {
+			dump["reconcile"] = result
+		}
+		if mappings, err := s.automation.Mappings(); err != nil {
+			errs["haproxy_mappings"] = err.Error()
+		} else {
+			dump["haproxy_mappings"] = mappings
+		}
+	}
+	if len(errs) > 0 {
+		dump["errors"] = errs
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="k8s-exposer-dump.json"`)
+	s.respondJSON(w, http.StatusOK, dump)
+}
+
+// dumpEnvironment returns the server's environment variables from env
+// ("KEY=value" entries) with secrets redacted
+func dumpEnvironment(env []string) map[string]string {
+	vars := make(map[string]string)
+	for _, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		if !hasAnyPrefix(key, dumpEnvPrefixes) {
+			continue
+		}
+		if value != "" && isSecret(key) {
+			value = redacted
+		}
+		vars[key] = value
+	}
+	return vars
+}
+
+// isSecret reports whether an environment variable holds a secret
+func isSecret(key string) bool {
+	for _, marker := range secretMarkers {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnyPrefix reports whether s starts with one of prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+func TestDebugDump(t *testing.T) {
+	t.Setenv("EXPOSER_API_TOKEN", "api-secret")
+	t.Setenv("HETZNER_TOKEN", "hetzner-secret")
+	t.Setenv("DNS_API_TOKEN", "")
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("UNRELATED_PASSWORD", "unrelated-secret")
+
+	s, registry := newTestAPI(t)
+	if _, err := registry.Update("agent", []types.ExposedService{{
+		Name: "web", Namespace: "default", Subdomain: "web", TargetIP: "127.0.0.1",
+		Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dump is only served with the API token
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/debug/dump", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, authorized(httptest.NewRequest(http.MethodGet, "/api/v1/debug/dump", nil)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+
+	var dump map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &dump); err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"time", "version", "services", "allocations", "listeners", "agents", "environment"} {
+		if _, ok := dump[section]; !ok {
+			t.Errorf("dump lacks section %q", section)
+		}
+	}
+	if !strings.Contains(string(dump["services"]), `"subdomain":"web"`) {
+		t.Errorf("dump lacks the registered service: %s", dump["services"])
+	}
+
+	for _, secret := range []string{"api-secret", "hetzner-secret", "unrelated-secret", testToken} {
+		if strings.Contains(body, secret) {
+			t.Errorf("dump contains secret %q", secret)
+		}
+	}
+	var env map[string]string
+	if err := json.Unmarshal(dump["environment"], &env); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"EXPOSER_API_TOKEN": redacted, "HETZNER_TOKEN": redacted, "DNS_API_TOKEN": "", "LOG_FORMAT": "json"}
+	for key, value := range want {
+		if env[key] != value {
+			t.Errorf("expected %s=%q in the dump, got %q", key, value, env[key])
+		}
+	}
+	if _, ok := env["UNRELATED_PASSWORD"]; ok {
+		t.Error("dump contains unrelated environment variables")
+	}
+}
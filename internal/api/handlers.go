@@ -1,12 +1,19 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/noahjeana/k8s-exposer/internal/automation"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
 )
 
 // handleHealth returns system health status
@@ -17,7 +24,54 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		"status":        "healthy",
 		"timestamp":     time.Now().UTC().Format(time.RFC3339),
 		"service_count": len(services),
-		"version":       "1.0.0",
+		"version":       s.buildInfo.Version,
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// handleReady reports whether the server can forward traffic, i.e. the
+// WireGuard interface exists and is up
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	wireguard := s.registry.WireguardStatus()
+
+	status := http.StatusOK
+	response := map[string]interface{}{
+		"status":    "ready",
+		"wireguard": wireguard,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	if !wireguard.Up {
+		status = http.StatusServiceUnavailable
+		response["status"] = "not ready"
+	}
+
+	s.respondJSON(w, status, response)
+}
+
+// handleLegacyHealth returns health status for the unversioned /health route,
+// keeping the original "services" count field alongside the v1 fields
+func (s *Server) handleLegacyHealth(w http.ResponseWriter, r *http.Request) {
+	services := s.registry.GetServices()
+
+	response := map[string]interface{}{
+		"status":        "healthy",
+		"services":      len(services),
+		"timestamp":     time.Now().UTC().Format(time.RFC3339),
+		"service_count": len(services),
+		"version":       s.buildInfo.Version,
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// handleVersion returns server build information
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"version":    s.buildInfo.Version,
+		"commit":     s.buildInfo.Commit,
+		"date":       s.buildInfo.Date,
+		"go_version": runtime.Version(),
 	}
 
 	s.respondJSON(w, http.StatusOK, response)
@@ -69,7 +123,9 @@ func (s *Server) handleListServices(w http.ResponseWriter, r *http.Request) {
 			"namespace": svc.Namespace,
 			"subdomain": svc.Subdomain,
 			"target_ip": svc.TargetIP,
+			"node_ip":   svc.NodeIP,
 			"ports":     svc.Ports,
+			"fqdn":      s.fqdn(svc.Subdomain),
 		})
 	}
 
@@ -78,7 +134,8 @@ func (s *Server) handleListServices(w http.ResponseWriter, r *http.Request) {
 		"count":    len(serviceList),
 	}
 
-	s.respondJSON(w, http.StatusOK, response)
+	// Pollers send the ETag back and get a 304 while nothing changed
+	s.respondJSONWithETag(w, r, response)
 }
 
 // handleGetService returns details for a specific service
@@ -96,13 +153,29 @@ func (s *Server) handleGetService(w http.ResponseWriter, r *http.Request) {
 	for _, svc := range services {
 		if svc.Name == name {
 			serviceData := map[string]interface{}{
-				"name":      svc.Name,
-				"namespace": svc.Namespace,
-				"subdomain": svc.Subdomain,
-				"target_ip": svc.TargetIP,
-				"node_ip":   svc.NodeIP,
-				"ports":     svc.Ports,
-				"fqdn":      fmt.Sprintf("%s.neverup.at", svc.Subdomain), // TODO: Get domain from config
+				"name":             svc.Name,
+				"namespace":        svc.Namespace,
+				"subdomain":        svc.Subdomain,
+				"target_ip":        svc.TargetIP,
+				"node_ip":          svc.NodeIP,
+				"ports":            svc.Ports,
+				"fqdn":             s.fqdn(svc.Subdomain),
+				"aliases":          svc.Aliases,
+				"source_ranges":    svc.SourceRanges,
+				"target_ips":       svc.TargetIPs,
+				"session_affinity": svc.SessionAffinity,
+				"interface":        svc.Interface,
+				"max_connections":  svc.MaxConnections,
+				"maxconn":          svc.MaxConn,
+				"server_first":     svc.ServerFirst,
+				"tls":              svc.TLS,
+				"allow_http":       svc.AllowHTTP,
+				"strict_port":      svc.StrictPort,
+				"maintenance_page": svc.MaintenancePage,
+				"drained":          s.registry.IsDrained(svc.Subdomain),
+				"agent_id":         s.registry.Owner(svc.Subdomain),
+				"health_check":     svc.HealthCheck,
+				"allocations":      s.registry.GetAllocations([]types.ExposedService{svc}),
 			}
 			found = &serviceData
 			break
@@ -117,29 +190,389 @@ func (s *Server) handleGetService(w http.ResponseWriter, r *http.Request) {
 	s.respondJSON(w, http.StatusOK, *found)
 }
 
-// handleSync forces a reconciliation
+// handleServiceMetrics returns traffic counters for a specific service
+func (s *Server) handleServiceMetrics(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if name == "" {
+		s.respondError(w, http.StatusBadRequest, "service name required")
+		return
+	}
+
+	for _, svc := range s.registry.GetServices() {
+		if svc.Name == name {
+			stats, ok := s.registry.GetStats(svc.Subdomain)
+			if !ok {
+				s.respondError(w, http.StatusNotFound, "no traffic counters for service")
+				return
+			}
+			response := map[string]interface{}{
+				"name":               svc.Name,
+				"namespace":          svc.Namespace,
+				"subdomain":          svc.Subdomain,
+				"bytes_in":           stats.BytesIn,
+				"bytes_out":          stats.BytesOut,
+				"active_connections": stats.ActiveConnections,
+				"total_connections":  stats.TotalConnections,
+				"rejected":           stats.Rejected,
+				"errors":             stats.Errors,
+				"timestamp":          time.Now().UTC().Format(time.RFC3339),
+			}
+			s.respondJSON(w, http.StatusOK, response)
+			return
+		}
+	}
+
+	s.respondError(w, http.StatusNotFound, "service not found")
+}
+
+// handleServiceBackend returns the HAProxy backend state for a specific service
+func (s *Server) handleServiceBackend(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if name == "" {
+		s.respondError(w, http.StatusBadRequest, "service name required")
+		return
+	}
+
+	for _, svc := range s.registry.GetServices() {
+		if svc.Name != name {
+			continue
+		}
+
+		response := map[string]interface{}{
+			"name":    svc.Name,
+			"backend": automation.BackendName(svc),
+			"status":  "unknown",
+		}
+		if s.automation == nil {
+			response["error"] = "automation not available"
+		} else if status, err := s.automation.BackendStatus(r.Context(), svc); err != nil {
+			response["error"] = err.Error()
+		} else {
+			response["status"] = status
+		}
+
+		s.respondJSON(w, http.StatusOK, response)
+		return
+	}
+
+	s.respondError(w, http.StatusNotFound, "service not found")
+}
+
+// handleDrainService stops a service from accepting new connections
+func (s *Server) handleDrainService(w http.ResponseWriter, r *http.Request) {
+	s.setServiceDrained(w, r, true)
+}
+
+// handleUndrainService lets a drained service accept new connections again
+func (s *Server) handleUndrainService(w http.ResponseWriter, r *http.Request) {
+	s.setServiceDrained(w, r, false)
+}
+
+// setServiceDrained changes the drain state of the service named in the request
+func (s *Server) setServiceDrained(w http.ResponseWriter, r *http.Request, drained bool) {
+	name := chi.URLParam(r, "name")
+	if name == "" {
+		s.respondError(w, http.StatusBadRequest, "service name required")
+		return
+	}
+
+	for _, svc := range s.registry.GetServices() {
+		if svc.Name != name {
+			continue
+		}
+
+		if !s.registry.SetDrained(svc.Subdomain, drained) {
+			break
+		}
+
+		response := map[string]interface{}{
+			"status":    "success",
+			"name":      svc.Name,
+			"namespace": svc.Namespace,
+			"subdomain": svc.Subdomain,
+			"drained":   drained,
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		}
+		s.respondJSON(w, http.StatusOK, response)
+		return
+	}
+
+	s.respondError(w, http.StatusNotFound, "service not found")
+}
+
+// handleListAgents returns all connected agents
+func (s *Server) handleListAgents(w http.ResponseWriter, r *http.Request) {
+	agents := s.agents.List()
+
+	agentList := make([]map[string]interface{}, 0, len(agents))
+	for _, agent := range agents {
+		agentList = append(agentList, map[string]interface{}{
+			"id":           agent.ID,
+			"remote_addr":  agent.RemoteAddr,
+			"interface":    agent.Interface,
+			"connected_at": agent.ConnectedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	response := map[string]interface{}{
+		"agents": agentList,
+		"count":  len(agentList),
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// handleAgentResync asks an agent to re-send its complete service list
+func (s *Server) handleAgentResync(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, exists := s.agents.Get(id); !exists {
+		s.respondError(w, http.StatusNotFound, "agent not found")
+		return
+	}
+
+	if err := s.agents.RequestResync(id); err != nil {
+		s.logger.Error("Failed to request agent resync", "agent_id", id, "error", err)
+		s.respondError(w, http.StatusBadGateway, fmt.Sprintf("resync request failed: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":    "success",
+		"message":   "resync requested",
+		"agent_id":  id,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// handleDeleteAgentServices removes all services sent by an agent and
+// reconciles so their HAProxy and firewall entries are closed
+func (s *Server) handleDeleteAgentServices(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	removed := s.registry.RemoveAgentServices(id)
+	if len(removed) == 0 {
+		if _, exists := s.agents.Get(id); !exists {
+			s.respondError(w, http.StatusNotFound, "agent not found")
+			return
+		}
+	}
+
+	response := map[string]interface{}{
+		"status":     "success",
+		"agent_id":   id,
+		"removed":    len(removed),
+		"subdomains": removed,
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if len(removed) > 0 && s.automation != nil {
+		requestID := middleware.GetReqID(r.Context())
+		ctx := automation.WithRequestID(r.Context(), requestID)
+		if err := s.automation.Reconcile(ctx, s.registry.GetServices()); err != nil {
+			s.logger.Error("Reconciliation after removing agent services failed", "request_id", requestID, "agent_id", id, "error", err)
+			response["reconcile_error"] = err.Error()
+		}
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// Time a synchronous manual sync waits for the reconcile before answering
+// 202 Accepted, kept below the request timeout
+const (
+	defaultSyncWait = 20 * time.Second
+	maxSyncWait     = 25 * time.Second
+)
+
+// handleSync forces a reconciliation. It waits for the result up to the
+// timeout query parameter; with async=true or once the timeout passed it
+// answers 202 and the reconcile continues in the background. Syncs arriving
+// while one runs share its reconcile.
 func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
 	if s.automation == nil {
 		s.respondError(w, http.StatusServiceUnavailable, "automation not available")
 		return
 	}
 
-	// Trigger sync by getting current services and calling reconcile
+	query := r.URL.Query()
+	async := false
+	if value := query.Get("async"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			s.respondError(w, http.StatusBadRequest, "async must be true or false")
+			return
+		}
+		async = parsed
+	}
+	wait := defaultSyncWait
+	if value := query.Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			s.respondError(w, http.StatusBadRequest, "timeout must be a positive duration, e.g. 10s")
+			return
+		}
+		wait = min(parsed, maxSyncWait)
+	}
+
+	// Syncs requested while one runs join it and report its request ID
+	ctx := automation.WithRequestID(r.Context(), middleware.GetReqID(r.Context()))
+	run := s.automation.Sync(ctx, s.registry.GetServices())
+
+	response := map[string]interface{}{
+		"request_id":    run.RequestID,
+		"service_count": run.Services,
+		"timestamp":     time.Now().UTC().Format(time.RFC3339),
+	}
+	accepted := func() {
+		response["status"] = "accepted"
+		response["message"] = "reconciliation running in the background"
+		response["status_url"] = "/api/v1/reconcile/status"
+		s.respondJSON(w, http.StatusAccepted, response)
+	}
+
+	if async {
+		accepted()
+		return
+	}
+
+	select {
+	case <-run.Done():
+		result, err := run.Result()
+		if err != nil {
+			s.respondError(w, http.StatusInternalServerError, fmt.Sprintf("reconciliation failed: %v", err))
+			return
+		}
+		response["status"] = "success"
+		response["message"] = "reconciliation completed"
+		response["result"] = result
+		s.respondJSON(w, http.StatusOK, response)
+	case <-time.After(wait):
+		accepted()
+	case <-r.Context().Done():
+	}
+}
+
+// handleReconcileStatus returns the result of the last reconciliation
+func (s *Server) handleReconcileStatus(w http.ResponseWriter, r *http.Request) {
+	if s.automation == nil {
+		s.respondError(w, http.StatusServiceUnavailable, "automation not available")
+		return
+	}
+
+	result, ok := s.automation.LastResult()
+	if !ok {
+		s.respondError(w, http.StatusNotFound, "no reconciliation has run yet")
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, result)
+}
+
+// handleReconcileHistory returns the most recent reconciliation results, oldest first
+func (s *Server) handleReconcileHistory(w http.ResponseWriter, r *http.Request) {
+	if s.automation == nil {
+		s.respondError(w, http.StatusServiceUnavailable, "automation not available")
+		return
+	}
+
+	history := s.automation.History()
+	response := map[string]interface{}{
+		"results": history,
+		"count":   len(history),
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// handleReconcilePlan returns the changes the next reconciliation would apply
+func (s *Server) handleReconcilePlan(w http.ResponseWriter, r *http.Request) {
+	if s.automation == nil {
+		s.respondError(w, http.StatusServiceUnavailable, "automation not available")
+		return
+	}
+
+	diff, err := s.automation.Plan(s.registry.GetServices())
+	if err != nil {
+		s.respondError(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid service configuration: %v", err))
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, diff)
+}
+
+// handleCreatePlan computes a plan without applying it and returns a token
+// that approves exactly this plan for /reconcile/apply
+func (s *Server) handleCreatePlan(w http.ResponseWriter, r *http.Request) {
+	if s.automation == nil {
+		s.respondError(w, http.StatusServiceUnavailable, "automation not available")
+		return
+	}
+
 	services := s.registry.GetServices()
-	if err := s.automation.Reconcile(services); err != nil {
-		s.logger.Error("Manual reconciliation failed", "error", err)
+	diff, token, err := s.automation.PlanWithToken(services)
+	if err != nil {
+		s.respondError(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid service configuration: %v", err))
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"token":         token,
+		"plan":          diff,
+		"service_count": len(services),
+		"timestamp":     time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// handleApplyPlan applies a plan previously returned by /reconcile/plan,
+// rejecting it if the services or applied state changed in the meantime
+func (s *Server) handleApplyPlan(w http.ResponseWriter, r *http.Request) {
+	if s.automation == nil {
+		s.respondError(w, http.StatusServiceUnavailable, "automation not available")
+		return
+	}
+
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request); err != nil || request.Token == "" {
+		s.respondError(w, http.StatusBadRequest, "plan token required")
+		return
+	}
+
+	services := s.registry.GetServices()
+	requestID := middleware.GetReqID(r.Context())
+	ctx := automation.WithRequestID(r.Context(), requestID)
+	if err := s.automation.ApplyPlan(ctx, services, request.Token); err != nil {
+		if errors.Is(err, automation.ErrStalePlan) {
+			s.respondError(w, http.StatusConflict, err.Error())
+			return
+		}
+		s.logger.Error("Applying plan failed", "request_id", requestID, "error", err)
 		s.respondError(w, http.StatusInternalServerError, fmt.Sprintf("reconciliation failed: %v", err))
 		return
 	}
 
-	response := map[string]interface{}{
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
 		"status":        "success",
-		"message":       "reconciliation triggered",
+		"message":       "plan applied",
 		"service_count": len(services),
 		"timestamp":     time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// handleTLSStatus returns which domains require and have a certificate
+func (s *Server) handleTLSStatus(w http.ResponseWriter, r *http.Request) {
+	if s.automation == nil {
+		s.respondError(w, http.StatusServiceUnavailable, "automation not available")
+		return
 	}
 
-	s.respondJSON(w, http.StatusOK, response)
+	domains := s.automation.TLSStatus(s.registry.GetServices())
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"domains": domains,
+		"count":   len(domains),
+	})
 }
 
 // handleHAProxyStatus returns HAProxy status
@@ -154,6 +587,47 @@ func (s *Server) handleHAProxyStatus(w http.ResponseWriter, r *http.Request) {
 	s.respondJSON(w, http.StatusOK, response)
 }
 
+// handleHAProxyConfig returns the HAProxy config file, or with dry_run=true
+// the config a reconcile of the current services would write. The config
+// contains the stats credentials, so the route requires the API token.
+func (s *Server) handleHAProxyConfig(w http.ResponseWriter, r *http.Request) {
+	if s.automation == nil {
+		s.respondError(w, http.StatusServiceUnavailable, "automation not available")
+		return
+	}
+
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			s.respondError(w, http.StatusBadRequest, "dry_run must be true or false")
+			return
+		}
+		dryRun = parsed
+	}
+
+	var config string
+	var err error
+	if dryRun {
+		config, err = s.automation.RenderHAProxyConfig(s.registry.GetServices())
+		if err != nil {
+			s.respondError(w, http.StatusUnprocessableEntity, fmt.Sprintf("failed to render config: %v", err))
+			return
+		}
+	} else {
+		config, err = s.automation.HAProxyConfig()
+		if err != nil {
+			s.respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"config":  config,
+		"dry_run": dryRun,
+	})
+}
+
 // handleHAProxyReload triggers HAProxy reload
 func (s *Server) handleHAProxyReload(w http.ResponseWriter, r *http.Request) {
 	// TODO: Implement HAProxy reload
@@ -165,3 +639,12 @@ func (s *Server) handleHAProxyReload(w http.ResponseWriter, r *http.Request) {
 
 	s.respondJSON(w, http.StatusNotImplemented, response)
 }
+
+// fqdn returns the fully qualified domain name for a subdomain
+func (s *Server) fqdn(subdomain string) string {
+	domain := "neverup.at"
+	if s.automation != nil {
+		domain = s.automation.Domain()
+	}
+	return fmt.Sprintf("%s.%s", subdomain, domain)
+}
@@ -0,0 +1,750 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/automation"
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	"github.com/noahjeana/k8s-exposer/internal/server"
+	"github.com/noahjeana/k8s-exposer/pkg/client"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// testToken is the API token of test servers
+const testToken = "test-token"
+
+// authorized adds the test API token to a request
+func authorized(req *http.Request) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	return req
+}
+
+// newTestAPI creates an API server on a registry listening on loopback
+func newTestAPI(t *testing.T) (*Server, *server.ServiceRegistry) {
+	t.Helper()
+	return newTestAPIWithBuildInfo(t, BuildInfo{})
+}
+
+// newTestAPIWithBuildInfo is newTestAPI reporting the given build info
+func newTestAPIWithBuildInfo(t *testing.T, buildInfo BuildInfo) (*Server, *server.ServiceRegistry) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	forwarder := server.NewForwarder("wg-test", logger)
+	registry := server.NewServiceRegistry(30000, 30100, server.ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1"}, forwarder, logger)
+	t.Cleanup(func() {
+		registry.Close()
+		forwarder.Close()
+	})
+	s := NewServer(registry, server.NewAgentRegistry(0), nil, buildInfo, logger)
+	s.SetAPIToken(testToken)
+	return s, registry
+}
+
+// startEcho starts a TCP backend echoing everything it receives
+func startEcho(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// freePort returns a TCP port on loopback that is currently unused
+func freePort(t *testing.T) int32 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return int32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func getMetrics(t *testing.T, s *Server, name string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/services/"+name+"/metrics", nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestHandleServiceMetrics(t *testing.T) {
+	s, registry := newTestAPI(t)
+	backend := startEcho(t)
+	port := freePort(t)
+
+	_, err := registry.Update("agent", []types.ExposedService{{
+		Name:      "web",
+		Namespace: "default",
+		Subdomain: "web",
+		Ports:     []types.PortMapping{{Port: port, TargetPort: int32(backend.Port), Protocol: "tcp"}},
+		TargetIP:  "127.0.0.1",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed the counters with one echoed connection
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("hello")
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(payload))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		code, body := getMetrics(t, s, "web")
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %v", code, body)
+		}
+		if body["total_connections"] == float64(1) && body["bytes_in"] == float64(len(payload)) &&
+			body["bytes_out"] == float64(len(payload)) && body["active_connections"] == float64(0) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected counters: %v", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if code, _ := getMetrics(t, s, "missing"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown service, got %d", code)
+	}
+
+	// Removed services drop their counters instead of leaking them
+	if err := registry.RemoveService("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.GetStats("web"); ok {
+		t.Error("counters of a removed service are still present")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	s, _ := newTestAPIWithBuildInfo(t, BuildInfo{Version: "1.4.2", Commit: "abc1234", Date: "2026-01-02T03:04:05Z"})
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+	c := client.NewClient(srv.URL)
+
+	version, err := c.GetVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := client.Version{Version: "1.4.2", Commit: "abc1234", Date: "2026-01-02T03:04:05Z", GoVersion: runtime.Version()}
+	if *version != want {
+		t.Errorf("expected %+v, got %+v", want, *version)
+	}
+
+	health, err := c.GetHealth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Version != "1.4.2" {
+		t.Errorf("health reports version %q", health.Version)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestAPIWithAutomation creates an API server with an automation
+// controller logging to logs. A fake HAProxy runtime API answers every
+// command with success.
+func newTestAPIWithAutomation(t *testing.T, logs io.Writer) (*Server, *automation.Controller) {
+	t.Helper()
+	s, registry := newTestAPI(t)
+	dir := t.TempDir()
+	ln, err := net.Listen("unix", filepath.Join(dir, "haproxy.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+		}
+	}()
+	controller := automation.NewController(automation.Config{
+		HAProxySocket: filepath.Join(dir, "haproxy.sock"),
+		HAProxyMap:    filepath.Join(dir, "domains.map"),
+		HAProxyConfig: filepath.Join(dir, "haproxy.cfg"),
+		Domain:        "example.com",
+	}, slog.New(slog.NewJSONHandler(logs, nil)))
+	s = NewServer(registry, s.agents, controller, BuildInfo{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.SetAPIToken(testToken)
+	return s, controller
+}
+
+func TestSyncRequestIDInReconcileLogs(t *testing.T) {
+	var logs syncBuffer
+	s, _ := newTestAPIWithAutomation(t, &logs)
+
+	req := authorized(httptest.NewRequest(http.MethodPost, "/api/v1/sync", nil))
+	req.Header.Set("X-Request-Id", "trace-4711")
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sync failed with %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Every reconcile log record carries the ID of the triggering request
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log line %q", line)
+		}
+		if record["request_id"] != "trace-4711" {
+			t.Errorf("log record without the request ID: %s", line)
+		}
+		if record["msg"] == "Starting reconciliation" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no reconcile log records for the request: %s", logs.String())
+	}
+}
+
+func TestAgentResync(t *testing.T) {
+	s, registry := newTestAPI(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		server.HandleAgentConnection(ctx, conn, registry, s.agents, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Agents are registered by their first message
+	if err := protocol.SendMessage(conn, &types.Message{Type: types.MessageTypeHeartbeat}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); len(s.agents.List()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("agent not registered")
+		}
+	}
+
+	resync := func(id string) int {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, authorized(httptest.NewRequest(http.MethodPost, "/api/v1/agents/"+id+"/resync", nil)))
+		return rec.Code
+	}
+	if code := resync("10.0.0.1"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown agent, got %d", code)
+	}
+	if code := resync("127.0.0.1"); code != http.StatusOK {
+		t.Fatalf("resync failed with %d", code)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := protocol.ReceiveMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != types.MessageTypeResync {
+		t.Errorf("expected a resync request, got %s", msg.Type)
+	}
+}
+
+func TestReconcileStatus(t *testing.T) {
+	s, _ := newTestAPIWithAutomation(t, io.Discard)
+	status := func() (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/reconcile/status", nil))
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	if code, _ := status(); code != http.StatusNotFound {
+		t.Errorf("expected 404 before the first reconcile, got %d", code)
+	}
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, authorized(httptest.NewRequest(http.MethodPost, "/api/v1/sync", nil)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sync failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	if code, body := status(); code != http.StatusOK || body["success"] != true {
+		t.Errorf("expected a successful result, got %d: %v", code, body)
+	}
+}
+
+func TestLegacyAndV1Shapes(t *testing.T) {
+	s, registry := newTestAPI(t)
+	if _, err := registry.Update("agent", []types.ExposedService{{
+		Name: "web", Namespace: "default", Subdomain: "web", TargetIP: "127.0.0.1",
+		Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) map[string]interface{} {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s failed with %d", path, rec.Code)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("GET %s returned invalid JSON: %v", path, err)
+		}
+		return body
+	}
+	hasKeys := func(path string, body map[string]interface{}, keys ...string) {
+		t.Helper()
+		for _, key := range keys {
+			if _, ok := body[key]; !ok {
+				t.Errorf("%s lacks %q: %v", path, key, body)
+			}
+		}
+	}
+
+	// The legacy routes keep the fields of the original API server
+	legacy := get("/health")
+	hasKeys("/health", legacy, "status", "services")
+	if legacy["services"] != float64(1) {
+		t.Errorf("expected the legacy service count, got %v", legacy["services"])
+	}
+	v1 := get("/api/v1/health")
+	hasKeys("/api/v1/health", v1, "status", "service_count", "timestamp")
+
+	for _, path := range []string{"/services", "/api/v1/services"} {
+		body := get(path)
+		hasKeys(path, body, "services", "count")
+		services, _ := body["services"].([]interface{})
+		if len(services) != 1 {
+			t.Fatalf("%s: expected one service, got %v", path, body["services"])
+		}
+		hasKeys(path, services[0].(map[string]interface{}), "name", "namespace", "subdomain", "ports")
+	}
+}
+
+func TestReconcilePlan(t *testing.T) {
+	s, _ := newTestAPIWithAutomation(t, io.Discard)
+	port := freePort(t)
+	if _, err := s.registry.Update("agent", []types.ExposedService{{
+		Name: "web", Namespace: "default", Subdomain: "web", TargetIP: "127.0.0.1",
+		Ports: []types.PortMapping{{Port: port, TargetPort: 80, Protocol: "tcp"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/reconcile/plan", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("plan failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	var diff automation.ReconcileDiff
+	if err := json.Unmarshal(rec.Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{fmt.Sprintf("web.example.com -> backend_%d", port)}; !reflect.DeepEqual(diff.AddedMappings, want) {
+		t.Errorf("expected added mappings %v, got %v", want, diff.AddedMappings)
+	}
+	if want := []int{int(port)}; !reflect.DeepEqual(diff.OpenedPorts, want) {
+		t.Errorf("expected opened ports %v, got %v", want, diff.OpenedPorts)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	// The test forwarder's interface doesn't exist
+	s, _ := newTestAPI(t)
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a WireGuard interface, got %d", rec.Code)
+	}
+	var body struct {
+		Status    string                 `json:"status"`
+		Wireguard server.InterfaceStatus `json:"wireguard"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "not ready" || body.Wireguard.Name != "wg-test" || body.Wireguard.Exists {
+		t.Errorf("unexpected readiness response: %s", rec.Body.String())
+	}
+}
+
+func TestTLSStatus(t *testing.T) {
+	s, _ := newTestAPIWithAutomation(t, io.Discard)
+	if _, err := s.registry.Update("agent", []types.ExposedService{
+		{Name: "secure", Namespace: "default", Subdomain: "secure", TargetIP: "127.0.0.1", TLS: true,
+			Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}}},
+		{Name: "landing", Namespace: "default", Subdomain: types.WildcardSubdomain, TargetIP: "127.0.0.1",
+			Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/tls", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("tls status failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Domains []automation.TLSDomain `json:"domains"`
+		Count   int                    `json:"count"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	// The wildcard service has no domain of its own
+	if body.Count != 1 || body.Domains[0].Domain != "secure.example.com" || !body.Domains[0].Required {
+		t.Errorf("expected only secure.example.com requiring TLS, got %+v", body)
+	}
+}
+
+func TestPlanAndApply(t *testing.T) {
+	s, _ := newTestAPIWithAutomation(t, io.Discard)
+	web := types.ExposedService{Name: "web", Namespace: "default", Subdomain: "web", TargetIP: "127.0.0.1",
+		Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}}}
+	if _, err := s.registry.Update("agent", []types.ExposedService{web}); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, authorized(httptest.NewRequest(http.MethodPost, "/api/v1/reconcile/plan", nil)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("plan failed with %d: %s", rec.Code, rec.Body.String())
+		}
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Token == "" {
+			t.Fatalf("expected a plan token, got %s (%v)", rec.Body.String(), err)
+		}
+		return body.Token
+	}
+	apply := func(body string) int {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, authorized(httptest.NewRequest(http.MethodPost, "/api/v1/reconcile/apply", strings.NewReader(body))))
+		return rec.Code
+	}
+
+	if code := apply(`{}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a token, got %d", code)
+	}
+
+	// The services change between planning and applying
+	stale := plan()
+	web.Subdomain = "www"
+	if _, err := s.registry.Update("agent", []types.ExposedService{web}); err != nil {
+		t.Fatal(err)
+	}
+	if code := apply(fmt.Sprintf(`{"token":%q}`, stale)); code != http.StatusConflict {
+		t.Errorf("expected 409 for a stale plan, got %d", code)
+	}
+
+	if code := apply(fmt.Sprintf(`{"token":%q}`, plan())); code != http.StatusOK {
+		t.Errorf("expected the current plan to apply, got %d", code)
+	}
+}
+
+func TestDrainRequiresToken(t *testing.T) {
+	s, registry := newTestAPI(t)
+	if _, err := registry.Update("agent", []types.ExposedService{{
+		Name: "web", Namespace: "default", Subdomain: "web", TargetIP: "127.0.0.1",
+		Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	post := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without a configured token the endpoints are disabled
+	s.SetAPIToken("")
+	if code := post("/api/v1/services/web/drain", "secret"); code != http.StatusForbidden {
+		t.Errorf("expected 403 without a configured token, got %d", code)
+	}
+
+	s.SetAPIToken("secret")
+	if code := post("/api/v1/services/web/drain", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", code)
+	}
+	if code := post("/api/v1/services/web/drain", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong token, got %d", code)
+	}
+	if registry.IsDrained("web") {
+		t.Fatal("service drained by an unauthenticated request")
+	}
+
+	if code := post("/api/v1/services/web/drain", "secret"); code != http.StatusOK || !registry.IsDrained("web") {
+		t.Errorf("expected the service to be drained, got %d", code)
+	}
+	if code := post("/api/v1/services/web/undrain", "secret"); code != http.StatusOK || registry.IsDrained("web") {
+		t.Errorf("expected the service to be undrained, got %d", code)
+	}
+	if code := post("/api/v1/services/missing/drain", "secret"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown service, got %d", code)
+	}
+}
+
+func TestMutatingRoutesRequireToken(t *testing.T) {
+	s, _ := newTestAPIWithAutomation(t, io.Discard)
+	routes := []struct{ method, path string }{
+		{http.MethodPost, "/api/v1/services/web/drain"},
+		{http.MethodPost, "/api/v1/services/web/undrain"},
+		{http.MethodPost, "/api/v1/agents/10.0.0.1/resync"},
+		{http.MethodDelete, "/api/v1/agents/10.0.0.1/services"},
+		{http.MethodPost, "/api/v1/sync"},
+		{http.MethodPost, "/api/v1/reconcile/plan"},
+		{http.MethodPost, "/api/v1/reconcile/apply"},
+		{http.MethodPost, "/api/v1/haproxy/reload"},
+	}
+	serve := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, route := range routes {
+		if code := serve(httptest.NewRequest(route.method, route.path, nil)); code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401 without a token, got %d", route.method, route.path, code)
+		}
+		if code := serve(authorized(httptest.NewRequest(route.method, route.path, nil))); code == http.StatusUnauthorized || code == http.StatusForbidden {
+			t.Errorf("%s %s: rejected with the token (%d)", route.method, route.path, code)
+		}
+	}
+
+	s.SetAPIToken("")
+	for _, route := range routes {
+		if code := serve(authorized(httptest.NewRequest(route.method, route.path, nil))); code != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403 while no token is configured, got %d", route.method, route.path, code)
+		}
+	}
+}
+
+func TestDeleteAgentServices(t *testing.T) {
+	s, _ := newTestAPIWithAutomation(t, io.Discard)
+	service := func(name string) types.ExposedService {
+		return types.ExposedService{Name: name, Namespace: "default", Subdomain: name, TargetIP: "127.0.0.1",
+			Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}}}
+	}
+	if _, err := s.registry.Update("10.0.0.1", []types.ExposedService{service("web"), service("api")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.registry.Update("10.0.0.2", []types.ExposedService{service("db")}); err != nil {
+		t.Fatal(err)
+	}
+
+	remove := func(id string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, authorized(httptest.NewRequest(http.MethodDelete, "/api/v1/agents/"+id+"/services", nil)))
+		return rec
+	}
+	rec := remove("10.0.0.1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Removed    int      `json:"removed"`
+		Subdomains []string `json:"subdomains"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(body.Subdomains)
+	if body.Removed != 2 || !reflect.DeepEqual(body.Subdomains, []string{"api", "web"}) {
+		t.Errorf("expected web and api to be removed, got %+v", body)
+	}
+
+	// Only the other agent's service is left
+	services := s.registry.GetServices()
+	if len(services) != 1 || services[0].Name != "db" || s.registry.Owner("db") != "10.0.0.2" {
+		t.Errorf("expected only db of 10.0.0.2 to remain, got %+v", services)
+	}
+
+	// Agents that are neither connected nor own services are unknown
+	if rec := remove("10.0.0.1"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an agent without services, got %d", rec.Code)
+	}
+}
+
+func TestListServicesETag(t *testing.T) {
+	s, registry := newTestAPI(t)
+	if _, err := registry.Update("agent", []types.ExposedService{{Name: "web", Namespace: "default", Subdomain: "web", TargetIP: "127.0.0.1",
+		Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	list := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/services", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := list("")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d %q", rec.Code, etag)
+	}
+	rec = list(etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("expected an empty 304 for the current ETag, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := list(`W/` + etag + `, "other"`); rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a weak ETag in a list, got %d", rec.Code)
+	}
+
+	// A changed service list gets a new ETag
+	if _, err := registry.Update("agent", nil); err != nil {
+		t.Fatal(err)
+	}
+	rec = list(etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("expected 200 with a new ETag after a change, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	// The client reports an unchanged list as ErrNotModified
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+	c := client.NewClient(srv.URL)
+	services, etag, err := c.ListServicesIfChanged("")
+	if err != nil || len(services) != 0 || etag == "" {
+		t.Fatalf("expected an empty list with an ETag, got %v %q %v", services, etag, err)
+	}
+	if _, same, err := c.ListServicesIfChanged(etag); !errors.Is(err, client.ErrNotModified) || same != etag {
+		t.Errorf("expected ErrNotModified keeping the ETag, got %q %v", same, err)
+	}
+}
+
+func TestSyncWaitsOrRunsAsync(t *testing.T) {
+	s, _ := newTestAPIWithAutomation(t, io.Discard)
+	trigger := func(query, requestID string) (int, map[string]interface{}) {
+		req := authorized(httptest.NewRequest(http.MethodPost, "/api/v1/sync"+query, nil))
+		req.Header.Set("X-Request-Id", requestID)
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+		}
+		return rec.Code, body
+	}
+	lastResult := func() automation.ReconcileResult {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/reconcile/status", nil))
+		var result automation.ReconcileResult
+		if rec.Code == http.StatusOK {
+			json.Unmarshal(rec.Body.Bytes(), &result)
+		}
+		return result
+	}
+
+	// A synchronous sync answers with the result of its reconcile
+	code, body := trigger("", "sync-1")
+	if code != http.StatusOK || body["status"] != "success" || body["request_id"] != "sync-1" {
+		t.Fatalf("expected a completed sync, got %d %v", code, body)
+	}
+	result, ok := body["result"].(map[string]interface{})
+	if !ok || result["request_id"] != "sync-1" {
+		t.Errorf("expected the result of the request's reconcile, got %v", body["result"])
+	}
+
+	// An async sync returns at once and its result shows up in the status
+	code, body = trigger("?async=true", "async-1")
+	if code != http.StatusAccepted || body["status_url"] != "/api/v1/reconcile/status" || body["request_id"] != "async-1" {
+		t.Fatalf("expected an accepted sync, got %d %v", code, body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for lastResult().RequestID != "async-1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("async reconcile did not complete, last result %+v", lastResult())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, query := range []string{"?async=maybe", "?timeout=-1s", "?timeout=soon"} {
+		if code, _ := trigger(query, "bad"); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3 description of the /api/v1 routes. Update it
+// together with setupRoutes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// handleOpenAPI serves the OpenAPI spec with the running server's version
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		s.respondError(w, http.StatusInternalServerError, "invalid OpenAPI spec")
+		return
+	}
+
+	if info, ok := spec["info"].(map[string]interface{}); ok && s.buildInfo.Version != "" {
+		info["version"] = s.buildInfo.Version
+	}
+
+	s.respondJSON(w, http.StatusOK, spec)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	s, _ := newTestAPIWithBuildInfo(t, BuildInfo{Version: "1.2.3"})
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json failed with %d", rec.Code)
+	}
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Info    struct {
+			Version string `json:"version"`
+		} `json:"info"`
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("spec does not parse: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("expected an OpenAPI 3 spec, got %q", spec.OpenAPI)
+	}
+	if spec.Info.Version != "1.2.3" {
+		t.Errorf("expected the server version in the spec, got %q", spec.Info.Version)
+	}
+
+	// Every v1 route is documented and every documented route exists
+	documented := make(map[string]bool)
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	err := chi.Walk(s.router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		path, ok := strings.CutPrefix(route, "/api/v1")
+		if !ok {
+			return nil
+		}
+		key := method + " " + path
+		if !documented[key] {
+			t.Errorf("route %s is not documented", key)
+		}
+		delete(documented, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range documented {
+		t.Errorf("documented route %s does not exist", key)
+	}
+}
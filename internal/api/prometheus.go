@@ -1,6 +1,7 @@
 package api
 
 import (
+	"github.com/noahjeana/k8s-exposer/pkg/types"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -17,6 +18,16 @@ var (
 		Help: "Total number of exposed ports",
 	})
 
+	servicesByNamespace = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_exposer_services",
+		Help: "Number of exposed services by namespace",
+	}, []string{"namespace"})
+
+	portsByNamespace = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_exposer_ports",
+		Help: "Number of exposed ports by namespace",
+	}, []string{"namespace"})
+
 	// Request metrics
 	httpRequestsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -35,3 +46,30 @@ var (
 		[]string{"method", "path"},
 	)
 )
+
+// setNamespaceMetrics updates the per-namespace service gauges and removes
+// the series of namespaces in previous that no longer expose services. It
+// returns the namespaces now exposing services.
+func setNamespaceMetrics(services []types.ExposedService, previous map[string]bool) map[string]bool {
+	serviceCounts := make(map[string]int)
+	portCounts := make(map[string]int)
+	for _, svc := range services {
+		serviceCounts[svc.Namespace]++
+		portCounts[svc.Namespace] += len(svc.Ports)
+	}
+
+	current := make(map[string]bool, len(serviceCounts))
+	for namespace, count := range serviceCounts {
+		servicesByNamespace.WithLabelValues(namespace).Set(float64(count))
+		portsByNamespace.WithLabelValues(namespace).Set(float64(portCounts[namespace]))
+		current[namespace] = true
+	}
+
+	for namespace := range previous {
+		if !current[namespace] {
+			servicesByNamespace.DeleteLabelValues(namespace)
+			portsByNamespace.DeleteLabelValues(namespace)
+		}
+	}
+	return current
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNamespaceMetrics(t *testing.T) {
+	service := func(namespace string, ports int) types.ExposedService {
+		svc := types.ExposedService{Name: "svc", Namespace: namespace}
+		for i := 0; i < ports; i++ {
+			svc.Ports = append(svc.Ports, types.PortMapping{Port: int32(30000 + i), Protocol: "tcp"})
+		}
+		return svc
+	}
+
+	namespaces := setNamespaceMetrics([]types.ExposedService{
+		service("games", 2), service("games", 3), service("web", 1), service("tools", 1),
+	}, nil)
+	for namespace, want := range map[string][2]float64{"games": {2, 5}, "web": {1, 1}, "tools": {1, 1}} {
+		if got := testutil.ToFloat64(servicesByNamespace.WithLabelValues(namespace)); got != want[0] {
+			t.Errorf("%s: expected %v services, got %v", namespace, want[0], got)
+		}
+		if got := testutil.ToFloat64(portsByNamespace.WithLabelValues(namespace)); got != want[1] {
+			t.Errorf("%s: expected %v ports, got %v", namespace, want[1], got)
+		}
+	}
+
+	// Namespaces without services left lose their series
+	namespaces = setNamespaceMetrics([]types.ExposedService{service("games", 2)}, namespaces)
+	if len(namespaces) != 1 || !namespaces["games"] {
+		t.Errorf("unexpected namespaces %v", namespaces)
+	}
+	if n := testutil.CollectAndCount(servicesByNamespace); n != 1 {
+		t.Errorf("expected one services series, got %d", n)
+	}
+	if n := testutil.CollectAndCount(portsByNamespace); n != 1 {
+		t.Errorf("expected one ports series, got %d", n)
+	}
+	if got := testutil.ToFloat64(portsByNamespace.WithLabelValues("games")); got != 2 {
+		t.Errorf("expected 2 ports in games, got %v", got)
+	}
+
+	setNamespaceMetrics(nil, namespaces)
+	if n := testutil.CollectAndCount(servicesByNamespace); n != 0 {
+		t.Errorf("expected no series without services, got %d", n)
+	}
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -14,27 +15,48 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// BuildInfo contains build metadata injected at link time
+type BuildInfo struct {
+	Version string
+	Commit  string
+	Date    string
+}
+
 // Server provides HTTP API for management and monitoring
 type Server struct {
 	registry   *server.ServiceRegistry
+	agents     *server.AgentRegistry
 	automation *automation.Controller
+	buildInfo  BuildInfo
+	apiToken   string // Bearer token protecting mutating routes (empty = disabled)
 	logger     *slog.Logger
 	router     chi.Router
+	httpServer *http.Server
 }
 
 // NewServer creates a new API server
-func NewServer(registry *server.ServiceRegistry, automation *automation.Controller, logger *slog.Logger) *Server {
+func NewServer(registry *server.ServiceRegistry, agents *server.AgentRegistry, automation *automation.Controller, buildInfo BuildInfo, logger *slog.Logger) *Server {
 	s := &Server{
 		registry:   registry,
+		agents:     agents,
 		automation: automation,
+		buildInfo:  buildInfo,
 		logger:     logger.With("component", "api"),
 		router:     chi.NewRouter(),
 	}
+	// Created up front so a Shutdown racing with Start stops the server
+	s.httpServer = &http.Server{Handler: s.router}
 
 	s.setupRoutes()
 	return s
 }
 
+// SetAPIToken sets the bearer token required by the protected routes, which
+// are disabled while no token is set
+func (s *Server) SetAPIToken(token string) {
+	s.apiToken = token
+}
+
 // setupRoutes configures all API routes
 func (s *Server) setupRoutes() {
 	r := s.router
@@ -51,25 +73,54 @@ func (s *Server) setupRoutes() {
 		// Services
 		r.Get("/services", s.handleListServices)
 		r.Get("/services/{name}", s.handleGetService)
+		r.Get("/services/{name}/metrics", s.handleServiceMetrics)
+		r.Get("/services/{name}/backend", s.handleServiceBackend)
+		r.With(s.requireToken).Post("/services/{name}/drain", s.handleDrainService)
+		r.With(s.requireToken).Post("/services/{name}/undrain", s.handleUndrainService)
+
+		// Agents
+		r.Get("/agents", s.handleListAgents)
+		r.With(s.requireToken).Post("/agents/{id}/resync", s.handleAgentResync)
+		r.With(s.requireToken).Delete("/agents/{id}/services", s.handleDeleteAgentServices)
 
 		// System
 		r.Get("/health", s.handleHealth)
+		r.Get("/version", s.handleVersion)
 		r.Get("/metrics", s.handleMetrics)
-		r.Post("/sync", s.handleSync)
+		r.With(s.requireToken).Post("/sync", s.handleSync)
+		r.Get("/reconcile/status", s.handleReconcileStatus)
+		r.Get("/reconcile/history", s.handleReconcileHistory)
+		r.Get("/reconcile/plan", s.handleReconcilePlan)
+		r.With(s.requireToken).Post("/reconcile/plan", s.handleCreatePlan)
+		r.With(s.requireToken).Post("/reconcile/apply", s.handleApplyPlan)
 
 		// HAProxy
 		r.Route("/haproxy", func(r chi.Router) {
 			r.Get("/status", s.handleHAProxyStatus)
-			r.Post("/reload", s.handleHAProxyReload)
+			r.With(s.requireToken).Post("/reload", s.handleHAProxyReload)
+			r.With(s.requireToken).Get("/config", s.handleHAProxyConfig)
 		})
+
+		// TLS
+		r.Get("/tls", s.handleTLSStatus)
+
+		// Debugging, requires the API token
+		r.With(s.requireToken).Get("/debug/dump", s.handleDebugDump)
 	})
 
-	// Legacy routes (backwards compatibility)
-	r.Get("/health", s.handleHealth)
+	// Readiness probe
+	r.Get("/readyz", s.handleReady)
+
+	// Legacy unversioned routes (backwards compatibility with the original
+	// API server). Responses are supersets of the original shapes.
+	r.Get("/health", s.handleLegacyHealth)
 	r.Get("/services", s.handleListServices)
 
 	// Prometheus metrics endpoint (standard path)
 	r.Handle("/metrics", promhttp.Handler())
+
+	// Machine-readable API description
+	r.Get("/openapi.json", s.handleOpenAPI)
 }
 
 // Start starts the HTTP server
@@ -78,8 +129,21 @@ func (s *Server) Start(addr string) error {
 	
 	// Start background goroutine to update service metrics
 	go s.updateServiceMetrics()
-	
-	return http.ListenAndServe(addr, s.router)
+
+	s.httpServer.Addr = addr
+
+	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully stops the HTTP server
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.httpServer == nil {
+		return nil
+	}
+	return s.httpServer.Shutdown(ctx)
 }
 
 // updateServiceMetrics periodically updates Prometheus service gauges
@@ -87,6 +151,7 @@ func (s *Server) updateServiceMetrics() {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 	
+	var namespaces map[string]bool
 	for {
 		services := s.registry.GetServices()
 		servicesTotal.Set(float64(len(services)))
@@ -96,6 +161,7 @@ func (s *Server) updateServiceMetrics() {
 			totalPorts += len(svc.Ports)
 		}
 		portsTotal.Set(float64(totalPorts))
+		namespaces = setNamespaceMetrics(services, namespaces)
 		
 		<-ticker.C
 	}
@@ -114,6 +180,7 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 		duration := time.Since(start)
 		
 		s.logger.Info("API request",
+			"request_id", middleware.GetReqID(r.Context()),
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", ww.statusCode,
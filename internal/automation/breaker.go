@@ -0,0 +1,120 @@
+package automation
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Circuit breaker states, also the values of the state gauge
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// Default firewall circuit breaker settings
+const (
+	DefaultFirewallBreakerThreshold = 5
+	DefaultFirewallBreakerCooldown  = 5 * time.Minute
+)
+
+var firewallBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "k8s_exposer_firewall_breaker_state",
+	Help: "State of the firewall API circuit breaker (0 = closed, 1 = open, 2 = half-open)",
+})
+
+// breaker suppresses calls to a failing dependency. After threshold
+// consecutive failures it opens for cooldown, then lets a single probe call
+// through (half-open) that either closes it again or re-opens it.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	gauge     prometheus.Gauge
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// newBreaker creates a circuit breaker, a threshold <= 0 disables it
+func newBreaker(name string, threshold int, cooldown time.Duration, gauge prometheus.Gauge, logger *slog.Logger) *breaker {
+	return &breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		gauge:     gauge,
+		logger:    logger,
+	}
+}
+
+// allow reports whether a call may be made
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.logger.Info("Circuit breaker half-open, probing", "breaker", b.name)
+		return true
+	case breakerHalfOpen:
+		// Only the probe call is let through
+		return false
+	default:
+		return true
+	}
+}
+
+// record reports the outcome of an allowed call
+func (b *breaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != breakerClosed {
+			b.logger.Info("Circuit breaker closed, calls resumed", "breaker", b.name)
+		}
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			b.logger.Warn("Circuit breaker opened, suspending calls",
+				"breaker", b.name,
+				"failures", b.failures,
+				"cooldown", b.cooldown,
+				"error", err)
+		}
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState updates the state and its gauge
+func (b *breaker) setState(state int) {
+	b.state = state
+	if b.gauge != nil {
+		b.gauge.Set(float64(state))
+	}
+}
@@ -0,0 +1,64 @@
+package automation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/automation/firewall"
+)
+
+func TestFirewallBreakerSuppressesCalls(t *testing.T) {
+	// A firewall API failing every request
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer api.Close()
+
+	c := NewController(Config{
+		FirewallToken:            "token",
+		FirewallID:               "42",
+		FirewallBreakerThreshold: 2,
+		FirewallBreakerCooldown:  100 * time.Millisecond,
+	}, testLogger())
+	c.firewallClient.SetBaseURL(api.URL)
+	reconcile := func() error {
+		return c.reconcileFirewall(context.Background(), testLogger(), []firewall.PortRule{{Port: 8080, Protocol: "tcp"}})
+	}
+
+	// Failures up to the threshold reach the API and open the breaker
+	for i := 0; i < 2; i++ {
+		if err := reconcile(); err == nil {
+			t.Fatal("expected the firewall update to fail")
+		}
+	}
+	tripped := calls.Load()
+
+	// While open, reconciles skip the API entirely
+	for i := 0; i < 5; i++ {
+		if err := reconcile(); err != nil {
+			t.Fatalf("expected the open breaker to skip the update, got %v", err)
+		}
+	}
+	if n := calls.Load(); n != tripped {
+		t.Errorf("expected no API calls while open, got %d more", n-tripped)
+	}
+
+	// After the cooldown a single probe is let through, failing re-opens it
+	time.Sleep(150 * time.Millisecond)
+	if err := reconcile(); err == nil {
+		t.Fatal("expected the probe to fail")
+	}
+	if calls.Load() == tripped {
+		t.Error("expected the half-open probe to reach the API")
+	}
+	probed := calls.Load()
+	if err := reconcile(); err != nil || calls.Load() != probed {
+		t.Errorf("expected the breaker to re-open after a failed probe (err %v, %d more calls)", err, calls.Load()-probed)
+	}
+}
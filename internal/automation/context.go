@@ -0,0 +1,30 @@
+package automation
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// WithRequestID returns a context carrying the ID of the request that
+// triggered a reconcile, so its logs can be correlated with the request
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFrom returns the request ID stored in ctx, if any
+func RequestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// loggerFor returns the controller logger enriched with the request ID from ctx
+func (c *Controller) loggerFor(ctx context.Context) *slog.Logger {
+	if requestID := RequestIDFrom(ctx); requestID != "" {
+		return c.logger.With("request_id", requestID)
+	}
+	return c.logger
+}
@@ -1,11 +1,20 @@
 package automation
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/noahjeana/k8s-exposer/internal/automation/dns"
 	"github.com/noahjeana/k8s-exposer/internal/automation/firewall"
 	"github.com/noahjeana/k8s-exposer/internal/automation/haproxy"
 	"github.com/noahjeana/k8s-exposer/pkg/types"
@@ -28,17 +37,68 @@ var (
 		Name: "k8s_exposer_last_reconciliation_timestamp_seconds",
 		Help: "Unix timestamp of last reconciliation",
 	})
+
+	reconcileTriggers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_exposer_reconcile_triggers_total",
+		Help: "Total number of change-triggered reconcile requests by result (reconciled or coalesced into another reconcile)",
+	}, []string{"result"})
 )
 
+// DefaultReconcileDebounce is the default quiet period before a triggered reconcile
+const DefaultReconcileDebounce = 500 * time.Millisecond
+
+// maxDebounceWindows bounds how long a steady stream of changes can postpone
+// a triggered reconcile, in debounce windows
+const maxDebounceWindows = 10
+
 // Controller manages HAProxy and firewall automation
 type Controller struct {
-	haproxyClient    *haproxy.Client
-	haproxyGenerator *haproxy.ConfigGenerator
-	firewallClient   *firewall.Client
-	domain           string
-	haproxyConfig    string
+	haproxyClient     *haproxy.Client
+	haproxyMaps       *haproxy.MapManager
+	haproxyGenerator  *haproxy.ConfigGenerator
+	haproxyReloader   *reloader
+	firewallClient    *firewall.Client
+	firewallBreaker   *breaker
+	dnsProvider       dns.Provider
+	dnsTarget         string
+	domain            string
+	haproxyConfig     string
 	reconcileInterval time.Duration
-	logger           *slog.Logger
+	agentWait         time.Duration
+	reconcileDebounce time.Duration
+	after             func(time.Duration) <-chan time.Time // Timer of the debounce, replaced by tests
+	haproxyWait       ReadinessWait
+	requireHAProxy    bool
+	requireFirewall   bool
+	requireApproval   bool
+	logger            *slog.Logger
+
+	// Services applied by the last successful reconciliation, see Flush
+	reconciledMu sync.Mutex
+	reconciled   []types.ExposedService
+
+	// Serializes reconciles so an approved plan is applied unchanged
+	reconcileMu sync.Mutex
+
+	// Manual sync in flight, joined by syncs requested while it runs
+	syncMu  sync.Mutex
+	syncRun *SyncRun
+
+	// Requests a reconcile ahead of the interval, coalescing pending requests
+	trigger chan struct{}
+	// Set by Trigger until the Run loop reads the services to reconcile
+	pending atomic.Bool
+
+	// Reconcile results
+	resultMu    sync.Mutex
+	lastResult  *ReconcileResult
+	lastErr     error
+	history     *resultHistory
+	subscribers map[chan ReconcileResult]struct{}
+	applied     *desiredState // Last state applied to HAProxy
+
+	// Ports the server actually listens on, see SetAllocationSource
+	allocations func([]types.ExposedService) []types.PortAllocation
 }
 
 // Config contains automation controller configuration
@@ -47,134 +107,542 @@ type Config struct {
 	HAProxySocket string
 	HAProxyMap    string
 	HAProxyConfig string
+	HAProxyStats  haproxy.StatsConfig
+	// Timeout of Runtime API socket commands (0 = haproxy.DefaultSocketTimeout)
+	HAProxySocketTimeout time.Duration
+	// HTML file served by services with the maintenance page enabled while
+	// their backend is down (empty = built-in page)
+	HAProxyMaintenancePage string
+	// ACME HTTP-01 challenge responder (host:port, empty disables the ACME exception)
+	HAProxyACMEBackend string
+	// Host of the k8s-exposer listeners HAProxy forwards to (empty = haproxy.DefaultBackendHost)
+	HAProxyBackendHost string
+
+	// HAProxy reload: command run after the generated config changed (empty
+	// disables reloading) and the minimum time between two reloads
+	HAProxyReloadCommand  string
+	HAProxyReloadInterval time.Duration
+
+	// HAProxy readiness wait before the first reconcile
+	HAProxyWait ReadinessWait
 
 	// Firewall
-	FirewallToken string
-	FirewallID    string
+	FirewallToken    string
+	FirewallID       string
+	FirewallTimeouts firewall.Timeouts
+	// Rules kept open in addition to the exposed ports
+	FirewallStaticRules []firewall.StaticRule
+
+	// DNS: records of service hostnames pointing at DNSTarget are managed
+	// through DNSProvider (nil disables DNS management)
+	DNSProvider dns.Provider
+	DNSTarget   string
 
 	// General
 	Domain            string
 	ReconcileInterval time.Duration
+	RequireApproval   bool          // Only reconcile on explicit sync or approved plans
+	HistorySize       int           // Number of reconcile results kept for /reconcile/history (0 disables)
+	AgentWait         time.Duration // Max wait for the first agent update before the initial reconcile
+	ReconcileDebounce time.Duration // Quiet period after the last change before a triggered reconcile (0 = immediately)
+
+	// Firewall circuit breaker: skip firewall calls for the cooldown after
+	// this many consecutive failures (0 disables the breaker)
+	FirewallBreakerThreshold int
+	FirewallBreakerCooldown  time.Duration
+
+	// Preflight: make failed checks for these features fatal at startup
+	RequireHAProxy  bool
+	RequireFirewall bool
 }
 
 // NewController creates a new automation controller
 func NewController(cfg Config, logger *slog.Logger) *Controller {
+	haproxyClient := haproxy.NewClient(cfg.HAProxySocket, cfg.HAProxyMap)
+	haproxyClient.SetTimeout(cfg.HAProxySocketTimeout)
+	haproxyGenerator := haproxy.NewConfigGenerator(cfg.HAProxyMap, cfg.HAProxyStats)
+	haproxyGenerator.SetMaintenancePage(cfg.HAProxyMaintenancePage)
+	haproxyGenerator.SetACMEBackend(cfg.HAProxyACMEBackend)
+	haproxyGenerator.SetBackendHost(cfg.HAProxyBackendHost)
+	firewallClient := firewall.NewClient(cfg.FirewallToken, cfg.FirewallID, cfg.FirewallTimeouts)
+	firewallClient.SetStaticRules(cfg.FirewallStaticRules)
+	dnsProvider := cfg.DNSProvider
+	if dnsProvider == nil {
+		dnsProvider = dns.Noop{}
+	}
 	return &Controller{
-		haproxyClient:     haproxy.NewClient(cfg.HAProxySocket, cfg.HAProxyMap),
-		haproxyGenerator:  haproxy.NewConfigGenerator(cfg.HAProxyMap),
-		firewallClient:    firewall.NewClient(cfg.FirewallToken, cfg.FirewallID),
+		haproxyClient:     haproxyClient,
+		haproxyMaps:       haproxy.NewMapManager(haproxyClient),
+		haproxyGenerator:  haproxyGenerator,
+		haproxyReloader:   newReloader(cfg.HAProxyReloadCommand, cfg.HAProxyReloadInterval, logger),
+		firewallClient:    firewallClient,
+		dnsProvider:       dnsProvider,
+		dnsTarget:         cfg.DNSTarget,
+		firewallBreaker:   newBreaker("firewall", cfg.FirewallBreakerThreshold, cfg.FirewallBreakerCooldown, firewallBreakerState, logger),
 		domain:            cfg.Domain,
 		haproxyConfig:     cfg.HAProxyConfig,
 		reconcileInterval: cfg.ReconcileInterval,
+		agentWait:         cfg.AgentWait,
+		reconcileDebounce: cfg.ReconcileDebounce,
+		after:             time.After,
+		haproxyWait:       cfg.HAProxyWait,
+		requireHAProxy:    cfg.RequireHAProxy,
+		requireFirewall:   cfg.RequireFirewall,
+		requireApproval:   cfg.RequireApproval,
 		logger:            logger,
+		history:           newResultHistory(cfg.HistorySize),
+		subscribers:       make(map[chan ReconcileResult]struct{}),
+		trigger:           make(chan struct{}, 1),
 	}
 }
 
-// Reconcile performs a full reconciliation of HAProxy and firewall
-func (c *Controller) Reconcile(services []types.ExposedService) error {
-	c.logger.Info("Starting reconciliation", "service_count", len(services))
+// Trigger requests a reconcile by the Run loop without waiting for the next
+// interval. Requests made while one is pending are coalesced.
+func (c *Controller) Trigger() {
+	c.pending.Store(true)
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+		reconcileTriggers.WithLabelValues("coalesced").Inc()
+	}
+}
 
-	// Collect desired state
-	desiredMappings := make(map[string]string)
-	desiredPorts := make([]int, 0)
-	backendConfigs := make([]haproxy.BackendConfig, 0)
+// debounce waits until no trigger arrived for the debounce window, so a burst
+// of changes (e.g. a rolling deploy) is reconciled once. A steady stream of
+// changes delays the reconcile by at most maxDebounceWindows windows.
+// Returns false if ctx was canceled while waiting.
+func (c *Controller) debounce(ctx context.Context) bool {
+	if c.reconcileDebounce <= 0 {
+		return true
+	}
 
-	for _, svc := range services {
-		if len(svc.Ports) == 0 {
-			continue
+	deadline := c.after(maxDebounceWindows * c.reconcileDebounce)
+	for {
+		quiet := c.after(c.reconcileDebounce)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-c.trigger:
+			reconcileTriggers.WithLabelValues("coalesced").Inc()
+		case <-quiet:
+			return true
+		case <-deadline:
+			return true
+		}
+	}
+}
+
+// SetAllocationSource sets the lookup of the ports allocated for services.
+// Listeners fall back to another port on conflicts, so HAProxy backends and
+// firewall rules have to use the port the listener got.
+func (c *Controller) SetAllocationSource(allocations func([]types.ExposedService) []types.PortAllocation) {
+	c.allocations = allocations
+}
+
+// Domain returns the base domain services are exposed under
+func (c *Controller) Domain() string {
+	return c.domain
+}
+
+// InvalidateCaches drops cached external state so the next reconcile
+// re-reads it from the source
+func (c *Controller) InvalidateCaches() {
+	c.firewallClient.InvalidateCache()
+}
+
+// Reconcile performs a full reconciliation of HAProxy and firewall. Failures
+// are returned as *ReconcileError; every run is published to subscribers.
+func (c *Controller) Reconcile(ctx context.Context, services []types.ExposedService) error {
+	c.reconcileMu.Lock()
+	defer c.reconcileMu.Unlock()
+	_, err := c.reconcileAndPublish(ctx, services)
+	return err
+}
+
+// SyncRun is a manual reconcile, shared by all syncs requested while it runs
+type SyncRun struct {
+	RequestID string // Request that started the run
+	Services  int    // Number of services reconciled
+
+	done   chan struct{}
+	result ReconcileResult
+	err    error
+}
+
+// Done is closed once the run finished
+func (r *SyncRun) Done() <-chan struct{} {
+	return r.done
+}
+
+// Result returns the result of the run, valid once Done is closed
+func (r *SyncRun) Result() (ReconcileResult, error) {
+	return r.result, r.err
+}
+
+// Sync starts a reconcile of services after dropping cached external state.
+// The reconcile outlives ctx, so a client giving up never leaves it half
+// applied. While a sync runs, further syncs join it instead of queueing
+// another reconcile behind it.
+func (c *Controller) Sync(ctx context.Context, services []types.ExposedService) *SyncRun {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	if c.syncRun != nil {
+		return c.syncRun
+	}
+
+	run := &SyncRun{RequestID: RequestIDFrom(ctx), Services: len(services), done: make(chan struct{})}
+	c.syncRun = run
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		c.InvalidateCaches()
+		c.reconcileMu.Lock()
+		run.result, run.err = c.reconcileAndPublish(ctx, services)
+		c.reconcileMu.Unlock()
+		if run.err != nil {
+			c.logger.Error("Manual reconciliation failed", "request_id", run.RequestID, "error", run.err)
+		}
+
+		c.syncMu.Lock()
+		c.syncRun = nil
+		c.syncMu.Unlock()
+		close(run.done)
+	}()
+	return run
+}
+
+// reconcileAndPublish reconciles and records the result (must be called with
+// reconcileMu held)
+func (c *Controller) reconcileAndPublish(ctx context.Context, services []types.ExposedService) (ReconcileResult, error) {
+	start := time.Now()
+	result, err := c.reconcile(ctx, services)
+	result.Time = start
+	result.Duration = time.Since(start)
+	result.Services = len(services)
+	result.RequestID = RequestIDFrom(ctx)
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+		var rerr *ReconcileError
+		if errors.As(err, &rerr) {
+			result.Stage = rerr.Stage
 		}
+	}
+	c.publish(result, err)
+	return result, err
+}
 
-		// Use first port
-		port := svc.Ports[0].Port
-		backend := fmt.Sprintf("backend_%d", port)
-		fqdn := fmt.Sprintf("%s.%s", svc.Subdomain, c.domain)
+// Flush reconciles services unless the last reconciliation already applied
+// them and no triggered reconcile is pending, e.g. on shutdown for changes
+// made since the last interval or still being debounced. Changes awaiting
+// approval are left alone. services must be in subdomain order as returned
+// by the registry.
+func (c *Controller) Flush(ctx context.Context, services []types.ExposedService) error {
+	if c.requireApproval {
+		return nil
+	}
 
-		desiredMappings[fqdn] = backend
-		desiredPorts = append(desiredPorts, int(port))
-		backendConfigs = append(backendConfigs, haproxy.BackendConfig{
-			Name: svc.Name,
-			Port: int(port),
-		})
+	pending := c.pending.Swap(false)
+	c.reconciledMu.Lock()
+	reconciled := c.reconciled
+	c.reconciledMu.Unlock()
+	if !pending && len(services) == len(reconciled) && (len(services) == 0 || reflect.DeepEqual(services, reconciled)) {
+		return nil
 	}
+	if pending {
+		reconcileTriggers.WithLabelValues("reconciled").Inc()
+	}
+
+	c.logger.Info("Flushing final reconciliation", "service_count", len(services))
+	return c.Reconcile(ctx, services)
+}
+
+// reconcile runs the reconciliation stages and reports what was applied
+func (c *Controller) reconcile(ctx context.Context, services []types.ExposedService) (ReconcileResult, error) {
+	var result ReconcileResult
+
+	logger := c.loggerFor(ctx)
+	logger.Info("Starting reconciliation", "service_count", len(services))
+
+	// Collect desired state
+	desired, err := c.desiredState(services)
+	if err != nil {
+		logger.Error("Invalid service configuration", "error", err)
+		reconciliationErrors.Inc()
+		return result, &ReconcileError{Stage: StageValidate, Err: err}
+	}
+
+	result.Domains = len(desired.mappings)
+	result.Ports = len(desired.ports) + len(desired.udpPorts)
+
+	// Log what changes relative to the last applied state
+	c.resultMu.Lock()
+	diff := diffStates(c.applied, desired)
+	c.resultMu.Unlock()
+	diff.log(logger)
+	result.Diff = &diff
 
 	// Update HAProxy configuration
-	if err := c.reconcileHAProxy(desiredMappings, backendConfigs); err != nil {
-		c.logger.Error("Failed to reconcile HAProxy", "error", err)
+	if err := c.reconcileHAProxy(ctx, logger, desired.mappings, desired.backends, desired.defaultBackend); err != nil {
+		logger.Error("Failed to reconcile HAProxy", "error", err)
 		reconciliationErrors.Inc()
-		return err
+		return result, &ReconcileError{Stage: StageHAProxy, Err: err}
 	}
 
+	// Later diffs are relative to what HAProxy now serves
+	c.resultMu.Lock()
+	c.applied = desired
+	c.resultMu.Unlock()
+
 	// Update firewall rules
-	if err := c.reconcileFirewall(desiredPorts); err != nil {
-		c.logger.Error("Failed to reconcile firewall", "error", err)
+	if err := c.reconcileFirewall(ctx, logger, desired.firewallPorts); err != nil {
+		logger.Error("Failed to reconcile firewall", "error", err)
 		// Don't fail on firewall errors - continue
+		result.FirewallError = err.Error()
+	}
+
+	// Update DNS records
+	if err := c.reconcileDNS(ctx, logger, desired.subdomains); err != nil {
+		logger.Error("Failed to reconcile DNS", "error", err)
+		// Like the firewall, DNS errors don't fail the reconcile
+		result.DNSError = err.Error()
 	}
 
-	c.logger.Info("Reconciliation complete", "domains", len(desiredMappings), "ports", len(desiredPorts))
-	
+	logger.Info("Reconciliation complete", "domains", len(desired.mappings), "ports", len(desired.ports), "udp_ports", len(desired.udpPorts))
+
 	// Record successful reconciliation
 	reconciliationsTotal.Inc()
 	lastReconciliationTime.SetToCurrentTime()
-	
-	return nil
+	c.reconciledMu.Lock()
+	c.reconciled = services
+	c.reconciledMu.Unlock()
+
+	return result, nil
+}
+
+// BackendName returns the name of the HAProxy backend serving a service,
+// empty for services without a TCP port
+func BackendName(svc types.ExposedService) string {
+	if svc.Subdomain == types.WildcardSubdomain {
+		return "backend_default"
+	}
+	port := tcpPort(svc, nil)
+	if port == 0 {
+		return ""
+	}
+	return backendName(port)
+}
+
+// backendName returns the name of the backend for a listener port
+func backendName(port int32) string {
+	return fmt.Sprintf("backend_%d", port)
+}
+
+// Mappings returns the current HAProxy domain to backend mappings
+func (c *Controller) Mappings() (map[string]string, error) {
+	return c.haproxyMaps.Mappings()
+}
+
+// HAProxyConfig returns the HAProxy config file as last written
+func (c *Controller) HAProxyConfig() (string, error) {
+	data, err := os.ReadFile(c.haproxyConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to read HAProxy config: %w", err)
+	}
+	return string(data), nil
+}
+
+// RenderHAProxyConfig returns the HAProxy config a reconcile of services
+// would write, without writing it
+func (c *Controller) RenderHAProxyConfig(services []types.ExposedService) (string, error) {
+	desired, err := c.desiredState(services)
+	if err != nil {
+		return "", err
+	}
+	return c.haproxyGenerator.Render(desired.backends, desired.defaultBackend)
+}
+
+// BackendStatus returns the HAProxy status of the backend serving a service
+func (c *Controller) BackendStatus(ctx context.Context, svc types.ExposedService) (string, error) {
+	if svc.Subdomain == types.WildcardSubdomain {
+		return c.haproxyClient.BackendStatus(ctx, "backend_default")
+	}
+	port := tcpPort(svc, c.allocatedPorts([]types.ExposedService{svc}))
+	if port == 0 {
+		return "", fmt.Errorf("service %s has no TCP port", svc.Name)
+	}
+	return c.haproxyClient.BackendStatus(ctx, backendName(port))
+}
+
+// backendConfig builds the HAProxy backend for a service on the given port
+func backendConfig(svc types.ExposedService, port int32) *haproxy.BackendConfig {
+	backend := &haproxy.BackendConfig{
+		Name:        svc.Name,
+		Port:        int(port),
+		TLS:         svc.TLS,
+		AllowHTTP:   svc.AllowHTTP,
+		MaxConn:     int(svc.MaxConn),
+		Maintenance: svc.MaintenancePage,
+	}
+	if svc.HealthCheck != nil {
+		backend.HealthCheckPath = svc.HealthCheck.Path
+		backend.HealthCheckStatus = int(svc.HealthCheck.ExpectStatus)
+	}
+	return backend
 }
 
 // reconcileHAProxy updates HAProxy domain mappings and backends
-func (c *Controller) reconcileHAProxy(desiredMappings map[string]string, backends []haproxy.BackendConfig) error {
+func (c *Controller) reconcileHAProxy(ctx context.Context, logger *slog.Logger, desiredMappings map[string]string, backends []haproxy.BackendConfig, defaultBackend *haproxy.BackendConfig) error {
 	// Get current mappings
-	currentMappings, err := c.haproxyClient.GetCurrentMappings()
+	currentMappings, err := c.haproxyMaps.Mappings()
 	if err != nil {
 		return fmt.Errorf("failed to get current mappings: %w", err)
 	}
 
-	// Add new mappings
-	for domain, backend := range desiredMappings {
-		if currentBackend, exists := currentMappings[domain]; exists {
-			if currentBackend == backend {
-				continue // Already correct
-			}
-			// Remove old mapping first
-			if err := c.haproxyClient.RemoveMapping(domain); err != nil {
-				c.logger.Warn("Failed to remove old mapping", "domain", domain, "error", err)
-			}
+	// Add new mappings in a stable order
+	domains := make([]string, 0, len(desiredMappings))
+	for domain := range desiredMappings {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		backend := desiredMappings[domain]
+		if currentMappings[domain] == backend {
+			continue // Already correct
 		}
 
-		// Add new mapping
-		if err := c.haproxyClient.AddMapping(domain, backend); err != nil {
+		if err := c.haproxyMaps.Set(ctx, domain, backend); err != nil {
 			return fmt.Errorf("failed to add mapping %s -> %s: %w", domain, backend, err)
 		}
-		c.logger.Info("Added domain mapping", "domain", domain, "backend", backend)
+		logger.Info("Added domain mapping", "domain", domain, "backend", backend)
+	}
+
+	// Remove mappings of hostnames no longer exposed, e.g. the aliases of a
+	// removed service. Mappings to backends not generated here are kept.
+	var stale []string
+	for domain, backend := range currentMappings {
+		if _, ok := desiredMappings[domain]; !ok && strings.HasPrefix(backend, "backend_") {
+			stale = append(stale, domain)
+		}
+	}
+	sort.Strings(stale)
+
+	for _, domain := range stale {
+		if err := c.haproxyMaps.Remove(ctx, domain); err != nil {
+			return fmt.Errorf("failed to remove mapping %s: %w", domain, err)
+		}
+		logger.Info("Removed domain mapping", "domain", domain)
 	}
 
 	// Generate new HAProxy config with all backends
-	if err := c.haproxyGenerator.Generate(backends, c.haproxyConfig); err != nil {
+	previous, _ := os.ReadFile(c.haproxyConfig)
+	if err := c.haproxyGenerator.Generate(backends, defaultBackend, c.haproxyConfig); err != nil {
 		return fmt.Errorf("failed to generate HAProxy config: %w", err)
 	}
-	c.logger.Info("Generated HAProxy config", "backends", len(backends))
+	logger.Info("Generated HAProxy config", "backends", len(backends), "catch_all", defaultBackend != nil)
+
+	// Point out domains still waiting for a certificate
+	certs := haproxy.LoadCertificates(haproxy.CertDir)
+	for _, backend := range backends {
+		if !backend.TLS {
+			continue
+		}
+		for _, domain := range backend.Domains() {
+			if !certs.Covers(domain) {
+				logger.Warn("No certificate for TLS domain", "domain", domain, "service", backend.Name)
+			}
+		}
+	}
 
-	// TODO: Reload HAProxy gracefully
-	// For now, manual reload required: systemctl reload haproxy
+	// Backends only take effect after a reload, domain mappings are live already
+	current, err := os.ReadFile(c.haproxyConfig)
+	if err != nil {
+		return fmt.Errorf("failed to read generated HAProxy config: %w", err)
+	}
+	if !bytes.Equal(previous, current) {
+		if c.haproxyReloader.enabled() {
+			c.haproxyReloader.request()
+		} else {
+			logger.Info("HAProxy config changed, reload required (no HAPROXY_RELOAD_COMMAND set)")
+		}
+	}
 
 	return nil
 }
 
+// reconcileDNS ensures a record for the hostname of every subdomain and
+// removes the owned records of hostnames no longer exposed. Ownership is read
+// from the provider, so records left behind while the server was down are
+// cleaned up too. Failed records are retried on the next reconcile.
+func (c *Controller) reconcileDNS(ctx context.Context, logger *slog.Logger, subdomains []string) error {
+	if _, ok := c.dnsProvider.(dns.Noop); ok {
+		return nil
+	}
+
+	owned, err := c.dnsProvider.Records(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get DNS records: %w", err)
+	}
+
+	var errs []error
+	desired := make(map[string]bool, len(subdomains))
+	for _, subdomain := range subdomains {
+		hostname := fmt.Sprintf("%s.%s", subdomain, c.domain)
+		desired[hostname] = true
+		if target, ok := owned[hostname]; ok && target == c.dnsTarget {
+			continue
+		}
+		if err := c.dnsProvider.EnsureRecord(ctx, hostname, c.dnsTarget); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info("Ensured DNS record", "hostname", hostname, "target", c.dnsTarget)
+	}
+
+	for hostname := range owned {
+		if desired[hostname] {
+			continue
+		}
+		if err := c.dnsProvider.RemoveRecord(ctx, hostname); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info("Removed DNS record", "hostname", hostname)
+	}
+
+	return errors.Join(errs...)
+}
+
 // reconcileFirewall updates firewall rules
-func (c *Controller) reconcileFirewall(ports []int) error {
+func (c *Controller) reconcileFirewall(ctx context.Context, logger *slog.Logger, ports []firewall.PortRule) error {
 	if !c.firewallClient.Enabled() {
-		c.logger.Debug("Firewall management disabled")
+		logger.Debug("Firewall management disabled")
+		return nil
+	}
+
+	// Don't keep hitting a failing API on every reconcile
+	if !c.firewallBreaker.allow() {
+		logger.Debug("Firewall circuit breaker open, skipping firewall update")
 		return nil
 	}
 
-	if err := c.firewallClient.EnsurePortsOpen(ports); err != nil {
+	err := c.firewallClient.EnsurePortsOpen(ctx, ports)
+	// An aborted request says nothing about the API's health
+	if ctx.Err() == nil {
+		c.firewallBreaker.record(err)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to update firewall: %w", err)
 	}
 
-	c.logger.Info("Updated firewall rules", "ports", ports)
+	logger.Info("Updated firewall rules", "ports", len(ports))
 	return nil
 }
 
-// Run starts the reconciliation loop
-func (c *Controller) Run(ctx context.Context, serviceGetter func() []types.ExposedService) error {
+// Run starts the reconciliation loop. The initial reconcile runs once
+// agentReady is closed or after the configured agent wait, whichever is first.
+// Afterwards it reconciles shortly after every Trigger and periodically as a resync.
+func (c *Controller) Run(ctx context.Context, serviceGetter func() []types.ExposedService, agentReady <-chan struct{}) error {
 	c.logger.Info("Starting automation controller",
 		"domain", c.domain,
 		"interval", c.reconcileInterval,
@@ -182,37 +650,41 @@ func (c *Controller) Run(ctx context.Context, serviceGetter func() []types.Expos
 	)
 
 	// Wait for HAProxy to be ready (retry with backoff)
-	for i := 0; i < 30; i++ {
-		if err := c.haproxyClient.Validate(); err != nil {
-			c.logger.Warn("HAProxy not ready, retrying...", "attempt", i+1, "error", err)
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(time.Duration(i+1) * time.Second):
-				continue
-			}
-		}
-		break
+	if err := c.waitForHAProxy(ctx); err != nil {
+		return err
 	}
-	
-	// Final validation check
-	if err := c.haproxyClient.Validate(); err != nil {
-		return fmt.Errorf("HAProxy validation failed after retries: %w", err)
+
+	defer c.haproxyReloader.stop()
+
+	if c.requireApproval {
+		c.logger.Info("Automatic reconciliation disabled, waiting for approved plans")
+		<-ctx.Done()
+		return ctx.Err()
 	}
 
 	ticker := time.NewTicker(c.reconcileInterval)
 	defer ticker.Stop()
 
-	// Wait a bit for agents to connect before initial reconciliation
+	// Wait for the first agent update so the initial reconcile doesn't run
+	// with zero services
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case <-time.After(5 * time.Second):
+	case <-agentReady:
+		c.logger.Info("Agent reported services, running initial reconciliation")
+	case <-time.After(c.agentWait):
+		c.logger.Warn("No agent update received, running initial reconciliation anyway", "waited", c.agentWait)
 	}
 
-	// Initial reconciliation
+	// Initial reconciliation, which covers changes triggered while waiting
+	select {
+	case <-c.trigger:
+		reconcileTriggers.WithLabelValues("coalesced").Inc()
+	default:
+	}
+	c.pending.Store(false)
 	services := serviceGetter()
-	if err := c.Reconcile(services); err != nil {
+	if err := c.Reconcile(ctx, services); err != nil {
 		c.logger.Error("Initial reconciliation failed", "error", err)
 	}
 
@@ -222,10 +694,24 @@ func (c *Controller) Run(ctx context.Context, serviceGetter func() []types.Expos
 			c.logger.Info("Automation controller stopping")
 			return ctx.Err()
 		case <-ticker.C:
+			c.pending.Store(false)
+			services := serviceGetter()
+			if err := c.Reconcile(ctx, services); err != nil {
+				c.logger.Error("Reconciliation failed", "error", err)
+			}
+		case <-c.trigger:
+			// Let a burst of changes (e.g. a full agent update) settle first
+			if !c.debounce(ctx) {
+				continue
+			}
+			reconcileTriggers.WithLabelValues("reconciled").Inc()
+			c.logger.Debug("Reconciling after registry change")
+			c.pending.Store(false)
 			services := serviceGetter()
-			if err := c.Reconcile(services); err != nil {
+			if err := c.Reconcile(ctx, services); err != nil {
 				c.logger.Error("Reconciliation failed", "error", err)
 			}
+			ticker.Reset(c.reconcileInterval)
 		}
 	}
 }
@@ -0,0 +1,551 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/server"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReconcileBackendOrder(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	c := NewController(cfg, testLogger())
+	service := func(subdomain string, port int32) types.ExposedService {
+		return types.ExposedService{Name: subdomain, Namespace: "default", Subdomain: subdomain,
+			Ports: []types.PortMapping{{Port: port, TargetPort: 80, Protocol: "tcp"}}}
+	}
+	services := []types.ExposedService{service("web", 8080), service("api", 8081), service("mail", 8082)}
+	backendLine := regexp.MustCompile(`(?m)^# Backend for (\S+)`)
+
+	for i := 0; i < 3; i++ {
+		// Every rotation of the input yields the same backend order
+		services = append(services[1:], services[0])
+		if err := c.Reconcile(context.Background(), services); err != nil {
+			t.Fatal(err)
+		}
+		config, err := os.ReadFile(cfg.HAProxyConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, match := range backendLine.FindAllStringSubmatch(string(config), -1) {
+			names = append(names, match[1])
+		}
+		if want := []string{"api", "mail", "web"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("expected backends in subdomain order %v, got %v", want, names)
+		}
+	}
+}
+
+func TestFlushReconcilesOnlyChanges(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	c := NewController(cfg, testLogger())
+	services := []types.ExposedService{{Name: "web", Namespace: "default", Subdomain: "web",
+		Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}}}
+
+	// Nothing was reconciled and nothing is registered
+	if err := c.Flush(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cfg.HAProxyConfig); !os.IsNotExist(err) {
+		t.Fatal("flush without services reconciled")
+	}
+
+	if err := c.Reconcile(context.Background(), services); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(cfg.HAProxyConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// Services already applied are not reconciled again
+	if err := c.Flush(context.Background(), services); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cfg.HAProxyConfig); !os.IsNotExist(err) {
+		t.Fatal("flush reconciled unchanged services")
+	}
+
+	// Changes since the last reconciliation are applied
+	changed := append(services, types.ExposedService{Name: "api", Namespace: "default", Subdomain: "api",
+		Ports: []types.PortMapping{{Port: 8081, TargetPort: 80, Protocol: "tcp"}}})
+	if err := c.Flush(context.Background(), changed); err != nil {
+		t.Fatal(err)
+	}
+	config, err := os.ReadFile(cfg.HAProxyConfig)
+	if err != nil {
+		t.Fatalf("flush did not reconcile the changed services: %v", err)
+	}
+	if !regexp.MustCompile(`(?m)^# Backend for api`).Match(config) {
+		t.Error("flushed config lacks the new service")
+	}
+}
+
+func TestReconcileWildcard(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	c := NewController(cfg, testLogger())
+	port := func(p int32) []types.PortMapping {
+		return []types.PortMapping{{Port: p, TargetPort: 80, Protocol: "tcp"}}
+	}
+	landing := types.ExposedService{Name: "landing", Namespace: "default", Subdomain: types.WildcardSubdomain, Ports: port(30080)}
+	web := types.ExposedService{Name: "web", Namespace: "default", Subdomain: "web", Ports: port(8080)}
+
+	if err := c.Reconcile(context.Background(), []types.ExposedService{landing, web}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only named subdomains are mapped, so they take precedence over the
+	// catch-all the map lookup falls back to
+	mappings, err := os.ReadFile(cfg.HAProxyMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "web.example.com backend_8080\n"; string(mappings) != want {
+		t.Errorf("expected map file %q, got %q", want, mappings)
+	}
+	config, err := os.ReadFile(cfg.HAProxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"backend backend_default\n    mode http\n    server landing 127.0.0.1:30080",
+		"backend backend_8080\n",
+	} {
+		if !strings.Contains(string(config), want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+	if strings.Contains(string(config), "404 Not Found") {
+		t.Error("config still serves the 404 default backend")
+	}
+
+	// A second wildcard service is rejected
+	other := landing
+	other.Name = "landing-2"
+	err = c.Reconcile(context.Background(), []types.ExposedService{landing, other, web})
+	if err == nil || !strings.Contains(err.Error(), "multiple wildcard services") {
+		t.Errorf("expected multiple wildcard services to be rejected, got %v", err)
+	}
+}
+
+// runController runs c until the test ends and returns a channel receiving
+// a value for each time the services are fetched for a reconcile
+func runController(t *testing.T, c *Controller, agentReady <-chan struct{}) <-chan struct{} {
+	t.Helper()
+	fetched := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, func() []types.ExposedService {
+			fetched <- struct{}{}
+			return nil
+		}, agentReady)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return fetched
+}
+
+func TestInitialReconcileWaitsForAgent(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.ReconcileInterval = time.Hour
+	cfg.AgentWait = time.Hour
+	agentReady := make(chan struct{})
+	fetched := runController(t, NewController(cfg, testLogger()), agentReady)
+
+	select {
+	case <-fetched:
+		t.Fatal("initial reconcile ran before an agent connected")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(agentReady)
+	select {
+	case <-fetched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("initial reconcile did not run after the agent connected")
+	}
+}
+
+func TestInitialReconcileAfterAgentWait(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.ReconcileInterval = time.Hour
+	cfg.AgentWait = 20 * time.Millisecond
+	fetched := runController(t, NewController(cfg, testLogger()), make(chan struct{}))
+
+	select {
+	case <-fetched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("initial reconcile did not run after the agent wait")
+	}
+}
+
+func TestReconcileResults(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	c := NewController(cfg, testLogger())
+	results, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	web := []types.ExposedService{{Name: "web", Namespace: "default", Subdomain: "web",
+		Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}}}
+
+	if err := c.Reconcile(context.Background(), web); err != nil {
+		t.Fatal(err)
+	}
+	result := <-results
+	if !result.Success || result.Services != 1 || result.Domains != 1 || result.Ports != 1 || c.LastError() != nil {
+		t.Errorf("unexpected result for a successful reconcile: %+v", result)
+	}
+
+	// Without the Runtime API adding the mapping fails in the HAProxy stage
+	c = NewController(Config{
+		HAProxySocket: filepath.Join(t.TempDir(), "missing.sock"),
+		HAProxyMap:    cfg.HAProxyMap + ".other",
+		HAProxyConfig: cfg.HAProxyConfig,
+		Domain:        "example.com",
+	}, testLogger())
+	results, unsubscribe = c.Subscribe()
+	defer unsubscribe()
+
+	err := c.Reconcile(context.Background(), web)
+	var rerr *ReconcileError
+	if !errors.As(err, &rerr) || rerr.Stage != StageHAProxy {
+		t.Fatalf("expected a HAProxy stage error, got %v", err)
+	}
+	select {
+	case result := <-results:
+		if result.Success || result.Stage != StageHAProxy || result.Error == "" {
+			t.Errorf("unexpected result for a failed reconcile: %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no result published for the failed reconcile")
+	}
+	if last, ok := c.LastResult(); !ok || last.Success {
+		t.Errorf("expected the failure as last result, got %+v", last)
+	}
+	if c.LastError() != err {
+		t.Errorf("expected the last error %v, got %v", err, c.LastError())
+	}
+}
+
+func TestRegistryChangeTriggersReconcile(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.ReconcileInterval = time.Hour
+	cfg.AgentWait = time.Hour
+	cfg.ReconcileDebounce = 50 * time.Millisecond
+	c := NewController(cfg, testLogger())
+	agentReady := make(chan struct{})
+	close(agentReady)
+	fetched := runController(t, c, agentReady)
+
+	select {
+	case <-fetched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("initial reconcile did not run")
+	}
+
+	// Registry changes trigger the controller as wired by the server
+	forwarder := server.NewForwarder("wg-test", testLogger())
+	registry := server.NewServiceRegistry(30000, 30100, server.ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1"}, forwarder, testLogger())
+	defer forwarder.Close()
+	defer registry.Close()
+	events, unsubscribe := registry.Subscribe()
+	defer unsubscribe()
+	go func() {
+		for range events {
+			c.Trigger()
+		}
+	}()
+
+	// A burst of changes is reconciled once, after the debounce
+	start := time.Now()
+	var services []types.ExposedService
+	for _, name := range []string{"web", "api", "docs"} {
+		services = append(services, types.ExposedService{Name: name, Namespace: "default", Subdomain: name, TargetIP: "127.0.0.1",
+			Ports: []types.PortMapping{{Port: freePort(t), TargetPort: 80, Protocol: "tcp"}}})
+	}
+	if _, err := registry.Update("agent", services); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fetched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("registry change did not trigger a reconcile before the interval")
+	}
+	if elapsed := time.Since(start); elapsed < cfg.ReconcileDebounce {
+		t.Errorf("reconciled after %s, before the debounce", elapsed)
+	}
+	select {
+	case <-fetched:
+		t.Error("burst of changes reconciled more than once")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Nothing is pending once the triggered reconcile ran
+	if c.pending.Load() {
+		t.Error("trigger still pending after the reconcile")
+	}
+}
+
+// freePort returns a TCP port that is currently unused on loopback
+func freePort(t *testing.T) int32 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return int32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestFlushPendingReconcile(t *testing.T) {
+	cfg := preflightConfig(t)
+	c := NewController(cfg, testLogger())
+	results, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	// Without a pending trigger there is nothing to flush
+	if err := c.Flush(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-results:
+		t.Fatal("flush reconciled without a pending trigger")
+	default:
+	}
+
+	c.Trigger()
+	if err := c.Flush(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-results:
+	case <-time.After(time.Second):
+		t.Fatal("pending trigger was not flushed")
+	}
+	if c.pending.Load() {
+		t.Error("trigger still pending after the flush")
+	}
+}
+
+func TestReconcileAliases(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	c := NewController(cfg, testLogger())
+	// The listener of web was moved to a fallback port
+	c.SetAllocationSource(func(services []types.ExposedService) []types.PortAllocation {
+		return []types.PortAllocation{{Subdomain: "web", RequestedPort: 8080, AllocatedPort: 30080, Protocol: "tcp"}}
+	})
+	port := func(p int32) []types.PortMapping {
+		return []types.PortMapping{{Port: p, TargetPort: 80, Protocol: "tcp"}}
+	}
+	web := types.ExposedService{Name: "web", Namespace: "default", Subdomain: "web", Aliases: []string{"www", "www.app"}, Ports: port(8080)}
+	api := types.ExposedService{Name: "api", Namespace: "default", Subdomain: "api", Ports: port(8081)}
+
+	mappings := func() map[string]string {
+		t.Helper()
+		got, err := c.haproxyMaps.Mappings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	if err := c.Reconcile(context.Background(), []types.ExposedService{web, api}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"api.example.com":     "backend_8081",
+		"web.example.com":     "backend_30080",
+		"www.example.com":     "backend_30080",
+		"www.app.example.com": "backend_30080",
+	}
+	if got := mappings(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected mappings %v, got %v", want, got)
+	}
+	config, err := os.ReadFile(cfg.HAProxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(config), "backend backend_30080\n"); n != 1 {
+		t.Errorf("expected aliases to share a single backend, found %d", n)
+	}
+
+	// Removing the service removes its aliases with it
+	if err := c.Reconcile(context.Background(), []types.ExposedService{api}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mappings(); !reflect.DeepEqual(got, map[string]string{"api.example.com": "backend_8081"}) {
+		t.Errorf("expected only the api mapping left, got %v", got)
+	}
+}
+
+func TestSyncJoinsRunningSync(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	c := NewController(cfg, testLogger())
+	wait := func(run *SyncRun) ReconcileResult {
+		t.Helper()
+		select {
+		case <-run.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("sync did not finish")
+		}
+		result, err := run.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// Hold the reconcile lock so the first sync stays in flight
+	c.reconcileMu.Lock()
+	first := c.Sync(WithRequestID(context.Background(), "first"), nil)
+	if second := c.Sync(WithRequestID(context.Background(), "second"), nil); second != first {
+		t.Error("expected the second sync to join the running one")
+	}
+	c.reconcileMu.Unlock()
+	if result := wait(first); result.RequestID != "first" {
+		t.Errorf("expected the result of the first sync, got %q", result.RequestID)
+	}
+
+	// A sync after the run finished reconciles again
+	third := c.Sync(WithRequestID(context.Background(), "third"), nil)
+	if third == first {
+		t.Fatal("finished sync was joined")
+	}
+	if result := wait(third); result.RequestID != "third" {
+		t.Errorf("expected the result of the third sync, got %q", result.RequestID)
+	}
+}
+
+// fakeAfter replaces the debounce timer, the test fires the waits itself
+type fakeAfter struct {
+	waits chan fakeWait
+}
+
+// fakeWait is a wait started by the debounce loop
+type fakeWait struct {
+	d    time.Duration
+	fire chan time.Time
+}
+
+func newFakeAfter() *fakeAfter {
+	return &fakeAfter{waits: make(chan fakeWait, 64)}
+}
+
+func (f *fakeAfter) after(d time.Duration) <-chan time.Time {
+	w := fakeWait{d: d, fire: make(chan time.Time, 1)}
+	f.waits <- w
+	return w.fire
+}
+
+// next returns the next wait started by the debounce loop
+func (f *fakeAfter) next(t *testing.T) fakeWait {
+	t.Helper()
+	select {
+	case w := <-f.waits:
+		return w
+	case <-time.After(2 * time.Second):
+		t.Fatal("debounce did not start a wait")
+		return fakeWait{}
+	}
+}
+
+// startDebouncedController runs a controller with a fake debounce timer and
+// waits for its initial reconcile
+func startDebouncedController(t *testing.T) (*Controller, *fakeAfter, <-chan struct{}) {
+	t.Helper()
+	cfg := preflightConfig(t)
+	cfg.ReconcileInterval = time.Hour
+	cfg.ReconcileDebounce = 100 * time.Millisecond
+	c := NewController(cfg, testLogger())
+	clock := newFakeAfter()
+	c.after = clock.after
+	agentReady := make(chan struct{})
+	close(agentReady)
+	fetched := runController(t, c, agentReady)
+	select {
+	case <-fetched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("initial reconcile did not run")
+	}
+	return c, clock, fetched
+}
+
+func TestDebounceCoalescesBurst(t *testing.T) {
+	c, clock, fetched := startDebouncedController(t)
+	reconciled := testutil.ToFloat64(reconcileTriggers.WithLabelValues("reconciled"))
+	coalesced := testutil.ToFloat64(reconcileTriggers.WithLabelValues("coalesced"))
+
+	// Every change within the quiet period restarts it
+	c.Trigger()
+	if deadline := clock.next(t); deadline.d != maxDebounceWindows*100*time.Millisecond {
+		t.Errorf("expected the postponement bounded to %d windows, got %s", maxDebounceWindows, deadline.d)
+	}
+	quiet := clock.next(t)
+	for i := 0; i < 19; i++ {
+		c.Trigger()
+		quiet = clock.next(t)
+	}
+	if quiet.d != 100*time.Millisecond {
+		t.Errorf("expected a quiet period of the debounce window, got %s", quiet.d)
+	}
+	select {
+	case <-fetched:
+		t.Fatal("reconciled before the changes settled")
+	default:
+	}
+
+	// The burst of 20 changes is reconciled once the last quiet period passed
+	quiet.fire <- time.Now()
+	select {
+	case <-fetched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("settled changes were not reconciled")
+	}
+	if got := testutil.ToFloat64(reconcileTriggers.WithLabelValues("reconciled")) - reconciled; got != 1 {
+		t.Errorf("expected one reconciled trigger, got %v", got)
+	}
+	if got := testutil.ToFloat64(reconcileTriggers.WithLabelValues("coalesced")) - coalesced; got != 19 {
+		t.Errorf("expected 19 coalesced triggers, got %v", got)
+	}
+}
+
+func TestDebounceBoundsPostponement(t *testing.T) {
+	c, clock, fetched := startDebouncedController(t)
+
+	// A steady stream of changes never settles, it is still reconciled once
+	// the postponement limit passed
+	for round := 0; round < 2; round++ {
+		c.Trigger()
+		deadline := clock.next(t)
+		clock.next(t)
+		for i := 0; i < 5; i++ {
+			c.Trigger()
+			clock.next(t)
+		}
+		deadline.fire <- time.Now()
+		select {
+		case <-fetched:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: changes were postponed past the limit", round)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hetznerAPI is the base URL of the Hetzner DNS API
+const hetznerAPI = "https://dns.hetzner.com/api/v1"
+
+// ownerValue marks the records created by k8s-exposer. It is stored in a TXT
+// record next to the address record, records without it are left alone.
+const ownerValue = `"heritage=k8s-exposer"`
+
+// ErrRecordNotOwned is returned for address records that exist but were not
+// created by k8s-exposer
+var ErrRecordNotOwned = errors.New("record exists and is not managed by k8s-exposer")
+
+// HetznerProvider manages A/AAAA records in a Hetzner DNS zone
+type HetznerProvider struct {
+	token      string
+	zoneID     string
+	ttl        int
+	baseURL    string
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	zoneName string // Cached name of the zone, looked up on first use
+}
+
+// hetznerRecord is a record as returned and accepted by the Hetzner DNS API
+type hetznerRecord struct {
+	ID     string `json:"id,omitempty"`
+	ZoneID string `json:"zone_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+// NewHetznerProvider creates a Hetzner DNS provider for a zone
+func NewHetznerProvider(token, zoneID string, ttl int, timeout time.Duration) *HetznerProvider {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &HetznerProvider{
+		token:      token,
+		zoneID:     zoneID,
+		ttl:        ttl,
+		baseURL:    hetznerAPI,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Records returns the address records of every name carrying the ownership
+// record
+func (p *HetznerProvider) Records(ctx context.Context) (map[string]string, error) {
+	zone, err := p.zone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all, err := p.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make(map[string]string)
+	for _, record := range all {
+		if isOwnerRecord(record) {
+			hostname := hostnameOf(record.Name, zone)
+			if _, ok := owned[hostname]; !ok {
+				owned[hostname] = ""
+			}
+		}
+	}
+	for _, record := range all {
+		if record.Type != "A" && record.Type != "AAAA" {
+			continue
+		}
+		hostname := hostnameOf(record.Name, zone)
+		if _, ok := owned[hostname]; ok {
+			owned[hostname] = record.Value
+		}
+	}
+	return owned, nil
+}
+
+// EnsureRecord creates or updates the address record of a hostname. An
+// existing record is only changed if k8s-exposer owns it or it already points
+// at target, in which case it is adopted.
+func (p *HetznerProvider) EnsureRecord(ctx context.Context, hostname, target string) error {
+	rtype, err := recordType(target)
+	if err != nil {
+		return err
+	}
+	name, err := p.recordName(ctx, hostname)
+	if err != nil {
+		return err
+	}
+
+	records, err := p.records(ctx, name)
+	if err != nil {
+		return err
+	}
+	owned := ownedBy(records)
+
+	desired := hetznerRecord{
+		ZoneID: p.zoneID,
+		Type:   rtype,
+		Name:   name,
+		Value:  target,
+		TTL:    p.ttl,
+	}
+
+	for _, record := range records {
+		if record.Type != rtype {
+			continue
+		}
+		if !owned {
+			if record.Value != target {
+				return fmt.Errorf("failed to update record %s: %w", hostname, ErrRecordNotOwned)
+			}
+			return p.claim(ctx, hostname, name)
+		}
+		if record.Value == target && (p.ttl == 0 || record.TTL == p.ttl) {
+			return nil
+		}
+		if err := p.do(ctx, "PUT", "/records/"+url.PathEscape(record.ID), desired, nil); err != nil {
+			return fmt.Errorf("failed to update record %s: %w", hostname, err)
+		}
+		return nil
+	}
+
+	// Claim the name first, so a failed create is retried as an owned record
+	if !owned {
+		if err := p.claim(ctx, hostname, name); err != nil {
+			return err
+		}
+	}
+	if err := p.do(ctx, "POST", "/records", desired, nil); err != nil {
+		return fmt.Errorf("failed to create record %s: %w", hostname, err)
+	}
+	return nil
+}
+
+// RemoveRecord deletes the A and AAAA records of a hostname and its ownership
+// record. Records not owned by k8s-exposer are kept.
+func (p *HetznerProvider) RemoveRecord(ctx context.Context, hostname string) error {
+	name, err := p.recordName(ctx, hostname)
+	if err != nil {
+		return err
+	}
+	records, err := p.records(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !ownedBy(records) {
+		return nil
+	}
+
+	// The ownership record goes last, so an interrupted removal is retried
+	for _, record := range records {
+		if record.Type != "A" && record.Type != "AAAA" {
+			continue
+		}
+		if err := p.do(ctx, "DELETE", "/records/"+url.PathEscape(record.ID), nil, nil); err != nil {
+			return fmt.Errorf("failed to delete record %s: %w", hostname, err)
+		}
+	}
+	for _, record := range records {
+		if !isOwnerRecord(record) {
+			continue
+		}
+		if err := p.do(ctx, "DELETE", "/records/"+url.PathEscape(record.ID), nil, nil); err != nil {
+			return fmt.Errorf("failed to delete ownership record %s: %w", hostname, err)
+		}
+	}
+	return nil
+}
+
+// claim creates the TXT record marking name as owned by k8s-exposer
+func (p *HetznerProvider) claim(ctx context.Context, hostname, name string) error {
+	owner := hetznerRecord{
+		ZoneID: p.zoneID,
+		Type:   "TXT",
+		Name:   name,
+		Value:  ownerValue,
+		TTL:    p.ttl,
+	}
+	if err := p.do(ctx, "POST", "/records", owner, nil); err != nil {
+		return fmt.Errorf("failed to create ownership record %s: %w", hostname, err)
+	}
+	return nil
+}
+
+// recordName returns the name of hostname relative to the zone, "@" for the
+// zone apex
+func (p *HetznerProvider) recordName(ctx context.Context, hostname string) (string, error) {
+	zone, err := p.zone(ctx)
+	if err != nil {
+		return "", err
+	}
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if hostname == zone {
+		return "@", nil
+	}
+	name, ok := strings.CutSuffix(hostname, "."+zone)
+	if !ok {
+		return "", fmt.Errorf("hostname %s is not in zone %s", hostname, zone)
+	}
+	return name, nil
+}
+
+// hostnameOf returns the fully qualified hostname of a record name
+func hostnameOf(name, zone string) string {
+	if name == "@" {
+		return zone
+	}
+	return strings.ToLower(name) + "." + zone
+}
+
+// zone returns the name of the zone, fetching it once from the API
+func (p *HetznerProvider) zone(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.zoneName != "" {
+		return p.zoneName, nil
+	}
+
+	var result struct {
+		Zone struct {
+			Name string `json:"name"`
+		} `json:"zone"`
+	}
+	if err := p.do(ctx, "GET", "/zones/"+url.PathEscape(p.zoneID), nil, &result); err != nil {
+		return "", fmt.Errorf("failed to get zone %s: %w", p.zoneID, err)
+	}
+	if result.Zone.Name == "" {
+		return "", fmt.Errorf("zone %s has no name", p.zoneID)
+	}
+	p.zoneName = strings.TrimSuffix(strings.ToLower(result.Zone.Name), ".")
+	return p.zoneName, nil
+}
+
+// list returns all records of the zone
+func (p *HetznerProvider) list(ctx context.Context) ([]hetznerRecord, error) {
+	var result struct {
+		Records []hetznerRecord `json:"records"`
+	}
+	if err := p.do(ctx, "GET", "/records?zone_id="+url.QueryEscape(p.zoneID), nil, &result); err != nil {
+		return nil, fmt.Errorf("failed to list records: %w", err)
+	}
+	return result.Records, nil
+}
+
+// records returns the records of the zone with the given name
+func (p *HetznerProvider) records(ctx context.Context, name string) ([]hetznerRecord, error) {
+	all, err := p.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []hetznerRecord
+	for _, record := range all {
+		if record.Name == name {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// isOwnerRecord reports whether record is the ownership record of k8s-exposer
+func isOwnerRecord(record hetznerRecord) bool {
+	return record.Type == "TXT" && strings.Trim(record.Value, `"`) == strings.Trim(ownerValue, `"`)
+}
+
+// ownedBy reports whether records contain the ownership record
+func ownedBy(records []hetznerRecord) bool {
+	for _, record := range records {
+		if isOwnerRecord(record) {
+			return true
+		}
+	}
+	return false
+}
+
+// do sends an API request, encoding body and decoding the response into out
+// when they are non-nil
+func (p *HetznerProvider) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Auth-API-Token", p.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
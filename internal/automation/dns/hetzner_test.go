@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeHetzner is an in-memory Hetzner DNS API for a single zone
+type fakeHetzner struct {
+	mu      sync.Mutex
+	zone    string
+	records map[string]hetznerRecord
+	nextID  int
+}
+
+func startFakeHetzner(t *testing.T, zone string, records ...hetznerRecord) (*fakeHetzner, *HetznerProvider) {
+	t.Helper()
+	f := &fakeHetzner{zone: zone, records: make(map[string]hetznerRecord)}
+	for _, record := range records {
+		f.add(record)
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	p := NewHetznerProvider("token", "zone-1", 300, 0)
+	p.baseURL = srv.URL
+	return f, p
+}
+
+func (f *fakeHetzner) add(record hetznerRecord) {
+	f.nextID++
+	record.ID = fmt.Sprint(f.nextID)
+	f.records[record.ID] = record
+}
+
+func (f *fakeHetzner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, "/records/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/zones/zone-1":
+		json.NewEncoder(w).Encode(map[string]interface{}{"zone": map[string]string{"id": "zone-1", "name": f.zone}})
+	case r.Method == "GET" && r.URL.Path == "/records":
+		list := make([]hetznerRecord, 0, len(f.records))
+		for _, record := range f.records {
+			list = append(list, record)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"records": list})
+	case r.Method == "POST" && r.URL.Path == "/records":
+		var record hetznerRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		f.add(record)
+	case r.Method == "PUT" && f.records[id].ID != "":
+		var record hetznerRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		record.ID = id
+		f.records[id] = record
+	case r.Method == "DELETE" && f.records[id].ID != "":
+		delete(f.records, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// find returns the values of the records with name and type
+func (f *fakeHetzner) find(name, rtype string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var values []string
+	for _, record := range f.records {
+		if record.Name == name && record.Type == rtype {
+			values = append(values, record.Value)
+		}
+	}
+	return values
+}
+
+func TestHetznerRecordLifecycle(t *testing.T) {
+	ctx := context.Background()
+	f, p := startFakeHetzner(t, "example.com")
+
+	if err := p.EnsureRecord(ctx, "web.apps.example.com", "203.0.113.10"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.find("web.apps", "A"); len(got) != 1 || got[0] != "203.0.113.10" {
+		t.Fatalf("expected an A record named relative to the zone, got %v", got)
+	}
+	if got := f.find("web.apps", "TXT"); len(got) != 1 {
+		t.Fatalf("expected an ownership record, got %v", got)
+	}
+
+	// Owned records follow the target
+	if err := p.EnsureRecord(ctx, "web.apps.example.com", "203.0.113.20"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.find("web.apps", "A"); len(got) != 1 || got[0] != "203.0.113.20" {
+		t.Fatalf("owned record not updated, got %v", got)
+	}
+
+	if err := p.RemoveRecord(ctx, "web.apps.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.find("web.apps", "A")) != 0 || len(f.find("web.apps", "TXT")) != 0 {
+		t.Error("records not removed")
+	}
+
+	if err := p.EnsureRecord(ctx, "web.other.org", "203.0.113.10"); err == nil {
+		t.Error("expected an error for a hostname outside the zone")
+	}
+}
+
+func TestHetznerLeavesForeignRecords(t *testing.T) {
+	ctx := context.Background()
+	f, p := startFakeHetzner(t, "example.com",
+		hetznerRecord{ZoneID: "zone-1", Type: "A", Name: "mail", Value: "198.51.100.1"},
+		hetznerRecord{ZoneID: "zone-1", Type: "A", Name: "www", Value: "203.0.113.10"},
+	)
+
+	// A record pointing elsewhere is neither overwritten nor deleted
+	if err := p.EnsureRecord(ctx, "mail.example.com", "203.0.113.10"); !errors.Is(err, ErrRecordNotOwned) {
+		t.Fatalf("expected ErrRecordNotOwned, got %v", err)
+	}
+	if err := p.RemoveRecord(ctx, "mail.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.find("mail", "A"); len(got) != 1 || got[0] != "198.51.100.1" {
+		t.Errorf("foreign record changed: %v", got)
+	}
+
+	// A record already pointing at the target is adopted
+	if err := p.EnsureRecord(ctx, "www.example.com", "203.0.113.10"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.find("www", "A")) != 1 || len(f.find("www", "TXT")) != 1 {
+		t.Error("matching record not adopted")
+	}
+}
+
+func TestHetznerRecordsReportsOwnedOnly(t *testing.T) {
+	ctx := context.Background()
+	_, p := startFakeHetzner(t, "example.com",
+		hetznerRecord{ZoneID: "zone-1", Type: "A", Name: "mail", Value: "198.51.100.1"},
+		hetznerRecord{ZoneID: "zone-1", Type: "A", Name: "web", Value: "203.0.113.10"},
+		hetznerRecord{ZoneID: "zone-1", Type: "TXT", Name: "web", Value: ownerValue},
+		hetznerRecord{ZoneID: "zone-1", Type: "TXT", Name: "api", Value: ownerValue},
+	)
+
+	got, err := p.Records(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"web.example.com": "203.0.113.10", "api.example.com": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected owned records %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Provider manages the DNS records pointing service hostnames at the server.
+// Ownership is kept with the records themselves, so providers only change
+// records they created, even across restarts.
+type Provider interface {
+	// Records returns the records owned by k8s-exposer, hostname -> target
+	// (empty while an owned name has no address record)
+	Records(ctx context.Context) (map[string]string, error)
+	// EnsureRecord creates or updates the record of a fully qualified
+	// hostname ("*.example.com" for the wildcard) to resolve to target
+	EnsureRecord(ctx context.Context, hostname, target string) error
+	// RemoveRecord deletes the record of a hostname, a missing record is not an error
+	RemoveRecord(ctx context.Context, hostname string) error
+}
+
+// Noop is the default provider for setups where DNS is managed elsewhere
+type Noop struct{}
+
+// Records returns no records
+func (Noop) Records(ctx context.Context) (map[string]string, error) { return nil, nil }
+
+// EnsureRecord does nothing
+func (Noop) EnsureRecord(ctx context.Context, hostname, target string) error { return nil }
+
+// RemoveRecord does nothing
+func (Noop) RemoveRecord(ctx context.Context, hostname string) error { return nil }
+
+// Config selects and configures a DNS provider
+type Config struct {
+	Provider string        // "" or "none" disables DNS management, "hetzner" for Hetzner DNS
+	Token    string        // API token of the provider
+	ZoneID   string        // Zone containing the service hostnames
+	TTL      int           // Record TTL in seconds (0 = provider default)
+	Timeout  time.Duration // Timeout of API requests (0 = 10s)
+}
+
+// Enabled reports whether a real provider is configured
+func (c Config) Enabled() bool {
+	return c.Provider != "" && c.Provider != "none"
+}
+
+// NewProvider creates the provider selected by cfg
+func NewProvider(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case "", "none":
+		return Noop{}, nil
+	case "hetzner":
+		if cfg.Token == "" || cfg.ZoneID == "" {
+			return nil, fmt.Errorf("hetzner DNS requires an API token and a zone ID")
+		}
+		return NewHetznerProvider(cfg.Token, cfg.ZoneID, cfg.TTL, cfg.Timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q", cfg.Provider)
+	}
+}
+
+// recordType returns the record type for a target address
+func recordType(target string) (string, error) {
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return "", fmt.Errorf("DNS target %q is not an IP address", target)
+	}
+	if ip.To4() != nil {
+		return "A", nil
+	}
+	return "AAAA", nil
+}
+
+// ValidateTarget checks that target can be used as record value
+func ValidateTarget(target string) error {
+	_, err := recordType(target)
+	return err
+}
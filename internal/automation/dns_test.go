@@ -0,0 +1,111 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// stubDNS is a zone where every record is owned by the exposer
+type stubDNS struct {
+	records map[string]string
+}
+
+func (s *stubDNS) Records(ctx context.Context) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	owned := make(map[string]string, len(s.records))
+	for hostname, target := range s.records {
+		owned[hostname] = target
+	}
+	return owned, nil
+}
+
+func (s *stubDNS) EnsureRecord(ctx context.Context, hostname, target string) error {
+	s.records[hostname] = target
+	return nil
+}
+
+func (s *stubDNS) RemoveRecord(ctx context.Context, hostname string) error {
+	delete(s.records, hostname)
+	return nil
+}
+
+func (s *stubDNS) hostnames() []string {
+	var names []string
+	for name := range s.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reconcileDNSFor runs the DNS step of a reconcile of services
+func reconcileDNSFor(t *testing.T, c *Controller, services ...types.ExposedService) {
+	t.Helper()
+	desired, err := c.desiredState(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcileDNS(context.Background(), c.logger, desired.subdomains); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcileDNSFollowsServices(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	provider := &stubDNS{records: make(map[string]string)}
+	c := NewController(Config{DNSProvider: provider, DNSTarget: "203.0.113.10", Domain: "example.com"}, logger)
+
+	port := []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}
+	web := types.ExposedService{Name: "web", Subdomain: "web", Ports: port}
+	api := types.ExposedService{Name: "api", Subdomain: "api", Ports: port}
+
+	reconcileDNSFor(t, c, web, api)
+	want := []string{"api.example.com", "web.example.com"}
+	if got := provider.hostnames(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected records %v, got %v", want, got)
+	}
+	if provider.records["web.example.com"] != "203.0.113.10" {
+		t.Errorf("record points at %s", provider.records["web.example.com"])
+	}
+
+	reconcileDNSFor(t, c, api)
+	if got := provider.hostnames(); !reflect.DeepEqual(got, []string{"api.example.com"}) {
+		t.Fatalf("records of the removed service kept: %v", got)
+	}
+
+	reconcileDNSFor(t, c)
+	if got := provider.hostnames(); len(got) != 0 {
+		t.Fatalf("records left after all services are gone: %v", got)
+	}
+}
+
+func TestReconcileDNSRemovesRecordsAfterRestart(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// Records owned by a previous run, one of them for a service removed since
+	provider := &stubDNS{records: map[string]string{
+		"web.example.com": "203.0.113.10",
+		"old.example.com": "203.0.113.10",
+	}}
+	c := NewController(Config{DNSProvider: provider, DNSTarget: "203.0.113.10", Domain: "example.com"}, logger)
+
+	port := []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}
+	reconcileDNSFor(t, c, types.ExposedService{Name: "web", Subdomain: "web", Ports: port})
+	if got := provider.hostnames(); !reflect.DeepEqual(got, []string{"web.example.com"}) {
+		t.Fatalf("expected the stale record to be removed, got %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.reconcileDNS(ctx, logger, []string{"web"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the reconcile context to reach the provider, got %v", err)
+	}
+}
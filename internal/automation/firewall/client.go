@@ -2,31 +2,124 @@ package firewall
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 )
 
+// hetznerAPI is the base URL of the Hetzner Cloud API
+const hetznerAPI = "https://api.hetzner.cloud/v1"
+
+// cacheTTL is how long applied rules are trusted before re-checking the API
+const cacheTTL = 10 * time.Minute
+
+// Timeouts configures the HTTP client talking to the Hetzner API, zero
+// values select the defaults
+type Timeouts struct {
+	Dial           time.Duration // Establishing the TCP connection (default 5s)
+	TLSHandshake   time.Duration // TLS handshake (default 5s)
+	ResponseHeader time.Duration // Waiting for response headers after sending a request (default 10s)
+	Request        time.Duration // Whole request including reading the body (default 10s)
+}
+
+// withDefaults fills unset timeouts with their defaults
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Dial <= 0 {
+		t.Dial = 5 * time.Second
+	}
+	if t.TLSHandshake <= 0 {
+		t.TLSHandshake = 5 * time.Second
+	}
+	if t.ResponseHeader <= 0 {
+		t.ResponseHeader = 10 * time.Second
+	}
+	if t.Request <= 0 {
+		t.Request = 10 * time.Second
+	}
+	return t
+}
+
 // Client manages Hetzner Cloud Firewall
 type Client struct {
 	token      string
 	firewallID string
+	baseURL    string
 	httpClient *http.Client
+
+	// Rules kept open in addition to the exposed ports
+	staticRules []StaticRule
+
+	// Cache of the last successfully applied port set
+	mu         sync.Mutex
+	appliedKey string
+	appliedAt  time.Time
 }
 
 // NewClient creates a new Hetzner Firewall client
-func NewClient(token, firewallID string) *Client {
+func NewClient(token, firewallID string, timeouts Timeouts) *Client {
 	return &Client{
 		token:      token,
 		firewallID: firewallID,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		baseURL:    hetznerAPI,
+		httpClient: newHTTPClient(timeouts),
 	}
 }
 
+// SetBaseURL points the client at another Hetzner Cloud API compatible
+// endpoint, e.g. a proxy or a stub in tests
+func (c *Client) SetBaseURL(url string) {
+	c.baseURL = strings.TrimSuffix(url, "/")
+}
+
+// SetStaticRules configures rules that are always kept open. They are
+// applied on every EnsurePortsOpen alongside the exposed ports.
+func (c *Client) SetStaticRules(rules []StaticRule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.staticRules = rules
+	c.appliedKey = ""
+}
+
+// newHTTPClient creates an HTTP client keeping connections to the API alive
+// between reconciles
+func newHTTPClient(timeouts Timeouts) *http.Client {
+	timeouts = timeouts.withDefaults()
+
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Dial,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          4,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeouts.Request,
+	}
+}
+
+// closeBody drains and closes a response body so the connection can be reused
+func closeBody(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
 // FirewallRule represents a Hetzner firewall rule
 type FirewallRule struct {
 	Direction   string   `json:"direction"`
@@ -37,13 +130,13 @@ type FirewallRule struct {
 }
 
 // GetRules retrieves current firewall rules
-func (c *Client) GetRules() ([]FirewallRule, error) {
+func (c *Client) GetRules(ctx context.Context) ([]FirewallRule, error) {
 	if c.token == "" || c.firewallID == "" {
 		return nil, fmt.Errorf("firewall management disabled (no token or firewall ID)")
 	}
 
-	url := fmt.Sprintf("https://api.hetzner.cloud/v1/firewalls/%s", c.firewallID)
-	req, err := http.NewRequest("GET", url, nil)
+	url := fmt.Sprintf("%s/firewalls/%s", c.baseURL, c.firewallID)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -54,7 +147,7 @@ func (c *Client) GetRules() ([]FirewallRule, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get firewall rules: %w", err)
 	}
-	defer resp.Body.Close()
+	defer closeBody(resp)
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
@@ -75,12 +168,12 @@ func (c *Client) GetRules() ([]FirewallRule, error) {
 }
 
 // SetRules updates firewall rules
-func (c *Client) SetRules(rules []FirewallRule) error {
+func (c *Client) SetRules(ctx context.Context, rules []FirewallRule) error {
 	if c.token == "" || c.firewallID == "" {
 		return fmt.Errorf("firewall management disabled (no token or firewall ID)")
 	}
 
-	url := fmt.Sprintf("https://api.hetzner.cloud/v1/firewalls/%s/actions/set_rules", c.firewallID)
+	url := fmt.Sprintf("%s/firewalls/%s/actions/set_rules", c.baseURL, c.firewallID)
 
 	payload := map[string]interface{}{
 		"rules": rules,
@@ -91,7 +184,7 @@ func (c *Client) SetRules(rules []FirewallRule) error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -103,7 +196,7 @@ func (c *Client) SetRules(rules []FirewallRule) error {
 	if err != nil {
 		return fmt.Errorf("failed to set firewall rules: %w", err)
 	}
-	defer resp.Body.Close()
+	defer closeBody(resp)
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		respBody, _ := io.ReadAll(resp.Body)
@@ -113,15 +206,23 @@ func (c *Client) SetRules(rules []FirewallRule) error {
 	return nil
 }
 
-// EnsurePortsOpen ensures the specified ports are open in the firewall
-func (c *Client) EnsurePortsOpen(ports []int) error {
+// EnsurePortsOpen ensures the specified ports are open in the firewall, with
+// separate rules for IPv4 and IPv6 sources. Canceling ctx aborts the API
+// requests in flight.
+func (c *Client) EnsurePortsOpen(ctx context.Context, ports []PortRule) error {
 	if c.token == "" || c.firewallID == "" {
 		// Firewall management disabled
 		return nil
 	}
 
+	// Skip the API round-trips when the same ports were applied recently
+	key := portRulesKey(ports)
+	if c.isCached(key) {
+		return nil
+	}
+
 	// Get current rules
-	currentRules, err := c.GetRules()
+	currentRules, err := c.GetRules(ctx)
 	if err != nil {
 		return err
 	}
@@ -129,9 +230,10 @@ func (c *Client) EnsurePortsOpen(ports []int) error {
 	// Build desired rules (keep existing non-k8s-exposer rules)
 	var newRules []FirewallRule
 
-	// Keep existing rules that are not managed by k8s-exposer
+	// Keep existing rules that are not managed by k8s-exposer. SSH, HTTP and
+	// HTTPS are added below and would otherwise be duplicated on every apply.
 	for _, rule := range currentRules {
-		if rule.Description != "" && rule.Description != "k8s-exposer" {
+		if rule.Description != "" && rule.Description != "k8s-exposer" && !isStatic(rule) && !isAlwaysOpen(rule) {
 			newRules = append(newRules, rule)
 		}
 	}
@@ -139,7 +241,7 @@ func (c *Client) EnsurePortsOpen(ports []int) error {
 	// Add SSH rule (always keep)
 	sshExists := false
 	for _, rule := range currentRules {
-		if rule.Port == "22" && rule.Protocol == "tcp" {
+		if rule.Port == "22" && rule.Protocol == "tcp" && !isStatic(rule) {
 			sshExists = true
 			newRules = append(newRules, rule)
 			break
@@ -171,19 +273,57 @@ func (c *Client) EnsurePortsOpen(ports []int) error {
 		Description: "HTTPS",
 	})
 
+	// Add static rules, replacing the ones applied by earlier reconciles
+	c.mu.Lock()
+	staticRules := c.staticRules
+	c.mu.Unlock()
+	for _, rule := range staticRules {
+		newRules = append(newRules, rule.rule())
+	}
+
 	// Add k8s-exposer managed ports
 	for _, port := range ports {
-		newRules = append(newRules, FirewallRule{
-			Direction:   "in",
-			Protocol:    "tcp",
-			Port:        fmt.Sprintf("%d", port),
-			SourceIPs:   []string{"0.0.0.0/0", "::/0"},
-			Description: "k8s-exposer",
-		})
+		newRules = append(newRules, port.rules()...)
 	}
 
-	// Update rules
-	return c.SetRules(newRules)
+	// Only update when the rules actually differ
+	if !reflect.DeepEqual(newRules, currentRules) {
+		if err := c.SetRules(ctx, newRules); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.appliedKey = key
+	c.appliedAt = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+// isAlwaysOpen reports whether rule is one of the SSH, HTTP and HTTPS rules
+// EnsurePortsOpen adds itself
+func isAlwaysOpen(rule FirewallRule) bool {
+	if rule.Protocol != "tcp" {
+		return false
+	}
+	return rule.Port == "22" || (rule.Port == "80" && rule.Description == "HTTP") ||
+		(rule.Port == "443" && rule.Description == "HTTPS")
+}
+
+// InvalidateCache forces the next EnsurePortsOpen to query the API
+func (c *Client) InvalidateCache() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.appliedKey = ""
+	c.appliedAt = time.Time{}
+}
+
+// isCached reports whether key was applied within the cache TTL
+func (c *Client) isCached(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.appliedKey == key && !c.appliedAt.IsZero() && time.Since(c.appliedAt) < cacheTTL
 }
 
 // Validate checks if firewall management is configured
@@ -0,0 +1,277 @@
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAPI is an in-memory Hetzner Cloud firewall API
+type fakeAPI struct {
+	mu    sync.Mutex
+	rules []FirewallRule
+	gets  atomic.Int32
+	sets  atomic.Int32
+	conns atomic.Int32 // Connections opened by clients
+}
+
+// startFakeAPI starts a fake API holding rules and returns a client using it
+func startFakeAPI(t *testing.T, rules ...FirewallRule) (*fakeAPI, *Client) {
+	t.Helper()
+	api := &fakeAPI{rules: rules}
+	srv := httptest.NewUnstartedServer(api)
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			api.conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	c := NewClient("token", "42", Timeouts{})
+	c.SetBaseURL(srv.URL)
+	return api, c
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/firewalls/42":
+		a.gets.Add(1)
+		var result struct {
+			Firewall struct {
+				Rules []FirewallRule `json:"rules"`
+			} `json:"firewall"`
+		}
+		result.Firewall.Rules = a.rules
+		json.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPost && r.URL.Path == "/firewalls/42/actions/set_rules":
+		a.sets.Add(1)
+		var payload struct {
+			Rules []FirewallRule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.rules = payload.Rules
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"actions":[]}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// current returns the rules the fake API holds
+func (a *fakeAPI) current() []FirewallRule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]FirewallRule(nil), a.rules...)
+}
+
+// openPorts returns port rules open to everyone for TCP and UDP ports
+func openPorts(tcp, udp []int) []PortRule {
+	var rules []PortRule
+	for _, port := range tcp {
+		rules = append(rules, PortRule{Port: port, Protocol: "tcp"})
+	}
+	for _, port := range udp {
+		rules = append(rules, PortRule{Port: port, Protocol: "udp"})
+	}
+	return rules
+}
+
+func TestEnsurePortsOpenCachesAppliedRules(t *testing.T) {
+	custom := FirewallRule{Direction: "in", Protocol: "tcp", Port: "9100", SourceIPs: []string{"10.0.0.0/8"}, Description: "node-exporter"}
+	api, c := startFakeAPI(t, custom)
+	ports := []int{8080, 27015}
+
+	for i := 0; i < 3; i++ {
+		if err := c.EnsurePortsOpen(context.Background(), openPorts(ports, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gets, sets := api.gets.Load(), api.sets.Load(); gets != 1 || sets != 1 {
+		t.Fatalf("expected one GET and one SetRules for unchanged ports, got %d and %d", gets, sets)
+	}
+
+	// The same ports in another order are still cached
+	if err := c.EnsurePortsOpen(context.Background(), openPorts([]int{ports[1], ports[0]}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if api.sets.Load() != 1 {
+		t.Error("reordered ports were applied again")
+	}
+
+	// Changed ports and an invalidated cache go to the API again
+	if err := c.EnsurePortsOpen(context.Background(), openPorts(ports[:1], nil)); err != nil {
+		t.Fatal(err)
+	}
+	if api.sets.Load() != 2 {
+		t.Errorf("changed ports not applied, %d SetRules calls", api.sets.Load())
+	}
+	c.InvalidateCache()
+	if err := c.EnsurePortsOpen(context.Background(), openPorts(ports[:1], nil)); err != nil {
+		t.Fatal(err)
+	}
+	if gets, sets := api.gets.Load(), api.sets.Load(); gets != 3 || sets != 2 {
+		t.Errorf("expected a GET but no SetRules after invalidation with matching rules, got %d GETs and %d SetRules", gets, sets)
+	}
+
+	// Rules not managed by k8s-exposer are kept and nothing is duplicated
+	rules := api.current()
+	if len(rules) != 6 || rules[0].Description != "node-exporter" {
+		t.Errorf("expected node-exporter, SSH, HTTP, HTTPS and the IPv4 and IPv6 port rules, got %+v", rules)
+	}
+}
+
+func TestEnsurePortsOpenUDP(t *testing.T) {
+	api, c := startFakeAPI(t)
+	if err := c.EnsurePortsOpen(context.Background(), openPorts([]int{8080}, []int{27015})); err != nil {
+		t.Fatal(err)
+	}
+
+	var tcp, udp []string
+	for _, rule := range api.current() {
+		if rule.Description != "k8s-exposer" {
+			continue
+		}
+		switch rule.Protocol {
+		case "tcp":
+			tcp = append(tcp, rule.Port)
+		case "udp":
+			udp = append(udp, rule.Port)
+		}
+	}
+	if !reflect.DeepEqual(tcp, []string{"8080", "8080"}) || !reflect.DeepEqual(udp, []string{"27015", "27015"}) {
+		t.Errorf("expected TCP 8080 and UDP 27015, got TCP %v and UDP %v", tcp, udp)
+	}
+
+	// A changed UDP port set is not served from the cache
+	if err := c.EnsurePortsOpen(context.Background(), openPorts([]int{8080}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if api.sets.Load() != 2 {
+		t.Errorf("expected the removed UDP port to be applied, %d SetRules calls", api.sets.Load())
+	}
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	api, c := startFakeAPI(t)
+	for i := 0; i < 5; i++ {
+		if _, err := c.GetRules(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		c.InvalidateCache()
+		if err := c.EnsurePortsOpen(context.Background(), openPorts([]int{8080 + i}, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gets, sets := api.gets.Load(), api.sets.Load(); gets != 10 || sets != 5 {
+		t.Fatalf("expected 10 GETs and 5 SetRules, got %d and %d", gets, sets)
+	}
+	if conns := api.conns.Load(); conns != 1 {
+		t.Errorf("expected all requests to share one connection, got %d connections", conns)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	c := NewClient("token", "42", Timeouts{ResponseHeader: 50 * time.Millisecond})
+	c.SetBaseURL(srv.URL)
+	start := time.Now()
+	if _, err := c.GetRules(context.Background()); err == nil {
+		t.Fatal("expected a slow API to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("request took %s despite the response header timeout", elapsed)
+	}
+
+	defaults := Timeouts{Dial: time.Second}.withDefaults()
+	if want := (Timeouts{Dial: time.Second, TLSHandshake: 5 * time.Second, ResponseHeader: 10 * time.Second, Request: 10 * time.Second}); defaults != want {
+		t.Errorf("expected %+v, got %+v", want, defaults)
+	}
+}
+
+func TestStaticRulesPreservedAcrossReconciles(t *testing.T) {
+	manual := FirewallRule{Direction: "in", Protocol: "tcp", Port: "5432", SourceIPs: []string{"10.0.0.0/8"}, Description: "postgres"}
+	removed := StaticRule{Port: "9100", Protocol: "tcp", Description: "node-exporter"}.rule()
+	api, c := startFakeAPI(t, manual, removed)
+
+	wireguard := StaticRule{Port: "51820", Protocol: "udp", Description: "WireGuard"}
+	monitoring := StaticRule{Port: "60000-61000", Protocol: "tcp", SourceIPs: []string{"10.0.0.0/8"}}
+	c.SetStaticRules([]StaticRule{wireguard, monitoring})
+
+	// Reconciles with changing exposed ports keep the static rules exactly once
+	for _, ports := range [][]int{{8080}, {8080, 27015}, nil} {
+		if err := c.EnsurePortsOpen(context.Background(), openPorts(ports, nil)); err != nil {
+			t.Fatal(err)
+		}
+		counts := map[string]int{}
+		for _, rule := range api.current() {
+			counts[rule.Description+" "+rule.Port+"/"+rule.Protocol]++
+		}
+		for _, want := range []string{
+			"k8s-exposer static: WireGuard 51820/udp",
+			"k8s-exposer static 60000-61000/tcp",
+			"postgres 5432/tcp",
+		} {
+			if counts[want] != 1 {
+				t.Errorf("ports %v: expected rule %q once, got %d in %v", ports, want, counts[want], api.current())
+			}
+		}
+		// Static rules dropped from the configuration are closed
+		if counts["k8s-exposer static: node-exporter 9100/tcp"] != 0 {
+			t.Errorf("ports %v: removed static rule is still open", ports)
+		}
+	}
+	for _, rule := range api.current() {
+		if rule.Port == "60000-61000" && !reflect.DeepEqual(rule.SourceIPs, []string{"10.0.0.0/8"}) {
+			t.Errorf("static rule lost its sources: %v", rule.SourceIPs)
+		}
+	}
+}
+
+func TestCanceledContextAbortsRequest(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := NewClient("token", "42", Timeouts{})
+	c.SetBaseURL(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := c.EnsurePortsOpen(ctx, openPorts([]int{8080}, nil))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled call took %s", elapsed)
+	}
+}
@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Sources of rules open to everyone
+var (
+	anyIPv4 = []string{"0.0.0.0/0"}
+	anyIPv6 = []string{"::/0"}
+)
+
+// PortRule is an exposed port to open in the firewall
+type PortRule struct {
+	Port      int
+	Protocol  string   // tcp or udp
+	SourceIPs []string // Allowed source CIDRs of both families (empty = everywhere, dual-stack)
+}
+
+// rules returns separate IPv4 and IPv6 firewall rules for the port. A port
+// whose sources only contain one family gets a single rule.
+func (p PortRule) rules() []FirewallRule {
+	v4, v6 := anyIPv4, anyIPv6
+	if len(p.SourceIPs) > 0 {
+		v4, v6 = splitFamilies(p.SourceIPs)
+	}
+
+	var rules []FirewallRule
+	for _, sources := range [][]string{v4, v6} {
+		if len(sources) == 0 {
+			continue
+		}
+		rules = append(rules, FirewallRule{
+			Direction:   "in",
+			Protocol:    p.Protocol,
+			Port:        fmt.Sprintf("%d", p.Port),
+			SourceIPs:   sources,
+			Description: "k8s-exposer",
+		})
+	}
+	return rules
+}
+
+// key returns an identifier of the port and its sources
+func (p PortRule) key() string {
+	sources := append([]string(nil), p.SourceIPs...)
+	sort.Strings(sources)
+	return fmt.Sprintf("%d/%s@%s", p.Port, p.Protocol, strings.Join(sources, ","))
+}
+
+// splitFamilies returns the IPv4 and IPv6 CIDRs of sources, dropping
+// entries that are not valid CIDRs
+func splitFamilies(sources []string) (v4, v6 []string) {
+	for _, source := range sources {
+		ip, _, err := net.ParseCIDR(source)
+		if err != nil {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, source)
+		} else {
+			v6 = append(v6, source)
+		}
+	}
+	return v4, v6
+}
+
+// portRulesKey returns an order-independent key for a set of port rules
+func portRulesKey(ports []PortRule) string {
+	keys := make([]string, len(ports))
+	for i, port := range ports {
+		keys[i] = port.key()
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ";")
+}
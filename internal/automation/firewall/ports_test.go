@@ -0,0 +1,61 @@
+package firewall
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPortRuleFamilies(t *testing.T) {
+	rule := func(protocol string, sources ...string) FirewallRule {
+		return FirewallRule{Direction: "in", Protocol: protocol, Port: "8080", SourceIPs: sources, Description: "k8s-exposer"}
+	}
+	tests := []struct {
+		name    string
+		sources []string
+		want    []FirewallRule
+	}{
+		{"dual-stack by default", nil, []FirewallRule{rule("tcp", "0.0.0.0/0"), rule("tcp", "::/0")}},
+		{"IPv4 only", []string{"0.0.0.0/0"}, []FirewallRule{rule("tcp", "0.0.0.0/0")}},
+		{"IPv6 only", []string{"2001:db8::/32"}, []FirewallRule{rule("tcp", "2001:db8::/32")}},
+		{"per-family ranges", []string{"10.0.0.0/8", "2001:db8::/32", "192.168.0.0/16"},
+			[]FirewallRule{rule("tcp", "10.0.0.0/8", "192.168.0.0/16"), rule("tcp", "2001:db8::/32")}},
+	}
+	for _, tt := range tests {
+		got := PortRule{Port: 8080, Protocol: "tcp", SourceIPs: tt.sources}.rules()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestEnsurePortsOpenIPv4Only(t *testing.T) {
+	api, c := startFakeAPI(t)
+	ports := []PortRule{
+		{Port: 8080, Protocol: "tcp"},
+		{Port: 27015, Protocol: "udp", SourceIPs: []string{"0.0.0.0/0"}},
+	}
+	if err := c.EnsurePortsOpen(context.Background(), ports); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, rule := range api.current() {
+		if rule.Description == "k8s-exposer" {
+			got = append(got, rule.Port+"/"+rule.Protocol+" "+rule.SourceIPs[0])
+		}
+	}
+	want := []string{"8080/tcp 0.0.0.0/0", "8080/tcp ::/0", "27015/udp 0.0.0.0/0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected rules %v, got %v", want, got)
+	}
+
+	// Narrowing the sources of a port is not served from the cache
+	ports[0].SourceIPs = []string{"10.0.0.0/8"}
+	if err := c.EnsurePortsOpen(context.Background(), ports); err != nil {
+		t.Fatal(err)
+	}
+	if api.sets.Load() != 2 {
+		t.Errorf("expected changed sources to be applied, %d SetRules calls", api.sets.Load())
+	}
+}
@@ -0,0 +1,126 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// StaticDescriptionPrefix marks firewall rules managed as static rules
+const StaticDescriptionPrefix = "k8s-exposer static"
+
+// StaticRule is a firewall rule that is always kept open, independent of
+// the exposed services
+type StaticRule struct {
+	Port        string   // Single port or range, e.g. "51820" or "60000-61000"
+	Protocol    string   // tcp or udp
+	SourceIPs   []string // Allowed source CIDRs (default: everywhere)
+	Description string
+}
+
+// rule converts the static rule to a firewall rule whose description marks
+// it as static, so it is replaced on every reconcile instead of duplicated
+func (r StaticRule) rule() FirewallRule {
+	description := StaticDescriptionPrefix
+	if r.Description != "" {
+		description += ": " + r.Description
+	}
+
+	sourceIPs := r.SourceIPs
+	if len(sourceIPs) == 0 {
+		sourceIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+
+	return FirewallRule{
+		Direction:   "in",
+		Protocol:    r.Protocol,
+		Port:        r.Port,
+		SourceIPs:   sourceIPs,
+		Description: description,
+	}
+}
+
+// isStatic reports whether a firewall rule was created from a static rule
+func isStatic(rule FirewallRule) bool {
+	return strings.HasPrefix(rule.Description, StaticDescriptionPrefix)
+}
+
+// ParseStaticRules parses a semicolon separated list of static rules in the
+// format port/protocol[@cidr,cidr...][=description], e.g.
+// "51820/udp=WireGuard;9100/tcp@10.0.0.0/8=node-exporter"
+func ParseStaticRules(spec string) ([]StaticRule, error) {
+	var rules []StaticRule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rule, err := parseStaticRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static firewall rule %q: %w", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseStaticRule parses a single static rule entry
+func parseStaticRule(entry string) (StaticRule, error) {
+	var rule StaticRule
+
+	if i := strings.Index(entry, "="); i >= 0 {
+		rule.Description = strings.TrimSpace(entry[i+1:])
+		entry = entry[:i]
+	}
+
+	if i := strings.Index(entry, "@"); i >= 0 {
+		for _, cidr := range strings.Split(entry[i+1:], ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return rule, fmt.Errorf("invalid source CIDR %q", cidr)
+			}
+			rule.SourceIPs = append(rule.SourceIPs, cidr)
+		}
+		entry = entry[:i]
+	}
+
+	port, protocol, ok := strings.Cut(strings.TrimSpace(entry), "/")
+	if !ok {
+		return rule, fmt.Errorf("expected port/protocol")
+	}
+
+	rule.Protocol = strings.ToLower(protocol)
+	if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+		return rule, fmt.Errorf("protocol must be tcp or udp")
+	}
+
+	if err := validatePortRange(port); err != nil {
+		return rule, err
+	}
+	rule.Port = port
+
+	return rule, nil
+}
+
+// validatePortRange checks a single port or a start-end port range
+func validatePortRange(port string) error {
+	start, end, isRange := strings.Cut(port, "-")
+	if !isRange {
+		end = start
+	}
+
+	startPort, err := strconv.Atoi(start)
+	if err != nil || startPort < 1 || startPort > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	endPort, err := strconv.Atoi(end)
+	if err != nil || endPort < startPort || endPort > 65535 {
+		return fmt.Errorf("invalid port range %q", port)
+	}
+	return nil
+}
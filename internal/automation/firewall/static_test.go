@@ -0,0 +1,31 @@
+package firewall
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStaticRules(t *testing.T) {
+	rules, err := ParseStaticRules(" 51820/udp=WireGuard; 9100/TCP@10.0.0.0/8, fd00::/8=node-exporter;;60000-61000/tcp ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StaticRule{
+		{Port: "51820", Protocol: "udp", Description: "WireGuard"},
+		{Port: "9100", Protocol: "tcp", SourceIPs: []string{"10.0.0.0/8", "fd00::/8"}, Description: "node-exporter"},
+		{Port: "60000-61000", Protocol: "tcp"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("unexpected rules:\n%+v\nwant:\n%+v", rules, want)
+	}
+
+	if rules, err := ParseStaticRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("expected no rules for an empty list, got %v %v", rules, err)
+	}
+
+	for _, spec := range []string{"51820", "51820/icmp", "0/tcp", "70000/tcp", "200-100/tcp", "80/tcp@10.0.0.0"} {
+		if _, err := ParseStaticRules(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
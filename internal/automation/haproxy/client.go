@@ -2,17 +2,25 @@ package haproxy
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
+// DefaultSocketTimeout bounds connecting to the Runtime API socket and each
+// command exchange
+const DefaultSocketTimeout = 5 * time.Second
+
 // Client manages HAProxy via Runtime API socket
 type Client struct {
 	socketPath string
 	mapFile    string
+	timeout    time.Duration
 }
 
 // NewClient creates a new HAProxy client
@@ -20,24 +28,89 @@ func NewClient(socketPath, mapFile string) *Client {
 	return &Client{
 		socketPath: socketPath,
 		mapFile:    mapFile,
+		timeout:    DefaultSocketTimeout,
+	}
+}
+
+// SetTimeout sets the timeout of socket commands (0 = DefaultSocketTimeout)
+func (c *Client) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultSocketTimeout
 	}
+	c.timeout = timeout
+}
+
+// Connection-level failures, e.g. while HAProxy reloads, are retried up to
+// socketRetries times, starting at socketRetryDelay and doubling
+const (
+	socketRetries    = 3
+	socketRetryDelay = 100 * time.Millisecond
+)
+
+// CommandError is an error response of the Runtime API to a command.
+// Repeating the command would yield the same answer, so it is never retried.
+type CommandError struct {
+	Command string
+	Message string
 }
 
-// runCommand executes a command via HAProxy socket
-func (c *Client) runCommand(command string) (string, error) {
-	conn, err := net.DialTimeout("unix", c.socketPath, 5*time.Second)
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("HAProxy rejected %q: %s", e.Command, e.Message)
+}
+
+// socketError is a failure to talk to the Runtime API socket. sent reports
+// whether the command may have reached HAProxy.
+type socketError struct {
+	err  error
+	sent bool
+}
+
+func (e *socketError) Error() string { return e.err.Error() }
+func (e *socketError) Unwrap() error { return e.err }
+
+// runCommand executes a command via HAProxy socket. Failures to connect are
+// retried with backoff; failures after the command was sent only for
+// read-only commands, since changes must not be applied twice. Canceling ctx
+// aborts the command and the retries.
+func (c *Client) runCommand(ctx context.Context, command string) (string, error) {
+	readOnly := strings.HasPrefix(command, "show ")
+	delay := socketRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		response, err := c.runCommandOnce(ctx, command)
+		var sockErr *socketError
+		if !errors.As(err, &sockErr) || attempt >= socketRetries || (sockErr.sent && !readOnly) || ctx.Err() != nil {
+			return response, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// runCommandOnce executes a command via HAProxy socket without retrying
+func (c *Client) runCommandOnce(ctx context.Context, command string) (string, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "unix", c.socketPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to connect to socket: %w", err)
+		return "", &socketError{err: fmt.Errorf("failed to connect to socket: %w", err)}
 	}
 	defer conn.Close()
 
-	// Set deadline
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Set deadline, and expire it early when ctx is canceled
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
 
 	// Send command
 	_, err = conn.Write([]byte(command + "\n"))
 	if err != nil {
-		return "", fmt.Errorf("failed to write command: %w", err)
+		return "", &socketError{err: fmt.Errorf("failed to write command: %w", contextError(ctx, err)), sent: true}
 	}
 
 	// Read response
@@ -49,110 +122,93 @@ func (c *Client) runCommand(command string) (string, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		return "", &socketError{err: fmt.Errorf("failed to read response: %w", contextError(ctx, err)), sent: true}
 	}
 
+	if err := commandError(command, response.String()); err != nil {
+		return "", err
+	}
 	return response.String(), nil
 }
 
-// GetCurrentMappings returns current domain to backend mappings from map file
-func (c *Client) GetCurrentMappings() (map[string]string, error) {
-	mappings := make(map[string]string)
+// contextError returns the context's error instead of the deadline error
+// caused by canceling ctx
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// commandError detects error responses. Commands changing state answer with
+// an empty response on success, so any output is an error message; output
+// of show commands is only an error for the generic error answers.
+func commandError(command, response string) error {
+	message := strings.TrimSpace(response)
+	if message == "" {
+		return nil
+	}
+	if strings.HasPrefix(command, "show ") &&
+		!strings.HasPrefix(message, "Unknown command") &&
+		!strings.HasPrefix(message, "Permission denied") {
+		return nil
+	}
+	return &CommandError{Command: command, Message: message}
+}
 
-	file, err := os.Open(c.mapFile)
+// BackendStatus returns the status of a backend (e.g. UP, DOWN) from the
+// Runtime API statistics
+func (c *Client) BackendStatus(ctx context.Context, backend string) (string, error) {
+	output, err := c.runCommand(ctx, "show stat")
 	if err != nil {
-		if os.IsNotExist(err) {
-			return mappings, nil // Empty map if file doesn't exist yet
-		}
-		return nil, fmt.Errorf("failed to open map file: %w", err)
+		return "", fmt.Errorf("failed to get stats: %w", err)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	// CSV header: # pxname,svname,...,status (18th column),...
+	for _, line := range strings.Split(output, "\n") {
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-
-		parts := strings.Fields(line)
-		if len(parts) >= 2 {
-			mappings[parts[0]] = parts[1]
+		fields := strings.Split(line, ",")
+		if len(fields) < 18 {
+			continue
+		}
+		if fields[0] == backend && fields[1] == "BACKEND" {
+			return fields[17], nil
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read map file: %w", err)
-	}
-
-	return mappings, nil
+	return "", fmt.Errorf("backend %s not found", backend)
 }
 
-// AddMapping adds a domain to backend mapping via Runtime API
-func (c *Client) AddMapping(domain, backend string) error {
-	// Add to runtime map (live, no reload!)
-	command := fmt.Sprintf("add map %s %s %s", c.mapFile, domain, backend)
-	_, err := c.runCommand(command)
-	if err != nil {
-		return fmt.Errorf("failed to add mapping via Runtime API: %w", err)
-	}
-
-	// Persist to file
-	file, err := os.OpenFile(c.mapFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// Validate checks if HAProxy socket is accessible
+func (c *Client) Validate() error {
+	conn, err := net.DialTimeout("unix", c.socketPath, 2*time.Second)
 	if err != nil {
-		return fmt.Errorf("failed to open map file for writing: %w", err)
-	}
-	defer file.Close()
-
-	if _, err := file.WriteString(fmt.Sprintf("%s %s\n", domain, backend)); err != nil {
-		return fmt.Errorf("failed to persist mapping: %w", err)
+		return fmt.Errorf("cannot connect to HAProxy socket: %w", err)
 	}
-
+	conn.Close()
 	return nil
 }
 
-// RemoveMapping removes a domain mapping via Runtime API
-func (c *Client) RemoveMapping(domain string) error {
-	// Remove from runtime map
-	command := fmt.Sprintf("del map %s %s", c.mapFile, domain)
-	_, err := c.runCommand(command)
+// ValidateMapDir checks that the map file directory exists and is writable
+func (c *Client) ValidateMapDir() error {
+	dir := filepath.Dir(c.mapFile)
+	info, err := os.Stat(dir)
 	if err != nil {
-		return fmt.Errorf("failed to remove mapping via Runtime API: %w", err)
+		return fmt.Errorf("map file directory %s not accessible: %w", dir, err)
 	}
-
-	// Remove from file
-	mappings, err := c.GetCurrentMappings()
-	if err != nil {
-		return err
+	if !info.IsDir() {
+		return fmt.Errorf("map file directory %s is not a directory", dir)
 	}
-	delete(mappings, domain)
 
-	// Rewrite file
-	file, err := os.OpenFile(c.mapFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	// Probe writability with a temporary file
+	probe, err := os.CreateTemp(dir, ".k8s-exposer-preflight-*")
 	if err != nil {
-		return fmt.Errorf("failed to open map file for writing: %w", err)
-	}
-	defer file.Close()
-
-	// Write header
-	file.WriteString("# HAProxy domain to backend mapping\n")
-	file.WriteString("# Format: domain backend_name\n")
-	file.WriteString("# Managed by k8s-exposer automation\n\n")
-
-	// Write mappings
-	for domain, backend := range mappings {
-		file.WriteString(fmt.Sprintf("%s %s\n", domain, backend))
+		return fmt.Errorf("map file directory %s not writable: %w", dir, err)
 	}
+	probe.Close()
+	os.Remove(probe.Name())
 
 	return nil
 }
-
-// Validate checks if HAProxy socket is accessible
-func (c *Client) Validate() error {
-	conn, err := net.DialTimeout("unix", c.socketPath, 2*time.Second)
-	if err != nil {
-		return fmt.Errorf("cannot connect to HAProxy socket: %w", err)
-	}
-	conn.Close()
-	return nil
-}
@@ -0,0 +1,113 @@
+package haproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunCommandRetriesUnavailableSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "haproxy.sock")
+	client := NewClient(socket, "/etc/haproxy/domains.map")
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.runCommand(context.Background(), "add map /etc/haproxy/domains.map web.example.com backend_8080")
+		result <- err
+	}()
+
+	// HAProxy comes back while the client is retrying, as after a reload
+	time.Sleep(socketRetryDelay / 2)
+	api := startRuntimeAPIAt(t, socket)
+
+	if err := <-result; err != nil {
+		t.Fatalf("expected the command to succeed after a retry, got %v", err)
+	}
+	if got := api.Commands(); len(got) != 1 {
+		t.Errorf("expected the command to be sent once, got %v", got)
+	}
+}
+
+func TestRunCommandErrorNotRetried(t *testing.T) {
+	api := startRuntimeAPI(t)
+	api.Respond("Unknown map identifier. Please use #<id> or <file>.\n")
+	client := NewClient(api.socket, "/etc/haproxy/domains.map")
+
+	_, err := client.runCommand(context.Background(), "del map /etc/haproxy/missing.map web.example.com")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected a CommandError, got %v", err)
+	}
+	if cmdErr.Message != "Unknown map identifier. Please use #<id> or <file>." {
+		t.Errorf("unexpected error message %q", cmdErr.Message)
+	}
+	if got := api.Commands(); len(got) != 1 {
+		t.Errorf("expected a single attempt, got %v", got)
+	}
+
+	// Output of show commands is their result, not an error
+	api.Respond("0x55d0 web.example.com backend_8080\n")
+	if _, err := client.runCommand(context.Background(), "show map /etc/haproxy/domains.map"); err != nil {
+		t.Errorf("show output treated as error: %v", err)
+	}
+}
+
+// startHangingSocket starts a Runtime API socket that accepts commands but
+// never answers
+func startHangingSocket(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "haproxy.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				<-done
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestRunCommandCanceled(t *testing.T) {
+	client := NewClient(startHangingSocket(t), "/etc/haproxy/domains.map")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := client.runCommand(ctx, "show stat")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultSocketTimeout/2 {
+		t.Errorf("canceled command took %s", elapsed)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	client := NewClient(startHangingSocket(t), "/etc/haproxy/domains.map")
+	client.SetTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := client.runCommand(context.Background(), "del map /etc/haproxy/domains.map web.example.com"); err == nil {
+		t.Fatal("expected an unanswered command to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("command took %s despite a 50ms timeout", elapsed)
+	}
+}
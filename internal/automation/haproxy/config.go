@@ -2,7 +2,12 @@ package haproxy
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
 	"text/template"
 )
 
@@ -49,34 +54,41 @@ defaults
     errorfile 503 /etc/haproxy/errors/503.http
     errorfile 504 /etc/haproxy/errors/504.http
 
-# Stats page
+{{if .Stats.Port}}# Stats page
 frontend stats
-    bind *:8404
+    bind *:{{.Stats.Port}}
     stats enable
     stats uri /stats
     stats refresh 10s
-    stats admin if TRUE
-
+    {{if .Stats.User}}stats auth {{.Stats.User}}:{{.Stats.Password}}
+    {{end}}stats admin if TRUE
+{{end}}
 # HTTP Frontend
 frontend http_front
     bind *:80
-    
+    {{if .ACMEBackend}}
     # ACME challenge exception (for Let's Encrypt)
     acl is_acme_challenge path_beg /.well-known/acme-challenge/
     use_backend backend_acme if is_acme_challenge
-    
+    {{end}}{{if .PlainHTTPHosts}}
+    # Hosts served over plain HTTP without redirect
+    acl plain_http_host req.hdr(host),lower,field(1,:) -m str{{range .PlainHTTPHosts}} {{.}}{{end}}
+    {{end}}{{if and .DefaultBackend .DefaultBackend.AllowHTTP}}
+    # Unmapped hosts reach the catch-all service over plain HTTP
+    acl mapped_host req.hdr(host),lower,map({{.MapFile}}) -m found
+    {{end}}
     # Redirect to HTTPS
-    http-request redirect scheme https code 301 if !is_acme_challenge
+    http-request redirect scheme https code 301{{if .RedirectCondition}} if {{.RedirectCondition}}{{end}}
     
     # Use domain map for dynamic routing (fallback)
     use_backend %[req.hdr(host),lower,map({{.MapFile}},backend_default)]
 
-# ACME challenge backend
+{{if .ACMEBackend}}# ACME challenge backend
 backend backend_acme
     mode http
-    server acme localhost:8888
+    server acme {{.ACMEBackend}}
 
-# HTTPS Frontend{{if .HasSSL}}
+{{end}}# HTTPS Frontend{{if .HasSSL}}
 frontend https_front
     bind *:443 ssl crt /etc/ssl/private/ alpn h2,http/1.1
     mode http
@@ -85,11 +97,18 @@ frontend https_front
     use_backend %[ssl_fc_sni,lower,map({{.MapFile}},backend_default)]
 {{end}}
 
-# Default backend (404)
+{{if .DefaultBackend}}# Default backend (catch-all for {{.DefaultBackend.Name}}, port {{.DefaultBackend.Port}})
+backend backend_default
+    mode http
+    {{if .DefaultBackend.Maintenance}}http-request return status 503 content-type text/html {{$.MaintenanceSource}} if { nbsrv(backend_default) eq 0 }
+    {{end}}{{if .DefaultBackend.HealthCheckPath}}option httpchk GET {{.DefaultBackend.HealthCheckPath}}
+    {{if .DefaultBackend.HealthCheckStatus}}http-check expect status {{.DefaultBackend.HealthCheckStatus}}
+    {{end}}{{end}}server {{.DefaultBackend.Name}} {{.DefaultBackend.Address}}{{if .DefaultBackend.HealthCheckPath}} check{{end}}{{if .DefaultBackend.MaxConn}} maxconn {{.DefaultBackend.MaxConn}}{{end}}
+{{else}}# Default backend (404)
 backend backend_default
     mode http
     http-request return status 404 content-type text/html string "<html><body><h1>404 Not Found</h1><p>Service not configured</p></body></html>"
-
+{{end}}
 {{range .Backends}}
 # Backend for {{.Name}} (port {{.Port}})
 backend backend_{{.Port}}
@@ -99,71 +118,281 @@ backend backend_{{.Port}}
     acl too_many_uploads src_conn_cur gt 3
     http-request deny deny_status 429 if too_many_uploads
     {{end}}
-    server {{.Name}} 127.0.0.1:{{.Port}}
+    {{if .Maintenance}}http-request return status 503 content-type text/html {{$.MaintenanceSource}} if { nbsrv(backend_{{.Port}}) eq 0 }
+    {{end}}{{if .HealthCheckPath}}option httpchk GET {{.HealthCheckPath}}
+    {{if .HealthCheckStatus}}http-check expect status {{.HealthCheckStatus}}
+    {{end}}{{end}}server {{.Name}} {{.Address}}{{if .HealthCheckPath}} check{{end}}{{if .MaxConn}} maxconn {{.MaxConn}}{{end}}
 {{end}}
 `
 
 // BackendConfig represents a HAProxy backend configuration
 type BackendConfig struct {
-	Name string
-	Port int
+	Name              string
+	Port              int
+	Domain            string   // Domain routed to the backend (empty for the default backend)
+	Aliases           []string // Additional domains routed to the backend
+	TLS               bool     // The service requires a certificate for its domain
+	AllowHTTP         bool     // Serve plain HTTP instead of redirecting to HTTPS
+	HealthCheckPath   string   // Enables an active HTTP check when set
+	HealthCheckStatus int      // Expected status (0 = HAProxy default)
+	MaxConn           int      // Per-server connection limit (0 = unlimited)
+	Maintenance       bool     // Serve the maintenance page while no server is up
+	Host              string   // Host of the k8s-exposer listener (empty = the generator's backend host)
+}
+
+// Address returns the host:port HAProxy forwards the backend's traffic to
+func (b BackendConfig) Address() string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+// Domains returns the domain and aliases routed to the backend
+func (b BackendConfig) Domains() []string {
+	if b.Domain == "" {
+		return b.Aliases
+	}
+	return append([]string{b.Domain}, b.Aliases...)
+}
+
+// defaultMaintenancePage is served by maintenance-enabled backends when no
+// maintenance page file is configured
+const defaultMaintenancePage = `string "<html><body><h1>Down for maintenance</h1><p>This service is temporarily unavailable, please try again later.</p></body></html>"`
+
+// StatsConfig configures the HAProxy stats frontend. Without credentials
+// the stats page, including its admin actions, is reachable by anyone who
+// can connect to the port.
+type StatsConfig struct {
+	Port     int    // 0 disables the stats frontend
+	User     string // Enables basic auth when set
+	Password string
+}
+
+// Validate checks that the stats settings can be rendered safely
+func (s StatsConfig) Validate() error {
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid stats port %d", s.Port)
+	}
+	if s.User == "" {
+		if s.Password != "" {
+			return fmt.Errorf("stats password set without a user")
+		}
+		return nil
+	}
+	if s.Password == "" {
+		return fmt.Errorf("stats user set without a password")
+	}
+	if strings.ContainsAny(s.User, ": \t\n") || strings.ContainsAny(s.Password, " \t\n") {
+		return fmt.Errorf("stats credentials must not contain whitespace or a colon in the user")
+	}
+	return nil
 }
 
+// DefaultACMEBackend is the default address of the ACME challenge responder
+const DefaultACMEBackend = "localhost:8888"
+
+// DefaultBackendHost is the default host of the k8s-exposer listeners
+// HAProxy forwards to, i.e. HAProxy and the server share a host
+const DefaultBackendHost = "127.0.0.1"
+
 // ConfigGenerator generates HAProxy configuration
 type ConfigGenerator struct {
-	mapFile string
+	mapFile         string
+	stats           StatsConfig
+	maintenancePage string // HTML file served by maintenance-enabled backends (empty = built-in page)
+	acmeBackend     string // ACME challenge responder (empty disables the ACME exception)
+	backendHost     string // Host of the k8s-exposer listeners
 }
 
 // NewConfigGenerator creates a new config generator
-func NewConfigGenerator(mapFile string) *ConfigGenerator {
+func NewConfigGenerator(mapFile string, stats StatsConfig) *ConfigGenerator {
 	return &ConfigGenerator{
-		mapFile: mapFile,
+		mapFile:     mapFile,
+		stats:       stats,
+		acmeBackend: DefaultACMEBackend,
+		backendHost: DefaultBackendHost,
+	}
+}
+
+// SetBackendHost sets the host of the k8s-exposer listeners that backends
+// forward to, for HAProxy running on another node than the server. An empty
+// host selects DefaultBackendHost.
+func (g *ConfigGenerator) SetBackendHost(host string) {
+	if host == "" {
+		host = DefaultBackendHost
+	}
+	g.backendHost = host
+}
+
+// ValidateBackendHost checks that the backend host is an IP address or host name
+func (g *ConfigGenerator) ValidateBackendHost() error {
+	if net.ParseIP(g.backendHost) != nil || validHostname.MatchString(g.backendHost) {
+		return nil
+	}
+	return fmt.Errorf("invalid backend host %q, expected an IP address or host name", g.backendHost)
+}
+
+// validHostname matches DNS host names, including single-label ones
+var validHostname = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// SetACMEBackend sets the host:port ACME HTTP-01 challenge requests are
+// routed to, exempt from the HTTPS redirect. An empty address disables the
+// ACME exception.
+func (g *ConfigGenerator) SetACMEBackend(address string) {
+	g.acmeBackend = address
+}
+
+// ValidateACMEBackend checks that the ACME backend is a host:port address
+func (g *ConfigGenerator) ValidateACMEBackend() error {
+	if g.acmeBackend == "" {
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(g.acmeBackend); err != nil || port == "" || strings.ContainsAny(g.acmeBackend, " \t\n") {
+		return fmt.Errorf("invalid ACME backend %q, expected host:port", g.acmeBackend)
+	}
+	return nil
+}
+
+// SetMaintenancePage sets the HTML file served by backends with the
+// maintenance page enabled while none of their servers is up. HAProxy reads
+// the file when loading the config, an empty path selects a built-in page.
+func (g *ConfigGenerator) SetMaintenancePage(path string) {
+	g.maintenancePage = path
+}
+
+// ValidateMaintenancePage checks that the maintenance page file is readable
+// and can be referenced from the config
+func (g *ConfigGenerator) ValidateMaintenancePage() error {
+	if g.maintenancePage == "" {
+		return nil
+	}
+	if strings.ContainsAny(g.maintenancePage, " \t\n\"") {
+		return fmt.Errorf("maintenance page path %q must not contain whitespace or quotes", g.maintenancePage)
+	}
+	if _, err := os.ReadFile(g.maintenancePage); err != nil {
+		return fmt.Errorf("failed to read maintenance page: %w", err)
+	}
+	return nil
+}
+
+// maintenanceSource returns the content source of the maintenance page for
+// an http-request return directive
+func (g *ConfigGenerator) maintenanceSource() string {
+	if g.maintenancePage == "" {
+		return defaultMaintenancePage
+	}
+	return "file " + g.maintenancePage
+}
+
+// Generate renders the HAProxy configuration with backends and writes it to
+// outputPath. A non-nil defaultBackend replaces the 404 default backend as
+// catch-all.
+func (g *ConfigGenerator) Generate(backends []BackendConfig, defaultBackend *BackendConfig, outputPath string) error {
+	config, err := g.Render(backends, defaultBackend)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(outputPath, []byte(config), 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
 	}
+	return nil
 }
 
-// Generate generates HAProxy configuration with backends
-func (g *ConfigGenerator) Generate(backends []BackendConfig, outputPath string) error {
+// Render returns the HAProxy configuration Generate would write for backends
+// and defaultBackend, without touching the config file
+func (g *ConfigGenerator) Render(backends []BackendConfig, defaultBackend *BackendConfig) (string, error) {
+	if err := g.stats.Validate(); err != nil {
+		return "", err
+	}
+	if err := g.ValidateMaintenancePage(); err != nil {
+		return "", err
+	}
+	if err := g.ValidateACMEBackend(); err != nil {
+		return "", err
+	}
+	if err := g.ValidateBackendHost(); err != nil {
+		return "", err
+	}
+
+	// Backends without a host of their own forward to the backend host
+	backends = append([]BackendConfig(nil), backends...)
+	for i := range backends {
+		if backends[i].Host == "" {
+			backends[i].Host = g.backendHost
+		}
+	}
+	if defaultBackend != nil && defaultBackend.Host == "" {
+		backend := *defaultBackend
+		backend.Host = g.backendHost
+		defaultBackend = &backend
+	}
+
 	tmpl, err := template.New("haproxy").Parse(configTemplate)
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %w", err)
-	}
-
-	// Check if SSL certificates exist
-	hasSSL := false
-	if _, err := os.Stat("/etc/ssl/private"); err == nil {
-		// Check if there's at least one .pem file
-		entries, err := os.ReadDir("/etc/ssl/private")
-		if err == nil {
-			for _, entry := range entries {
-				if !entry.IsDir() && len(entry.Name()) > 4 && entry.Name()[len(entry.Name())-4:] == ".pem" {
-					hasSSL = true
-					break
-				}
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	// Only enable the HTTPS frontend when a certificate covers a routed domain
+	certs := LoadCertificates(CertDir)
+	hasSSL := defaultBackend != nil && len(certs) > 0
+	for _, backend := range backends {
+		for _, domain := range backend.Domains() {
+			if certs.Covers(domain) {
+				hasSSL = true
 			}
 		}
 	}
 
-	data := struct {
-		MapFile  string
-		Backends []BackendConfig
-		HasSSL   bool
-	}{
-		MapFile:  g.mapFile,
-		Backends: backends,
-		HasSSL:   hasSSL,
+	// Domains excepted from the HTTPS redirect
+	var plainHTTPHosts []string
+	for _, backend := range backends {
+		if !backend.AllowHTTP {
+			continue
+		}
+		for _, domain := range backend.Domains() {
+			plainHTTPHosts = append(plainHTTPHosts, strings.ToLower(domain))
+		}
 	}
 
-	file, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create config file: %w", err)
+	// Requests excepted from the HTTPS redirect
+	var redirectConditions []string
+	if g.acmeBackend != "" {
+		redirectConditions = append(redirectConditions, "!is_acme_challenge")
+	}
+	if len(plainHTTPHosts) > 0 {
+		redirectConditions = append(redirectConditions, "!plain_http_host")
+	}
+	if defaultBackend != nil && defaultBackend.AllowHTTP {
+		redirectConditions = append(redirectConditions, "mapped_host")
 	}
-	defer file.Close()
 
-	if err := tmpl.Execute(file, data); err != nil {
-		return fmt.Errorf("failed to execute template: %w", err)
+	data := struct {
+		MapFile           string
+		Backends          []BackendConfig
+		DefaultBackend    *BackendConfig
+		HasSSL            bool
+		PlainHTTPHosts    []string
+		Stats             StatsConfig
+		MaintenanceSource string
+		ACMEBackend       string
+		RedirectCondition string
+	}{
+		MapFile:           g.mapFile,
+		Backends:          backends,
+		DefaultBackend:    defaultBackend,
+		HasSSL:            hasSSL,
+		PlainHTTPHosts:    plainHTTPHosts,
+		Stats:             g.stats,
+		MaintenanceSource: g.maintenanceSource(),
+		ACMEBackend:       g.acmeBackend,
+		RedirectCondition: strings.Join(redirectConditions, " "),
 	}
 
-	return nil
+	var config strings.Builder
+	if err := tmpl.Execute(&config, data); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	return config.String(), nil
 }
 
 // ValidateConfig validates HAProxy configuration file
@@ -175,3 +404,16 @@ func (g *ConfigGenerator) ValidateConfig(configPath string) error {
 	}
 	return nil
 }
+
+// ValidateStats checks the stats frontend settings
+func (g *ConfigGenerator) ValidateStats() error {
+	return g.stats.Validate()
+}
+
+// ValidateBinary checks that the haproxy binary is available in PATH
+func (g *ConfigGenerator) ValidateBinary() error {
+	if _, err := exec.LookPath("haproxy"); err != nil {
+		return fmt.Errorf("haproxy binary not found: %w", err)
+	}
+	return nil
+}
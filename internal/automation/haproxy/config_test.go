@@ -0,0 +1,356 @@
+package haproxy
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// update rewrites the golden files with the current output
+var update = flag.Bool("update", false, "update golden files")
+
+// render generates the config for backends with g, by default a generator
+// using the map file /etc/haproxy/domains.map
+func render(t *testing.T, g *ConfigGenerator, backends []BackendConfig, defaultBackend *BackendConfig) string {
+	t.Helper()
+	if g == nil {
+		g = NewConfigGenerator("/etc/haproxy/domains.map", StatsConfig{})
+	}
+	path := filepath.Join(t.TempDir(), "haproxy.cfg")
+	if err := g.Generate(backends, defaultBackend, path); err != nil {
+		t.Fatal(err)
+	}
+	config, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(config)
+}
+
+func TestGenerateDefaultBackend(t *testing.T) {
+	web := BackendConfig{Name: "web", Port: 8080}
+
+	// Without a wildcard service unmatched hosts get a 404
+	config := render(t, nil, []BackendConfig{web}, nil)
+	if !strings.Contains(config, "# Default backend (404)\nbackend backend_default") {
+		t.Errorf("expected the 404 default backend:\n%s", config)
+	}
+
+	config = render(t, nil, []BackendConfig{web}, &BackendConfig{Name: "landing", Port: 30080})
+	for _, want := range []string{
+		"# Default backend (catch-all for landing, port 30080)\nbackend backend_default\n    mode http\n    server landing 127.0.0.1:30080\n",
+		// Mapped hosts are looked up first and only fall back to the catch-all
+		"use_backend %[req.hdr(host),lower,map(/etc/haproxy/domains.map,backend_default)]",
+		"backend backend_8080\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+	if strings.Contains(config, "404 Not Found") {
+		t.Error("the catch-all config still serves the 404 page")
+	}
+}
+
+func TestGenerateHealthCheck(t *testing.T) {
+	plain := BackendConfig{Name: "web", Port: 8080}
+	checked := BackendConfig{Name: "api", Port: 8081, HealthCheckPath: "/healthz", HealthCheckStatus: 200}
+	pathOnly := BackendConfig{Name: "docs", Port: 8082, HealthCheckPath: "/ready"}
+	config := render(t, nil, []BackendConfig{plain, checked, pathOnly}, nil)
+
+	for _, want := range []string{
+		// Without a health check the server is not checked
+		"    server web 127.0.0.1:8080\n",
+		"    option httpchk GET /healthz\n    http-check expect status 200\n    server api 127.0.0.1:8081 check\n",
+		// Without an expected status HAProxy's default applies
+		"    option httpchk GET /ready\n    server docs 127.0.0.1:8082 check\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+	if strings.Count(config, "option httpchk") != 2 {
+		t.Errorf("expected exactly two checked backends:\n%s", config)
+	}
+
+	// The catch-all backend is checked the same way
+	config = render(t, nil, nil, &BackendConfig{Name: "landing", Port: 30080, HealthCheckPath: "/", HealthCheckStatus: 204})
+	if want := "backend backend_default\n    mode http\n    option httpchk GET /\n    http-check expect status 204\n    server landing 127.0.0.1:30080 check\n"; !strings.Contains(config, want) {
+		t.Errorf("config lacks %q:\n%s", want, config)
+	}
+}
+
+func TestGenerateMaxConn(t *testing.T) {
+	config := render(t, nil, []BackendConfig{
+		{Name: "web", Port: 8080},
+		{Name: "api", Port: 8081, MaxConn: 50},
+		{Name: "docs", Port: 8082, MaxConn: 20, HealthCheckPath: "/healthz"},
+	}, &BackendConfig{Name: "landing", Port: 30080, MaxConn: 10})
+
+	for _, want := range []string{
+		"    server web 127.0.0.1:8080\n",
+		"    server api 127.0.0.1:8081 maxconn 50\n",
+		"    server docs 127.0.0.1:8082 check maxconn 20\n",
+		"    server landing 127.0.0.1:30080 maxconn 10\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+	// The process-wide limit is unchanged
+	if !strings.Contains(config, "maxconn 10000") {
+		t.Errorf("global maxconn missing:\n%s", config)
+	}
+}
+
+func TestGenerateStats(t *testing.T) {
+	// A zero port disables the stats frontend
+	if config := render(t, nil, nil, nil); strings.Contains(config, "frontend stats") {
+		t.Errorf("expected no stats frontend:\n%s", config)
+	}
+
+	open := render(t, NewConfigGenerator("/etc/haproxy/domains.map", StatsConfig{Port: 9000}), nil, nil)
+	if !strings.Contains(open, "frontend stats\n    bind *:9000\n") || strings.Contains(open, "stats auth") {
+		t.Errorf("expected an unauthenticated stats frontend on 9000:\n%s", open)
+	}
+
+	auth := render(t, NewConfigGenerator("/etc/haproxy/domains.map", StatsConfig{Port: 8404, User: "admin", Password: "s3cret"}), nil, nil)
+	if !strings.Contains(auth, "    stats auth admin:s3cret\n    stats admin if TRUE\n") {
+		t.Errorf("expected basic auth on the stats frontend:\n%s", auth)
+	}
+}
+
+func TestStatsConfigValidate(t *testing.T) {
+	for _, invalid := range []StatsConfig{
+		{Port: 70000},
+		{Port: 8404, User: "admin"},
+		{Port: 8404, Password: "s3cret"},
+		{Port: 8404, User: "ad:min", Password: "s3cret"},
+		{Port: 8404, User: "admin", Password: "s3 cret"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+		g := NewConfigGenerator("/etc/haproxy/domains.map", invalid)
+		if err := g.Generate(nil, nil, filepath.Join(t.TempDir(), "haproxy.cfg")); err == nil {
+			t.Errorf("expected Generate to reject %+v", invalid)
+		}
+	}
+}
+
+func TestGenerateForceHTTPS(t *testing.T) {
+	web := BackendConfig{Name: "web", Port: 8080, Domain: "web.example.com"}
+	hook := BackendConfig{Name: "hook", Port: 8081, Domain: "Hook.example.com", AllowHTTP: true}
+
+	// Without exceptions every non-ACME request is redirected
+	config := render(t, nil, []BackendConfig{web}, nil)
+	if !strings.Contains(config, "http-request redirect scheme https code 301 if !is_acme_challenge\n") {
+		t.Errorf("expected an unconditional redirect:\n%s", config)
+	}
+	if strings.Contains(config, "plain_http_host") {
+		t.Errorf("unexpected plain HTTP exception:\n%s", config)
+	}
+
+	// Only the flagged host is excepted
+	config = render(t, nil, []BackendConfig{web, hook}, nil)
+	for _, want := range []string{
+		"acl plain_http_host req.hdr(host),lower,field(1,:) -m str hook.example.com\n",
+		"http-request redirect scheme https code 301 if !is_acme_challenge !plain_http_host\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+	if strings.Contains(config, "web.example.com") {
+		t.Errorf("redirected host listed in the exception:\n%s", config)
+	}
+
+	// A plain HTTP catch-all only redirects mapped hosts
+	config = render(t, nil, []BackendConfig{web}, &BackendConfig{Name: "landing", Port: 30080, AllowHTTP: true})
+	for _, want := range []string{
+		"acl mapped_host req.hdr(host),lower,map(/etc/haproxy/domains.map) -m found\n",
+		"http-request redirect scheme https code 301 if !is_acme_challenge mapped_host\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+}
+
+func TestGenerateMaintenancePage(t *testing.T) {
+	web := BackendConfig{Name: "web", Port: 8080, HealthCheckPath: "/healthz"}
+	shop := BackendConfig{Name: "shop", Port: 8081, HealthCheckPath: "/healthz", Maintenance: true}
+
+	// Only flagged backends serve the page while none of their servers is up
+	config := render(t, nil, []BackendConfig{web, shop}, nil)
+	want := "backend backend_8081\n    mode http\n    \n    http-request return status 503 content-type text/html " + defaultMaintenancePage + " if { nbsrv(backend_8081) eq 0 }\n    option httpchk GET /healthz\n"
+	if !strings.Contains(config, want) {
+		t.Errorf("config lacks the maintenance directive %q:\n%s", want, config)
+	}
+	if strings.Contains(config, "nbsrv(backend_8080)") {
+		t.Errorf("unflagged backend serves the maintenance page:\n%s", config)
+	}
+
+	// The catch-all service can serve it as well
+	config = render(t, nil, nil, &BackendConfig{Name: "landing", Port: 30080, HealthCheckPath: "/", Maintenance: true})
+	if !strings.Contains(config, "if { nbsrv(backend_default) eq 0 }") {
+		t.Errorf("catch-all lacks the maintenance directive:\n%s", config)
+	}
+
+	// A configured page is read by HAProxy from its file
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(page, []byte("<h1>Back soon</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g := NewConfigGenerator("/etc/haproxy/domains.map", StatsConfig{})
+	g.SetMaintenancePage(page)
+	config = render(t, g, []BackendConfig{shop}, nil)
+	if !strings.Contains(config, "content-type text/html file "+page+" if { nbsrv(backend_8081) eq 0 }") {
+		t.Errorf("config does not serve the configured page:\n%s", config)
+	}
+
+	// Missing files and paths HAProxy cannot parse are rejected
+	for _, path := range []string{filepath.Join(t.TempDir(), "missing.html"), "/etc/haproxy/down time.html"} {
+		g.SetMaintenancePage(path)
+		if err := g.ValidateMaintenancePage(); err == nil {
+			t.Errorf("expected maintenance page %q to be rejected", path)
+		}
+	}
+}
+
+func TestGenerateACMEBackend(t *testing.T) {
+	web := BackendConfig{Name: "web", Port: 8080}
+
+	// By default challenges go to the local responder on 8888
+	config := render(t, nil, []BackendConfig{web}, nil)
+	for _, want := range []string{
+		"use_backend backend_acme if is_acme_challenge\n",
+		"backend backend_acme\n    mode http\n    server acme localhost:8888\n",
+		"http-request redirect scheme https code 301 if !is_acme_challenge\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+
+	g := NewConfigGenerator("/etc/haproxy/domains.map", StatsConfig{})
+	g.SetACMEBackend("10.0.0.5:8402")
+	config = render(t, g, []BackendConfig{web}, nil)
+	if !strings.Contains(config, "    server acme 10.0.0.5:8402\n") || strings.Contains(config, "localhost:8888") {
+		t.Errorf("config does not use the custom ACME backend:\n%s", config)
+	}
+
+	// Disabled, challenges are redirected like every other request
+	g.SetACMEBackend("")
+	config = render(t, g, []BackendConfig{web}, nil)
+	if strings.Contains(config, "acme") {
+		t.Errorf("disabled ACME exception still configured:\n%s", config)
+	}
+	if !strings.Contains(config, "http-request redirect scheme https code 301\n") {
+		t.Errorf("expected an unconditional redirect:\n%s", config)
+	}
+	config = render(t, g, []BackendConfig{web, {Name: "hook", Port: 8081, Domain: "hook.example.com", AllowHTTP: true}}, nil)
+	if !strings.Contains(config, "http-request redirect scheme https code 301 if !plain_http_host\n") {
+		t.Errorf("expected only the plain HTTP exception:\n%s", config)
+	}
+
+	for _, address := range []string{"localhost", "localhost:", "local host:80"} {
+		g.SetACMEBackend(address)
+		if err := g.ValidateACMEBackend(); err == nil {
+			t.Errorf("expected ACME backend %q to be rejected", address)
+		}
+	}
+}
+
+func TestGenerateBackendHost(t *testing.T) {
+	web := BackendConfig{Name: "web", Port: 8080}
+	fallback := &BackendConfig{Name: "fallback", Port: 8090}
+
+	// By default HAProxy forwards to the listeners on its own host
+	config := render(t, nil, []BackendConfig{web}, fallback)
+	for _, want := range []string{"    server web 127.0.0.1:8080\n", "    server fallback 127.0.0.1:8090\n"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+
+	g := NewConfigGenerator("/etc/haproxy/domains.map", StatsConfig{})
+	g.SetBackendHost("10.0.0.7")
+	config = render(t, g, []BackendConfig{web}, fallback)
+	for _, want := range []string{"    server web 10.0.0.7:8080\n", "    server fallback 10.0.0.7:8090\n"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+	if strings.Contains(config, "127.0.0.1") {
+		t.Errorf("config still forwards to 127.0.0.1:\n%s", config)
+	}
+
+	// IPv6 hosts are bracketed, host names kept as they are
+	g.SetBackendHost("fd00::7")
+	if config = render(t, g, []BackendConfig{web}, nil); !strings.Contains(config, "    server web [fd00::7]:8080\n") {
+		t.Errorf("config lacks the bracketed IPv6 host:\n%s", config)
+	}
+	g.SetBackendHost("exposer.internal")
+	if config = render(t, g, []BackendConfig{web}, nil); !strings.Contains(config, "    server web exposer.internal:8080\n") {
+		t.Errorf("config lacks the backend host name:\n%s", config)
+	}
+
+	// A backend's own host takes precedence
+	config = render(t, g, []BackendConfig{{Name: "db", Port: 5432, Host: "10.0.0.9"}}, nil)
+	if !strings.Contains(config, "    server db 10.0.0.9:5432\n") {
+		t.Errorf("config ignores the backend's host:\n%s", config)
+	}
+
+	// Empty restores the default
+	g.SetBackendHost("")
+	if config = render(t, g, []BackendConfig{web}, nil); !strings.Contains(config, "    server web 127.0.0.1:8080\n") {
+		t.Errorf("config does not use the default host:\n%s", config)
+	}
+
+	for _, host := range []string{"10.0.0.7:80", "exposer internal", "-exposer"} {
+		g.SetBackendHost(host)
+		if err := g.ValidateBackendHost(); err == nil {
+			t.Errorf("expected backend host %q to be rejected", host)
+		}
+		if err := g.Generate([]BackendConfig{web}, nil, filepath.Join(t.TempDir(), "haproxy.cfg")); err == nil {
+			t.Errorf("expected Generate to reject backend host %q", host)
+		}
+	}
+}
+
+func TestRenderGolden(t *testing.T) {
+	g := NewConfigGenerator("/etc/haproxy/domains.map", StatsConfig{Port: 8404, User: "admin", Password: "secret"})
+	g.SetBackendHost("10.0.0.7")
+	backends := []BackendConfig{
+		{Name: "web", Port: 30001, Domain: "web.example.invalid", Aliases: []string{"www.example.invalid"}, HealthCheckPath: "/healthz", HealthCheckStatus: 204},
+		{Name: "hook", Port: 30002, Domain: "hook.example.invalid", AllowHTTP: true, MaxConn: 50},
+		{Name: "shop", Port: 30003, Domain: "shop.example.invalid", Maintenance: true},
+	}
+
+	config, err := g.Render(backends, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "render.golden")
+	if *update {
+		if err := os.WriteFile(golden, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != string(want) {
+		t.Errorf("rendered config differs from %s (run with -update to accept):\n%s", golden, config)
+	}
+
+	// Generate writes exactly what Render returns
+	if written := render(t, g, backends, nil); written != config {
+		t.Errorf("Generate wrote a different config than Render returned:\n%s", written)
+	}
+}
@@ -0,0 +1,239 @@
+package haproxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// validDomain matches the host names allowed in the domain map: lowercase DNS
+// labels separated by dots, as HAProxy lowercases the Host header and SNI
+// before the lookup
+var validDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// validBackend matches HAProxy backend names
+var validBackend = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// ValidateDomain checks that domain is a fully qualified DNS name, so it can
+// neither add fields or lines to the map file nor arguments to Runtime API
+// commands
+func ValidateDomain(domain string) error {
+	if len(domain) > 253 || !validDomain.MatchString(domain) {
+		return fmt.Errorf("invalid domain %q: only lowercase DNS names are allowed in the domain map", domain)
+	}
+	return nil
+}
+
+// validateMapping checks a domain map entry before it is written
+func validateMapping(domain, backend string) error {
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+	if !validBackend.MatchString(backend) {
+		return fmt.Errorf("invalid backend name %q", backend)
+	}
+	return nil
+}
+
+// mapLine is a line of the map file, either a domain mapping or a comment or
+// blank line kept verbatim
+type mapLine struct {
+	domain  string // Empty for comments and blank lines
+	backend string
+	raw     string
+}
+
+// MapManager serializes all changes of the domain map. It applies them via
+// the Runtime API and keeps an in-memory copy that is written to the map
+// file as a whole, so concurrent reconciles can never interleave writes.
+type MapManager struct {
+	client  *Client
+	mapFile string
+
+	mu     sync.Mutex
+	lines  []mapLine
+	loaded bool
+}
+
+// NewMapManager creates a map manager for the client's map file
+func NewMapManager(client *Client) *MapManager {
+	return &MapManager{
+		client:  client,
+		mapFile: client.mapFile,
+	}
+}
+
+// Mappings returns the current domain to backend mappings
+func (m *MapManager) Mappings() (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.loadLocked(); err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[string]string)
+	for _, line := range m.lines {
+		if line.domain != "" {
+			mappings[line.domain] = line.backend
+		}
+	}
+	return mappings, nil
+}
+
+// Set maps a domain to a backend, replacing an existing mapping in place
+func (m *MapManager) Set(ctx context.Context, domain, backend string) error {
+	if err := validateMapping(domain, backend); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.loadLocked(); err != nil {
+		return err
+	}
+
+	i := m.indexLocked(domain)
+	if i >= 0 && m.lines[i].backend == backend {
+		return nil
+	}
+
+	// Apply to the runtime map first (live, no reload!)
+	command := fmt.Sprintf("add map %s %s %s", m.mapFile, domain, backend)
+	if i >= 0 {
+		command = fmt.Sprintf("set map %s %s %s", m.mapFile, domain, backend)
+	}
+	if _, err := m.client.runCommand(ctx, command); err != nil {
+		return fmt.Errorf("failed to set mapping via Runtime API: %w", err)
+	}
+
+	line := mapLine{domain: domain, backend: backend, raw: fmt.Sprintf("%s %s", domain, backend)}
+	if i >= 0 {
+		m.lines[i] = line
+	} else {
+		m.lines = append(m.lines, line)
+	}
+
+	return m.writeLocked()
+}
+
+// Remove removes a domain mapping, keeping the order of other entries and comments
+func (m *MapManager) Remove(ctx context.Context, domain string) error {
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.loadLocked(); err != nil {
+		return err
+	}
+
+	i := m.indexLocked(domain)
+	if i < 0 {
+		return nil
+	}
+
+	command := fmt.Sprintf("del map %s %s", m.mapFile, domain)
+	if _, err := m.client.runCommand(ctx, command); err != nil {
+		return fmt.Errorf("failed to remove mapping via Runtime API: %w", err)
+	}
+
+	m.lines = append(m.lines[:i], m.lines[i+1:]...)
+	return m.writeLocked()
+}
+
+// indexLocked returns the line index of a domain, -1 if it is not mapped
+// (must be called with lock held)
+func (m *MapManager) indexLocked(domain string) int {
+	for i, line := range m.lines {
+		if line.domain == domain {
+			return i
+		}
+	}
+	return -1
+}
+
+// loadLocked reads the map file once, later changes are only made through
+// the manager (must be called with lock held)
+func (m *MapManager) loadLocked() error {
+	if m.loaded {
+		return nil
+	}
+
+	data, err := os.ReadFile(m.mapFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read map file: %w", err)
+	}
+
+	var lines []mapLine
+	seen := make(map[string]bool)
+	content := strings.TrimSuffix(string(data), "\n")
+	for _, raw := range strings.Split(content, "\n") {
+		if content == "" {
+			break
+		}
+		trimmed := strings.TrimSpace(raw)
+		fields := strings.Fields(trimmed)
+		if len(fields) < 2 || strings.HasPrefix(trimmed, "#") {
+			lines = append(lines, mapLine{raw: raw})
+			continue
+		}
+		// Drop duplicates left behind by older appending writers, the last one wins
+		if seen[fields[0]] {
+			for i := range lines {
+				if lines[i].domain == fields[0] {
+					lines = append(lines[:i], lines[i+1:]...)
+					break
+				}
+			}
+		}
+		seen[fields[0]] = true
+		lines = append(lines, mapLine{domain: fields[0], backend: fields[1], raw: raw})
+	}
+
+	m.lines = lines
+	m.loaded = true
+	return nil
+}
+
+// writeLocked writes the in-memory map to the map file (must be called with
+// lock held)
+func (m *MapManager) writeLocked() error {
+	var out strings.Builder
+	for _, line := range m.lines {
+		out.WriteString(line.raw)
+		out.WriteString("\n")
+	}
+
+	// Write to a temporary file and rename so readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(m.mapFile), ".domains.map-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary map file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(out.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write map file: %w", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set map file permissions: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write map file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), m.mapFile); err != nil {
+		return fmt.Errorf("failed to replace map file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package haproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRuntimeAPI accepts Runtime API commands on a unix socket and answers
+// them with an empty (successful) response unless told otherwise
+type fakeRuntimeAPI struct {
+	socket string
+
+	mu       sync.Mutex
+	commands []string
+	response string
+}
+
+// startRuntimeAPI starts a fake Runtime API in a temporary directory
+func startRuntimeAPI(t *testing.T) *fakeRuntimeAPI {
+	t.Helper()
+	return startRuntimeAPIAt(t, filepath.Join(t.TempDir(), "haproxy.sock"))
+}
+
+// startRuntimeAPIAt starts a fake Runtime API listening on socket
+func startRuntimeAPIAt(t *testing.T, socket string) *fakeRuntimeAPI {
+	t.Helper()
+	api := &fakeRuntimeAPI{socket: socket}
+	ln, err := net.Listen("unix", api.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			api.mu.Lock()
+			api.commands = append(api.commands, line[:max(len(line)-1, 0)])
+			response := api.response
+			api.mu.Unlock()
+			conn.Write([]byte(response))
+			conn.Close()
+		}
+	}()
+	return api
+}
+
+// Respond makes the fake answer all further commands with response
+func (a *fakeRuntimeAPI) Respond(response string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.response = response
+}
+
+// Commands returns the commands received so far
+func (a *fakeRuntimeAPI) Commands() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.commands...)
+}
+
+func TestRemoveKeepsOrderAndComments(t *testing.T) {
+	api := startRuntimeAPI(t)
+	mapFile := filepath.Join(t.TempDir(), "domains.map")
+	original := "# Managed by k8s-exposer, manual entries below are kept\n" +
+		"a.example.com backend_a\n" +
+		"\n" +
+		"# legacy site, do not remove\n" +
+		"legacy.example.com backend_legacy\n" +
+		"b.example.com backend_b\n" +
+		"c.example.com backend_c\n"
+	if err := os.WriteFile(mapFile, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMapManager(NewClient(api.socket, mapFile))
+	if err := m.Remove(context.Background(), "b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Managed by k8s-exposer, manual entries below are kept\n" +
+		"a.example.com backend_a\n" +
+		"\n" +
+		"# legacy site, do not remove\n" +
+		"legacy.example.com backend_legacy\n" +
+		"c.example.com backend_c\n"
+	if string(data) != want {
+		t.Errorf("unexpected map file:\n%s\nwant:\n%s", data, want)
+	}
+	if cmds := api.Commands(); len(cmds) != 1 || cmds[0] != "del map "+mapFile+" b.example.com" {
+		t.Errorf("unexpected Runtime API commands: %q", cmds)
+	}
+
+	// Removing an unknown domain leaves the file untouched
+	if err := m.Remove(context.Background(), "missing.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(mapFile)
+	if string(data) != want {
+		t.Errorf("unexpected map file after removing an unknown domain:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestMapManagerConcurrentWriters(t *testing.T) {
+	api := startRuntimeAPI(t)
+	mapFile := filepath.Join(t.TempDir(), "domains.map")
+	if err := os.WriteFile(mapFile, []byte("# manual entries\nkeep.example.com backend_keep\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMapManager(NewClient(api.socket, mapFile))
+
+	// Each writer sets its own domains, switches their backends and removes
+	// every other one again
+	const writers, domains = 8, 10
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for d := 0; d < domains; d++ {
+				domain := fmt.Sprintf("w%d-d%d.example.com", w, d)
+				for _, backend := range []string{"backend_old", "backend_new"} {
+					if err := m.Set(context.Background(), domain, backend); err != nil {
+						t.Error(err)
+					}
+				}
+				if d%2 == 1 {
+					if err := m.Remove(context.Background(), domain); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	want := map[string]string{"keep.example.com": "backend_keep"}
+	for w := 0; w < writers; w++ {
+		for d := 0; d < domains; d += 2 {
+			want[fmt.Sprintf("w%d-d%d.example.com", w, d)] = "backend_new"
+		}
+	}
+
+	// The file holds every mapping exactly once, as does a fresh manager reading it
+	data, err := os.ReadFile(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != len(want)+1 || lines[0] != "# manual entries" {
+		t.Fatalf("expected the comment and %d mappings, got:\n%s", len(want), data)
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || want[fields[0]] != fields[1] {
+			t.Errorf("unexpected map line %q", line)
+		}
+	}
+	mappings, err := NewMapManager(NewClient(api.socket, mapFile)).Mappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mappings, want) {
+		t.Errorf("unexpected mappings after reload: %v", mappings)
+	}
+}
+
+func TestSetRejectsHostileDomains(t *testing.T) {
+	api := startRuntimeAPI(t)
+	mapFile := filepath.Join(t.TempDir(), "domains.map")
+	m := NewMapManager(NewClient(api.socket, mapFile))
+
+	hostile := []string{
+		"evil.example.com backend_admin",
+		"evil.example.com\nadmin.example.com",
+		"evil.example.com;show stat",
+		"evil\t.example.com",
+		"#comment.example.com",
+		"-.example.com",
+		"Evil.example.com",
+		"example",
+		"",
+		strings.Repeat("a", 64) + ".example.com",
+	}
+	for _, domain := range hostile {
+		if err := m.Set(context.Background(), domain, "backend_8080"); err == nil {
+			t.Errorf("expected %q to be rejected", domain)
+		}
+		if err := m.Remove(context.Background(), domain); err == nil {
+			t.Errorf("expected removal of %q to be rejected", domain)
+		}
+	}
+	if err := m.Set(context.Background(), "web.example.com", "backend_8080 extra"); err == nil {
+		t.Error("expected a backend name with a space to be rejected")
+	}
+	if cmds := api.Commands(); len(cmds) > 0 {
+		t.Errorf("rejected mappings reached the Runtime API: %q", cmds)
+	}
+	if _, err := os.Stat(mapFile); !os.IsNotExist(err) {
+		t.Errorf("rejected mappings were written to the map file: %v", err)
+	}
+
+	if err := m.Set(context.Background(), "web.sub.example.com", "backend_8080"); err != nil {
+		t.Errorf("valid multi-level domain rejected: %v", err)
+	}
+}
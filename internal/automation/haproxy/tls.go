@@ -0,0 +1,54 @@
+package haproxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CertDir is the directory the HTTPS frontend loads certificates from
+const CertDir = "/etc/ssl/private"
+
+// Certificates are the certificates available to the HTTPS frontend
+type Certificates []*x509.Certificate
+
+// LoadCertificates parses the certificates of all .pem files in dir. A
+// missing directory and unreadable or invalid files are skipped.
+func LoadCertificates(dir string) Certificates {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var certs Certificates
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return certs
+}
+
+// Covers reports whether any certificate is valid for the domain
+func (c Certificates) Covers(domain string) bool {
+	for _, cert := range c {
+		if cert.VerifyHostname(domain) == nil {
+			return true
+		}
+	}
+	return false
+}
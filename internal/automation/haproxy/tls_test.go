@@ -0,0 +1,69 @@
+package haproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for names to dir/file
+func writeCertificate(t *testing.T, dir, file string, names ...string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, file), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "web.pem", "web.example.com")
+	writeCertificate(t, dir, "wildcard.pem", "*.apps.example.com")
+	// Files that are not certificates are skipped
+	writeCertificate(t, dir, "other.crt", "other.example.com")
+	os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("not a certificate"), 0o600)
+
+	certs := LoadCertificates(dir)
+	if len(certs) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(certs))
+	}
+	for domain, want := range map[string]bool{
+		"web.example.com":      true,
+		"api.apps.example.com": true,
+		"other.example.com":    false,
+		"api.example.com":      false,
+		"a.b.apps.example.com": false,
+		"":                     false,
+	} {
+		if got := certs.Covers(domain); got != want {
+			t.Errorf("Covers(%q) = %v, want %v", domain, got, want)
+		}
+	}
+
+	if certs := LoadCertificates(filepath.Join(dir, "missing")); len(certs) != 0 {
+		t.Errorf("expected no certificates from a missing directory, got %d", len(certs))
+	}
+}
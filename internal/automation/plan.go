@@ -0,0 +1,323 @@
+package automation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/noahjeana/k8s-exposer/internal/automation/firewall"
+	"github.com/noahjeana/k8s-exposer/internal/automation/haproxy"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// desiredState is the HAProxy and firewall state derived from a service list
+type desiredState struct {
+	mappings       map[string]string // fqdn -> backend
+	backends       []haproxy.BackendConfig
+	defaultBackend *haproxy.BackendConfig
+	ports          []int
+	udpPorts       []int // UDP bypasses HAProxy, every allocated UDP port is opened directly
+	firewallPorts  []firewall.PortRule
+	subdomains     []string
+}
+
+// ReconcileDiff lists what a reconcile changes relative to the last applied state
+type ReconcileDiff struct {
+	AddedMappings   []string `json:"added_mappings,omitempty"`   // "fqdn -> backend"
+	RemovedMappings []string `json:"removed_mappings,omitempty"` // "fqdn -> backend"
+	ChangedMappings []string `json:"changed_mappings,omitempty"` // "fqdn: old -> new"
+	AddedBackends   []string `json:"added_backends,omitempty"`
+	RemovedBackends []string `json:"removed_backends,omitempty"`
+	OpenedPorts     []int    `json:"opened_ports,omitempty"`
+	ClosedPorts     []int    `json:"closed_ports,omitempty"`
+	OpenedUDPPorts  []int    `json:"opened_udp_ports,omitempty"`
+	ClosedUDPPorts  []int    `json:"closed_udp_ports,omitempty"`
+}
+
+// Empty reports whether the diff contains no changes
+func (d ReconcileDiff) Empty() bool {
+	return len(d.AddedMappings) == 0 && len(d.RemovedMappings) == 0 && len(d.ChangedMappings) == 0 &&
+		len(d.AddedBackends) == 0 && len(d.RemovedBackends) == 0 &&
+		len(d.OpenedPorts) == 0 && len(d.ClosedPorts) == 0 &&
+		len(d.OpenedUDPPorts) == 0 && len(d.ClosedUDPPorts) == 0
+}
+
+// log writes the individual changes of the diff
+func (d ReconcileDiff) log(logger *slog.Logger) {
+	if d.Empty() {
+		logger.Info("Reconcile plan: no changes")
+		return
+	}
+	logger.Info("Reconcile plan",
+		"added_mappings", d.AddedMappings,
+		"removed_mappings", d.RemovedMappings,
+		"changed_mappings", d.ChangedMappings,
+		"added_backends", d.AddedBackends,
+		"removed_backends", d.RemovedBackends,
+		"opened_ports", d.OpenedPorts,
+		"closed_ports", d.ClosedPorts,
+		"opened_udp_ports", d.OpenedUDPPorts,
+		"closed_udp_ports", d.ClosedUDPPorts)
+}
+
+// ErrStalePlan is returned when applying a plan whose services or applied
+// state changed since it was computed
+var ErrStalePlan = errors.New("plan is stale, services or applied state changed since planning")
+
+// Plan returns the changes reconciling the given services would apply
+// relative to the last successful reconcile
+func (c *Controller) Plan(services []types.ExposedService) (ReconcileDiff, error) {
+	desired, err := c.desiredState(services)
+	if err != nil {
+		return ReconcileDiff{}, err
+	}
+
+	c.resultMu.Lock()
+	applied := c.applied
+	c.resultMu.Unlock()
+
+	return diffStates(applied, desired), nil
+}
+
+// PlanWithToken returns the plan for the given services together with a
+// token identifying it, to be passed to ApplyPlan
+func (c *Controller) PlanWithToken(services []types.ExposedService) (ReconcileDiff, string, error) {
+	diff, err := c.Plan(services)
+	if err != nil {
+		return ReconcileDiff{}, "", err
+	}
+	token, err := planToken(services, diff)
+	if err != nil {
+		return ReconcileDiff{}, "", err
+	}
+	return diff, token, nil
+}
+
+// ApplyPlan reconciles the given services if they still produce the plan
+// identified by token, and returns ErrStalePlan otherwise
+func (c *Controller) ApplyPlan(ctx context.Context, services []types.ExposedService, token string) error {
+	c.reconcileMu.Lock()
+	defer c.reconcileMu.Unlock()
+
+	_, current, err := c.PlanWithToken(services)
+	if err != nil {
+		return err
+	}
+	if current != token {
+		return ErrStalePlan
+	}
+	_, err = c.reconcileAndPublish(ctx, services)
+	return err
+}
+
+// planToken hashes the inputs and the outcome of a plan. Both the service
+// list and the diff against the applied state have to match for a plan to
+// still be valid.
+func planToken(services []types.ExposedService, diff ReconcileDiff) (string, error) {
+	hash := sha256.New()
+	if err := json.NewEncoder(hash).Encode(services); err != nil {
+		return "", fmt.Errorf("failed to hash services: %w", err)
+	}
+	if err := json.NewEncoder(hash).Encode(diff); err != nil {
+		return "", fmt.Errorf("failed to hash plan: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// desiredState computes the HAProxy mappings, backends and firewall ports
+// for a service list
+func (c *Controller) desiredState(services []types.ExposedService) (*desiredState, error) {
+	// Process services in subdomain order so backend ordering is deterministic
+	services = append([]types.ExposedService(nil), services...)
+	sort.SliceStable(services, func(i, j int) bool {
+		return services[i].Subdomain < services[j].Subdomain
+	})
+
+	state := &desiredState{
+		mappings: make(map[string]string),
+		backends: make([]haproxy.BackendConfig, 0),
+		ports:    make([]int, 0),
+		udpPorts: make([]int, 0),
+	}
+
+	allocated := c.allocatedPorts(services)
+
+	for _, svc := range services {
+		for _, p := range svc.Ports {
+			if p.Protocol == "udp" || p.Protocol == "tcp+udp" {
+				udpPort := int(allocatedPort(allocated, svc, p))
+				state.udpPorts = append(state.udpPorts, udpPort)
+				state.firewallPorts = append(state.firewallPorts, firewall.PortRule{Port: udpPort, Protocol: "udp", SourceIPs: svc.SourceRanges})
+			}
+		}
+
+		state.subdomains = append(state.subdomains, svc.Hostnames()...)
+
+		// Only TCP goes through HAProxy, UDP-only services need no backend
+		port := tcpPort(svc, allocated)
+		if port == 0 {
+			continue
+		}
+		state.firewallPorts = append(state.firewallPorts, firewall.PortRule{Port: int(port), Protocol: "tcp", SourceIPs: svc.SourceRanges})
+
+		// The wildcard service becomes the catch-all default backend
+		if svc.Subdomain == types.WildcardSubdomain {
+			if state.defaultBackend != nil {
+				return nil, fmt.Errorf("multiple wildcard services: %s and %s", state.defaultBackend.Name, svc.Name)
+			}
+			state.defaultBackend = backendConfig(svc, port)
+			state.ports = append(state.ports, int(port))
+			continue
+		}
+
+		fqdn := fmt.Sprintf("%s.%s", svc.Subdomain, c.domain)
+		if err := haproxy.ValidateDomain(fqdn); err != nil {
+			return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		state.mappings[fqdn] = backendName(port)
+		state.ports = append(state.ports, int(port))
+		backend := backendConfig(svc, port)
+		backend.Domain = fqdn
+
+		// Aliases share the backend of the service
+		for _, alias := range svc.Aliases {
+			aliasFQDN := fmt.Sprintf("%s.%s", alias, c.domain)
+			if err := haproxy.ValidateDomain(aliasFQDN); err != nil {
+				return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+			state.mappings[aliasFQDN] = backendName(port)
+			backend.Aliases = append(backend.Aliases, aliasFQDN)
+		}
+		state.backends = append(state.backends, *backend)
+	}
+
+	return state, nil
+}
+
+// allocatedPorts returns the allocated port of every listener of the
+// services, keyed by allocationKey
+func (c *Controller) allocatedPorts(services []types.ExposedService) map[string]int32 {
+	allocated := make(map[string]int32)
+	if c.allocations == nil {
+		return allocated
+	}
+	for _, a := range c.allocations(services) {
+		allocated[allocationKey(a.Subdomain, a.RequestedPort, a.Protocol)] = a.AllocatedPort
+	}
+	return allocated
+}
+
+// allocationKey identifies the listener of a service port mapping
+func allocationKey(subdomain string, port int32, protocol string) string {
+	return fmt.Sprintf("%s/%d/%s", subdomain, port, protocol)
+}
+
+// allocatedPort returns the port the listener of a port mapping got, the
+// requested port if it is unknown
+func allocatedPort(allocated map[string]int32, svc types.ExposedService, p types.PortMapping) int32 {
+	if port, ok := allocated[allocationKey(svc.Subdomain, p.Port, p.Protocol)]; ok {
+		return port
+	}
+	return p.Port
+}
+
+// tcpPort returns the allocated port of the first TCP port mapping of a
+// service, 0 if it only exposes UDP
+func tcpPort(svc types.ExposedService, allocated map[string]int32) int32 {
+	for _, p := range svc.Ports {
+		if p.Protocol == "tcp" || p.Protocol == "tcp+udp" {
+			return allocatedPort(allocated, svc, p)
+		}
+	}
+	return 0
+}
+
+// backendNames returns the names of all HAProxy backends of the state
+func (s *desiredState) backendNames() map[string]struct{} {
+	names := make(map[string]struct{})
+	if s == nil {
+		return names
+	}
+	for _, b := range s.backends {
+		names[fmt.Sprintf("backend_%d", b.Port)] = struct{}{}
+	}
+	if s.defaultBackend != nil {
+		names["backend_default"] = struct{}{}
+	}
+	return names
+}
+
+// diffStates compares two desired states, prev may be nil
+func diffStates(prev, next *desiredState) ReconcileDiff {
+	var diff ReconcileDiff
+
+	prevMappings := map[string]string{}
+	var prevPorts, prevUDPPorts []int
+	if prev != nil {
+		prevMappings = prev.mappings
+		prevPorts = prev.ports
+		prevUDPPorts = prev.udpPorts
+	}
+
+	for fqdn, backend := range next.mappings {
+		old, ok := prevMappings[fqdn]
+		switch {
+		case !ok:
+			diff.AddedMappings = append(diff.AddedMappings, fmt.Sprintf("%s -> %s", fqdn, backend))
+		case old != backend:
+			diff.ChangedMappings = append(diff.ChangedMappings, fmt.Sprintf("%s: %s -> %s", fqdn, old, backend))
+		}
+	}
+	for fqdn, backend := range prevMappings {
+		if _, ok := next.mappings[fqdn]; !ok {
+			diff.RemovedMappings = append(diff.RemovedMappings, fmt.Sprintf("%s -> %s", fqdn, backend))
+		}
+	}
+
+	prevBackends, nextBackends := prev.backendNames(), next.backendNames()
+	for name := range nextBackends {
+		if _, ok := prevBackends[name]; !ok {
+			diff.AddedBackends = append(diff.AddedBackends, name)
+		}
+	}
+	for name := range prevBackends {
+		if _, ok := nextBackends[name]; !ok {
+			diff.RemovedBackends = append(diff.RemovedBackends, name)
+		}
+	}
+
+	diff.OpenedPorts = missingPorts(next.ports, prevPorts)
+	diff.ClosedPorts = missingPorts(prevPorts, next.ports)
+	diff.OpenedUDPPorts = missingPorts(next.udpPorts, prevUDPPorts)
+	diff.ClosedUDPPorts = missingPorts(prevUDPPorts, next.udpPorts)
+
+	sort.Strings(diff.AddedMappings)
+	sort.Strings(diff.RemovedMappings)
+	sort.Strings(diff.ChangedMappings)
+	sort.Strings(diff.AddedBackends)
+	sort.Strings(diff.RemovedBackends)
+	return diff
+}
+
+// missingPorts returns the sorted ports of a that are not in b
+func missingPorts(a, b []int) []int {
+	present := make(map[int]struct{}, len(b))
+	for _, p := range b {
+		present[p] = struct{}{}
+	}
+
+	var missing []int
+	for _, p := range a {
+		if _, ok := present[p]; !ok {
+			missing = append(missing, p)
+			present[p] = struct{}{}
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
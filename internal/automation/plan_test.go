@@ -0,0 +1,170 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+func TestReconcileDiff(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	c := NewController(cfg, testLogger())
+	service := func(subdomain string, port int32) types.ExposedService {
+		return types.ExposedService{Name: subdomain, Namespace: "default", Subdomain: subdomain,
+			Ports: []types.PortMapping{{Port: port, TargetPort: 80, Protocol: "tcp"}}}
+	}
+	web, api := service("web", 8080), service("api", 8081)
+
+	// Without an applied state everything is new
+	diff, err := c.Plan([]types.ExposedService{web})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReconcileDiff{
+		AddedMappings: []string{"web.example.com -> backend_8080"},
+		AddedBackends: []string{"backend_8080"},
+		OpenedPorts:   []int{8080},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("expected %+v, got %+v", want, diff)
+	}
+
+	if err := c.Reconcile(context.Background(), []types.ExposedService{web}); err != nil {
+		t.Fatal(err)
+	}
+	if diff, _ := c.Plan([]types.ExposedService{web}); !diff.Empty() {
+		t.Errorf("expected no changes after applying, got %+v", diff)
+	}
+
+	// Replacing web by api is reported relative to the applied state
+	diff, err = c.Plan([]types.ExposedService{api})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = ReconcileDiff{
+		AddedMappings:   []string{"api.example.com -> backend_8081"},
+		RemovedMappings: []string{"web.example.com -> backend_8080"},
+		AddedBackends:   []string{"backend_8081"},
+		RemovedBackends: []string{"backend_8080"},
+		OpenedPorts:     []int{8081},
+		ClosedPorts:     []int{8080},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("expected %+v, got %+v", want, diff)
+	}
+
+	// The reconcile result carries the same diff
+	results, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	if err := c.Reconcile(context.Background(), []types.ExposedService{api}); err != nil {
+		t.Fatal(err)
+	}
+	if result := <-results; result.Diff == nil || !reflect.DeepEqual(*result.Diff, want) {
+		t.Errorf("expected result diff %+v, got %+v", want, result.Diff)
+	}
+}
+
+func TestDesiredStateUsesAllocatedPorts(t *testing.T) {
+	c := NewController(Config{Domain: "example.com"}, testLogger())
+	c.SetAllocationSource(func(services []types.ExposedService) []types.PortAllocation {
+		return []types.PortAllocation{
+			{Subdomain: "dns", RequestedPort: 53, AllocatedPort: 30053, Protocol: "udp"},
+			{Subdomain: "game", RequestedPort: 27015, AllocatedPort: 30015, Protocol: "tcp+udp"},
+			{Subdomain: "web", RequestedPort: 8080, AllocatedPort: 8080, Protocol: "tcp"},
+		}
+	})
+	services := []types.ExposedService{
+		{Name: "dns", Subdomain: "dns", Ports: []types.PortMapping{{Port: 53, TargetPort: 53, Protocol: "udp"}}},
+		{Name: "game", Subdomain: "game", Ports: []types.PortMapping{{Port: 27015, TargetPort: 27015, Protocol: "tcp+udp"}}},
+		{Name: "web", Subdomain: "web", Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}},
+	}
+
+	desired, err := c.desiredState(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The UDP-only service gets neither a TCP rule nor an HAProxy backend
+	if want := []int{30015, 8080}; !reflect.DeepEqual(desired.ports, want) {
+		t.Errorf("expected TCP ports %v, got %v", want, desired.ports)
+	}
+	if want := []int{30053, 30015}; !reflect.DeepEqual(desired.udpPorts, want) {
+		t.Errorf("expected UDP ports %v, got %v", want, desired.udpPorts)
+	}
+	want := map[string]string{"game.example.com": "backend_30015", "web.example.com": "backend_8080"}
+	if !reflect.DeepEqual(desired.mappings, want) {
+		t.Errorf("expected mappings %v, got %v", want, desired.mappings)
+	}
+	var backendPorts []int
+	for _, backend := range desired.backends {
+		backendPorts = append(backendPorts, backend.Port)
+	}
+	if !reflect.DeepEqual(backendPorts, []int{30015, 8080}) {
+		t.Errorf("expected backends on the allocated ports, got %v", backendPorts)
+	}
+	var firewallPorts []string
+	for _, port := range desired.firewallPorts {
+		firewallPorts = append(firewallPorts, fmt.Sprintf("%d/%s", port.Port, port.Protocol))
+	}
+	if want := []string{"30053/udp", "30015/udp", "30015/tcp", "8080/tcp"}; !reflect.DeepEqual(firewallPorts, want) {
+		t.Errorf("expected firewall rules for the allocated ports %v, got %v", want, firewallPorts)
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	c := NewController(cfg, testLogger())
+	web := types.ExposedService{Name: "web", Namespace: "default", Subdomain: "web",
+		Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}}
+	services := []types.ExposedService{web}
+
+	_, token, err := c.PlanWithToken(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Planning twice without changes yields the same token
+	if _, again, _ := c.PlanWithToken(services); again != token {
+		t.Errorf("expected a stable token, got %q and %q", token, again)
+	}
+
+	// A plan computed for other services is rejected without applying it
+	changed := []types.ExposedService{web}
+	changed[0].Subdomain = "www"
+	if err := c.ApplyPlan(context.Background(), changed, token); !errors.Is(err, ErrStalePlan) {
+		t.Fatalf("expected ErrStalePlan for changed services, got %v", err)
+	}
+	if diff, _ := c.Plan(services); diff.Empty() {
+		t.Fatal("a stale plan must not be applied")
+	}
+
+	if err := c.ApplyPlan(context.Background(), services, token); err != nil {
+		t.Fatal(err)
+	}
+	if diff, _ := c.Plan(services); !diff.Empty() {
+		t.Errorf("expected no changes after applying the plan, got %+v", diff)
+	}
+
+	// Once applied, the plan's diff no longer matches the applied state
+	if err := c.ApplyPlan(context.Background(), services, token); !errors.Is(err, ErrStalePlan) {
+		t.Errorf("expected ErrStalePlan for an already applied plan, got %v", err)
+	}
+}
+
+func TestDesiredStateRejectsHostileSubdomains(t *testing.T) {
+	c := NewController(Config{Domain: "example.com"}, testLogger())
+	for _, svc := range []types.ExposedService{
+		{Name: "space", Subdomain: "evil backend_admin", Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}},
+		{Name: "newline", Subdomain: "evil\nadmin", Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}},
+		{Name: "alias", Subdomain: "web", Aliases: []string{"www\tadmin"}, Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}},
+	} {
+		if _, err := c.desiredState([]types.ExposedService{svc}); err == nil {
+			t.Errorf("expected service %s to be rejected", svc.Name)
+		}
+	}
+}
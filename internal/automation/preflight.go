@@ -0,0 +1,74 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Preflight checks that the automation environment is usable before the
+// server starts serving. Failed checks of required features are returned as
+// one aggregated error; failed checks of optional features are only logged.
+func (c *Controller) Preflight() error {
+	var haproxyErrs []error
+	if err := c.haproxyClient.Validate(); err != nil {
+		haproxyErrs = append(haproxyErrs, err)
+	}
+	if err := c.haproxyClient.ValidateMapDir(); err != nil {
+		haproxyErrs = append(haproxyErrs, err)
+	}
+	if err := c.haproxyGenerator.ValidateBinary(); err != nil {
+		haproxyErrs = append(haproxyErrs, err)
+	}
+	if err := c.haproxyGenerator.ValidateStats(); err != nil {
+		haproxyErrs = append(haproxyErrs, err)
+	}
+	if err := c.haproxyGenerator.ValidateMaintenancePage(); err != nil {
+		haproxyErrs = append(haproxyErrs, err)
+	}
+	if err := c.haproxyGenerator.ValidateACMEBackend(); err != nil {
+		haproxyErrs = append(haproxyErrs, err)
+	}
+	if err := c.haproxyGenerator.ValidateBackendHost(); err != nil {
+		haproxyErrs = append(haproxyErrs, err)
+	}
+
+	var firewallErrs []error
+	if c.firewallClient.Enabled() {
+		// Fetching the rules verifies both the token and the firewall ID
+		if _, err := c.firewallClient.GetRules(context.Background()); err != nil {
+			firewallErrs = append(firewallErrs, fmt.Errorf("firewall credentials check failed: %w", err))
+		}
+	} else if c.requireFirewall {
+		firewallErrs = append(firewallErrs, c.firewallClient.Validate())
+	}
+
+	var fatal []error
+	fatal = c.preflightFeature("haproxy", haproxyErrs, c.requireHAProxy, fatal)
+	fatal = c.preflightFeature("firewall", firewallErrs, c.requireFirewall, fatal)
+
+	if len(fatal) > 0 {
+		return fmt.Errorf("preflight checks failed: %w", errors.Join(fatal...))
+	}
+
+	c.logger.Info("Preflight checks complete",
+		"haproxy_ok", len(haproxyErrs) == 0,
+		"firewall_ok", len(firewallErrs) == 0,
+		"firewall_enabled", c.firewallClient.Enabled(),
+	)
+	return nil
+}
+
+// preflightFeature logs failed checks for a feature and appends them to fatal
+// when the feature is required
+func (c *Controller) preflightFeature(feature string, errs []error, required bool, fatal []error) []error {
+	for _, err := range errs {
+		if required {
+			c.logger.Error("Preflight check failed", "feature", feature, "error", err)
+			fatal = append(fatal, fmt.Errorf("%s: %w", feature, err))
+		} else {
+			c.logger.Warn("Preflight check failed (feature not required)", "feature", feature, "error", err)
+		}
+	}
+	return fatal
+}
@@ -0,0 +1,112 @@
+package automation
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLogger discards all log output
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// preflightConfig returns a config passing every preflight check: a listening
+// HAProxy socket accepting all commands, a writable map directory and a
+// haproxy binary in PATH
+func preflightConfig(t *testing.T) Config {
+	t.Helper()
+	dir := t.TempDir()
+
+	socket := filepath.Join(dir, "haproxy.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Answer every Runtime API command with success
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+		}
+	}()
+
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "haproxy"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	return Config{
+		HAProxySocket:  socket,
+		HAProxyMap:     filepath.Join(dir, "domains.map"),
+		HAProxyConfig:  filepath.Join(dir, "haproxy.cfg"),
+		RequireHAProxy: true,
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	// Hetzner API stub rejecting the token "bad"
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer bad" {
+			http.Error(w, `{"error":{"code":"unauthorized"}}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"firewall":{"rules":[]}}`))
+	}))
+	defer api.Close()
+
+	tests := []struct {
+		name   string
+		modify func(*testing.T, *Config)
+		want   string // Substring of the error, empty if preflight passes
+	}{
+		{"all checks pass", func(*testing.T, *Config) {}, ""},
+		{"socket unreachable", func(_ *testing.T, c *Config) { c.HAProxySocket += ".missing" }, "cannot connect to HAProxy socket"},
+		{"map directory missing", func(_ *testing.T, c *Config) { c.HAProxyMap = filepath.Join(c.HAProxyMap, "missing", "domains.map") }, "map file directory"},
+		{"binary missing", func(t *testing.T, _ *Config) { t.Setenv("PATH", t.TempDir()) }, "haproxy binary not found"},
+		{"haproxy not required", func(_ *testing.T, c *Config) { c.HAProxySocket += ".missing"; c.RequireHAProxy = false }, ""},
+		{"firewall credentials rejected", func(_ *testing.T, c *Config) {
+			c.FirewallToken, c.FirewallID, c.RequireFirewall = "bad", "1", true
+		}, "firewall credentials check failed"},
+		{"firewall credentials accepted", func(_ *testing.T, c *Config) {
+			c.FirewallToken, c.FirewallID, c.RequireFirewall = "good", "1", true
+		}, ""},
+		{"firewall not configured", func(_ *testing.T, c *Config) { c.RequireFirewall = true }, "firewall token not configured"},
+		{"firewall not required", func(_ *testing.T, c *Config) { c.FirewallToken, c.FirewallID = "bad", "1" }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := preflightConfig(t)
+			tt.modify(t, &cfg)
+			c := NewController(cfg, testLogger())
+			c.firewallClient.SetBaseURL(api.URL)
+
+			err := c.Preflight()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected preflight error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
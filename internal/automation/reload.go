@@ -0,0 +1,128 @@
+package automation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// reloadTimeout bounds a single run of the reload command
+const reloadTimeout = 30 * time.Second
+
+// DefaultHAProxyReloadInterval is the default minimum time between two reloads
+const DefaultHAProxyReloadInterval = 30 * time.Second
+
+var (
+	haproxyReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_exposer_haproxy_reloads_total",
+		Help: "Total number of HAProxy reloads by result",
+	}, []string{"result"})
+
+	haproxyReloadPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_exposer_haproxy_reload_pending",
+		Help: "Whether a config change is waiting for the reload cooldown (1) or not (0)",
+	})
+
+	haproxyLastReloadTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_exposer_haproxy_last_reload_timestamp_seconds",
+		Help: "Unix timestamp of the last successful HAProxy reload",
+	})
+)
+
+// reloader runs the HAProxy reload command at most once per interval.
+// Requests arriving during the cooldown are coalesced into a single reload
+// at the end of the window, so the last change is always applied.
+type reloader struct {
+	command  []string
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu         sync.Mutex
+	lastReload time.Time
+	timer      *time.Timer
+}
+
+// newReloader creates a reloader, an empty command disables reloading
+func newReloader(command string, interval time.Duration, logger *slog.Logger) *reloader {
+	return &reloader{
+		command:  strings.Fields(command),
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// enabled reports whether a reload command is configured
+func (r *reloader) enabled() bool {
+	return len(r.command) > 0
+}
+
+// request asks for a reload, running it now or once the cooldown expires
+func (r *reloader) request() {
+	if !r.enabled() {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timer != nil {
+		// A reload is already scheduled and will pick up this change
+		return
+	}
+
+	wait := r.interval - time.Since(r.lastReload)
+	if wait <= 0 {
+		r.reloadLocked()
+		return
+	}
+
+	r.logger.Info("HAProxy reload deferred by cooldown", "wait", wait.Round(time.Second))
+	haproxyReloadPending.Set(1)
+	r.timer = time.AfterFunc(wait, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.timer = nil
+		r.reloadLocked()
+	})
+}
+
+// reloadLocked runs the reload command (must be called with lock held)
+func (r *reloader) reloadLocked() {
+	haproxyReloadPending.Set(0)
+	r.lastReload = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, r.command[0], r.command[1:]...).CombinedOutput()
+	if err != nil {
+		haproxyReloadsTotal.WithLabelValues("error").Inc()
+		r.logger.Error("HAProxy reload failed",
+			"error", fmt.Errorf("failed to run %q: %w", strings.Join(r.command, " "), err),
+			"output", strings.TrimSpace(string(output)))
+		return
+	}
+
+	haproxyReloadsTotal.WithLabelValues("success").Inc()
+	haproxyLastReloadTime.SetToCurrentTime()
+	r.logger.Info("Reloaded HAProxy")
+}
+
+// stop cancels a scheduled reload
+func (r *reloader) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+		haproxyReloadPending.Set(0)
+	}
+}
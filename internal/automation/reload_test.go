@@ -0,0 +1,96 @@
+package automation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// countingReloadCommand returns a reload command appending a line to a file
+// per run and a function returning the number of runs
+func countingReloadCommand(t *testing.T) (string, func() int) {
+	t.Helper()
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "reload.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho reload >> "+runs+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return script, func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "reload")
+	}
+}
+
+func TestReloadCooldown(t *testing.T) {
+	command, runs := countingReloadCommand(t)
+	r := newReloader(command, 200*time.Millisecond, testLogger())
+	defer r.stop()
+
+	// The first request reloads immediately
+	r.request()
+	if n := runs(); n != 1 {
+		t.Fatalf("expected an immediate reload, got %d runs", n)
+	}
+
+	// Requests within the cooldown collapse into one deferred reload
+	for i := 0; i < 5; i++ {
+		r.request()
+	}
+	if n := runs(); n != 1 {
+		t.Fatalf("expected the reload to be deferred, got %d runs", n)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runs() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := runs(); n != 2 {
+		t.Fatalf("expected exactly one deferred reload, got %d runs", n-1)
+	}
+
+	// Stopping cancels a scheduled reload
+	r.request()
+	r.stop()
+	time.Sleep(300 * time.Millisecond)
+	if n := runs(); n != 2 {
+		t.Errorf("expected the scheduled reload to be cancelled, got %d runs", n)
+	}
+}
+
+func TestReloadDisabled(t *testing.T) {
+	r := newReloader("", time.Second, testLogger())
+	if r.enabled() {
+		t.Fatal("expected an empty command to disable reloading")
+	}
+	r.request()
+	if r.timer != nil {
+		t.Error("disabled reloader scheduled a reload")
+	}
+}
+
+func TestReconcileReloadsOnConfigChange(t *testing.T) {
+	command, runs := countingReloadCommand(t)
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	cfg.HAProxyReloadCommand = command
+	c := NewController(cfg, testLogger())
+	defer c.haproxyReloader.stop()
+	web := []types.ExposedService{{Name: "web", Namespace: "default", Subdomain: "web",
+		Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}}}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Reconcile(context.Background(), web); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the first reconcile changed the generated config
+	if n := runs(); n != 1 {
+		t.Errorf("expected one reload, got %d", n)
+	}
+}
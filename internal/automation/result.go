@@ -0,0 +1,151 @@
+package automation
+
+import (
+	"fmt"
+	"time"
+)
+
+// Reconcile stages reported in errors and results
+const (
+	StageValidate = "validate"
+	StageHAProxy  = "haproxy"
+	StageFirewall = "firewall"
+)
+
+// ReconcileError is returned when a reconcile stage fails
+type ReconcileError struct {
+	Stage string
+	Err   error
+}
+
+func (e *ReconcileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *ReconcileError) Unwrap() error {
+	return e.Err
+}
+
+// ReconcileResult describes the outcome of a single reconciliation
+type ReconcileResult struct {
+	Time          time.Time      `json:"time"`
+	Duration      time.Duration  `json:"duration_ns"`
+	Success       bool           `json:"success"`
+	RequestID     string         `json:"request_id,omitempty"` // Request that triggered the reconcile
+	Services      int            `json:"services"`
+	Domains       int            `json:"domains"`
+	Ports         int            `json:"ports"`
+	Stage         string         `json:"stage,omitempty"`          // Failed stage
+	Error         string         `json:"error,omitempty"`          // Error that failed the reconcile
+	FirewallError string         `json:"firewall_error,omitempty"` // Non-fatal firewall error
+	DNSError      string         `json:"dns_error,omitempty"`      // Non-fatal DNS error
+	Diff          *ReconcileDiff `json:"diff,omitempty"`           // Changes relative to the previous reconcile
+}
+
+// resultBufferSize is the number of results buffered per subscriber
+const resultBufferSize = 16
+
+// DefaultHistorySize is the default number of reconcile results kept in history
+const DefaultHistorySize = 20
+
+// resultHistory is a ring buffer of the most recent reconcile results
+type resultHistory struct {
+	results []ReconcileResult
+	next    int // Slot the next result is written to
+	full    bool
+}
+
+// newResultHistory creates a history keeping the last size results,
+// size <= 0 disables it
+func newResultHistory(size int) *resultHistory {
+	if size <= 0 {
+		return &resultHistory{}
+	}
+	return &resultHistory{results: make([]ReconcileResult, size)}
+}
+
+// add records a result, evicting the oldest once the history is full
+func (h *resultHistory) add(result ReconcileResult) {
+	if len(h.results) == 0 {
+		return
+	}
+	h.results[h.next] = result
+	h.next = (h.next + 1) % len(h.results)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the recorded results, oldest first
+func (h *resultHistory) list() []ReconcileResult {
+	if !h.full {
+		return append([]ReconcileResult(nil), h.results[:h.next]...)
+	}
+	list := make([]ReconcileResult, 0, len(h.results))
+	list = append(list, h.results[h.next:]...)
+	return append(list, h.results[:h.next]...)
+}
+
+// LastResult returns the most recent reconcile result, false if none ran yet
+func (c *Controller) LastResult() (ReconcileResult, bool) {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+
+	if c.lastResult == nil {
+		return ReconcileResult{}, false
+	}
+	return *c.lastResult, true
+}
+
+// History returns the most recent reconcile results, oldest first
+func (c *Controller) History() []ReconcileResult {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+	return c.history.list()
+}
+
+// LastError returns the error of the most recent reconcile, nil on success
+func (c *Controller) LastError() error {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+	return c.lastErr
+}
+
+// Subscribe returns a channel receiving every reconcile result and a
+// function to unsubscribe. Results are dropped for subscribers that fall
+// behind rather than blocking reconciliation.
+func (c *Controller) Subscribe() (<-chan ReconcileResult, func()) {
+	ch := make(chan ReconcileResult, resultBufferSize)
+
+	c.resultMu.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.resultMu.Unlock()
+
+	unsubscribe := func() {
+		c.resultMu.Lock()
+		defer c.resultMu.Unlock()
+		if _, ok := c.subscribers[ch]; ok {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// publish records a reconcile result and fans it out to subscribers
+func (c *Controller) publish(result ReconcileResult, err error) {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+
+	c.lastResult = &result
+	c.lastErr = err
+	c.history.add(result)
+
+	for ch := range c.subscribers {
+		select {
+		case ch <- result:
+		default:
+			c.logger.Warn("Dropping reconcile result for slow subscriber")
+		}
+	}
+}
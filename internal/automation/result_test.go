@@ -0,0 +1,71 @@
+package automation
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// servicesOf returns the service counts of results
+func servicesOf(results []ReconcileResult) []int {
+	counts := make([]int, 0, len(results))
+	for _, result := range results {
+		counts = append(counts, result.Services)
+	}
+	return counts
+}
+
+func TestResultHistory(t *testing.T) {
+	h := newResultHistory(3)
+	if got := h.list(); len(got) != 0 {
+		t.Fatalf("expected an empty history, got %v", servicesOf(got))
+	}
+
+	// Results are listed oldest first, the oldest are evicted once full
+	for i, want := range [][]int{{1}, {1, 2}, {1, 2, 3}, {2, 3, 4}, {3, 4, 5}, {4, 5, 6}, {5, 6, 7}} {
+		h.add(ReconcileResult{Services: i + 1})
+		if got := servicesOf(h.list()); !reflect.DeepEqual(got, want) {
+			t.Fatalf("after %d results expected %v, got %v", i+1, want, got)
+		}
+	}
+
+	// The list is a copy
+	list := h.list()
+	list[0].Services = 100
+	if h.list()[0].Services != 5 {
+		t.Error("modifying the list changed the history")
+	}
+
+	disabled := newResultHistory(0)
+	disabled.add(ReconcileResult{Services: 1})
+	if got := disabled.list(); len(got) != 0 {
+		t.Errorf("expected a disabled history to stay empty, got %v", servicesOf(got))
+	}
+}
+
+func TestControllerHistory(t *testing.T) {
+	cfg := preflightConfig(t)
+	cfg.Domain = "example.com"
+	cfg.HistorySize = 2
+	c := NewController(cfg, testLogger())
+
+	web := types.ExposedService{Name: "web", Namespace: "default", Subdomain: "web",
+		Ports: []types.PortMapping{{Port: 8080, TargetPort: 80, Protocol: "tcp"}}}
+	api := web
+	api.Name, api.Subdomain = "api", "api"
+	for _, services := range [][]types.ExposedService{nil, {web}, {web, api}} {
+		if err := c.Reconcile(context.Background(), services); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history := c.History()
+	if got := servicesOf(history); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatalf("expected the last two reconciles oldest first, got %v", got)
+	}
+	if history[1].Time.Before(history[0].Time) {
+		t.Errorf("history not ordered by time: %v, %v", history[0].Time, history[1].Time)
+	}
+}
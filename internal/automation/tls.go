@@ -0,0 +1,41 @@
+package automation
+
+import (
+	"fmt"
+
+	"github.com/noahjeana/k8s-exposer/internal/automation/haproxy"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// TLSDomain describes the certificate state of an exposed domain
+type TLSDomain struct {
+	Domain      string `json:"domain"`
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace"`
+	Required    bool   `json:"required"`    // The service requested TLS
+	Certificate bool   `json:"certificate"` // A certificate covers the domain
+}
+
+// TLSStatus returns the certificate state of the domains of the given
+// services, e.g. for an ACME client deciding which certificates to issue
+func (c *Controller) TLSStatus(services []types.ExposedService) []TLSDomain {
+	certs := haproxy.LoadCertificates(haproxy.CertDir)
+
+	domains := make([]TLSDomain, 0, len(services))
+	for _, svc := range services {
+		if svc.Subdomain == types.WildcardSubdomain {
+			continue
+		}
+		for _, hostname := range svc.Hostnames() {
+			domain := fmt.Sprintf("%s.%s", hostname, c.domain)
+			domains = append(domains, TLSDomain{
+				Domain:      domain,
+				Name:        svc.Name,
+				Namespace:   svc.Namespace,
+				Required:    svc.TLS,
+				Certificate: certs.Covers(domain),
+			})
+		}
+	}
+	return domains
+}
@@ -0,0 +1,101 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Backoff strategies of the HAProxy readiness wait
+const (
+	BackoffConstant    = "constant"    // Always wait the base delay
+	BackoffLinear      = "linear"      // Wait attempt * base delay
+	BackoffExponential = "exponential" // Double the delay after every attempt
+)
+
+// Defaults of the HAProxy readiness wait
+const (
+	DefaultWaitAttempts = 30
+	DefaultWaitDelay    = time.Second
+	maxWaitDelay        = time.Minute
+)
+
+// ErrHAProxyNotReady is returned by Run when HAProxy did not become ready
+// within the configured readiness wait
+var ErrHAProxyNotReady = errors.New("HAProxy not ready")
+
+// ReadinessWait configures how long the controller waits for the HAProxy
+// socket before its first reconcile
+type ReadinessWait struct {
+	Attempts int           // Number of checks before giving up (0 = DefaultWaitAttempts)
+	Delay    time.Duration // Delay after the first failed check (0 = DefaultWaitDelay)
+	Backoff  string        // Growth of the delay: linear (default), exponential or constant
+}
+
+// Validate checks the backoff strategy and limits
+func (w ReadinessWait) Validate() error {
+	switch w.Backoff {
+	case "", BackoffConstant, BackoffLinear, BackoffExponential:
+	default:
+		return fmt.Errorf("invalid backoff %q (expected constant, linear or exponential)", w.Backoff)
+	}
+	if w.Attempts < 0 || w.Delay < 0 {
+		return fmt.Errorf("attempts and delay cannot be negative")
+	}
+	return nil
+}
+
+// attempts returns the number of checks
+func (w ReadinessWait) attempts() int {
+	if w.Attempts <= 0 {
+		return DefaultWaitAttempts
+	}
+	return w.Attempts
+}
+
+// delay returns the wait after the given failed check (0-based), capped at
+// maxWaitDelay
+func (w ReadinessWait) delay(attempt int) time.Duration {
+	base := w.Delay
+	if base <= 0 {
+		base = DefaultWaitDelay
+	}
+
+	delay := base
+	switch w.Backoff {
+	case BackoffConstant:
+	case BackoffExponential:
+		for i := 0; i < attempt && delay < maxWaitDelay; i++ {
+			delay *= 2
+		}
+	default:
+		delay = time.Duration(attempt+1) * base
+	}
+	return min(delay, maxWaitDelay)
+}
+
+// waitForHAProxy checks the HAProxy socket until it is reachable, giving up
+// with ErrHAProxyNotReady once the attempts are used up
+func (c *Controller) waitForHAProxy(ctx context.Context) error {
+	attempts := c.haproxyWait.attempts()
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = c.haproxyClient.Validate(); err == nil {
+			return nil
+		}
+		if i == attempts-1 {
+			break
+		}
+
+		delay := c.haproxyWait.delay(i)
+		c.logger.Warn("HAProxy not ready, retrying...", "attempt", i+1, "attempts", attempts, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return fmt.Errorf("%w after %d attempts: %w", ErrHAProxyNotReady, attempts, err)
+}
@@ -0,0 +1,67 @@
+package automation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessWaitDelays(t *testing.T) {
+	tests := []struct {
+		backoff string
+		want    []time.Duration
+	}{
+		{BackoffConstant, []time.Duration{10, 10, 10, 10}},
+		{BackoffLinear, []time.Duration{10, 20, 30, 40}},
+		{BackoffExponential, []time.Duration{10, 20, 40, 80}},
+	}
+	for _, tt := range tests {
+		wait := ReadinessWait{Delay: 10 * time.Millisecond, Backoff: tt.backoff}
+		for attempt, want := range tt.want {
+			if got := wait.delay(attempt); got != want*time.Millisecond {
+				t.Errorf("%s: expected delay %v after attempt %d, got %v", tt.backoff, want*time.Millisecond, attempt, got)
+			}
+		}
+	}
+
+	if got := (ReadinessWait{Delay: 40 * time.Second, Backoff: BackoffExponential}).delay(5); got != maxWaitDelay {
+		t.Errorf("expected the delay to be capped at %v, got %v", maxWaitDelay, got)
+	}
+}
+
+func TestWaitForHAProxyHonorsAttempts(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	c := NewController(Config{
+		HAProxySocket: filepath.Join(t.TempDir(), "missing.sock"),
+		HAProxyWait:   ReadinessWait{Attempts: 4, Delay: time.Millisecond, Backoff: BackoffConstant},
+	}, logger)
+
+	err := c.waitForHAProxy(context.Background())
+	if !errors.Is(err, ErrHAProxyNotReady) {
+		t.Fatalf("expected ErrHAProxyNotReady, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "after 4 attempts") {
+		t.Errorf("expected the error to report 4 attempts, got %v", err)
+	}
+	// Every check but the last is followed by a retry
+	if got := strings.Count(logs.String(), "HAProxy not ready, retrying..."); got != 3 {
+		t.Errorf("expected 3 retries, got %d", got)
+	}
+
+	// A canceled context stops the wait early
+	c = NewController(Config{
+		HAProxySocket: filepath.Join(t.TempDir(), "missing.sock"),
+		HAProxyWait:   ReadinessWait{Attempts: 10, Delay: time.Hour},
+	}, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.waitForHAProxy(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait to stop on cancel, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -18,6 +19,8 @@ type Connection struct {
 	mu         sync.Mutex
 	reconnectDelay time.Duration
 	maxReconnectDelay time.Duration
+	writeTimeout time.Duration
+	maxMessageSize int
 	logger     *slog.Logger
 }
 
@@ -27,10 +30,19 @@ func NewConnection(addr string, logger *slog.Logger) *Connection {
 		addr:              addr,
 		reconnectDelay:    1 * time.Second,
 		maxReconnectDelay: 60 * time.Second,
+		writeTimeout:      10 * time.Second,
+		maxMessageSize:    DefaultMaxMessageSize,
 		logger:            logger,
 	}
 }
 
+// SetMaxMessageSize sets the size limit for sent and received messages
+func (c *Connection) SetMaxMessageSize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxMessageSize = size
+}
+
 // Connect establishes a connection to the server
 func (c *Connection) Connect(ctx context.Context) error {
 	c.mu.Lock()
@@ -60,7 +72,15 @@ func (c *Connection) Send(msg *types.Message) error {
 		return fmt.Errorf("not connected")
 	}
 
-	if err := SendMessage(c.conn, msg); err != nil {
+	if err := SendMessageTimeout(c.conn, msg, c.writeTimeout, c.maxMessageSize); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// A partially written frame corrupts the stream, drop the connection
+			// so the caller reconnects
+			c.conn.Close()
+			c.conn = nil
+			c.logger.Warn("Write timed out, connection dropped", "timeout", c.writeTimeout)
+		}
 		return fmt.Errorf("failed to send message: %w", err)
 	}
 
@@ -71,13 +91,14 @@ func (c *Connection) Send(msg *types.Message) error {
 func (c *Connection) Receive() (*types.Message, error) {
 	c.mu.Lock()
 	conn := c.conn
+	maxSize := c.maxMessageSize
 	c.mu.Unlock()
 
 	if conn == nil {
 		return nil, fmt.Errorf("not connected")
 	}
 
-	msg, err := ReceiveMessage(conn)
+	msg, err := ReceiveMessageLimit(conn, maxSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to receive message: %w", err)
 	}
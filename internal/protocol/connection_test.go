@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+func TestSendMessageTimeout(t *testing.T) {
+	// Writes on a pipe block until the peer reads, which it never does
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+
+	start := time.Now()
+	err := SendMessageTimeout(client, &types.Message{Type: types.MessageTypeHeartbeat}, 50*time.Millisecond, DefaultMaxMessageSize)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("send returned after %s", elapsed)
+	}
+}
+
+func TestSendTimeoutDropsConnection(t *testing.T) {
+	client, peer := net.Pipe()
+	defer peer.Close()
+
+	c := NewConnection("unused", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	c.conn = client
+	c.writeTimeout = 50 * time.Millisecond
+
+	if err := c.Send(&types.Message{Type: types.MessageTypeHeartbeat}); err == nil {
+		t.Fatal("expected the blocked send to fail")
+	}
+	if c.IsConnected() {
+		t.Error("connection kept after a write timeout, the caller would not reconnect")
+	}
+}
+
+func TestConnectionMaxMessageSize(t *testing.T) {
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+
+	c := NewConnection("unused", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	c.conn = client
+	c.SetMaxMessageSize(10)
+
+	go SendMessage(peer, &types.Message{Type: types.MessageTypeHeartbeat})
+	if _, err := c.Receive(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected the receive cap to reject the message, got %v", err)
+	}
+	if err := c.Send(&types.Message{Type: types.MessageTypeHeartbeat}); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected the send cap to reject the message, got %v", err)
+	}
+}
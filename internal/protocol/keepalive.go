@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// ErrPingTimeout is returned by Keepalive.Run when the peer did not answer a
+// ping in time; callers should reconnect
+var ErrPingTimeout = errors.New("ping timeout")
+
+// Default keepalive settings, see NewKeepalive
+const (
+	DefaultPingInterval = 15 * time.Second
+	DefaultPingTimeout  = 10 * time.Second
+)
+
+// Keepalive verifies a connection by sending pings and waiting for the
+// peer's pongs. Unlike a fire-and-forget heartbeat, a missing pong tells a
+// dead peer apart from a write that was merely buffered by the kernel.
+type Keepalive struct {
+	interval time.Duration
+	timeout  time.Duration
+	send     func(*types.Message) error
+	seq      atomic.Uint64
+	pongs    chan uint64
+}
+
+// NewKeepalive creates a keepalive sending pings through send every interval
+// and expecting each pong within timeout
+func NewKeepalive(interval, timeout time.Duration, send func(*types.Message) error) *Keepalive {
+	return &Keepalive{
+		interval: interval,
+		timeout:  timeout,
+		send:     send,
+		pongs:    make(chan uint64, 1),
+	}
+}
+
+// Ping returns a ping message with sequence number seq
+func Ping(seq uint64) *types.Message {
+	return &types.Message{Type: types.MessageTypePing, Seq: seq}
+}
+
+// Pong returns the answer to a ping
+func Pong(ping *types.Message) *types.Message {
+	return &types.Message{Type: types.MessageTypePong, Seq: ping.Seq}
+}
+
+// HandlePong records a pong received from the peer
+func (k *Keepalive) HandlePong(msg *types.Message) {
+	// Only the newest pong matters, replace an unread one
+	select {
+	case k.pongs <- msg.Seq:
+	default:
+		select {
+		case <-k.pongs:
+		default:
+		}
+		select {
+		case k.pongs <- msg.Seq:
+		default:
+		}
+	}
+}
+
+// Run pings the peer every interval until ctx is canceled. It returns an
+// error wrapping ErrPingTimeout if a pong is overdue, or the send error if a
+// ping could not be sent.
+func (k *Keepalive) Run(ctx context.Context) error {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		seq := k.seq.Add(1)
+		if err := k.send(Ping(seq)); err != nil {
+			return fmt.Errorf("failed to send ping: %w", err)
+		}
+		if err := k.awaitPong(ctx, seq); err != nil {
+			return err
+		}
+	}
+}
+
+// awaitPong waits for the pong of ping seq, ignoring late pongs of earlier pings
+func (k *Keepalive) awaitPong(ctx context.Context, seq uint64) error {
+	timer := time.NewTimer(k.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case got := <-k.pongs:
+			if got >= seq {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("%w: no pong within %s", ErrPingTimeout, k.timeout)
+		}
+	}
+}
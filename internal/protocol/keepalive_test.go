@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+func TestKeepaliveTimesOutWithoutPong(t *testing.T) {
+	k := NewKeepalive(10*time.Millisecond, 50*time.Millisecond, func(*types.Message) error { return nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := k.Run(ctx); !errors.Is(err, ErrPingTimeout) {
+		t.Fatalf("expected ErrPingTimeout, got %v", err)
+	}
+}
+
+func TestKeepaliveAnsweredPings(t *testing.T) {
+	var k *Keepalive
+	pings := 0
+	k = NewKeepalive(10*time.Millisecond, 50*time.Millisecond, func(msg *types.Message) error {
+		pings++
+		go k.HandlePong(Pong(msg))
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := k.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the keepalive to run until canceled, got %v", err)
+	}
+	if pings < 3 {
+		t.Errorf("expected several pings, got %d", pings)
+	}
+}
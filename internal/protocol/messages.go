@@ -3,14 +3,44 @@ package protocol
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"syscall"
+	"time"
 
 	"github.com/noahjeana/k8s-exposer/pkg/types"
 )
 
+var (
+	// ErrMalformedFrame is returned for frames violating the wire protocol
+	ErrMalformedFrame = errors.New("malformed frame")
+
+	// ErrConnectionLost is returned when the peer went away mid-frame or
+	// reset the connection; callers should reconnect
+	ErrConnectionLost = errors.New("connection lost")
+
+	// ErrMessageTooLarge is returned for messages exceeding the size limit
+	ErrMessageTooLarge = errors.New("message too large")
+
+	// ErrInvalidMessage is returned for complete frames whose body fails to
+	// decode or validate; the stream stays in sync, so the next message can
+	// still be read
+	ErrInvalidMessage = errors.New("invalid message")
+)
+
+// DefaultMaxMessageSize is the default limit for encoded messages (10MB)
+const DefaultMaxMessageSize = 10 * 1024 * 1024
+
 // SendMessage sends a message over the connection with length prefix framing
 func SendMessage(w io.Writer, msg *types.Message) error {
+	return SendMessageLimit(w, msg, DefaultMaxMessageSize)
+}
+
+// SendMessageLimit sends a message, failing before anything is written if
+// the encoded message exceeds maxSize bytes (0 disables the limit)
+func SendMessageLimit(w io.Writer, msg *types.Message, maxSize int) error {
 	// Validate message before sending
 	if err := msg.Validate(); err != nil {
 		return fmt.Errorf("message validation failed: %w", err)
@@ -22,6 +52,11 @@ func SendMessage(w io.Writer, msg *types.Message) error {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
+	// Fail fast instead of sending a frame the peer will reject
+	if maxSize > 0 && len(data) > maxSize {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrMessageTooLarge, len(data), maxSize)
+	}
+
 	// Write length prefix (4 bytes, big endian)
 	length := uint32(len(data))
 	if err := binary.Write(w, binary.BigEndian, length); err != nil {
@@ -36,35 +71,71 @@ func SendMessage(w io.Writer, msg *types.Message) error {
 	return nil
 }
 
+// SendMessageTimeout sends a message of at most maxSize bytes, failing with a
+// timeout error if the length prefix and body are not fully written within timeout
+func SendMessageTimeout(conn net.Conn, msg *types.Message, timeout time.Duration, maxSize int) error {
+	if timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("failed to set write deadline: %w", err)
+		}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	return SendMessageLimit(conn, msg, maxSize)
+}
+
 // ReceiveMessage receives a message from the connection with length prefix framing
 func ReceiveMessage(r io.Reader) (*types.Message, error) {
+	return ReceiveMessageLimit(r, DefaultMaxMessageSize)
+}
+
+// ReceiveMessageLimit receives a message, rejecting frames larger than
+// maxSize bytes (0 disables the limit)
+func ReceiveMessageLimit(r io.Reader, maxSize int) (*types.Message, error) {
 	// Read length prefix (4 bytes, big endian)
 	var length uint32
 	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
-		return nil, fmt.Errorf("failed to read message length: %w", err)
+		return nil, fmt.Errorf("failed to read message length: %w", classifyReadError(err))
 	}
 
-	// Sanity check: limit message size to 10MB
-	if length > 10*1024*1024 {
-		return nil, fmt.Errorf("message too large: %d bytes", length)
+	// A frame always carries a JSON body
+	if length == 0 {
+		return nil, fmt.Errorf("%w: zero-length message", ErrMalformedFrame)
+	}
+
+	// Sanity check: reject frames over the size limit before allocating
+	if maxSize > 0 && uint64(length) > uint64(maxSize) {
+		return nil, fmt.Errorf("%w: %w: %d bytes exceeds limit of %d", ErrMalformedFrame, ErrMessageTooLarge, length, maxSize)
 	}
 
 	// Read message data
 	data := make([]byte, length)
 	if _, err := io.ReadFull(r, data); err != nil {
-		return nil, fmt.Errorf("failed to read message data: %w", err)
+		// EOF after a length prefix means the body was truncated
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read message data: %w", classifyReadError(err))
 	}
 
 	// Decode JSON
 	var msg types.Message
 	if err := json.Unmarshal(data, &msg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		return nil, fmt.Errorf("%w: failed to unmarshal message: %w", ErrInvalidMessage, err)
 	}
 
 	// Validate received message
 	if err := msg.Validate(); err != nil {
-		return nil, fmt.Errorf("received invalid message: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
 	}
 
 	return &msg, nil
 }
+
+// classifyReadError marks truncated reads and connection resets as
+// ErrConnectionLost while keeping the original error in the chain
+func classifyReadError(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// frame returns a length-prefixed frame announcing length bytes followed by body
+func frame(length uint32, body string) *bytes.Buffer {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, length)
+	buf.WriteString(body)
+	return &buf
+}
+
+func TestReceiveMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SendMessage(&buf, &types.Message{Type: types.MessageTypeHeartbeat}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ReceiveMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != types.MessageTypeHeartbeat {
+		t.Errorf("expected a heartbeat, got %s", msg.Type)
+	}
+
+	// A peer closing between frames is a clean EOF, not a lost connection
+	if _, err := ReceiveMessage(&buf); !errors.Is(err, io.EOF) || errors.Is(err, ErrConnectionLost) {
+		t.Errorf("expected a clean EOF, got %v", err)
+	}
+}
+
+func TestReceiveMessageZeroLength(t *testing.T) {
+	_, err := ReceiveMessage(frame(0, ""))
+	if !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("expected ErrMalformedFrame, got %v", err)
+	}
+	if errors.Is(err, ErrConnectionLost) {
+		t.Error("a zero-length frame is not a lost connection")
+	}
+}
+
+func TestReceiveMessageInvalid(t *testing.T) {
+	for _, body := range []string{"not json", `{"type":"bogus"}`} {
+		buf := frame(uint32(len(body)), body)
+		// The stream stays in sync, the next frame can still be read
+		SendMessage(buf, &types.Message{Type: types.MessageTypeHeartbeat})
+
+		_, err := ReceiveMessage(buf)
+		if !errors.Is(err, ErrInvalidMessage) {
+			t.Fatalf("%q: expected ErrInvalidMessage, got %v", body, err)
+		}
+		if errors.Is(err, ErrMalformedFrame) {
+			t.Errorf("%q: a complete frame is not malformed", body)
+		}
+		if msg, err := ReceiveMessage(buf); err != nil || msg.Type != types.MessageTypeHeartbeat {
+			t.Errorf("%q: expected the next heartbeat, got %v, %v", body, msg, err)
+		}
+	}
+}
+
+func TestReceiveMessageTruncated(t *testing.T) {
+	body := `{"type":"heartbeat"}`
+	tests := []struct {
+		name  string
+		frame *bytes.Buffer
+	}{
+		{"truncated body", frame(uint32(len(body)), body[:5])},
+		{"missing body", frame(uint32(len(body)), "")},
+		{"truncated length", bytes.NewBufferString("\x00\x00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReceiveMessage(tt.frame)
+			if !errors.Is(err, ErrConnectionLost) || !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("expected ErrConnectionLost wrapping io.ErrUnexpectedEOF, got %v", err)
+			}
+		})
+	}
+}
+
+// resetReader fails every read with a connection reset
+type resetReader struct{}
+
+func (resetReader) Read([]byte) (int, error) {
+	return 0, syscall.ECONNRESET
+}
+
+func TestReceiveMessageConnectionReset(t *testing.T) {
+	_, err := ReceiveMessage(io.MultiReader(frame(20, `{"type"`), resetReader{}))
+	if !errors.Is(err, ErrConnectionLost) || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected ErrConnectionLost wrapping ECONNRESET, got %v", err)
+	}
+}
+
+func TestSendMessageLimit(t *testing.T) {
+	msg := &types.Message{Type: types.MessageTypeHeartbeat}
+
+	// An oversized message fails before anything is written
+	var buf bytes.Buffer
+	if err := SendMessageLimit(&buf, msg, 10); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing written, got %d bytes", buf.Len())
+	}
+
+	// A limit of 0 disables the check
+	if err := SendMessageLimit(&buf, msg, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReceiveMessage(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveMessageLimit(t *testing.T) {
+	body := `{"type":"heartbeat"}`
+
+	// Frames over the configured cap are rejected as malformed
+	_, err := ReceiveMessageLimit(frame(uint32(len(body)), body), len(body)-1)
+	if !errors.Is(err, ErrMessageTooLarge) || !errors.Is(err, ErrMalformedFrame) {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+
+	// The same frame passes a cap that fits it
+	msg, err := ReceiveMessageLimit(frame(uint32(len(body)), body), len(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != types.MessageTypeHeartbeat {
+		t.Errorf("expected a heartbeat, got %s", msg.Type)
+	}
+
+	// The default cap rejects frames over 10MB without reading the body
+	if _, err := ReceiveMessage(frame(DefaultMaxMessageSize+1, "")); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// HandleAgentConnection processes messages from a connected agent and applies
+// them to the registry until the connection fails or ctx is canceled
+func HandleAgentConnection(ctx context.Context, conn net.Conn, registry *ServiceRegistry, agents *AgentRegistry, logger *slog.Logger) {
+	defer conn.Close()
+
+	// Services from this agent are forwarded through the interface it connected on
+	iface := InterfaceForAddr(conn.LocalAddr())
+
+	// Registered once the first message tells the agent's ID
+	agent := agents.newAgentConn(conn, iface)
+	registered := false
+	defer func() {
+		if registered {
+			agents.unregister(agent)
+		}
+	}()
+
+	logger = logger.With("agent", conn.RemoteAddr())
+	logger.Info("Handling agent connection", "interface", iface)
+
+	// Push centrally managed settings before the agent's first update
+	if config := agents.agentConfig(); config != nil {
+		if err := agent.Send(configMessage(config)); err != nil {
+			logger.Warn("Failed to send agent configuration", "error", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Context canceled, closing agent connection")
+			return
+		default:
+		}
+
+		// Receive message
+		msg, err := protocol.ReceiveMessageLimit(conn, agents.maxMessageSize)
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF):
+				logger.Info("Agent disconnected")
+			case errors.Is(err, protocol.ErrConnectionLost):
+				logger.Warn("Agent connection lost", "error", err)
+			default:
+				logger.Error("Failed to receive message", "error", err)
+			}
+			return
+		}
+
+		if !registered {
+			if err := agents.register(agent, msg.AgentID); err != nil {
+				logger.Warn("Refusing agent connection", "error", err)
+				return
+			}
+			registered = true
+			logger = logger.With("agent_id", agent.ID)
+		}
+
+		// Process message
+		switch msg.Type {
+		case types.MessageTypeServiceUpdate:
+			logger.Info("Received service update", "count", len(msg.Services), "full", msg.IsFull())
+			// Agents cannot pick the interface, otherwise one cluster could
+			// route its services through another cluster's tunnel
+			for i := range msg.Services {
+				msg.Services[i].Interface = iface
+			}
+			services, rejected := validateServices(msg.Services)
+			for _, rejection := range rejected {
+				logger.Warn("Rejected service",
+					"name", rejection.Name,
+					"namespace", rejection.Namespace,
+					"subdomain", rejection.Subdomain,
+					"reason", rejection.Reason)
+			}
+			update := registry.Update
+			if !msg.IsFull() {
+				update = registry.Merge
+			}
+			conflicts, err := update(agent.ID, services)
+			if err != nil {
+				logger.Error("Failed to update registry", "error", err)
+			}
+			rejected = append(rejected, conflicts...)
+
+			// Report the allocated external ports and rejections back to the agent
+			status := &types.Message{
+				Type:        types.MessageTypeServiceStatus,
+				Allocations: registry.GetAllocations(services),
+				Errors:      rejected,
+				Ping:        true,
+			}
+			if err := agent.Send(status); err != nil {
+				logger.Warn("Failed to send service status", "error", err)
+			}
+
+		case types.MessageTypeServiceDelete:
+			logger.Info("Received service delete", "count", len(msg.Services))
+			for _, svc := range msg.Services {
+				// Agents can only delete the services they sent
+				if owner := registry.Owner(svc.Subdomain); owner != "" && owner != agent.ID {
+					logger.Warn("Ignoring delete of another agent's service", "subdomain", svc.Subdomain, "owner", owner)
+					continue
+				}
+				if err := registry.RemoveService(svc.Subdomain); err != nil {
+					logger.Error("Failed to remove service", "subdomain", svc.Subdomain, "error", err)
+				}
+			}
+
+		case types.MessageTypeHeartbeat:
+			logger.Debug("Received heartbeat")
+
+		case types.MessageTypePing:
+			// Answered right away, the agent reconnects if the pong is late
+			if err := agent.Send(protocol.Pong(msg)); err != nil {
+				logger.Warn("Failed to answer ping", "error", err)
+			}
+
+		default:
+			logger.Warn("Received unknown message type", "type", msg.Type)
+		}
+	}
+}
+
+// validateServices splits an update into valid services and rejections.
+// Services claiming a subdomain or alias already used earlier in the update
+// are rejected as well.
+func validateServices(services []types.ExposedService) ([]types.ExposedService, []types.ServiceError) {
+	valid := make([]types.ExposedService, 0, len(services))
+	var rejected []types.ServiceError
+	owners := make(map[string]types.ExposedService)
+
+	for _, svc := range services {
+		err := svc.Validate()
+		for _, hostname := range svc.Hostnames() {
+			if owner, ok := owners[hostname]; ok && err == nil {
+				err = fmt.Errorf("subdomain %q already used by %s/%s", hostname, owner.Namespace, owner.Name)
+			}
+		}
+		if err != nil {
+			rejected = append(rejected, types.ServiceError{
+				Name:      svc.Name,
+				Namespace: svc.Namespace,
+				Subdomain: svc.Subdomain,
+				Reason:    err.Error(),
+			})
+			continue
+		}
+		for _, hostname := range svc.Hostnames() {
+			owners[hostname] = svc
+		}
+		valid = append(valid, svc)
+	}
+	return valid, rejected
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// startAgentServer accepts agent connections on loopback and handles them
+// with HandleAgentConnection until the test ends
+func startAgentServer(t *testing.T, registry *ServiceRegistry, agents *AgentRegistry) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go HandleAgentConnection(ctx, conn, registry, agents, testLogger())
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// sendUpdate sends a service update over conn and returns the server's status
+func sendUpdate(t *testing.T, conn net.Conn, services ...types.ExposedService) *types.Message {
+	t.Helper()
+	return sendMessage(t, conn, &types.Message{Type: types.MessageTypeServiceUpdate, Services: services})
+}
+
+// sendMessage sends an update message over conn and returns the server's status
+func sendMessage(t *testing.T, conn net.Conn, update *types.Message) *types.Message {
+	t.Helper()
+	if err := protocol.SendMessage(conn, update); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	status, err := protocol.ReceiveMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Type != types.MessageTypeServiceStatus {
+		t.Fatalf("expected a service status, got %s", status.Type)
+	}
+	return status
+}
+
+func TestServiceInterfaceFromConnection(t *testing.T) {
+	lo := loopbackInterface(t)
+	registry, _ := newTestRegistry(t)
+	conn, err := net.Dial("tcp", startAgentServer(t, registry, NewAgentRegistry(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The interface claimed by the agent is replaced by the one it connected on
+	svc := testService("web", freePort(t), 8080, "tcp")
+	svc.Interface = "wg-other-cluster"
+	sendUpdate(t, conn, svc)
+
+	got, exists := registry.GetService("web")
+	if !exists {
+		t.Fatal("service not registered")
+	}
+	if got.Interface != lo {
+		t.Errorf("expected the service to be routed through %s, got %q", lo, got.Interface)
+	}
+}
+
+func TestStatusReportsAllocatedPorts(t *testing.T) {
+	requested, fallback := freePort(t), freePort(t)
+	forwarder := NewForwarder("wg-test", testLogger())
+	registry := NewServiceRegistry(fallback, fallback, ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1"}, forwarder, testLogger())
+	defer forwarder.Close()
+	defer registry.Close()
+
+	// Another service holds the requested port, forcing the fallback
+	if _, err := registry.AllocatePort(requested, "tcp"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", startAgentServer(t, registry, NewAgentRegistry(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	status := sendUpdate(t, conn, testService("web", requested, 8080, "tcp"))
+	want := []types.PortAllocation{{
+		Name: "web", Namespace: "default", Subdomain: "web",
+		RequestedPort: requested, AllocatedPort: fallback, Protocol: "tcp",
+	}}
+	if !reflect.DeepEqual(status.Allocations, want) {
+		t.Errorf("expected allocations %+v, got %+v", want, status.Allocations)
+	}
+}
+
+func TestStatusReportsRejectedServices(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	conn, err := net.Dial("tcp", startAgentServer(t, registry, NewAgentRegistry(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	web := testService("web", freePort(t), 8080, "tcp")
+	duplicate := testService("web", freePort(t), 8080, "tcp")
+	duplicate.Name = "web-copy"
+	invalid := testService("api", freePort(t), 8080, "tcp")
+	invalid.TargetIP = ""
+
+	// Invalid services are rejected individually, the rest is registered
+	status := sendUpdate(t, conn, web, duplicate, invalid)
+	if len(status.Allocations) != 1 || status.Allocations[0].Name != "web" {
+		t.Errorf("expected only web to be allocated, got %+v", status.Allocations)
+	}
+	rejected := map[string]string{}
+	for _, rejection := range status.Errors {
+		rejected[rejection.Name] = rejection.Reason
+	}
+	if len(rejected) != 2 || rejected["web-copy"] != `subdomain "web" already used by default/web` ||
+		rejected["api"] != "target IP cannot be empty" {
+		t.Errorf("unexpected rejections %+v", status.Errors)
+	}
+	if _, exists := registry.GetService("web"); !exists {
+		t.Error("valid service not registered")
+	}
+	if _, exists := registry.GetService("api"); exists {
+		t.Error("invalid service registered")
+	}
+}
+
+func TestFullAndPartialUpdates(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	conn, err := net.Dial("tcp", startAgentServer(t, registry, NewAgentRegistry(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	web := testService("web", freePort(t), 8080, "tcp")
+	api := testService("api", freePort(t), 8080, "tcp")
+	update := func(full *bool, services ...types.ExposedService) {
+		t.Helper()
+		sendMessage(t, conn, &types.Message{Type: types.MessageTypeServiceUpdate, Services: services, Full: full})
+	}
+	exists := func(name string) bool {
+		_, ok := registry.GetService(name)
+		return ok
+	}
+	full, partial := true, false
+
+	update(&full, web, api)
+
+	// A partial update leaves services it doesn't list in place
+	update(&partial, web)
+	if !exists("web") || !exists("api") {
+		t.Fatal("partial update removed a service")
+	}
+
+	// An update without the flag is authoritative, like an explicit full one
+	update(nil, web)
+	if exists("api") {
+		t.Fatal("update without the full flag did not prune")
+	}
+	update(&full, api)
+	if exists("web") || !exists("api") {
+		t.Error("full update did not replace the services")
+	}
+}
+
+func TestRequestResync(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	agents := NewAgentRegistry(0)
+	conn, err := net.Dial("tcp", startAgentServer(t, registry, agents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendUpdate(t, conn) // Round trip so the agent is registered
+
+	if err := agents.RequestResync("unknown"); err == nil {
+		t.Error("expected an error for an unknown agent")
+	}
+	if err := agents.RequestResync("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := protocol.ReceiveMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != types.MessageTypeResync {
+		t.Errorf("expected a resync request, got %s", msg.Type)
+	}
+}
+
+// sendUpdateAs sends a service update as the agent with the given ID and
+// returns the server's status
+func sendUpdateAs(t *testing.T, conn net.Conn, id string, services ...types.ExposedService) *types.Message {
+	t.Helper()
+	return sendMessage(t, conn, &types.Message{Type: types.MessageTypeServiceUpdate, Services: services, AgentID: id})
+}
+
+func TestAgentsBehindOneIPStayApart(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	agents := NewAgentRegistry(0)
+	registry.SetAgentRegistry(agents)
+	addr := startAgentServer(t, registry, agents)
+
+	a, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	web := testService("web", freePort(t), 8080, "tcp")
+	sendUpdateAs(t, a, "cluster-a", web)
+	sendUpdateAs(t, b, "cluster-b", testService("api", freePort(t), 8080, "tcp"))
+
+	// Both connections come from 127.0.0.1 but are separate agents
+	if list := agents.List(); len(list) != 2 || list[0].ID != "cluster-a" || list[1].ID != "cluster-b" {
+		t.Fatalf("expected agents cluster-a and cluster-b, got %d", len(list))
+	}
+	if registry.Owner("web") != "cluster-a" || registry.Owner("api") != "cluster-b" {
+		t.Errorf("unexpected owners: web=%s api=%s", registry.Owner("web"), registry.Owner("api"))
+	}
+
+	// The second agent can neither take over nor delete the first one's service
+	status := sendUpdateAs(t, b, "cluster-b", web)
+	if len(status.Errors) != 1 || registry.Owner("web") != "cluster-a" {
+		t.Errorf("expected the conflicting service to be rejected, got %v", status.Errors)
+	}
+	if err := protocol.SendMessage(b, &types.Message{Type: types.MessageTypeServiceDelete, Services: []types.ExposedService{web}, AgentID: "cluster-b"}); err != nil {
+		t.Fatal(err)
+	}
+	sendUpdateAs(t, b, "cluster-b") // Round trip so the delete was processed
+	if _, exists := registry.GetService("web"); !exists {
+		t.Error("another agent deleted the service")
+	}
+}
+
+func TestAgentWithoutIDUsesRemoteIP(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	agents := NewAgentRegistry(0)
+	addr := startAgentServer(t, registry, agents)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendUpdate(t, conn)
+
+	if _, exists := agents.Get("127.0.0.1"); !exists {
+		t.Error("agent without an ID is not registered by its remote IP")
+	}
+}
+
+func TestDuplicateAgentIDRefused(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	agents := NewAgentRegistry(0)
+	registry.SetAgentRegistry(agents)
+	addr := startAgentServer(t, registry, agents)
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	sendUpdateAs(t, first, "cluster-a", testService("web", freePort(t), 8080, "tcp"))
+
+	// A second connection claiming the ID of the connected agent is closed
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := protocol.SendMessage(second, &types.Message{Type: types.MessageTypeServiceUpdate, AgentID: "cluster-a"}); err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := protocol.ReceiveMessage(second); err == nil {
+		t.Fatalf("expected the duplicate connection to be closed, got %s", msg.Type)
+	}
+
+	// The first connection stays registered and keeps its services
+	agent, exists := agents.Get("cluster-a")
+	if !exists || agent.RemoteAddr != first.LocalAddr().String() {
+		t.Fatalf("expected the first connection to hold cluster-a, got %+v", agent)
+	}
+	if _, exists := registry.GetService("web"); !exists || registry.Owner("web") != "cluster-a" {
+		t.Error("refused connection affected the services of the connected agent")
+	}
+	sendUpdateAs(t, first, "cluster-a", testService("web", freePort(t), 8080, "tcp"))
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var agentConnsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "k8s_exposer_agent_connections_rejected_total",
+	Help: "Total number of agent connections refused by the connection limits",
+}, []string{"reason"})
+
+// Defaults of the agent connection limits
+const (
+	DefaultMaxAgentConns      = 64
+	DefaultMaxAgentConnsPerIP = 4
+	DefaultAgentConnRate      = 10 // New connections per source IP and minute
+)
+
+// AgentConnLimiter guards the agent listener against connection floods. It
+// bounds the concurrent agent connections overall and per source IP and the
+// rate of new connections per source IP, so excess connections are closed
+// before a goroutine reads from them.
+type AgentConnLimiter struct {
+	maxConns   int     // 0 = unlimited
+	maxPerIP   int     // 0 = unlimited
+	ratePerMin float64 // 0 = unlimited
+
+	mu    sync.Mutex
+	conns int
+	hosts map[string]*hostConns
+	now   func() time.Time
+}
+
+// hostConns is the connection state of one source IP
+type hostConns struct {
+	active int
+	tokens float64 // Connections the host may open before it is throttled
+	last   time.Time
+}
+
+// NewAgentConnLimiter creates a limiter; a limit of 0 disables it
+func NewAgentConnLimiter(maxConns, maxPerIP, ratePerMin int) *AgentConnLimiter {
+	return &AgentConnLimiter{
+		maxConns:   maxConns,
+		maxPerIP:   maxPerIP,
+		ratePerMin: float64(ratePerMin),
+		hosts:      make(map[string]*hostConns),
+		now:        time.Now,
+	}
+}
+
+// Acquire admits a connection from addr, returning a function that must be
+// called once the connection is closed, or an error if a limit is exceeded
+func (l *AgentConnLimiter) Acquire(addr net.Addr) (func(), error) {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostConns{tokens: l.ratePerMin, last: now}
+	}
+	h.refill(now, l.ratePerMin)
+
+	switch {
+	case l.maxConns > 0 && l.conns >= l.maxConns:
+		agentConnsRejected.WithLabelValues("max_connections").Inc()
+		return nil, fmt.Errorf("too many agent connections (max %d)", l.maxConns)
+	case l.maxPerIP > 0 && h.active >= l.maxPerIP:
+		agentConnsRejected.WithLabelValues("max_per_ip").Inc()
+		return nil, fmt.Errorf("too many agent connections from %s (max %d)", host, l.maxPerIP)
+	case l.ratePerMin > 0 && h.tokens < 1:
+		agentConnsRejected.WithLabelValues("rate").Inc()
+		// Remember the empty bucket, otherwise the host starts over full
+		l.hosts[host] = h
+		return nil, fmt.Errorf("agent connection rate of %s exceeded (max %.0f per minute)", host, l.ratePerMin)
+	}
+
+	if l.ratePerMin > 0 {
+		h.tokens--
+	}
+	h.active++
+	l.conns++
+	l.hosts[host] = h
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(host) })
+	}, nil
+}
+
+// release frees the slots of a closed connection from host
+func (l *AgentConnLimiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns--
+	h, ok := l.hosts[host]
+	if !ok {
+		return
+	}
+	h.active--
+	l.pruneLocked()
+}
+
+// pruneLocked forgets hosts without connections whose rate budget is full
+// again, so the map does not grow with every address that ever connected
+// (must be called with lock held)
+func (l *AgentConnLimiter) pruneLocked() {
+	now := l.now()
+	for host, h := range l.hosts {
+		h.refill(now, l.ratePerMin)
+		if h.active == 0 && h.tokens >= l.ratePerMin {
+			delete(l.hosts, host)
+		}
+	}
+}
+
+// refill adds the tokens earned since the last refill, up to one minute's worth
+func (h *hostConns) refill(now time.Time, ratePerMin float64) {
+	if elapsed := now.Sub(h.last); elapsed > 0 {
+		h.tokens = min(ratePerMin, h.tokens+elapsed.Minutes()*ratePerMin)
+	}
+	h.last = now
+}
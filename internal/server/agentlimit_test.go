@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAgentConnLimiterRefusesExcessFromOneSource(t *testing.T) {
+	limiter := NewAgentConnLimiter(0, 3, 0)
+	addr := func(port int) net.Addr {
+		return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}
+	}
+
+	var releases []func()
+	for port := 40000; port < 40010; port++ {
+		release, err := limiter.Acquire(addr(port))
+		if err != nil {
+			continue
+		}
+		releases = append(releases, release)
+	}
+	if len(releases) != 3 {
+		t.Fatalf("expected 3 of 10 connections to be admitted, got %d", len(releases))
+	}
+
+	// Other sources are not affected
+	other, err := limiter.Acquire(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000})
+	if err != nil {
+		t.Fatalf("connection from another source refused: %v", err)
+	}
+	other()
+
+	// A closed connection frees its slot, releasing twice frees it only once
+	releases[0]()
+	releases[0]()
+	if _, err := limiter.Acquire(addr(40010)); err != nil {
+		t.Fatalf("connection refused after a release: %v", err)
+	}
+	if _, err := limiter.Acquire(addr(40011)); err == nil {
+		t.Fatal("expected the limit to apply again")
+	}
+}
+
+func TestAgentConnLimiterRate(t *testing.T) {
+	limiter := NewAgentConnLimiter(0, 0, 2)
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+
+	for i := 0; i < 2; i++ {
+		release, err := limiter.Acquire(addr)
+		if err != nil {
+			t.Fatalf("connection %d refused: %v", i, err)
+		}
+		release()
+	}
+	if _, err := limiter.Acquire(addr); err == nil {
+		t.Fatal("expected the third connection within a minute to be refused")
+	}
+
+	// Half a minute later the budget has one connection again
+	now = now.Add(30 * time.Second)
+	if _, err := limiter.Acquire(addr); err != nil {
+		t.Fatalf("connection refused after the budget refilled: %v", err)
+	}
+}
+
+func TestAgentConnLimiterTotal(t *testing.T) {
+	limiter := NewAgentConnLimiter(2, 0, 0)
+	for i := byte(1); i <= 2; i++ {
+		if _, err := limiter.Acquire(&net.TCPAddr{IP: net.IPv4(192, 0, 2, i), Port: 40000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := limiter.Acquire(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 40000}); err == nil {
+		t.Fatal("expected the connection above the total limit to be refused")
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// agentWriteTimeout bounds writes of server-initiated messages to agents
+const agentWriteTimeout = 10 * time.Second
+
+// AgentConn is a connected agent that the server can send messages to
+type AgentConn struct {
+	ID          string
+	RemoteAddr  string
+	Interface   string
+	ConnectedAt time.Time
+
+	conn           net.Conn
+	maxMessageSize int
+	writeMu        sync.Mutex
+}
+
+// Send sends a message to the agent, serializing concurrent writers
+func (a *AgentConn) Send(msg *types.Message) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	return protocol.SendMessageTimeout(a.conn, msg, agentWriteTimeout, a.maxMessageSize)
+}
+
+// AgentRegistry tracks connected agents by ID
+type AgentRegistry struct {
+	agents         map[string]*AgentConn
+	maxMessageSize int
+	config         *types.AgentConfig // Runtime settings pushed to agents (nil = none)
+	mu             sync.RWMutex
+}
+
+// NewAgentRegistry creates a new agent registry. maxMessageSize limits
+// messages exchanged with agents (0 selects the protocol default).
+func NewAgentRegistry(maxMessageSize int) *AgentRegistry {
+	if maxMessageSize <= 0 {
+		maxMessageSize = protocol.DefaultMaxMessageSize
+	}
+	return &AgentRegistry{
+		agents:         make(map[string]*AgentConn),
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// newAgentConn wraps an accepted agent connection. Its ID is the remote IP
+// until the agent reports its own, see register.
+func (r *AgentRegistry) newAgentConn(conn net.Conn, iface string) *AgentConn {
+	id := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(id); err == nil {
+		id = host
+	}
+
+	return &AgentConn{
+		ID:             id,
+		RemoteAddr:     conn.RemoteAddr().String(),
+		Interface:      iface,
+		ConnectedAt:    time.Now(),
+		conn:           conn,
+		maxMessageSize: r.maxMessageSize,
+	}
+}
+
+// register adds an agent connection under the ID the agent reported in its
+// messages, the remote IP for agents that report none. A reconnecting agent
+// keeps its ID, agents sharing an IP behind NAT stay apart. An ID held by
+// another connection is refused, so no connection can take over the services
+// of a connected agent.
+func (r *AgentRegistry) register(agent *AgentConn, reportedID string) error {
+	if reportedID != "" {
+		agent.ID = reportedID
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, exists := r.agents[agent.ID]; exists && current != agent {
+		return fmt.Errorf("agent %s is already connected from %s", agent.ID, current.RemoteAddr)
+	}
+	r.agents[agent.ID] = agent
+	return nil
+}
+
+// Connected reports whether an agent with the ID is connected
+func (r *AgentRegistry) Connected(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, exists := r.agents[id]
+	return exists
+}
+
+// unregister removes an agent connection if it holds its ID
+func (r *AgentRegistry) unregister(agent *AgentConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, exists := r.agents[agent.ID]; exists && current == agent {
+		delete(r.agents, agent.ID)
+	}
+}
+
+// Get returns a connected agent by ID
+func (r *AgentRegistry) Get(id string) (*AgentConn, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	agent, exists := r.agents[id]
+	return agent, exists
+}
+
+// List returns all connected agents sorted by ID
+func (r *AgentRegistry) List() []*AgentConn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	agents := make([]*AgentConn, 0, len(r.agents))
+	for _, agent := range r.agents {
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].ID < agents[j].ID
+	})
+	return agents
+}
+
+// RequestResync asks an agent to re-send its complete service list
+func (r *AgentRegistry) RequestResync(id string) error {
+	agent, exists := r.Get(id)
+	if !exists {
+		return fmt.Errorf("agent %q not connected", id)
+	}
+	return agent.Send(&types.Message{Type: types.MessageTypeResync})
+}
+
+// SetAgentConfig sets the runtime settings pushed to every agent when it
+// connects and sends them to the agents already connected
+func (r *AgentRegistry) SetAgentConfig(config *types.AgentConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.config = config
+	r.mu.Unlock()
+
+	var errs []error
+	for _, agent := range r.List() {
+		if err := agent.Send(configMessage(config)); err != nil {
+			errs = append(errs, fmt.Errorf("agent %s: %w", agent.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// agentConfig returns the runtime settings pushed to agents, nil if none are set
+func (r *AgentRegistry) agentConfig() *types.AgentConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config
+}
+
+// configMessage wraps runtime settings in a config message
+func configMessage(config *types.AgentConfig) *types.Message {
+	return &types.Message{Type: types.MessageTypeConfig, Config: config}
+}
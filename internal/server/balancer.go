@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// backendBalancer picks the backend IP of new TCP connections and UDP
+// sessions of a service round-robin. With session affinity, a client IP is
+// pinned to the backend it got first until it stays away for the TTL.
+type backendBalancer struct {
+	mu        sync.Mutex
+	ips       []string
+	next      int
+	ttl       time.Duration
+	affinity  map[string]affinityEntry // client IP -> pinned backend
+	lastSweep time.Time
+}
+
+// affinityEntry is the backend a client IP is pinned to
+type affinityEntry struct {
+	ip      string
+	expires time.Time
+}
+
+// newBackendBalancer creates a balancer across the target IPs of a service
+func newBackendBalancer(svc *types.ExposedService) *backendBalancer {
+	return &backendBalancer{
+		ips:      slices.Clone(svc.TargetIPs),
+		ttl:      svc.AffinityTTL(),
+		affinity: make(map[string]affinityEntry),
+	}
+}
+
+// setBackends applies the backend IPs and affinity TTL of a changed service,
+// keeping clients pinned to backends that are still present. A shorter TTL
+// also shortens existing pins, disabling affinity forgets them.
+func (b *backendBalancer) setBackends(svc *types.ExposedService) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ips = slices.Clone(svc.TargetIPs)
+	b.ttl = svc.AffinityTTL()
+	if b.ttl <= 0 {
+		clear(b.affinity)
+		return
+	}
+	latest := time.Now().Add(b.ttl)
+	for client, entry := range b.affinity {
+		if entry.expires.After(latest) {
+			entry.expires = latest
+			b.affinity[client] = entry
+		}
+	}
+}
+
+// pick returns the backend IP for a client, fallback if the service has no
+// backends to balance across
+func (b *backendBalancer) pick(client, fallback string) string {
+	if b == nil {
+		return fallback
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.ips) == 0 {
+		return fallback
+	}
+
+	now := time.Now()
+	if b.ttl > 0 {
+		b.sweepLocked(now)
+		if entry, ok := b.affinity[client]; ok && now.Before(entry.expires) && slices.Contains(b.ips, entry.ip) {
+			entry.expires = now.Add(b.ttl)
+			b.affinity[client] = entry
+			return entry.ip
+		}
+	}
+
+	ip := b.ips[b.next%len(b.ips)]
+	b.next = (b.next + 1) % len(b.ips)
+	if b.ttl > 0 {
+		b.affinity[client] = affinityEntry{ip: ip, expires: now.Add(b.ttl)}
+	}
+	return ip
+}
+
+// sweepLocked drops expired affinity entries, at most once per TTL
+// (must be called with mu held)
+func (b *backendBalancer) sweepLocked(now time.Time) {
+	if now.Sub(b.lastSweep) < b.ttl {
+		return
+	}
+	b.lastSweep = now
+	for client, entry := range b.affinity {
+		if !now.Before(entry.expires) {
+			delete(b.affinity, client)
+		}
+	}
+}
+
+// clientIP returns the IP of a client address, which affinity is keyed by
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+func TestBalancerAffinity(t *testing.T) {
+	svc := &types.ExposedService{TargetIPs: []string{"10.0.0.1", "10.0.0.2"}, SessionAffinity: "1h"}
+	b := newBackendBalancer(svc)
+
+	first := b.pick("192.0.2.1", "fallback")
+	for i := 0; i < 5; i++ {
+		if got := b.pick("192.0.2.1", "fallback"); got != first {
+			t.Fatalf("client moved from %s to %s", first, got)
+		}
+	}
+	if other := b.pick("192.0.2.2", "fallback"); other == first {
+		t.Errorf("second client got the same backend %s", other)
+	}
+
+	// A removed backend releases its clients
+	b.setBackends(&types.ExposedService{TargetIPs: []string{"10.0.0.3"}, SessionAffinity: "1h"})
+	if got := b.pick("192.0.2.1", "fallback"); got != "10.0.0.3" {
+		t.Errorf("expected the remaining backend, got %s", got)
+	}
+}
+
+func TestBalancerRoundRobinWithoutAffinity(t *testing.T) {
+	b := newBackendBalancer(&types.ExposedService{TargetIPs: []string{"10.0.0.1", "10.0.0.2"}})
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[b.pick("192.0.2.1", "fallback")]++
+	}
+	if seen["10.0.0.1"] != 2 || seen["10.0.0.2"] != 2 {
+		t.Errorf("connections not spread evenly: %v", seen)
+	}
+
+	var nilBalancer *backendBalancer
+	if got := nilBalancer.pick("192.0.2.1", "fallback"); got != "fallback" {
+		t.Errorf("expected the fallback without a balancer, got %s", got)
+	}
+}
+
+func TestBalancerAffinityChange(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2"}
+	b := newBackendBalancer(&types.ExposedService{TargetIPs: ips})
+
+	// Enabling affinity on a running balancer pins clients
+	b.setBackends(&types.ExposedService{TargetIPs: ips, SessionAffinity: "1h"})
+	first := b.pick("192.0.2.1", "fallback")
+	if got := b.pick("192.0.2.1", "fallback"); got != first {
+		t.Fatalf("affinity enabled by an update is ignored, client moved from %s to %s", first, got)
+	}
+
+	// A changed TTL applies to the next pick
+	b.setBackends(&types.ExposedService{TargetIPs: ips, SessionAffinity: "1ms"})
+	time.Sleep(5 * time.Millisecond)
+	b.pick("192.0.2.9", "fallback") // Sweeps the expired entry
+	if _, ok := b.affinity["192.0.2.1"]; ok {
+		t.Error("entry not expired after the TTL was lowered")
+	}
+
+	// Disabling affinity forgets pinned clients and round-robins again
+	b.setBackends(&types.ExposedService{TargetIPs: ips, SessionAffinity: "1h"})
+	b.pick("192.0.2.1", "fallback")
+	b.setBackends(&types.ExposedService{TargetIPs: ips})
+	if len(b.affinity) != 0 {
+		t.Errorf("pinned clients kept after affinity was disabled: %v", b.affinity)
+	}
+	if b.pick("192.0.2.1", "fallback") == b.pick("192.0.2.1", "fallback") {
+		t.Error("client still pinned after affinity was disabled")
+	}
+}
+
+// startIdentBackends starts a backend on each IP, all on the same port,
+// answering every connection with the backend's IP
+func startIdentBackends(t *testing.T, ips ...string) int32 {
+	t.Helper()
+retry:
+	for attempt := 0; attempt < 10; attempt++ {
+		port := freePort(t)
+		var listeners []net.Listener
+		for _, ip := range ips {
+			ln, err := net.Listen("tcp", net.JoinHostPort(ip, fmt.Sprint(port)))
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				continue retry
+			}
+			listeners = append(listeners, ln)
+		}
+		for i, ln := range listeners {
+			ip := ips[i]
+			t.Cleanup(func() { ln.Close() })
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					conn.Read(make([]byte, 1))
+					conn.Write([]byte(ip))
+					conn.Close()
+				}
+			}()
+		}
+		return port
+	}
+	t.Fatal("no port free on all backend IPs")
+	return 0
+}
+
+// backendFrom connects to the listener from the local IP client and returns
+// the backend that answered
+func backendFrom(t *testing.T, client string, port int32) string {
+	t.Helper()
+	dialer := net.Dialer{Timeout: time.Second, LocalAddr: &net.TCPAddr{IP: net.ParseIP(client)}}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// Connections are dialed once the client speaks
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	ident, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(ident)
+}
+
+func TestSessionAffinityEndToEnd(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	backendPort := startIdentBackends(t, "127.0.0.2", "127.0.0.3")
+	port := freePort(t)
+
+	svc := testService("game", port, backendPort, "tcp")
+	svc.TargetIPs = []string{"127.0.0.2", "127.0.0.3"}
+	svc.SessionAffinity = "1h"
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := backendFrom(t, "127.0.0.10", port)
+	if second := backendFrom(t, "127.0.0.10", port); second != first {
+		t.Fatalf("same client reached %s and %s", first, second)
+	}
+	if other := backendFrom(t, "127.0.0.11", port); other == first {
+		t.Errorf("different clients were not spread, both reached %s", first)
+	}
+}
+
+func TestSessionAffinityUpdateKeepsListeners(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	port := freePort(t)
+
+	svc := testService("game", port, 8080, "tcp")
+	svc.TargetIPs = []string{"127.0.0.2", "127.0.0.3"}
+	svc.SessionAffinity = "1h"
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+	listener := registry.listeners[registry.portKey(port, "tcp")]
+	balancer := registry.balancers["game"]
+
+	svc.SessionAffinity = ""
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+	if registry.listeners[registry.portKey(port, "tcp")] != listener {
+		t.Error("listener restarted for an affinity change")
+	}
+	if registry.balancers["game"] != balancer || balancer.ttl != 0 {
+		t.Errorf("affinity change not applied to the running balancer (ttl %s)", balancer.ttl)
+	}
+
+	// Changed backends are picked up the same way
+	svc.TargetIPs = []string{"127.0.0.4"}
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+	if registry.listeners[registry.portKey(port, "tcp")] != listener {
+		t.Error("listener restarted for a backend change")
+	}
+	if got := balancer.pick("192.0.2.1", "fallback"); got != "127.0.0.4" {
+		t.Errorf("expected the new backend, got %s", got)
+	}
+}
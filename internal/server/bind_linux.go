@@ -0,0 +1,23 @@
+//go:build linux
+
+package server
+
+import (
+	"syscall"
+)
+
+// bindToDevice returns a dialer control function that pins the socket to a
+// network interface, so overlapping pod CIDRs behind different WireGuard
+// tunnels are routed through the right one
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
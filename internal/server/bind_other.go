@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"syscall"
+)
+
+// bindToDevice is a no-op on platforms without SO_BINDTODEVICE
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
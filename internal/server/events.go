@@ -0,0 +1,67 @@
+package server
+
+import (
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// RegistryEventType is the kind of change of a registry event
+type RegistryEventType string
+
+const (
+	RegistryEventAdded   RegistryEventType = "added"
+	RegistryEventUpdated RegistryEventType = "updated"
+	RegistryEventRemoved RegistryEventType = "removed"
+)
+
+// RegistryEvent describes a change of a single registered service
+type RegistryEvent struct {
+	Type      RegistryEventType
+	Subdomain string
+	Service   *types.ExposedService // Copy of the new configuration, nil on removal
+}
+
+// eventBufferSize is the number of events buffered per subscriber
+const eventBufferSize = 64
+
+// Subscribe returns a channel receiving every registry change and a
+// function to unsubscribe. Events are dropped for subscribers that fall
+// behind rather than blocking registry updates.
+func (r *ServiceRegistry) Subscribe() (<-chan RegistryEvent, func()) {
+	ch := make(chan RegistryEvent, eventBufferSize)
+
+	r.subMu.Lock()
+	r.subscribers[ch] = struct{}{}
+	r.subMu.Unlock()
+
+	unsubscribe := func() {
+		r.subMu.Lock()
+		defer r.subMu.Unlock()
+		if _, ok := r.subscribers[ch]; ok {
+			delete(r.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// emit fans out a change of a service to all subscribers, svc is nil for removals
+func (r *ServiceRegistry) emit(eventType RegistryEventType, subdomain string, svc *types.ExposedService) {
+	event := RegistryEvent{Type: eventType, Subdomain: subdomain}
+	if svc != nil {
+		copied := *svc
+		event.Service = &copied
+	}
+
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+
+	for ch := range r.subscribers {
+		select {
+		case ch <- event:
+		default:
+			r.logger.Warn("Dropping registry event for slow subscriber",
+				"type", eventType,
+				"subdomain", subdomain)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// nextEvent receives an event or fails the test after a second
+func nextEvent(t *testing.T, events <-chan RegistryEvent) RegistryEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no registry event received")
+		return RegistryEvent{}
+	}
+}
+
+func TestRegistryEvents(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	events, unsubscribe := registry.Subscribe()
+
+	web := testService("web", freePort(t), 8080, "tcp")
+	if _, err := registry.Update("agent", []types.ExposedService{web}); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Type != RegistryEventAdded || event.Subdomain != "web" || event.Service == nil || event.Service.TargetIP != "127.0.0.1" {
+		t.Errorf("unexpected add event %+v", event)
+	}
+
+	// Unchanged updates emit nothing, changes emit an update
+	if _, err := registry.Update("agent", []types.ExposedService{web}); err != nil {
+		t.Fatal(err)
+	}
+	web.TargetIP = "127.0.0.2"
+	if _, err := registry.Update("agent", []types.ExposedService{web}); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Type != RegistryEventUpdated || event.Service.TargetIP != "127.0.0.2" {
+		t.Errorf("unexpected update event %+v", event)
+	}
+
+	if err := registry.RemoveService("web"); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Type != RegistryEventRemoved || event.Subdomain != "web" || event.Service != nil {
+		t.Errorf("unexpected remove event %+v", event)
+	}
+	// Removing an unknown service emits nothing
+	if err := registry.RemoveService("web"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	default:
+	}
+
+	// Unsubscribing closes the channel and is safe to repeat
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Error("channel still open after unsubscribe")
+	}
+}
+
+func TestSlowSubscriberDoesNotBlock(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	slow, unsubscribe := registry.Subscribe()
+	defer unsubscribe()
+	fast, unsubscribeFast := registry.Subscribe()
+	defer unsubscribeFast()
+
+	// Nobody reads slow, so its buffer overflows while updates and the
+	// fast subscriber go on
+	port := freePort(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < eventBufferSize+10; i++ {
+			if _, err := registry.Update("agent", []types.ExposedService{testService("web", port, 8080, "tcp")}); err != nil {
+				t.Error(err)
+			}
+			if err := registry.RemoveService("web"); err != nil {
+				t.Error(err)
+			}
+			<-fast
+			<-fast
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("registry updates blocked by a slow subscriber")
+	}
+	if len(slow) != eventBufferSize {
+		t.Errorf("expected the slow subscriber's buffer to be full, got %d events", len(slow))
+	}
+}
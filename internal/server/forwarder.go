@@ -1,12 +1,33 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var udpPacketsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "k8s_exposer_udp_packets_dropped_total",
+	Help: "Total number of UDP packets dropped while forwarding by reason",
+}, []string{"reason"})
+
+var tcpDialRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "k8s_exposer_tcp_dial_retries_total",
+	Help: "Total number of retried TCP dials to backends",
+})
+
+// Default dial retry settings, see SetDialRetry
+const (
+	DefaultDialAttempts   = 3
+	DefaultDialRetryDelay = 100 * time.Millisecond
+	DefaultDialDeadline   = 10 * time.Second
 )
 
 // Forwarder handles traffic forwarding through Wireguard to K8s services
@@ -14,6 +35,15 @@ type Forwarder struct {
 	wireguardInterface string
 	udpSessions        map[string]*udpSession
 	udpMu              sync.RWMutex
+	stats              map[string]*ServiceStats // subdomain -> counters
+	statsMu            sync.Mutex
+	monitor            *interfaceMonitor
+	udpReadBuffer      int // Socket buffer sizes for UDP target connections (0 = OS default)
+	udpWriteBuffer     int
+	dialAttempts       int           // Dial attempts per TCP connection, including the first
+	dialRetryDelay     time.Duration // Delay before the first retry, doubled per retry
+	dialDeadline       time.Duration // Total time a connection may spend dialing
+	stopCh             chan struct{}
 	logger             *slog.Logger
 }
 
@@ -21,6 +51,7 @@ type Forwarder struct {
 type udpSession struct {
 	clientAddr *net.UDPAddr
 	targetConn *net.UDPConn
+	stats      *ServiceStats
 	lastActive time.Time
 	mu         sync.Mutex
 }
@@ -30,19 +61,120 @@ func NewForwarder(wireguardInterface string, logger *slog.Logger) *Forwarder {
 	f := &Forwarder{
 		wireguardInterface: wireguardInterface,
 		udpSessions:        make(map[string]*udpSession),
+		stats:              make(map[string]*ServiceStats),
+		monitor:            newInterfaceMonitor(wireguardInterface),
+		dialAttempts:       DefaultDialAttempts,
+		dialRetryDelay:     DefaultDialRetryDelay,
+		dialDeadline:       DefaultDialDeadline,
+		stopCh:             make(chan struct{}),
 		logger:             logger,
 	}
 
 	// Start UDP session cleanup goroutine
 	go f.cleanupUDPSessions()
 
+	// Keep the WireGuard interface state fresh for readiness and metrics
+	go f.monitor.run(f.stopCh)
+
 	return f
 }
 
-// ForwardTCP forwards TCP traffic to the target service
-func (f *Forwarder) ForwardTCP(client net.Conn, targetIP string, targetPort int32) error {
+// SetUDPBuffers sets the socket buffer sizes of UDP target connections,
+// 0 keeps the OS default
+func (f *Forwarder) SetUDPBuffers(readBuffer, writeBuffer int) {
+	f.udpMu.Lock()
+	defer f.udpMu.Unlock()
+	f.udpReadBuffer = readBuffer
+	f.udpWriteBuffer = writeBuffer
+}
+
+// SetDialRetry configures retries of failed TCP dials to a backend, e.g.
+// while a pod restarts. attempts includes the first dial (1 disables
+// retries), delay is doubled per retry and deadline bounds the total time
+// a client waits for the backend.
+func (f *Forwarder) SetDialRetry(attempts int, delay, deadline time.Duration) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	f.dialAttempts = attempts
+	f.dialRetryDelay = delay
+	f.dialDeadline = deadline
+}
+
+// WireguardStatus returns the last observed state of the WireGuard interface
+func (f *Forwarder) WireguardStatus() InterfaceStatus {
+	return f.monitor.Status()
+}
+
+// StatsFor returns the traffic counters for a service, creating them if needed
+func (f *Forwarder) StatsFor(subdomain string) *ServiceStats {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+
+	stats, exists := f.stats[subdomain]
+	if !exists {
+		stats = &ServiceStats{}
+		f.stats[subdomain] = stats
+	}
+	return stats
+}
+
+// lookupStats returns the traffic counters for a service without creating them
+func (f *Forwarder) lookupStats(subdomain string) (*ServiceStats, bool) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+
+	stats, exists := f.stats[subdomain]
+	return stats, exists
+}
+
+// removeStats drops the traffic counters of a removed service
+func (f *Forwarder) removeStats(subdomain string) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	delete(f.stats, subdomain)
+}
+
+// ForwardTarget is the backend a connection is forwarded to
+type ForwardTarget struct {
+	Interface    string // WireGuard interface (empty selects the default interface)
+	IP           string
+	Port         int32
+	FallbackIP   string // Dialed at FallbackPort when dialing IP fails (optional)
+	FallbackPort int32
+}
+
+// address returns the primary target address
+func (t ForwardTarget) address() string {
+	return net.JoinHostPort(t.IP, fmt.Sprint(t.Port))
+}
+
+// addresses returns the addresses to dial in order, the primary address
+// followed by the fallback address if one is configured
+func (t ForwardTarget) addresses() []string {
+	if fallback := t.fallbackAddress(); fallback != "" {
+		return []string{t.address(), fallback}
+	}
+	return []string{t.address()}
+}
+
+// fallbackAddress returns the fallback address, empty if none is configured
+func (t ForwardTarget) fallbackAddress() string {
+	if t.FallbackIP == "" || t.FallbackPort == 0 {
+		return ""
+	}
+	return net.JoinHostPort(t.FallbackIP, fmt.Sprint(t.FallbackPort))
+}
+
+// ForwardTCP forwards TCP traffic to the target service via its WireGuard
+// interface, falling back to the target's fallback address and retrying if
+// dialing fails. logger carries the connection's attributes (ID, subdomain).
+func (f *Forwarder) ForwardTCP(client net.Conn, initial []byte, dest ForwardTarget, stats *ServiceStats, logger *slog.Logger) error {
 	defer client.Close()
 
+	stats.connOpened()
+	defer stats.connClosed()
+
 	// Enable TCP keepalive on client connection
 	if tcpConn, ok := client.(*net.TCPConn); ok {
 		tcpConn.SetKeepAlive(true)
@@ -56,8 +188,9 @@ func (f *Forwarder) ForwardTCP(client net.Conn, targetIP string, targetPort int3
 	}
 
 	// Dial target via Wireguard interface
-	target, err := f.dialViaWireguard("tcp", fmt.Sprintf("%s:%d", targetIP, targetPort))
+	target, err := f.dialTarget(dest, logger)
 	if err != nil {
+		stats.addError()
 		return fmt.Errorf("failed to dial target: %w", err)
 	}
 	defer target.Close()
@@ -74,17 +207,28 @@ func (f *Forwarder) ForwardTCP(client net.Conn, targetIP string, targetPort int3
 		tcpConn.SetWriteBuffer(1 * 1024 * 1024) // 1MB
 	}
 
-	f.logger.Debug("TCP connection established", "target", fmt.Sprintf("%s:%d", targetIP, targetPort))
+	logger.Debug("TCP connection established", "target", target.RemoteAddr())
+
+	// Pass on bytes already read from the client before dialing
+	if len(initial) > 0 {
+		n, err := target.Write(initial)
+		stats.addBytesIn(n)
+		if err != nil {
+			stats.addError()
+			return fmt.Errorf("failed to write initial data: %w", err)
+		}
+	}
 
 	// Bidirectional copy with manual buffering (avoid splice syscall for WireGuard compatibility)
 	errCh := make(chan error, 2)
 
 	// Manual copy function to avoid splice
-	copyWithBuffer := func(dst, src net.Conn, buf []byte) error {
+	copyWithBuffer := func(dst, src net.Conn, buf []byte, count func(int)) error {
 		for {
 			nr, er := src.Read(buf)
 			if nr > 0 {
 				nw, ew := dst.Write(buf[0:nr])
+				count(nw)
 				if ew != nil {
 					return ew
 				}
@@ -104,14 +248,14 @@ func (f *Forwarder) ForwardTCP(client net.Conn, targetIP string, targetPort int3
 	// Client -> Target
 	go func() {
 		buf := make([]byte, 64*1024) // 64KB buffer (optimal for most networks)
-		err := copyWithBuffer(target, client, buf)
+		err := copyWithBuffer(target, client, buf, stats.addBytesIn)
 		errCh <- err
 	}()
 
 	// Target -> Client
 	go func() {
 		buf := make([]byte, 64*1024) // 64KB buffer
-		err := copyWithBuffer(client, target, buf)
+		err := copyWithBuffer(client, target, buf, stats.addBytesOut)
 		errCh <- err
 	}()
 
@@ -122,15 +266,17 @@ func (f *Forwarder) ForwardTCP(client net.Conn, targetIP string, targetPort int3
 	// Closing the connections will cause both to terminate
 
 	if err != nil && err != io.EOF {
+		stats.addError()
 		return fmt.Errorf("forwarding error: %w", err)
 	}
 
-	f.logger.Debug("TCP connection closed", "target", fmt.Sprintf("%s:%d", targetIP, targetPort))
+	logger.Debug("TCP connection closed", "target", target.RemoteAddr())
 	return nil
 }
 
-// ForwardUDP forwards UDP packets to the target service
-func (f *Forwarder) ForwardUDP(serverConn *net.UDPConn, clientAddr *net.UDPAddr, data []byte, targetIP string, targetPort int32) error {
+// ForwardUDP forwards UDP packets to the target service via its WireGuard
+// interface, falling back to the target's fallback address if dialing fails
+func (f *Forwarder) ForwardUDP(serverConn *net.UDPConn, clientAddr *net.UDPAddr, data []byte, dest ForwardTarget, stats *ServiceStats) error {
 	sessionKey := clientAddr.String()
 
 	// Get or create session
@@ -138,26 +284,47 @@ func (f *Forwarder) ForwardUDP(serverConn *net.UDPConn, clientAddr *net.UDPAddr,
 	session, exists := f.udpSessions[sessionKey]
 	if !exists {
 		// Create new session
-		targetAddr := fmt.Sprintf("%s:%d", targetIP, targetPort)
+		targetAddr := dest.address()
 		targetUDPAddr, err := net.ResolveUDPAddr("udp", targetAddr)
 		if err != nil {
 			f.udpMu.Unlock()
+			udpPacketsDropped.WithLabelValues("dial").Inc()
 			return fmt.Errorf("failed to resolve target address: %w", err)
 		}
 
 		// Dial target
-		targetConn, err := f.dialUDPViaWireguard(targetUDPAddr)
+		targetConn, err := f.dialUDPViaWireguard(dest.Interface, targetUDPAddr)
+		if err != nil && dest.fallbackAddress() != "" {
+			f.logger.Warn("Dialing UDP target failed, trying fallback",
+				"target", targetAddr,
+				"fallback", dest.fallbackAddress(),
+				"error", err)
+			targetAddr = dest.fallbackAddress()
+			if targetUDPAddr, err = net.ResolveUDPAddr("udp", targetAddr); err == nil {
+				targetConn, err = f.dialUDPViaWireguard(dest.Interface, targetUDPAddr)
+			}
+		}
+		if err == nil {
+			err = setUDPBuffers(targetConn, f.udpReadBuffer, f.udpWriteBuffer)
+			if err != nil {
+				targetConn.Close()
+			}
+		}
 		if err != nil {
 			f.udpMu.Unlock()
+			stats.addError()
+			udpPacketsDropped.WithLabelValues("dial").Inc()
 			return fmt.Errorf("failed to dial UDP target: %w", err)
 		}
 
 		session = &udpSession{
 			clientAddr: clientAddr,
 			targetConn: targetConn,
+			stats:      stats,
 			lastActive: time.Now(),
 		}
 		f.udpSessions[sessionKey] = session
+		stats.connOpened()
 
 		f.logger.Debug("UDP session created", "client", clientAddr, "target", targetAddr)
 
@@ -173,13 +340,24 @@ func (f *Forwarder) ForwardUDP(serverConn *net.UDPConn, clientAddr *net.UDPAddr,
 
 	// Forward packet to target
 	if _, err := session.targetConn.Write(data); err != nil {
+		session.stats.addError()
+		udpPacketsDropped.WithLabelValues("target_write").Inc()
 		return fmt.Errorf("failed to write to target: %w", err)
 	}
+	session.stats.addBytesIn(len(data))
 
 	f.logger.Debug("UDP packet forwarded", "client", clientAddr, "size", len(data))
 	return nil
 }
 
+// hasUDPSession reports whether a UDP session exists for a client
+func (f *Forwarder) hasUDPSession(clientAddr *net.UDPAddr) bool {
+	f.udpMu.RLock()
+	defer f.udpMu.RUnlock()
+	_, exists := f.udpSessions[clientAddr.String()]
+	return exists
+}
+
 // forwardUDPResponses forwards UDP responses from target back to client
 func (f *Forwarder) forwardUDPResponses(serverConn *net.UDPConn, session *udpSession, sessionKey string) {
 	buffer := make([]byte, 65535) // Max UDP packet size
@@ -217,8 +395,11 @@ func (f *Forwarder) forwardUDPResponses(serverConn *net.UDPConn, session *udpSes
 		// Forward response to client
 		if _, err := serverConn.WriteToUDP(buffer[:n], session.clientAddr); err != nil {
 			f.logger.Error("Failed to write UDP response to client", "error", err)
+			session.stats.addError()
+			udpPacketsDropped.WithLabelValues("client_write").Inc()
 			continue
 		}
+		session.stats.addBytesOut(n)
 
 		f.logger.Debug("UDP response forwarded", "client", session.clientAddr, "size", n)
 	}
@@ -231,16 +412,24 @@ func (f *Forwarder) removeUDPSession(sessionKey string) {
 
 	if session, exists := f.udpSessions[sessionKey]; exists {
 		session.targetConn.Close()
+		session.stats.connClosed()
 		delete(f.udpSessions, sessionKey)
 	}
 }
 
-// cleanupUDPSessions periodically cleans up inactive UDP sessions
+// cleanupUDPSessions periodically cleans up inactive UDP sessions until the
+// forwarder is closed
 func (f *Forwarder) cleanupUDPSessions() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case <-ticker.C:
+		}
+
 		f.udpMu.Lock()
 		now := time.Now()
 		for key, session := range f.udpSessions {
@@ -251,6 +440,7 @@ func (f *Forwarder) cleanupUDPSessions() {
 			if inactive {
 				f.logger.Debug("Cleaning up inactive UDP session", "client", session.clientAddr)
 				session.targetConn.Close()
+				session.stats.connClosed()
 				delete(f.udpSessions, key)
 			}
 		}
@@ -258,15 +448,81 @@ func (f *Forwarder) cleanupUDPSessions() {
 	}
 }
 
-// dialViaWireguard dials a TCP connection via the Wireguard interface
-func (f *Forwarder) dialViaWireguard(network, address string) (net.Conn, error) {
-	// For now, we'll use the default dialer
-	// In production, you might want to bind to a specific interface
+// outboundInterface returns the interface to dial through, defaulting to the global one
+func (f *Forwarder) outboundInterface(iface string) string {
+	if iface != "" {
+		return iface
+	}
+	return f.wireguardInterface
+}
+
+// dialer returns a dialer bound to the outbound interface when it exists on this host
+func (f *Forwarder) dialer(iface string) *net.Dialer {
 	dialer := &net.Dialer{
 		Timeout: 10 * time.Second,
 	}
 
-	conn, err := dialer.Dial(network, address)
+	iface = f.outboundInterface(iface)
+	if _, err := net.InterfaceByName(iface); err != nil {
+		// Interface not present (e.g. local development), use default routing
+		f.logger.Debug("Outbound interface not found, using default routing", "interface", iface)
+		return dialer
+	}
+
+	dialer.Control = bindToDevice(iface)
+	return dialer
+}
+
+// dialTarget dials a TCP target. Each attempt tries the backends in order,
+// the primary address before the fallback one. Failed attempts are retried
+// with backoff until the dial attempts or the dial deadline are used up.
+func (f *Forwarder) dialTarget(dest ForwardTarget, logger *slog.Logger) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.dialDeadline)
+	defer cancel()
+
+	addresses := dest.addresses()
+	delay := f.dialRetryDelay
+	for attempt := 1; ; attempt++ {
+		var err error
+		for i, address := range addresses {
+			var conn net.Conn
+			conn, err = f.dialViaWireguard(ctx, dest.Interface, "tcp", address)
+			if err == nil {
+				return conn, nil
+			}
+			if i+1 < len(addresses) {
+				logger.Warn("Dialing target failed, trying next backend",
+					"target", address,
+					"next", addresses[i+1],
+					"error", err)
+			}
+		}
+
+		if attempt >= f.dialAttempts {
+			return nil, err
+		}
+
+		logger.Debug("Dialing target failed, retrying",
+			"target", dest.address(),
+			"attempt", attempt,
+			"delay", delay,
+			"error", err)
+		tcpDialRetries.Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("dial deadline of %s exceeded: %w", f.dialDeadline, err)
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// dialViaWireguard dials a TCP connection via the Wireguard interface
+func (f *Forwarder) dialViaWireguard(ctx context.Context, iface, network, address string) (net.Conn, error) {
+	conn, err := f.dialer(iface).DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
@@ -275,24 +531,68 @@ func (f *Forwarder) dialViaWireguard(network, address string) (net.Conn, error)
 }
 
 // dialUDPViaWireguard dials a UDP connection via the Wireguard interface
-func (f *Forwarder) dialUDPViaWireguard(targetAddr *net.UDPAddr) (*net.UDPConn, error) {
-	// For now, we'll use the default dialer
-	// In production, you might want to bind to a specific interface
-	conn, err := net.DialUDP("udp", nil, targetAddr)
+func (f *Forwarder) dialUDPViaWireguard(iface string, targetAddr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := f.dialer(iface).Dial("udp", targetAddr.String())
 	if err != nil {
 		return nil, err
 	}
 
-	return conn, nil
+	return conn.(*net.UDPConn), nil
+}
+
+// setUDPBuffers applies socket buffer sizes to a UDP socket, 0 keeps the OS default
+func setUDPBuffers(conn *net.UDPConn, readBuffer, writeBuffer int) error {
+	if readBuffer > 0 {
+		if err := conn.SetReadBuffer(readBuffer); err != nil {
+			return fmt.Errorf("failed to set UDP read buffer: %w", err)
+		}
+	}
+	if writeBuffer > 0 {
+		if err := conn.SetWriteBuffer(writeBuffer); err != nil {
+			return fmt.Errorf("failed to set UDP write buffer: %w", err)
+		}
+	}
+	return nil
+}
+
+// InterfaceForAddr returns the name of the local interface owning addr, or ""
+// if it cannot be determined. Used to identify which WireGuard interface an
+// agent connected through.
+func InterfaceForAddr(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(tcpAddr.IP) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
 }
 
 // Close closes the forwarder and all active sessions
 func (f *Forwarder) Close() {
+	close(f.stopCh)
+
 	f.udpMu.Lock()
 	defer f.udpMu.Unlock()
 
 	for key, session := range f.udpSessions {
 		session.targetConn.Close()
+		session.stats.connClosed()
 		delete(f.udpSessions, key)
 	}
 
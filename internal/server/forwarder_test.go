@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// loopbackInterface returns the name of the loopback interface
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestOutboundInterface(t *testing.T) {
+	lo := loopbackInterface(t)
+	if got := InterfaceForAddr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}); got != lo {
+		t.Fatalf("expected %s for 127.0.0.1, got %q", lo, got)
+	}
+	if got := InterfaceForAddr(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}); got != "" {
+		t.Errorf("expected no interface for a foreign address, got %q", got)
+	}
+
+	forwarder := NewForwarder("wg-test", testLogger())
+	defer forwarder.Close()
+
+	// Services without an interface use the global one
+	if iface := forwarder.outboundInterface(""); iface != "wg-test" {
+		t.Errorf("expected the global interface, got %q", iface)
+	}
+	if iface := forwarder.outboundInterface("wg-cluster-b"); iface != "wg-cluster-b" {
+		t.Errorf("expected the service interface, got %q", iface)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	forwarder := NewForwarder("wg-test", testLogger())
+	defer forwarder.Close()
+	forwarder.SetDialRetry(5, 50*time.Millisecond, 5*time.Second)
+
+	// The backend only starts listening after the first dial failed
+	port := freePort(t)
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	before := testutil.ToFloat64(tcpDialRetries)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Cleanup(func() { ln.Close() })
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn)
+		}
+	}()
+
+	conn, err := forwarder.dialTarget(ForwardTarget{IP: "127.0.0.1", Port: port}, testLogger())
+	if err != nil {
+		t.Fatalf("retry did not reach the backend: %v", err)
+	}
+	conn.Close()
+	if retries := testutil.ToFloat64(tcpDialRetries) - before; retries < 1 {
+		t.Errorf("expected the dial to be retried, got %v retries", retries)
+	}
+}
+
+func TestDialRetryDeadline(t *testing.T) {
+	forwarder := NewForwarder("wg-test", testLogger())
+	defer forwarder.Close()
+	forwarder.SetDialRetry(100, 20*time.Millisecond, 200*time.Millisecond)
+
+	// Nothing ever listens, the deadline ends the retries long before the attempts
+	start := time.Now()
+	_, err := forwarder.dialTarget(ForwardTarget{IP: "127.0.0.1", Port: freePort(t)}, testLogger())
+	if err == nil || !strings.Contains(err.Error(), "dial deadline") {
+		t.Fatalf("expected the dial deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dialing took %s despite a 200ms deadline", elapsed)
+	}
+}
+
+func TestDialRetryNextBackend(t *testing.T) {
+	forwarder := NewForwarder("wg-test", testLogger())
+	defer forwarder.Close()
+	forwarder.SetDialRetry(1, time.Second, 5*time.Second)
+
+	// The primary backend is down, the next one answers within the same attempt
+	backend, dials := countingBackend(t)
+	start := time.Now()
+	conn, err := forwarder.dialTarget(ForwardTarget{IP: "127.0.0.1", Port: freePort(t), FallbackIP: "127.0.0.1", FallbackPort: backend}, testLogger())
+	if err != nil {
+		t.Fatalf("next backend not dialed: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected one dial of the next backend, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waited %s for a retry instead of trying the next backend", elapsed)
+	}
+}
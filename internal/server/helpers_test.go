@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// testLogger discards all log output
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestRegistry creates a registry whose listeners bind to loopback. The
+// forwarder dials through the default route as the interface doesn't exist.
+func newTestRegistry(t *testing.T) (*ServiceRegistry, *Forwarder) {
+	t.Helper()
+	return newTestRegistryWithConfig(t, ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1"})
+}
+
+// newTestRegistryWithConfig creates a registry with custom listener settings
+func newTestRegistryWithConfig(t *testing.T, config ListenerConfig) (*ServiceRegistry, *Forwarder) {
+	t.Helper()
+	forwarder := NewForwarder("wg-test", testLogger())
+	registry := NewServiceRegistry(30000, 30100, config, forwarder, testLogger())
+	t.Cleanup(func() {
+		registry.Close()
+		forwarder.Close()
+	})
+	return registry, forwarder
+}
+
+// testService returns a service forwarding port to a backend on loopback
+func testService(subdomain string, port, targetPort int32, protocol string) types.ExposedService {
+	return types.ExposedService{
+		Name:      subdomain,
+		Namespace: "default",
+		Subdomain: subdomain,
+		Ports:     []types.PortMapping{{Port: port, TargetPort: targetPort, Protocol: protocol}},
+		TargetIP:  "127.0.0.1",
+	}
+}
+
+// freePort returns a port that is currently unused for TCP and UDP on loopback
+func freePort(t *testing.T) int32 {
+	t.Helper()
+	for {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			continue
+		}
+		udp.Close()
+		return int32(port)
+	}
+}
+
+// startTCPBackend starts a TCP backend on ip serving each connection with
+// handle and returns its port
+func startTCPBackend(t *testing.T, ip string, handle func(net.Conn)) int32 {
+	t.Helper()
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return int32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// echo copies everything a connection receives back to it
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// startUDPEcho starts a UDP backend on loopback echoing every datagram and
+// returns its port
+func startUDPEcho(t *testing.T) int32 {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return int32(conn.LocalAddr().(*net.UDPAddr).Port)
+}
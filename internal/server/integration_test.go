@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/agent"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// exposedService returns an annotated Kubernetes service with endpoints
+// pointing at a backend on loopback
+func exposedService(subdomain string, port, backend int32) (*corev1.Service, *corev1.Endpoints) {
+	meta := metav1.ObjectMeta{
+		Name:      subdomain,
+		Namespace: "default",
+		Annotations: map[string]string{
+			agent.SubdomainAnnotation: subdomain,
+			agent.PortsAnnotation:     fmt.Sprintf("%d/tcp", port),
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: meta,
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Port: port, TargetPort: intstr.FromInt32(backend)}},
+		},
+	}
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: subdomain, Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "127.0.0.1"}},
+			Ports:     []corev1.EndpointPort{{Port: backend}},
+		}},
+	}
+	return svc, endpoints
+}
+
+// TestAgentToListener runs an agent against a server over loopback: the
+// agent discovers a service from a fake cluster, the server registers it and
+// its listener forwards to the backend
+func TestAgentToListener(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	addr := startAgentServer(t, registry, NewAgentRegistry(0))
+
+	backend := startTCPBackend(t, "127.0.0.1", echo)
+	port := freePort(t)
+	svc, endpoints := exposedService("web", port, backend)
+	clientset := fake.NewSimpleClientset(svc, endpoints)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	discover := func() []types.ExposedService {
+		t.Helper()
+		services, err := agent.DiscoverServices(ctx, clientset, agent.DiscoveryOptions{}, testLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return services
+	}
+
+	client := agent.NewServerClient(addr, testLogger())
+	statuses := make(chan []types.PortAllocation, 10)
+	client.SetStatusHandler(func(allocations []types.PortAllocation) { statuses <- allocations })
+
+	updates := agent.NewSnapshotBox()
+	updates.Put(discover())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx, updates)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		client.Close()
+	}()
+
+	// The server reports the allocation back to the agent
+	select {
+	case allocations := <-statuses:
+		if len(allocations) != 1 || allocations[0].AllocatedPort != port {
+			t.Fatalf("unexpected allocations: %+v", allocations)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no status from the server")
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn, "hello through the exposer")
+	conn.Close()
+
+	// Deleting the service in the cluster removes the listener
+	if err := clientset.CoreV1().Services("default").Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	updates.Put(discover())
+	select {
+	case allocations := <-statuses:
+		if len(allocations) != 0 {
+			t.Fatalf("expected no allocations, got %+v", allocations)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no status after the removal")
+	}
+	if _, exists := registry.GetService("web"); exists {
+		t.Error("service still registered after it was deleted in the cluster")
+	}
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), 100*time.Millisecond); err == nil {
+		conn.Close()
+		t.Error("listener still accepts connections after the service was deleted")
+	}
+}
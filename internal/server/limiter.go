@@ -0,0 +1,36 @@
+package server
+
+// connLimiter bounds the number of concurrent connections of a service
+type connLimiter struct {
+	slots chan struct{}
+}
+
+// newConnLimiter creates a limiter for max concurrent connections;
+// max <= 0 means unlimited and returns nil
+func newConnLimiter(max int32) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{slots: make(chan struct{}, max)}
+}
+
+// tryAcquire reserves a slot without blocking, reporting whether one was free
+func (l *connLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot reserved by tryAcquire
+func (l *connLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
@@ -5,47 +5,94 @@ import (
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/noahjeana/k8s-exposer/pkg/types"
 )
 
+// ListenerConfig contains settings shared by all port listeners
+type ListenerConfig struct {
+	TCPBindIP string // Address TCP listeners bind to (default 0.0.0.0)
+	UDPBindIP string // Address UDP listeners bind to (default 0.0.0.0)
+
+	// FirstByteTimeout drops TCP clients that send nothing within this window
+	// before a backend connection is dialed (0 disables). Services marked as
+	// server-first are dialed immediately.
+	FirstByteTimeout time.Duration
+
+	// Socket buffer sizes for UDP listeners (0 = OS default). Larger receive
+	// buffers absorb bursts that would otherwise be dropped by the kernel.
+	UDPReadBuffer  int
+	UDPWriteBuffer int
+}
+
+// connIDs numbers accepted TCP connections so all log lines of a
+// connection can be correlated
+var connIDs atomic.Uint64
+
 // PortListener manages a listener for a specific port and protocol
 type PortListener struct {
 	port      int32
 	protocol  string
-	target    types.ExposedService
+	config    ListenerConfig
 	forwarder *Forwarder
+	stats     *ServiceStats
+	limiter   *connLimiter
+	balancer  *backendBalancer
 	logger    *slog.Logger
 
+	// Service and requested mapping served by the listener, replaced in
+	// place when only the forwarding target changes
+	targetMu sync.RWMutex
+	target   types.ExposedService
+	mapping  types.PortMapping
+
+	// Drained listeners keep the port bound but refuse new connections
+	// and UDP sessions, established ones continue
+	drained atomic.Bool
+
 	// For TCP
 	tcpListener net.Listener
 
 	// For UDP
 	udpConn *net.UDPConn
 
-	stopCh chan struct{}
-	wg     sync.WaitGroup
+	// Active forwarded TCP connections, tracked for draining
+	conns   map[net.Conn]struct{}
+	connsMu sync.Mutex
+	connWg  sync.WaitGroup
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
-// NewPortListener creates a new port listener
-func NewPortListener(port int32, protocol string, target types.ExposedService, forwarder *Forwarder, logger *slog.Logger) *PortListener {
+// NewPortListener creates a new port listener on port serving a port mapping of target
+func NewPortListener(port int32, mapping types.PortMapping, target types.ExposedService, config ListenerConfig, limiter *connLimiter, balancer *backendBalancer, forwarder *Forwarder, logger *slog.Logger) *PortListener {
 	return &PortListener{
 		port:      port,
-		protocol:  protocol,
+		protocol:  mapping.Protocol,
 		target:    target,
+		mapping:   mapping,
+		config:    config,
 		forwarder: forwarder,
+		stats:     forwarder.StatsFor(target.Subdomain),
+		limiter:   limiter,
+		balancer:  balancer,
 		logger:    logger,
+		conns:     make(map[net.Conn]struct{}),
 		stopCh:    make(chan struct{}),
 	}
 }
 
 // Start starts the port listener
 func (pl *PortListener) Start() error {
-	pl.logger.Info("Starting listener",
-		"subdomain", pl.target.Subdomain,
-		"port", pl.port,
-		"protocol", pl.protocol,
-		"target", fmt.Sprintf("%s:%d", pl.target.TargetIP, pl.getTargetPort()))
+	args := []any{"subdomain", pl.service().Subdomain, "port", pl.port, "protocol", pl.protocol}
+	for _, protocol := range portProtocols(pl.protocol) {
+		args = append(args, protocol+"_target", pl.forwardTarget(protocol).address())
+	}
+	pl.logger.Info("Starting listener", args...)
 
 	switch pl.protocol {
 	case "tcp":
@@ -68,8 +115,19 @@ func (pl *PortListener) Start() error {
 
 // startTCP starts a TCP listener
 func (pl *PortListener) startTCP() error {
-	// Bind explicitly to 0.0.0.0 (IPv4) to ensure HAProxy can connect via localhost/127.0.0.1
-	listener, err := net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", pl.port))
+	// Bind explicitly to IPv4 (0.0.0.0 by default) to ensure HAProxy can connect via localhost/127.0.0.1
+	bindIP, err := parseBindIP(pl.config.TCPBindIP)
+	if err != nil {
+		return fmt.Errorf("failed to start TCP listener: %w", err)
+	}
+
+	// An IPv6 bind address (e.g. :: or ::1) cannot be served by a tcp4 socket
+	network := "tcp4"
+	if bindIP.To4() == nil {
+		network = "tcp"
+	}
+
+	listener, err := net.Listen(network, net.JoinHostPort(bindIP.String(), fmt.Sprint(pl.port)))
 	if err != nil {
 		return fmt.Errorf("failed to start TCP listener: %w", err)
 	}
@@ -77,39 +135,52 @@ func (pl *PortListener) startTCP() error {
 	pl.tcpListener = listener
 
 	pl.wg.Add(1)
-	go pl.acceptTCPConnections()
+	go pl.acceptTCPConnections(listener)
 
-	pl.logger.Info("TCP listener started", "port", pl.port)
+	pl.logger.Info("TCP listener started", "port", pl.port, "bind", bindIP)
 	return nil
 }
 
 // startUDP starts a UDP listener
 func (pl *PortListener) startUDP() error {
+	bindIP, err := parseBindIP(pl.config.UDPBindIP)
+	if err != nil {
+		return fmt.Errorf("failed to start UDP listener: %w", err)
+	}
+
 	addr := &net.UDPAddr{
 		Port: int(pl.port),
-		IP:   net.IPv4zero,
+		IP:   bindIP,
 	}
 
+	// Responses are written back through this socket, so binding a specific
+	// address makes clients see replies from the address they sent to
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to start UDP listener: %w", err)
 	}
 
+	if err := setUDPBuffers(conn, pl.config.UDPReadBuffer, pl.config.UDPWriteBuffer); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start UDP listener: %w", err)
+	}
+
 	pl.udpConn = conn
 
 	pl.wg.Add(1)
-	go pl.receiveUDPPackets()
+	go pl.receiveUDPPackets(conn)
 
-	pl.logger.Info("UDP listener started", "port", pl.port)
+	pl.logger.Info("UDP listener started", "port", pl.port, "bind", bindIP)
 	return nil
 }
 
-// acceptTCPConnections accepts incoming TCP connections
-func (pl *PortListener) acceptTCPConnections() {
+// acceptTCPConnections accepts incoming TCP connections. The listener is
+// passed in because Stop clears pl.tcpListener while this may still start.
+func (pl *PortListener) acceptTCPConnections(listener net.Listener) {
 	defer pl.wg.Done()
 
 	for {
-		conn, err := pl.tcpListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-pl.stopCh:
@@ -120,28 +191,87 @@ func (pl *PortListener) acceptTCPConnections() {
 			}
 		}
 
-		pl.logger.Debug("TCP connection accepted", "remote", conn.RemoteAddr())
+		logger := pl.logger.With("conn_id", connIDs.Add(1), "subdomain", pl.service().Subdomain)
+		logger.Debug("TCP connection accepted", "remote", conn.RemoteAddr())
+
+		// Refuse new connections while the service is drained
+		if pl.drained.Load() {
+			logger.Debug("Service drained, rejecting connection",
+				"remote", conn.RemoteAddr())
+			pl.stats.addRejected()
+			conn.Close()
+			continue
+		}
+
+		// Refuse connections over the service's connection limit
+		if !pl.limiter.tryAcquire() {
+			logger.Warn("Connection limit reached, rejecting connection",
+				"remote", conn.RemoteAddr(),
+				"max_connections", pl.service().MaxConnections)
+			pl.stats.addRejected()
+			conn.Close()
+			continue
+		}
 
 		// Handle connection in a new goroutine
-		go pl.handleTCPConnection(conn)
+		pl.trackConn(conn)
+		go pl.handleTCPConnection(conn, logger)
 	}
 }
 
-// handleTCPConnection handles a single TCP connection
-func (pl *PortListener) handleTCPConnection(conn net.Conn) {
-	targetPort := pl.getTargetPort()
+// handleTCPConnection handles a single TCP connection, logging with the
+// connection's logger
+func (pl *PortListener) handleTCPConnection(conn net.Conn, logger *slog.Logger) {
+	defer pl.untrackConn(conn)
+	defer pl.limiter.release()
+
+	target := pl.backendTarget("tcp", conn.RemoteAddr())
+
+	// Wait for the client to speak before tying up a backend connection
+	var initial []byte
+	if pl.config.FirstByteTimeout > 0 && !pl.service().ServerFirst {
+		data, err := pl.readFirstBytes(conn)
+		if err != nil {
+			logger.Debug("Dropping idle TCP connection",
+				"client", conn.RemoteAddr(),
+				"error", err)
+			pl.stats.addRejected()
+			conn.Close()
+			return
+		}
+		initial = data
+	}
 
-	pl.logger.Debug("Forwarding TCP connection",
+	logger.Debug("Forwarding TCP connection",
 		"client", conn.RemoteAddr(),
-		"target", fmt.Sprintf("%s:%d", pl.target.TargetIP, targetPort))
+		"target", target.address())
 
-	if err := pl.forwarder.ForwardTCP(conn, pl.target.TargetIP, targetPort); err != nil {
-		pl.logger.Error("TCP forwarding failed", "error", err)
+	if err := pl.forwarder.ForwardTCP(conn, initial, target, pl.stats, logger); err != nil {
+		logger.Error("TCP forwarding failed", "error", err)
 	}
 }
 
-// receiveUDPPackets receives and forwards UDP packets
-func (pl *PortListener) receiveUDPPackets() {
+// readFirstBytes reads the client's first bytes within the first byte timeout
+func (pl *PortListener) readFirstBytes(conn net.Conn) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(pl.config.FirstByteTimeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// receiveUDPPackets receives and forwards UDP packets. The socket is passed
+// in because Stop clears pl.udpConn while this may still start.
+func (pl *PortListener) receiveUDPPackets(conn *net.UDPConn) {
 	defer pl.wg.Done()
 
 	buffer := make([]byte, 65535) // Max UDP packet size
@@ -153,7 +283,7 @@ func (pl *PortListener) receiveUDPPackets() {
 		default:
 		}
 
-		n, clientAddr, err := pl.udpConn.ReadFromUDP(buffer)
+		n, clientAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			select {
 			case <-pl.stopCh:
@@ -166,39 +296,104 @@ func (pl *PortListener) receiveUDPPackets() {
 
 		pl.logger.Debug("UDP packet received", "client", clientAddr, "size", n)
 
-		// Forward packet
-		targetPort := pl.getTargetPort()
+		// Only existing sessions are served while the service is drained
+		if pl.drained.Load() && !pl.forwarder.hasUDPSession(clientAddr) {
+			udpPacketsDropped.WithLabelValues("drained").Inc()
+			continue
+		}
+
+		// Forward packet, a backend is only picked for new sessions
+		target := pl.forwardTarget("udp")
+		if !pl.forwarder.hasUDPSession(clientAddr) {
+			target = pl.backendTarget("udp", clientAddr)
+		}
 		data := make([]byte, n)
 		copy(data, buffer[:n])
 
 		go func() {
-			if err := pl.forwarder.ForwardUDP(pl.udpConn, clientAddr, data, pl.target.TargetIP, targetPort); err != nil {
+			if err := pl.forwarder.ForwardUDP(conn, clientAddr, data, target, pl.stats); err != nil {
 				pl.logger.Error("UDP forwarding failed", "error", err)
 			}
 		}()
 	}
 }
 
-// Stop stops the port listener
+// Stop stops the port listener. It is safe to call more than once, e.g. when
+// a service is removed while the registry drains it.
 func (pl *PortListener) Stop() error {
-	pl.logger.Info("Stopping listener", "port", pl.port, "protocol", pl.protocol)
+	pl.stopOnce.Do(func() {
+		pl.logger.Info("Stopping listener", "port", pl.port, "protocol", pl.protocol)
 
-	close(pl.stopCh)
+		close(pl.stopCh)
 
-	if pl.tcpListener != nil {
-		pl.stopTCP()
-	}
+		if pl.tcpListener != nil {
+			pl.stopTCP()
+		}
 
-	if pl.udpConn != nil {
-		pl.stopUDP()
+		if pl.udpConn != nil {
+			pl.stopUDP()
+		}
+
+		pl.wg.Wait()
+
+		pl.logger.Info("Listener stopped", "port", pl.port, "protocol", pl.protocol)
+	})
+	return nil
+}
+
+// Drain stops accepting new connections and waits up to timeout for active
+// TCP connections to finish before closing the remaining ones
+func (pl *PortListener) Drain(timeout time.Duration) error {
+	pl.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		pl.connWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		pl.logger.Info("Listener drained", "port", pl.port, "protocol", pl.protocol)
+		return nil
+	case <-time.After(timeout):
 	}
 
-	pl.wg.Wait()
+	pl.connsMu.Lock()
+	remaining := len(pl.conns)
+	for conn := range pl.conns {
+		conn.Close()
+	}
+	pl.connsMu.Unlock()
 
-	pl.logger.Info("Listener stopped", "port", pl.port, "protocol", pl.protocol)
+	pl.logger.Warn("Drain timeout, closed remaining connections",
+		"port", pl.port,
+		"protocol", pl.protocol,
+		"connections", remaining)
 	return nil
 }
 
+// setDrained stops (true) or resumes (false) accepting new connections
+func (pl *PortListener) setDrained(drained bool) {
+	pl.drained.Store(drained)
+}
+
+// trackConn registers an active TCP connection
+func (pl *PortListener) trackConn(conn net.Conn) {
+	pl.connsMu.Lock()
+	defer pl.connsMu.Unlock()
+	pl.conns[conn] = struct{}{}
+	pl.connWg.Add(1)
+}
+
+// untrackConn unregisters a finished TCP connection
+func (pl *PortListener) untrackConn(conn net.Conn) {
+	pl.connsMu.Lock()
+	defer pl.connsMu.Unlock()
+	delete(pl.conns, conn)
+	pl.connWg.Done()
+}
+
 // stopTCP stops the TCP listener
 func (pl *PortListener) stopTCP() {
 	if pl.tcpListener != nil {
@@ -215,18 +410,58 @@ func (pl *PortListener) stopUDP() {
 	}
 }
 
-// getTargetPort returns the target port for this listener
-func (pl *PortListener) getTargetPort() int32 {
-	// Find the matching port in the target service
-	for _, portMapping := range pl.target.Ports {
-		if portMapping.Protocol == pl.protocol || portMapping.Protocol == "tcp+udp" {
-			// Use TargetPort if available (for NodePort services), otherwise use Port
-			if portMapping.TargetPort != 0 {
-				return portMapping.TargetPort
-			}
-			return portMapping.Port
-		}
+// service returns the service the listener currently serves
+func (pl *PortListener) service() types.ExposedService {
+	pl.targetMu.RLock()
+	defer pl.targetMu.RUnlock()
+	return pl.target
+}
+
+// setTarget updates the service and mapping in place. New connections and
+// UDP sessions use the new target, established ones keep theirs.
+func (pl *PortListener) setTarget(target types.ExposedService, mapping types.PortMapping) {
+	pl.targetMu.Lock()
+	defer pl.targetMu.Unlock()
+	pl.target = target
+	pl.mapping = mapping
+}
+
+// forwardTarget returns the backend traffic of protocol ("tcp" or "udp")
+// is forwarded to, including the NodeIP/NodePort fallback for services that
+// opted into it. The sub-listeners of a tcp+udp mapping each pick their own
+// target port.
+func (pl *PortListener) forwardTarget(protocol string) ForwardTarget {
+	pl.targetMu.RLock()
+	defer pl.targetMu.RUnlock()
+
+	target := ForwardTarget{
+		Interface: pl.target.Interface,
+		IP:        pl.target.TargetIP,
+		Port:      pl.mapping.TargetPortFor(protocol),
+	}
+	if pl.target.NodeFallback {
+		target.FallbackIP = pl.target.NodeIP
+		target.FallbackPort = pl.mapping.NodePort
+	}
+	return target
+}
+
+// backendTarget returns the forward target of a new connection or UDP
+// session from client, with the backend IP picked by the service's balancer
+func (pl *PortListener) backendTarget(protocol string, client net.Addr) ForwardTarget {
+	target := pl.forwardTarget(protocol)
+	target.IP = pl.balancer.pick(clientIP(client), target.IP)
+	return target
+}
+
+// parseBindIP parses a listener bind address, defaulting to 0.0.0.0
+func parseBindIP(addr string) (net.IP, error) {
+	if addr == "" {
+		return net.IPv4zero, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid bind address %q", addr)
 	}
-	// Fallback to the listener port
-	return pl.port
+	return ip, nil
 }
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// countingBackend starts an echo backend counting the connections it accepted
+func countingBackend(t *testing.T) (int32, *atomic.Int32) {
+	t.Helper()
+	var dials atomic.Int32
+	port := startTCPBackend(t, "127.0.0.1", func(conn net.Conn) {
+		dials.Add(1)
+		echo(conn)
+	})
+	return port, &dials
+}
+
+func TestSilentClientReaped(t *testing.T) {
+	registry, _ := newTestRegistryWithConfig(t, ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1", FirstByteTimeout: 100 * time.Millisecond})
+	backend, dials := countingBackend(t)
+	port := freePort(t)
+	if _, err := registry.Update("agent", []types.ExposedService{testService("web", port, backend, "tcp")}); err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	silent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the silent client to be dropped, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("silent client dropped after %s", elapsed)
+	}
+	if n := dials.Load(); n != 0 {
+		t.Errorf("backend dialed %d times for a silent client", n)
+	}
+	if stats, _ := registry.GetStats("web"); stats.Rejected != 1 {
+		t.Errorf("expected one rejected connection, got %d", stats.Rejected)
+	}
+
+	// A client speaking within the window is forwarded including its first bytes
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected one backend dial, got %d", n)
+	}
+}
+
+func TestServerFirstDialsImmediately(t *testing.T) {
+	registry, _ := newTestRegistryWithConfig(t, ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1", FirstByteTimeout: 100 * time.Millisecond})
+	backend := startTCPBackend(t, "127.0.0.1", func(conn net.Conn) {
+		conn.Write([]byte("220 ready\r\n"))
+		io.Copy(io.Discard, conn)
+	})
+	port := freePort(t)
+	svc := testService("mail", port, backend, "tcp")
+	svc.ServerFirst = true
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend greets the client, which never has to send anything
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len("220 ready\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "220 ready\r\n" {
+		t.Fatalf("expected the backend greeting, got %q (%v)", buf, err)
+	}
+}
+
+func TestNodeFallback(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	nodePort, dials := countingBackend(t)
+	listenPort := freePort(t)
+
+	// Nothing listens on the pod port, so only the node path can answer
+	svc := testService("web", listenPort, freePort(t), "tcp")
+	svc.NodeFallback = true
+	svc.NodeIP = "127.0.0.1"
+	svc.Ports[0].NodePort = nodePort
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(listenPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected one dial of the node port, got %d", n)
+	}
+}
+
+func TestDrainedListener(t *testing.T) {
+	registry, forwarder := newTestRegistry(t)
+	tcpBackend, dials := countingBackend(t)
+	udpBackend := startUDPEcho(t)
+	tcpPort, udpPort := freePort(t), freePort(t)
+	svc := testService("game", tcpPort, tcpBackend, "tcp")
+	svc.Ports = append(svc.Ports, types.PortMapping{Port: udpPort, TargetPort: udpBackend, Protocol: "udp"})
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr := net.JoinHostPort("127.0.0.1", fmt.Sprint(tcpPort))
+	udpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(udpPort)}
+
+	established, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer established.Close()
+	roundTrip(t, established, "before draining")
+	session, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	udpRoundTrip(t, session, udpAddr, "before draining")
+
+	if !registry.SetDrained("game", true) || !registry.IsDrained("game") {
+		t.Fatal("service not drained")
+	}
+
+	// New TCP connections are closed without reaching the backend
+	refused, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatalf("drained port no longer bound: %v", err)
+	}
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the new connection to be closed, got %v", err)
+	}
+	if got := dials.Load(); got != 1 {
+		t.Errorf("expected only the established connection at the backend, got %d", got)
+	}
+
+	// New UDP clients are dropped, the existing session continues
+	newClient, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newClient.Close()
+	newClient.WriteToUDP([]byte("while drained"), udpAddr)
+	udpRoundTrip(t, session, udpAddr, "existing session")
+	if forwarder.hasUDPSession(newClient.LocalAddr().(*net.UDPAddr)) {
+		t.Error("UDP session created for a new client while drained")
+	}
+
+	// Established connections continue
+	roundTrip(t, established, "while drained")
+
+	// Undraining accepts new connections again
+	registry.SetDrained("game", false)
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "after undraining")
+	udpRoundTrip(t, newClient, udpAddr, "after undraining")
+
+	if registry.SetDrained("missing", true) {
+		t.Error("expected draining an unknown service to fail")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writers
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConnectionLogsShareID(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	forwarder := NewForwarder("wg-test", logger)
+	registry := NewServiceRegistry(30000, 30100, ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1"}, forwarder, logger)
+	t.Cleanup(func() {
+		registry.Close()
+		forwarder.Close()
+	})
+	backend := startTCPBackend(t, "127.0.0.1", echo)
+	port := freePort(t)
+	if _, err := registry.Update("agent", []types.ExposedService{testService("web", port, backend, "tcp")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, conn, "hello")
+		conn.Close()
+	}
+
+	// Collect the IDs of each connection's lifecycle records
+	ids := map[string][]float64{}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ids["TCP connection closed"]) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		ids = map[string][]float64{}
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var record struct {
+				Msg       string  `json:"msg"`
+				ConnID    float64 `json:"conn_id"`
+				Subdomain string  `json:"subdomain"`
+			}
+			if err := json.Unmarshal([]byte(line), &record); err != nil || record.ConnID == 0 {
+				continue
+			}
+			if record.Subdomain != "web" {
+				t.Fatalf("connection record without the subdomain: %s", line)
+			}
+			ids[record.Msg] = append(ids[record.Msg], record.ConnID)
+		}
+	}
+
+	// Every record of a connection carries the ID assigned at accept time
+	accepted := ids["TCP connection accepted"]
+	sort.Float64s(accepted)
+	if len(accepted) != 2 || accepted[0] == accepted[1] {
+		t.Fatalf("expected two distinct connection IDs, got %v", accepted)
+	}
+	for _, msg := range []string{"Forwarding TCP connection", "TCP connection established", "TCP connection closed"} {
+		got := ids[msg]
+		sort.Float64s(got)
+		if !reflect.DeepEqual(got, accepted) {
+			t.Errorf("%q records carry IDs %v, accepted connections %v", msg, got, accepted)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+// portPool hands out fallback ports from a range using a next-fit cursor, so
+// consecutive allocations continue where the last one stopped instead of
+// rescanning the range from its start
+type portPool struct {
+	start int32
+	end   int32
+	next  int32
+	used  int32 // Allocated ports inside the range
+}
+
+// newPortPool creates a pool for the inclusive range start-end
+func newPortPool(start, end int32) *portPool {
+	return &portPool{start: start, end: end, next: start}
+}
+
+// allocate returns the first port from the cursor on for which free reports
+// true, wrapping around once, and false if the range is exhausted
+func (p *portPool) allocate(free func(int32) bool) (int32, bool) {
+	size := p.end - p.start + 1
+	for i := int32(0); i < size; i++ {
+		port := p.start + (p.next-p.start+i)%size
+		if !free(port) {
+			continue
+		}
+		p.next = port + 1
+		if p.next > p.end {
+			p.next = p.start
+		}
+		return port, true
+	}
+	return 0, false
+}
+
+// contains reports whether port is part of the range
+func (p *portPool) contains(port int32) bool {
+	return port >= p.start && port <= p.end
+}
+
+// free returns the number of ports in the range that are not allocated
+func (p *portPool) free() int32 {
+	return p.end - p.start + 1 - p.used
+}
+
+// portProtocols returns the transport protocols a listener protocol occupies
+func portProtocols(protocol string) []string {
+	if protocol == "tcp+udp" {
+		return []string{"tcp", "udp"}
+	}
+	return []string{protocol}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPortPoolNextFit(t *testing.T) {
+	pool := newPortPool(100, 103)
+	used := map[int32]bool{101: true}
+	free := func(p int32) bool { return !used[p] }
+
+	// Allocations continue after the last port and skip used ones
+	var got []int32
+	for i := 0; i < 3; i++ {
+		port, ok := pool.allocate(free)
+		if !ok {
+			t.Fatalf("allocation %d failed", i)
+		}
+		used[port] = true
+		got = append(got, port)
+	}
+	if want := []int32{100, 102, 103}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if _, ok := pool.allocate(free); ok {
+		t.Error("expected the exhausted range to fail")
+	}
+
+	// Released ports are found again after wrapping around
+	delete(used, 100)
+	if port, ok := pool.allocate(free); !ok || port != 100 {
+		t.Errorf("expected the wrapped-around port 100, got %d (%v)", port, ok)
+	}
+}
+
+func TestUDPPortRangeIsolation(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	registry.SetUDPPortRange(31000, 31001)
+
+	// Every protocol holds port 53, forcing fallbacks
+	for _, protocol := range []string{"tcp", "udp"} {
+		if _, err := registry.AllocatePort(53, protocol); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allocate := func(protocol string) int32 {
+		t.Helper()
+		port, err := registry.AllocatePort(53, protocol)
+		if err != nil {
+			t.Fatalf("%s allocation failed: %v", protocol, err)
+		}
+		return port
+	}
+
+	if port := allocate("udp"); port != 31000 {
+		t.Errorf("expected UDP to fall back into its own range, got %d", port)
+	}
+	if port := allocate("tcp"); port != 30000 {
+		t.Errorf("expected TCP to fall back into the TCP range, got %d", port)
+	}
+	// tcp+udp ports come from the TCP range and occupy both protocols there
+	if port := allocate("tcp+udp"); port != 30001 {
+		t.Errorf("expected tcp+udp to fall back into the TCP range, got %d", port)
+	}
+	if port := allocate("udp"); port != 31001 {
+		t.Errorf("expected the next UDP port, got %d", port)
+	}
+
+	// Exhausting the UDP range leaves the TCP range usable
+	if _, err := registry.AllocatePort(53, "udp"); err == nil {
+		t.Error("expected the UDP range to be exhausted")
+	}
+	if port := allocate("tcp"); port != 30002 {
+		t.Errorf("expected TCP allocations to continue, got %d", port)
+	}
+}
+
+func BenchmarkAllocatePort(b *testing.B) {
+	const ports = 5000
+	forwarder := NewForwarder("wg-test", testLogger())
+	defer forwarder.Close()
+
+	for i := 0; i < b.N; i++ {
+		registry := NewServiceRegistry(30000, 30000+ports-1, ListenerConfig{}, forwarder, testLogger())
+		if _, err := registry.AllocatePort(80, "tcp"); err != nil {
+			b.Fatal(err)
+		}
+		// Every further request for port 80 conflicts and takes a fallback
+		for j := 0; j < ports; j++ {
+			if _, err := registry.AllocatePort(80, "tcp"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		registry.Close()
+	}
+}
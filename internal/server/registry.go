@@ -1,79 +1,340 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/noahjeana/k8s-exposer/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var strictPortConflicts = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "k8s_exposer_strict_port_conflicts_total",
+	Help: "Total number of service updates rejected because a strict port was already in use",
+})
+
+var servicesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "k8s_exposer_services_rejected_total",
+	Help: "Total number of services rejected by the registry by reason",
+}, []string{"reason"})
+
+// DefaultMaxServices is the default limit of registered services, unlimited
+// unless MAX_SERVICES opts in
+const DefaultMaxServices = 0
+
+var portFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "k8s_exposer_port_fallback_total",
+	Help: "Total number of ports allocated from the fallback range because the requested port was in use",
+}, []string{"protocol"})
+
+var portsAvailable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "k8s_exposer_ports_available",
+	Help: "Number of free ports left in the fallback range",
+}, []string{"protocol"})
+
 // ServiceRegistry maintains a registry of exposed services and their listeners
 type ServiceRegistry struct {
-	services       map[string]*types.ExposedService // subdomain -> service
-	listeners      map[string]*PortListener         // "port:protocol" -> listener
-	allocatedPorts map[string]bool                  // "port:protocol" -> allocated
-	portRangeStart int32
-	portRangeEnd   int32
+	services       map[string]*types.ExposedService  // subdomain -> service
+	listeners      map[string]*PortListener          // "port:protocol" -> listener
+	allocatedPorts map[string]bool                   // "port:tcp" or "port:udp" -> allocated
+	allocations    map[string][]types.PortAllocation // subdomain -> allocated ports
+	limiters       map[string]*connLimiter           // subdomain -> shared connection limit
+	balancers      map[string]*backendBalancer       // subdomain -> shared backend selection
+	drained        map[string]bool                   // subdomain -> refusing new connections
+	owners         map[string]string                 // subdomain -> ID of the agent that sent it
+	agents         *AgentRegistry                    // Connected agents, whose subdomains others cannot take over
+	tcpPool        *portPool
+	udpPool        *portPool
+	listenerConfig ListenerConfig
+	maxServices    int // 0 = unlimited
 	mu             sync.RWMutex
 	logger         *slog.Logger
 	forwarder      *Forwarder
+	closed         bool // Shut down, updates are refused
+	firstUpdate    chan struct{}
+	firstOnce      sync.Once
+
+	// Change event subscribers
+	subMu       sync.Mutex
+	subscribers map[chan RegistryEvent]struct{}
 }
 
+// ErrRegistryClosed is returned for updates after the registry was shut down
+var ErrRegistryClosed = errors.New("service registry is shut down")
+
 // NewServiceRegistry creates a new service registry
-func NewServiceRegistry(portRangeStart, portRangeEnd int32, forwarder *Forwarder, logger *slog.Logger) *ServiceRegistry {
-	return &ServiceRegistry{
+func NewServiceRegistry(portRangeStart, portRangeEnd int32, listenerConfig ListenerConfig, forwarder *Forwarder, logger *slog.Logger) *ServiceRegistry {
+	r := &ServiceRegistry{
 		services:       make(map[string]*types.ExposedService),
 		listeners:      make(map[string]*PortListener),
 		allocatedPorts: make(map[string]bool),
-		portRangeStart: portRangeStart,
-		portRangeEnd:   portRangeEnd,
+		allocations:    make(map[string][]types.PortAllocation),
+		limiters:       make(map[string]*connLimiter),
+		balancers:      make(map[string]*backendBalancer),
+		drained:        make(map[string]bool),
+		owners:         make(map[string]string),
+		tcpPool:        newPortPool(portRangeStart, portRangeEnd),
+		udpPool:        newPortPool(portRangeStart, portRangeEnd),
+		listenerConfig: listenerConfig,
 		logger:         logger,
 		forwarder:      forwarder,
+		firstUpdate:    make(chan struct{}),
+		subscribers:    make(map[chan RegistryEvent]struct{}),
+	}
+	r.updatePortsAvailableLocked()
+	return r
+}
+
+// SetUDPPortRange sets a separate fallback range for UDP ports, by default
+// UDP shares the TCP range. tcp+udp ports are allocated from the TCP range.
+func (r *ServiceRegistry) SetUDPPortRange(start, end int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.udpPool = newPortPool(start, end)
+	for port := start; port <= end; port++ {
+		if r.allocatedPorts[r.portKey(port, "udp")] {
+			r.udpPool.used++
+		}
+	}
+	r.updatePortsAvailableLocked()
+}
+
+// SetMaxServices limits the number of registered services (0 = unlimited).
+// New services above the limit are rejected, registered ones are kept.
+func (r *ServiceRegistry) SetMaxServices(max int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxServices = max
+}
+
+// SetAgentRegistry sets the connected agents. Services of a connected agent
+// cannot be taken over by another agent, those of disconnected agents can.
+func (r *ServiceRegistry) SetAgentRegistry(agents *AgentRegistry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.agents = agents
+}
+
+// ownedByOtherLocked returns the connected agent other than agentID that
+// owns subdomain, empty if none (must be called with lock held)
+func (r *ServiceRegistry) ownedByOtherLocked(subdomain, agentID string) string {
+	owner, exists := r.owners[subdomain]
+	if !exists || owner == agentID || r.agents == nil || !r.agents.Connected(owner) {
+		return ""
 	}
+	return owner
 }
 
-// Update updates the registry with new service configurations
-func (r *ServiceRegistry) Update(services []types.ExposedService) error {
+// FirstUpdate returns a channel closed once the first agent update was applied
+func (r *ServiceRegistry) FirstUpdate() <-chan struct{} {
+	return r.firstUpdate
+}
+
+// Update applies the complete service list of an agent, removing services
+// the agent sent before that are not part of it. Services of other agents
+// are left untouched. Services that could not be applied are returned as
+// rejections.
+func (r *ServiceRegistry) Update(agentID string, services []types.ExposedService) ([]types.ServiceError, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	r.logger.Info("Updating service registry", "agent_id", agentID, "count", len(services))
+	return r.applyLocked(agentID, services, true), nil
+}
+
+// Merge adds or changes the given services of an agent, leaving all others
+// untouched. Services that could not be applied are returned as rejections.
+func (r *ServiceRegistry) Merge(agentID string, services []types.ExposedService) ([]types.ServiceError, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.logger.Info("Updating service registry", "count", len(services))
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	r.logger.Info("Merging services into registry", "agent_id", agentID, "count", len(services))
+	return r.applyLocked(agentID, services, false), nil
+}
+
+// applyLocked applies service configurations of an agent, removing its
+// registered services missing from services if prune is set. Changes of
+// strict-port services whose ports are taken and of services claiming
+// another service's subdomain or alias are rejected, keeping the previous
+// configuration. New services above the service limit and services whose
+// subdomain another connected agent exposes are rejected too.
+// (must be called with lock held)
+func (r *ServiceRegistry) applyLocked(agentID string, services []types.ExposedService, prune bool) []types.ServiceError {
+	var rejected []types.ServiceError
+	reject := func(svc *types.ExposedService, err error, reason string) {
+		servicesRejected.WithLabelValues(reason).Inc()
+		r.logger.Warn("Rejecting service", "subdomain", svc.Subdomain, "error", err)
+		rejected = append(rejected, types.ServiceError{
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+			Subdomain: svc.Subdomain,
+			Reason:    err.Error(),
+		})
+	}
 
-	// Build a map of new services
+	// Build a map of new services, without subdomains of other agents
 	newServices := make(map[string]*types.ExposedService)
 	for i := range services {
 		svc := &services[i]
+		if owner := r.ownedByOtherLocked(svc.Subdomain, agentID); owner != "" {
+			reject(svc, fmt.Errorf("subdomain %q is already exposed by agent %s", svc.Subdomain, owner), "conflict")
+			continue
+		}
 		newServices[svc.Subdomain] = svc
 	}
 
+	// Services replaced because their configuration changed
+	replaced := make(map[string]bool)
+
 	// Stop and remove listeners for services that no longer exist
 	for subdomain, oldSvc := range r.services {
 		if _, exists := newServices[subdomain]; !exists {
+			if !prune || r.owners[subdomain] != agentID {
+				continue
+			}
 			r.logger.Info("Removing service", "subdomain", subdomain)
 			r.removeServiceLocked(subdomain)
+			delete(r.drained, subdomain)
+			delete(r.owners, subdomain)
+			r.emit(RegistryEventRemoved, subdomain, nil)
 		} else {
 			// Check if service configuration changed
 			newSvc := newServices[subdomain]
 			if !r.servicesEqual(oldSvc, newSvc) {
+				if err := r.checkServiceLocked(newSvc); err != nil {
+					reject(newSvc, err, "conflict")
+					delete(newServices, subdomain)
+					continue
+				}
+			}
+			switch {
+			case r.servicesEqual(oldSvc, newSvc):
+			case r.settingsEqual(oldSvc, newSvc):
+				// Only ports, targets, aliases, backends or affinity changed, keep the listeners of unchanged ports
+				r.logger.Info("Service ports, targets or backends changed", "subdomain", subdomain)
+				r.updatePortsLocked(newSvc)
+				r.emit(RegistryEventUpdated, subdomain, newSvc)
+			default:
 				r.logger.Info("Service configuration changed", "subdomain", subdomain)
 				r.removeServiceLocked(subdomain)
+				replaced[subdomain] = true
 			}
 		}
 	}
 
-	// Add or update services
-	for subdomain, svc := range newServices {
+	// Add or update services, the sending agent takes over ownership.
+	// Replaced services are added first so they keep their slot under the
+	// service limit, then new ones in a stable order.
+	subdomains := make([]string, 0, len(newServices))
+	for subdomain := range newServices {
+		subdomains = append(subdomains, subdomain)
+	}
+	sort.Slice(subdomains, func(i, j int) bool {
+		if replaced[subdomains[i]] != replaced[subdomains[j]] {
+			return replaced[subdomains[i]]
+		}
+		return subdomains[i] < subdomains[j]
+	})
+
+	for _, subdomain := range subdomains {
+		svc := newServices[subdomain]
 		if _, exists := r.services[subdomain]; !exists {
+			if r.maxServices > 0 && len(r.services) >= r.maxServices {
+				reject(svc, fmt.Errorf("service limit of %d reached", r.maxServices), "max_services")
+				if replaced[subdomain] {
+					r.emit(RegistryEventRemoved, subdomain, nil)
+					delete(r.owners, subdomain)
+				}
+				continue
+			}
+			if err := r.checkServiceLocked(svc); err != nil {
+				reject(svc, err, "conflict")
+				continue
+			}
 			r.logger.Info("Adding new service", "subdomain", subdomain)
 			if err := r.addServiceLocked(svc); err != nil {
 				r.logger.Error("Failed to add service", "subdomain", subdomain, "error", err)
 				continue
 			}
+			if replaced[subdomain] {
+				r.emit(RegistryEventUpdated, subdomain, svc)
+			} else {
+				r.emit(RegistryEventAdded, subdomain, svc)
+			}
 		}
+		r.owners[subdomain] = agentID
 	}
 
 	r.logger.Info("Service registry updated", "active_services", len(r.services))
+	r.firstOnce.Do(func() { close(r.firstUpdate) })
+	return rejected
+}
+
+// checkServiceLocked returns an error if a new or changed service conflicts
+// with the registered services (must be called with lock held)
+func (r *ServiceRegistry) checkServiceLocked(svc *types.ExposedService) error {
+	if err := r.checkHostnamesLocked(svc); err != nil {
+		return err
+	}
+	if err := r.checkStrictPortsLocked(svc); err != nil {
+		strictPortConflicts.Inc()
+		return err
+	}
+	return nil
+}
+
+// checkHostnamesLocked returns an error if the subdomain or an alias of a
+// service is already routed to another service (must be called with lock held)
+func (r *ServiceRegistry) checkHostnamesLocked(svc *types.ExposedService) error {
+	for subdomain, other := range r.services {
+		if subdomain == svc.Subdomain {
+			continue
+		}
+		for _, hostname := range svc.Hostnames() {
+			if slices.Contains(other.Hostnames(), hostname) {
+				return fmt.Errorf("subdomain %q already used by %s/%s", hostname, other.Namespace, other.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkStrictPortsLocked returns an error if a strict-port service requests
+// a port held by another service. Ports the service already holds count as
+// available. (must be called with lock held)
+func (r *ServiceRegistry) checkStrictPortsLocked(svc *types.ExposedService) error {
+	if !svc.StrictPort {
+		return nil
+	}
+
+	own := make(map[string]bool)
+	for _, allocation := range r.allocations[svc.Subdomain] {
+		for _, p := range portProtocols(allocation.Protocol) {
+			own[r.portKey(allocation.AllocatedPort, p)] = true
+		}
+	}
+
+	for _, portMapping := range svc.Ports {
+		for _, p := range portProtocols(portMapping.Protocol) {
+			key := r.portKey(portMapping.Port, p)
+			if r.allocatedPorts[key] && !own[key] {
+				return fmt.Errorf("strict port %d/%s is already in use", portMapping.Port, p)
+			}
+		}
+	}
 	return nil
 }
 
@@ -82,34 +343,96 @@ func (r *ServiceRegistry) addServiceLocked(svc *types.ExposedService) error {
 	// Add to registry
 	r.services[svc.Subdomain] = svc
 
+	// Connection limit is shared by all listeners of the service
+	r.limiters[svc.Subdomain] = newConnLimiter(svc.MaxConnections)
+	r.balancers[svc.Subdomain] = newBackendBalancer(svc)
+
 	// Start listeners for each port
 	for _, portMapping := range svc.Ports {
-		// Try to allocate the requested port
-		allocatedPort, err := r.allocatePortLocked(portMapping.Port, portMapping.Protocol)
-		if err != nil {
-			r.logger.Error("Failed to allocate port", "port", portMapping.Port, "protocol", portMapping.Protocol, "error", err)
+		r.startPortLocked(svc, portMapping)
+	}
+
+	return nil
+}
+
+// startPortLocked allocates a port for a mapping and starts its listener
+// (must be called with lock held)
+func (r *ServiceRegistry) startPortLocked(svc *types.ExposedService, portMapping types.PortMapping) {
+	// Try to allocate the requested port
+	allocatedPort, err := r.allocatePortLocked(portMapping.Port, portMapping.Protocol, svc.StrictPort)
+	if err != nil {
+		r.logger.Error("Failed to allocate port", "port", portMapping.Port, "protocol", portMapping.Protocol, "error", err)
+		return
+	}
+
+	// Start listener
+	listener := NewPortListener(allocatedPort, portMapping, *svc, r.listenerConfig, r.limiters[svc.Subdomain], r.balancers[svc.Subdomain], r.forwarder, r.logger)
+	if err := listener.Start(); err != nil {
+		r.logger.Error("Failed to start listener", "port", allocatedPort, "protocol", portMapping.Protocol, "error", err)
+		r.deallocatePortLocked(allocatedPort, portMapping.Protocol)
+		return
+	}
+	listener.setDrained(r.drained[svc.Subdomain])
+
+	listenerKey := r.portKey(allocatedPort, portMapping.Protocol)
+	r.listeners[listenerKey] = listener
+	r.allocations[svc.Subdomain] = append(r.allocations[svc.Subdomain], types.PortAllocation{
+		Name:          svc.Name,
+		Namespace:     svc.Namespace,
+		Subdomain:     svc.Subdomain,
+		RequestedPort: portMapping.Port,
+		AllocatedPort: allocatedPort,
+		Protocol:      portMapping.Protocol,
+	})
+
+	r.logger.Info("Listener started",
+		"subdomain", svc.Subdomain,
+		"port", allocatedPort,
+		"protocol", portMapping.Protocol,
+		"target", fmt.Sprintf("%s:%d", svc.TargetIP, portMapping.Port))
+}
+
+// updatePortsLocked applies a change of a registered service that does not
+// require restarting it: listeners of removed ports are stopped and new
+// ports get listeners, while listeners of kept ports keep their sockets and
+// connections and only switch to the new target. (must be called with lock held)
+func (r *ServiceRegistry) updatePortsLocked(svc *types.ExposedService) {
+	wanted := make(map[string]types.PortMapping, len(svc.Ports))
+	for _, portMapping := range svc.Ports {
+		wanted[r.portKey(portMapping.Port, portMapping.Protocol)] = portMapping
+	}
+
+	var kept []types.PortAllocation
+	for _, allocation := range r.allocations[svc.Subdomain] {
+		listenerKey := r.portKey(allocation.AllocatedPort, allocation.Protocol)
+		listener := r.listeners[listenerKey]
+		requestedKey := r.portKey(allocation.RequestedPort, allocation.Protocol)
+
+		if portMapping, ok := wanted[requestedKey]; ok && listener != nil {
+			listener.setTarget(*svc, portMapping)
+			kept = append(kept, allocation)
+			delete(wanted, requestedKey)
 			continue
 		}
 
-		// Start listener
-		listener := NewPortListener(allocatedPort, portMapping.Protocol, *svc, r.forwarder, r.logger)
-		if err := listener.Start(); err != nil {
-			r.logger.Error("Failed to start listener", "port", allocatedPort, "protocol", portMapping.Protocol, "error", err)
-			r.deallocatePortLocked(allocatedPort, portMapping.Protocol)
-			continue
+		if listener != nil {
+			listener.Stop()
+			delete(r.listeners, listenerKey)
 		}
+		r.deallocatePortLocked(allocation.AllocatedPort, allocation.Protocol)
+		r.logger.Info("Listener stopped", "subdomain", svc.Subdomain, "port", allocation.AllocatedPort, "protocol", allocation.Protocol)
+	}
 
-		listenerKey := r.portKey(allocatedPort, portMapping.Protocol)
-		r.listeners[listenerKey] = listener
+	r.allocations[svc.Subdomain] = kept
+	r.services[svc.Subdomain] = svc
+	r.balancers[svc.Subdomain].setBackends(svc)
 
-		r.logger.Info("Listener started",
-			"subdomain", svc.Subdomain,
-			"port", allocatedPort,
-			"protocol", portMapping.Protocol,
-			"target", fmt.Sprintf("%s:%d", svc.TargetIP, portMapping.Port))
+	// Start the new ports in the order the service declares them
+	for _, portMapping := range svc.Ports {
+		if _, ok := wanted[r.portKey(portMapping.Port, portMapping.Protocol)]; ok {
+			r.startPortLocked(svc, portMapping)
+		}
 	}
-
-	return nil
 }
 
 // removeServiceLocked removes a service and stops its listeners (must be called with lock held)
@@ -119,16 +442,20 @@ func (r *ServiceRegistry) removeServiceLocked(subdomain string) {
 		return
 	}
 
-	// Stop all listeners for this service
-	for _, portMapping := range svc.Ports {
-		listenerKey := r.portKey(portMapping.Port, portMapping.Protocol)
+	// Stop all listeners for this service (on the ports actually allocated)
+	for _, allocation := range r.allocations[svc.Subdomain] {
+		listenerKey := r.portKey(allocation.AllocatedPort, allocation.Protocol)
 		if listener, exists := r.listeners[listenerKey]; exists {
 			listener.Stop()
 			delete(r.listeners, listenerKey)
-			r.deallocatePortLocked(portMapping.Port, portMapping.Protocol)
+			r.deallocatePortLocked(allocation.AllocatedPort, allocation.Protocol)
 		}
 	}
 
+	r.forwarder.removeStats(subdomain)
+	delete(r.allocations, subdomain)
+	delete(r.limiters, subdomain)
+	delete(r.balancers, subdomain)
 	delete(r.services, subdomain)
 }
 
@@ -137,49 +464,167 @@ func (r *ServiceRegistry) RemoveService(subdomain string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	_, exists := r.services[subdomain]
 	r.removeServiceLocked(subdomain)
+	delete(r.drained, subdomain)
+	delete(r.owners, subdomain)
+	if exists {
+		r.emit(RegistryEventRemoved, subdomain, nil)
+	}
 	return nil
 }
 
-// allocatePortLocked allocates a port for a protocol (must be called with lock held)
-func (r *ServiceRegistry) allocatePortLocked(port int32, protocol string) (int32, error) {
+// RemoveAgentServices removes all services sent by an agent and returns
+// their subdomains
+func (r *ServiceRegistry) RemoveAgentServices(agentID string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var removed []string
+	for subdomain, owner := range r.owners {
+		if owner != agentID {
+			continue
+		}
+		r.logger.Info("Removing service of agent", "subdomain", subdomain, "agent_id", agentID)
+		r.removeServiceLocked(subdomain)
+		delete(r.drained, subdomain)
+		delete(r.owners, subdomain)
+		r.emit(RegistryEventRemoved, subdomain, nil)
+		removed = append(removed, subdomain)
+	}
+
+	sort.Strings(removed)
+	return removed
+}
+
+// Owner returns the ID of the agent that sent a service, empty if unknown
+func (r *ServiceRegistry) Owner(subdomain string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.owners[subdomain]
+}
+
+// SetDrained drains (true) or undrains (false) a service. Drained services
+// keep their ports bound but refuse new connections and UDP sessions while
+// established ones continue. The state survives configuration changes until
+// the service is removed. Returns false if the service is not registered.
+func (r *ServiceRegistry) SetDrained(subdomain string, drained bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.services[subdomain]; !exists {
+		return false
+	}
+
+	if drained {
+		r.drained[subdomain] = true
+	} else {
+		delete(r.drained, subdomain)
+	}
+
+	for _, allocation := range r.allocations[subdomain] {
+		if listener, exists := r.listeners[r.portKey(allocation.AllocatedPort, allocation.Protocol)]; exists {
+			listener.setDrained(drained)
+		}
+	}
+
+	r.logger.Info("Service drain state changed", "subdomain", subdomain, "drained", drained)
+	return true
+}
+
+// IsDrained reports whether a service is drained
+func (r *ServiceRegistry) IsDrained(subdomain string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.drained[subdomain]
+}
+
+// allocatePortLocked allocates a port for a protocol, falling back to the
+// protocol's range unless strict is set (must be called with lock held)
+func (r *ServiceRegistry) allocatePortLocked(port int32, protocol string, strict bool) (int32, error) {
 	// Try requested port first
 	if r.isPortAvailableLocked(port, protocol) {
-		key := r.portKey(port, protocol)
-		r.allocatedPorts[key] = true
+		r.markPortLocked(port, protocol, true)
 		return port, nil
 	}
+	if strict {
+		return 0, fmt.Errorf("strict port %d/%s is already in use", port, protocol)
+	}
+
+	// Port conflict - allocate from the protocol's high range
+	pool := r.poolFor(protocol)
+	p, ok := pool.allocate(func(p int32) bool {
+		return r.isPortAvailableLocked(p, protocol)
+	})
+	if !ok {
+		return 0, fmt.Errorf("no available %s ports in range %d-%d", protocol, pool.start, pool.end)
+	}
+	r.markPortLocked(p, protocol, true)
+	portFallbacks.WithLabelValues(protocol).Inc()
+	r.logger.Warn("Port conflict, allocated alternative", "requested", port, "allocated", p, "protocol", protocol)
+	return p, nil
+}
+
+// poolFor returns the fallback port pool of a protocol
+func (r *ServiceRegistry) poolFor(protocol string) *portPool {
+	if protocol == "udp" {
+		return r.udpPool
+	}
+	return r.tcpPool
+}
 
-	// Port conflict - allocate from high range
-	for p := r.portRangeStart; p <= r.portRangeEnd; p++ {
-		if r.isPortAvailableLocked(p, protocol) {
-			key := r.portKey(p, protocol)
+// markPortLocked marks a port as allocated or free for every transport
+// protocol it occupies (must be called with lock held)
+func (r *ServiceRegistry) markPortLocked(port int32, protocol string, allocated bool) {
+	for _, p := range portProtocols(protocol) {
+		key := r.portKey(port, p)
+		if allocated == r.allocatedPorts[key] {
+			continue
+		}
+		pool := r.poolFor(p)
+		if allocated {
 			r.allocatedPorts[key] = true
-			r.logger.Warn("Port conflict, allocated alternative", "requested", port, "allocated", p, "protocol", protocol)
-			return p, nil
+			if pool.contains(port) {
+				pool.used++
+			}
+		} else {
+			delete(r.allocatedPorts, key)
+			if pool.contains(port) {
+				pool.used--
+			}
 		}
 	}
+	r.updatePortsAvailableLocked()
+}
 
-	return 0, fmt.Errorf("no available ports in range %d-%d", r.portRangeStart, r.portRangeEnd)
+// updatePortsAvailableLocked sets the free port gauges of the fallback
+// ranges (must be called with lock held)
+func (r *ServiceRegistry) updatePortsAvailableLocked() {
+	for _, protocol := range []string{"tcp", "udp"} {
+		portsAvailable.WithLabelValues(protocol).Set(float64(r.poolFor(protocol).free()))
+	}
 }
 
 // AllocatePort allocates a port for a protocol
 func (r *ServiceRegistry) AllocatePort(port int32, protocol string) (int32, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.allocatePortLocked(port, protocol)
+	return r.allocatePortLocked(port, protocol, false)
 }
 
 // deallocatePortLocked deallocates a port (must be called with lock held)
 func (r *ServiceRegistry) deallocatePortLocked(port int32, protocol string) {
-	key := r.portKey(port, protocol)
-	delete(r.allocatedPorts, key)
+	r.markPortLocked(port, protocol, false)
 }
 
 // isPortAvailableLocked checks if a port is available (must be called with lock held)
 func (r *ServiceRegistry) isPortAvailableLocked(port int32, protocol string) bool {
-	key := r.portKey(port, protocol)
-	return !r.allocatedPorts[key]
+	for _, p := range portProtocols(protocol) {
+		if r.allocatedPorts[r.portKey(port, p)] {
+			return false
+		}
+	}
+	return true
 }
 
 // IsPortAvailable checks if a port is available for a protocol
@@ -198,7 +643,7 @@ func (r *ServiceRegistry) GetService(subdomain string) (*types.ExposedService, b
 	return svc, exists
 }
 
-// GetServices returns all currently registered services
+// GetServices returns all currently registered services sorted by subdomain
 func (r *ServiceRegistry) GetServices() []types.ExposedService {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -207,9 +652,83 @@ func (r *ServiceRegistry) GetServices() []types.ExposedService {
 	for _, svc := range r.services {
 		services = append(services, *svc)
 	}
+
+	// Stable ordering keeps API output and generated configs free of churn
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Subdomain < services[j].Subdomain
+	})
 	return services
 }
 
+// ListenerState describes a running listener
+type ListenerState struct {
+	Subdomain   string            `json:"subdomain"`
+	Port        int32             `json:"port"`
+	Protocol    string            `json:"protocol"`
+	Target      string            `json:"target"`
+	Drained     bool              `json:"drained"`
+	Connections int               `json:"connections"` // Tracked TCP connections
+	Mapping     types.PortMapping `json:"mapping"`
+}
+
+// Listeners returns the state of all running listeners sorted by port
+func (r *ServiceRegistry) Listeners() []ListenerState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	states := make([]ListenerState, 0, len(r.listeners))
+	for _, listener := range r.listeners {
+		listener.connsMu.Lock()
+		connections := len(listener.conns)
+		listener.connsMu.Unlock()
+
+		target := listener.forwardTarget(portProtocols(listener.protocol)[0])
+		states = append(states, ListenerState{
+			Subdomain:   listener.target.Subdomain,
+			Port:        listener.port,
+			Protocol:    listener.protocol,
+			Target:      net.JoinHostPort(target.IP, fmt.Sprint(target.Port)),
+			Drained:     listener.drained.Load(),
+			Connections: connections,
+			Mapping:     listener.mapping,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Port != states[j].Port {
+			return states[i].Port < states[j].Port
+		}
+		return states[i].Protocol < states[j].Protocol
+	})
+	return states
+}
+
+// GetAllocations returns the allocated ports of the given services
+func (r *ServiceRegistry) GetAllocations(services []types.ExposedService) []types.PortAllocation {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var allocations []types.PortAllocation
+	for _, svc := range services {
+		allocations = append(allocations, r.allocations[svc.Subdomain]...)
+	}
+	return allocations
+}
+
+// GetStats returns the traffic counters for a service, false if the
+// service has no listener
+func (r *ServiceRegistry) GetStats(subdomain string) (StatsSnapshot, bool) {
+	stats, exists := r.forwarder.lookupStats(subdomain)
+	if !exists {
+		return StatsSnapshot{}, false
+	}
+	return stats.Snapshot(), true
+}
+
+// WireguardStatus returns the state of the forwarder's WireGuard interface
+func (r *ServiceRegistry) WireguardStatus() InterfaceStatus {
+	return r.forwarder.WireguardStatus()
+}
+
 // portKey creates a unique key for port and protocol
 func (r *ServiceRegistry) portKey(port int32, protocol string) string {
 	return fmt.Sprintf("%d:%s", port, protocol)
@@ -217,22 +736,64 @@ func (r *ServiceRegistry) portKey(port int32, protocol string) string {
 
 // servicesEqual checks if two services have the same configuration
 func (r *ServiceRegistry) servicesEqual(a, b *types.ExposedService) bool {
-	if a.Name != b.Name || a.Namespace != b.Namespace || a.Subdomain != b.Subdomain || a.TargetIP != b.TargetIP {
+	if !r.settingsEqual(a, b) || a.TargetIP != b.TargetIP || a.Interface != b.Interface ||
+		a.ServerFirst != b.ServerFirst || a.MaxConn != b.MaxConn || a.NodeIP != b.NodeIP || a.NodeFallback != b.NodeFallback || a.TLS != b.TLS ||
+		a.AllowHTTP != b.AllowHTTP || a.StrictPort != b.StrictPort || a.MaintenancePage != b.MaintenancePage ||
+		!slices.Equal(a.Aliases, b.Aliases) || !slices.Equal(a.SourceRanges, b.SourceRanges) ||
+		!slices.Equal(a.TargetIPs, b.TargetIPs) || a.SessionAffinity != b.SessionAffinity {
+		return false
+	}
+	if (a.HealthCheck == nil) != (b.HealthCheck == nil) || (a.HealthCheck != nil && *a.HealthCheck != *b.HealthCheck) {
 		return false
 	}
 	if len(a.Ports) != len(b.Ports) {
 		return false
 	}
 	for i := range a.Ports {
-		if a.Ports[i].Port != b.Ports[i].Port || 
-			a.Ports[i].TargetPort != b.Ports[i].TargetPort ||
-			a.Ports[i].Protocol != b.Ports[i].Protocol {
+		if a.Ports[i] != b.Ports[i] {
 			return false
 		}
 	}
 	return true
 }
 
+// settingsEqual checks if two services share the settings their listeners
+// are started with. Ports, targets, backends, affinity and HAProxy settings are
+// updated in place.
+func (r *ServiceRegistry) settingsEqual(a, b *types.ExposedService) bool {
+	return a.Name == b.Name && a.Namespace == b.Namespace && a.Subdomain == b.Subdomain &&
+		a.MaxConnections == b.MaxConnections
+}
+
+// Shutdown stops all listeners from accepting new connections and drains
+// in-flight connections for up to gracePeriod before clearing the registry.
+// Updates are refused from then on, reads keep working while draining.
+func (r *ServiceRegistry) Shutdown(gracePeriod time.Duration) {
+	r.mu.Lock()
+	r.closed = true
+	listeners := make([]*PortListener, 0, len(r.listeners))
+	for _, listener := range r.listeners {
+		listeners = append(listeners, listener)
+	}
+	r.mu.Unlock()
+
+	r.logger.Info("Draining service registry", "listeners", len(listeners), "grace_period", gracePeriod)
+
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(l *PortListener) {
+			defer wg.Done()
+			l.Drain(gracePeriod)
+		}(listener)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clearLocked()
+}
+
 // Close stops all listeners and clears the registry
 func (r *ServiceRegistry) Close() {
 	r.mu.Lock()
@@ -240,11 +801,21 @@ func (r *ServiceRegistry) Close() {
 
 	r.logger.Info("Closing service registry")
 
+	r.closed = true
 	for _, listener := range r.listeners {
 		listener.Stop()
 	}
+	r.clearLocked()
+}
 
+// clearLocked forgets all services and ports (must be called with lock held)
+func (r *ServiceRegistry) clearLocked() {
 	r.services = make(map[string]*types.ExposedService)
 	r.listeners = make(map[string]*PortListener)
 	r.allocatedPorts = make(map[string]bool)
+	r.allocations = make(map[string][]types.PortAllocation)
+	r.limiters = make(map[string]*connLimiter)
+	r.balancers = make(map[string]*backendBalancer)
+	r.drained = make(map[string]bool)
+	r.owners = make(map[string]string)
 }
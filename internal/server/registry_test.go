@@ -0,0 +1,606 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// roundTrip writes msg to conn and reads the echoed answer
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("expected %q, got %q", msg, buf)
+	}
+}
+
+func TestGetServicesSorted(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+
+	var services []types.ExposedService
+	for _, subdomain := range []string{"zeta", "alpha", "mu", "beta"} {
+		services = append(services, testService(subdomain, freePort(t), 8080, "tcp"))
+	}
+	if _, err := registry.Update("agent", services); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		var got []string
+		for _, svc := range registry.GetServices() {
+			got = append(got, svc.Subdomain)
+		}
+		if want := []string{"alpha", "beta", "mu", "zeta"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestShutdownDrainsInFlightConnections(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	backend := startTCPBackend(t, "127.0.0.1", echo)
+	port := freePort(t)
+
+	if _, err := registry.Update("agent", []types.ExposedService{testService("web", port, backend, "tcp")}); err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "before")
+
+	done := make(chan struct{})
+	go func() {
+		registry.Shutdown(10 * time.Second)
+		close(done)
+	}()
+
+	// New connections are refused once the listener stopped accepting
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener still accepts connections while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The registry stays readable and refuses updates while draining
+	if len(registry.GetServices()) != 1 {
+		t.Error("services are not readable while draining")
+	}
+	if _, err := registry.Update("agent", nil); !errors.Is(err, ErrRegistryClosed) {
+		t.Errorf("expected ErrRegistryClosed, got %v", err)
+	}
+	// Removing a draining service must not stop its listener a second time
+	if err := registry.RemoveService("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The established connection keeps working until the client closes it
+	roundTrip(t, conn, "during")
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the connection was closed")
+	default:
+	}
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return after the last connection closed")
+	}
+}
+
+func TestShutdownClosesConnectionsAfterGracePeriod(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	backend := startTCPBackend(t, "127.0.0.1", echo)
+	port := freePort(t)
+
+	if _, err := registry.Update("agent", []types.ExposedService{testService("web", port, backend, "tcp")}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+
+	start := time.Now()
+	registry.Shutdown(200 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("shutdown took %s with a 200ms grace period", elapsed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection still open after the grace period")
+	}
+	if len(registry.GetServices()) != 0 {
+		t.Error("registry not cleared after shutdown")
+	}
+}
+
+func TestFirstUpdate(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	select {
+	case <-registry.FirstUpdate():
+		t.Fatal("first update signaled before any update")
+	default:
+	}
+
+	if _, err := registry.Update("agent", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-registry.FirstUpdate():
+	default:
+		t.Fatal("first update not signaled after an update")
+	}
+
+	// Later updates don't close the channel again
+	if _, err := registry.Update("agent", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdatePrunesAndMergeKeeps(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	web := testService("web", freePort(t), 8080, "tcp")
+	api := testService("api", freePort(t), 8080, "tcp")
+	dns := testService("dns", freePort(t), 53, "udp")
+	registered := func() []string {
+		var names []string
+		for _, svc := range registry.GetServices() {
+			names = append(names, svc.Name)
+		}
+		return names
+	}
+
+	if _, err := registry.Update("agent", []types.ExposedService{web, api}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partial update adds dns and changes web without removing api
+	web.MaxConnections = 5
+	if _, err := registry.Merge("agent", []types.ExposedService{web, dns}); err != nil {
+		t.Fatal(err)
+	}
+	if got := registered(); !reflect.DeepEqual(got, []string{"api", "dns", "web"}) {
+		t.Fatalf("expected a merge to keep api, got %v", got)
+	}
+	if got, _ := registry.GetService("web"); got.MaxConnections != 5 {
+		t.Errorf("expected the merge to change web, got %+v", got)
+	}
+
+	// A full update removes everything it doesn't list
+	if _, err := registry.Update("agent", []types.ExposedService{dns}); err != nil {
+		t.Fatal(err)
+	}
+	if got := registered(); !reflect.DeepEqual(got, []string{"dns"}) {
+		t.Errorf("expected a full update to prune, got %v", got)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	backend := startTCPBackend(t, "127.0.0.1", echo)
+	port := freePort(t)
+	svc := testService("game", port, backend, "tcp")
+	svc.MaxConnections = 2
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		roundTrip(t, conn, "within the limit")
+		conns = append(conns, conn)
+	}
+
+	// The third connection is closed right away without reaching the backend
+	excess, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer excess.Close()
+	excess.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := excess.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the excess connection to be closed, got %v", err)
+	}
+	if stats, _ := registry.GetStats("game"); stats.Rejected != 1 {
+		t.Errorf("expected one rejected connection, got %d", stats.Rejected)
+	}
+
+	// Closing a connection frees its slot
+	conns[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("x"))
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot not freed after a connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAddPortKeepsListener(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	backend := startTCPBackend(t, "127.0.0.1", echo)
+	port := freePort(t)
+	svc := testService("game", port, backend, "tcp")
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+	tcpKey := registry.portKey(port, "tcp")
+	original := registry.listeners[tcpKey]
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "before")
+
+	// Adding a UDP port starts its listener next to the running TCP one
+	udpPort := freePort(t)
+	withUDP := svc
+	withUDP.Ports = append([]types.PortMapping{svc.Ports[0]}, types.PortMapping{Port: udpPort, TargetPort: startUDPEcho(t), Protocol: "udp"})
+	if _, err := registry.Update("agent", []types.ExposedService{withUDP}); err != nil {
+		t.Fatal(err)
+	}
+	if registry.listeners[tcpKey] != original {
+		t.Fatal("the TCP listener was replaced")
+	}
+	if _, ok := registry.listeners[registry.portKey(udpPort, "udp")]; !ok {
+		t.Fatal("no listener for the added UDP port")
+	}
+
+	// The established connection survives and the socket keeps accepting
+	roundTrip(t, conn, "after")
+	other, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	roundTrip(t, other, "new")
+
+	// Removing the UDP port again leaves the TCP listener alone
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+	if registry.listeners[tcpKey] != original {
+		t.Fatal("the TCP listener was replaced on port removal")
+	}
+	roundTrip(t, conn, "still")
+}
+
+func TestRetargetKeepsListener(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	greeter := func(greeting string) func(net.Conn) {
+		return func(conn net.Conn) {
+			conn.Write([]byte(greeting))
+			echo(conn)
+		}
+	}
+	oldBackend := startTCPBackend(t, "127.0.0.1", greeter("old"))
+	newBackend := startTCPBackend(t, "127.0.0.1", greeter("new"))
+	port := freePort(t)
+	svc := testService("web", port, oldBackend, "tcp")
+	svc.ServerFirst = true
+	if _, err := registry.Update("agent", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+	original := registry.listeners[registry.portKey(port, "tcp")]
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	greeting := func(conn net.Conn) string {
+		t.Helper()
+		buf := make([]byte, 3)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := greeting(conn); got != "old" {
+		t.Fatalf("expected the old backend, got %q", got)
+	}
+
+	// A new target port is applied without restarting the listener
+	retargeted := svc
+	retargeted.Ports = []types.PortMapping{{Port: port, TargetPort: newBackend, Protocol: "tcp"}}
+	if _, err := registry.Update("agent", []types.ExposedService{retargeted}); err != nil {
+		t.Fatal(err)
+	}
+	if registry.listeners[registry.portKey(port, "tcp")] != original {
+		t.Fatal("the listener was replaced for a target change")
+	}
+	roundTrip(t, conn, "kept")
+
+	other, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if got := greeting(other); got != "new" {
+		t.Errorf("expected new connections to reach the new backend, got %q", got)
+	}
+}
+
+func TestSubdomainOwnedByConnectedAgent(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	agents := NewAgentRegistry(0)
+	registry.SetAgentRegistry(agents)
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	owner := agents.newAgentConn(conn, "")
+	if err := agents.register(owner, "cluster-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := testService("web", freePort(t), 8080, "tcp")
+	if _, err := registry.Update("cluster-a", []types.ExposedService{svc}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another agent cannot take over the subdomain while the owner is connected
+	other := svc
+	other.TargetIP = "127.0.0.9"
+	rejected, err := registry.Update("cluster-b", []types.ExposedService{other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 1 || rejected[0].Subdomain != "web" {
+		t.Fatalf("expected the conflicting service to be rejected, got %v", rejected)
+	}
+	if got, _ := registry.GetService("web"); got.TargetIP != svc.TargetIP || registry.Owner("web") != "cluster-a" {
+		t.Errorf("conflicting update changed the service: %+v owned by %s", got, registry.Owner("web"))
+	}
+
+	// Once the owner is gone the subdomain can move
+	agents.unregister(owner)
+	if rejected, err := registry.Update("cluster-b", []types.ExposedService{other}); err != nil || len(rejected) > 0 {
+		t.Fatalf("takeover failed: %v %v", err, rejected)
+	}
+	if registry.Owner("web") != "cluster-b" {
+		t.Errorf("expected cluster-b to own the service, got %s", registry.Owner("web"))
+	}
+}
+
+func TestStrictPortConflict(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	port := freePort(t)
+	if _, err := registry.Update("agent", []types.ExposedService{testService("web", port, 8080, "tcp")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A strict-port service requesting the taken port is rejected, not moved
+	game := testService("game", port, 25565, "tcp")
+	game.StrictPort = true
+	before := testutil.ToFloat64(strictPortConflicts)
+	rejected, err := registry.Merge("agent", []types.ExposedService{game})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 1 || rejected[0].Subdomain != "game" || !strings.Contains(rejected[0].Reason, "already in use") {
+		t.Fatalf("expected game to be rejected, got %+v", rejected)
+	}
+	if _, exists := registry.GetService("game"); exists {
+		t.Error("rejected service was registered")
+	}
+	if got := testutil.ToFloat64(strictPortConflicts) - before; got != 1 {
+		t.Errorf("expected one strict port conflict, got %v", got)
+	}
+
+	// Without the flag the service is moved to a fallback port
+	game.StrictPort = false
+	if rejected, err := registry.Merge("agent", []types.ExposedService{game}); err != nil || len(rejected) > 0 {
+		t.Fatalf("merge failed: %v %v", err, rejected)
+	}
+	allocations := registry.GetAllocations([]types.ExposedService{game})
+	if len(allocations) != 1 || allocations[0].AllocatedPort == port {
+		t.Errorf("expected game on a fallback port, got %+v", allocations)
+	}
+
+	// A strict-port service keeps its own ports when it changes, but a change
+	// to a taken port keeps the previous configuration
+	mail := testService("mail", freePort(t), 25, "tcp")
+	mail.StrictPort = true
+	if rejected, err := registry.Merge("agent", []types.ExposedService{mail}); err != nil || len(rejected) > 0 {
+		t.Fatalf("strict service on a free port rejected: %v %v", err, rejected)
+	}
+	mail.Ports[0].TargetPort = 2525
+	if rejected, err := registry.Merge("agent", []types.ExposedService{mail}); err != nil || len(rejected) > 0 {
+		t.Fatalf("change keeping the strict port rejected: %v %v", err, rejected)
+	}
+	moved := mail
+	moved.Ports = []types.PortMapping{{Port: port, TargetPort: 2525, Protocol: "tcp"}}
+	if rejected, _ := registry.Merge("agent", []types.ExposedService{moved}); len(rejected) != 1 {
+		t.Fatalf("expected the move to a taken port to be rejected, got %+v", rejected)
+	}
+	if got, _ := registry.GetService("mail"); got.Ports[0].Port != mail.Ports[0].Port {
+		t.Errorf("rejected change replaced the service: %+v", got.Ports)
+	}
+}
+
+func TestPortFallbackMetrics(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	port := freePort(t)
+	if _, err := registry.Update("agent", []types.ExposedService{testService("web", port, 8080, "tcp")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second service requesting the taken port falls back into the range
+	fallbacks := testutil.ToFloat64(portFallbacks.WithLabelValues("tcp"))
+	available := testutil.ToFloat64(portsAvailable.WithLabelValues("tcp"))
+	if _, err := registry.Merge("agent", []types.ExposedService{testService("api", port, 9090, "tcp")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(portFallbacks.WithLabelValues("tcp")) - fallbacks; got != 1 {
+		t.Errorf("expected one fallback allocation, got %v", got)
+	}
+	if got := available - testutil.ToFloat64(portsAvailable.WithLabelValues("tcp")); got != 1 {
+		t.Errorf("expected one port less available, got %v", got)
+	}
+
+	// Removing the service returns its port to the range
+	if _, err := registry.Update("agent", []types.ExposedService{testService("web", port, 8080, "tcp")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(portsAvailable.WithLabelValues("tcp")); got != available {
+		t.Errorf("expected %v ports available after removal, got %v", available, got)
+	}
+}
+
+func TestAliasConflict(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	web := testService("web", freePort(t), 8080, "tcp")
+	web.Aliases = []string{"www"}
+	if _, err := registry.Update("agent", []types.ExposedService{web}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither the subdomain nor an alias of another service may reuse a hostname of web
+	www := testService("www", freePort(t), 8080, "tcp")
+	api := testService("api", freePort(t), 8080, "tcp")
+	api.Aliases = []string{"web"}
+	rejected, err := registry.Merge("agent", []types.ExposedService{www, api})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 {
+		t.Fatalf("expected www and api to be rejected, got %+v", rejected)
+	}
+	for _, rejection := range rejected {
+		if !strings.Contains(rejection.Reason, "already used by default/web") {
+			t.Errorf("unexpected rejection reason %q", rejection.Reason)
+		}
+	}
+
+	// A service can change its own aliases
+	web.Aliases = []string{"www", "home"}
+	if rejected, err := registry.Merge("agent", []types.ExposedService{web}); err != nil || len(rejected) > 0 {
+		t.Fatalf("alias change rejected: %v %v", err, rejected)
+	}
+}
+
+func TestMaxServices(t *testing.T) {
+	ports := map[string]int32{}
+	services := func(subdomains ...string) []types.ExposedService {
+		var result []types.ExposedService
+		for _, subdomain := range subdomains {
+			if _, ok := ports[subdomain]; !ok {
+				ports[subdomain] = freePort(t)
+			}
+			result = append(result, testService(subdomain, ports[subdomain], 8080, "tcp"))
+		}
+		return result
+	}
+	subdomains := func(errs []types.ServiceError) []string {
+		var result []string
+		for _, err := range errs {
+			result = append(result, err.Subdomain)
+		}
+		return result
+	}
+
+	// The overflow is the same whatever order the agent sends the services in
+	for _, order := range [][]string{
+		{"echo", "alpha", "delta", "charlie", "bravo"},
+		{"bravo", "delta", "echo", "charlie", "alpha"},
+	} {
+		registry, _ := newTestRegistry(t)
+		registry.SetMaxServices(3)
+
+		before := testutil.ToFloat64(servicesRejected.WithLabelValues("max_services"))
+		rejected, err := registry.Update("agent", services(order...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := subdomains(rejected); !reflect.DeepEqual(got, []string{"delta", "echo"}) {
+			t.Errorf("order %v: expected delta and echo to be rejected, got %v", order, got)
+		}
+		for _, err := range rejected {
+			if !strings.Contains(err.Reason, "service limit of 3 reached") {
+				t.Errorf("unexpected reason %q", err.Reason)
+			}
+		}
+		var registered []string
+		for _, svc := range registry.GetServices() {
+			registered = append(registered, svc.Subdomain)
+		}
+		if !reflect.DeepEqual(registered, []string{"alpha", "bravo", "charlie"}) {
+			t.Errorf("order %v: expected alpha, bravo and charlie registered, got %v", order, registered)
+		}
+		if got := testutil.ToFloat64(servicesRejected.WithLabelValues("max_services")) - before; got != 2 {
+			t.Errorf("expected two rejected services, got %v", got)
+		}
+
+		// Registered services keep their slot over new ones sorting before them
+		rejected, err = registry.Update("agent", services("aaa", "alpha", "bravo", "charlie"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := subdomains(rejected); !reflect.DeepEqual(got, []string{"aaa"}) {
+			t.Errorf("expected the new service to be rejected, got %v", got)
+		}
+
+		// Lifting the limit accepts everything
+		registry.SetMaxServices(0)
+		if rejected, err := registry.Update("agent", services(order...)); err != nil || len(rejected) > 0 {
+			t.Errorf("unlimited registry rejected services: %v %+v", err, rejected)
+		}
+		if got := len(registry.GetServices()); got != 5 {
+			t.Errorf("expected 5 services, got %d", got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"sync/atomic"
+)
+
+// ServiceStats holds traffic counters for a single exposed service
+type ServiceStats struct {
+	bytesIn           atomic.Int64
+	bytesOut          atomic.Int64
+	activeConnections atomic.Int64
+	totalConnections  atomic.Int64
+	rejected          atomic.Int64
+	errors            atomic.Int64
+}
+
+// StatsSnapshot is a point-in-time copy of a service's traffic counters
+type StatsSnapshot struct {
+	BytesIn           int64 `json:"bytes_in"`
+	BytesOut          int64 `json:"bytes_out"`
+	ActiveConnections int64 `json:"active_connections"`
+	TotalConnections  int64 `json:"total_connections"`
+	Rejected          int64 `json:"rejected"`
+	Errors            int64 `json:"errors"`
+}
+
+// connOpened records a new connection (or UDP session)
+func (s *ServiceStats) connOpened() {
+	if s == nil {
+		return
+	}
+	s.activeConnections.Add(1)
+	s.totalConnections.Add(1)
+}
+
+// connClosed records a closed connection (or UDP session)
+func (s *ServiceStats) connClosed() {
+	if s == nil {
+		return
+	}
+	s.activeConnections.Add(-1)
+}
+
+// addRejected records a connection refused by the connection limit
+func (s *ServiceStats) addRejected() {
+	if s == nil {
+		return
+	}
+	s.rejected.Add(1)
+}
+
+// addBytesIn records bytes received from clients
+func (s *ServiceStats) addBytesIn(n int) {
+	if s == nil {
+		return
+	}
+	s.bytesIn.Add(int64(n))
+}
+
+// addBytesOut records bytes sent back to clients
+func (s *ServiceStats) addBytesOut(n int) {
+	if s == nil {
+		return
+	}
+	s.bytesOut.Add(int64(n))
+}
+
+// addError records a forwarding error
+func (s *ServiceStats) addError() {
+	if s == nil {
+		return
+	}
+	s.errors.Add(1)
+}
+
+// Snapshot returns a copy of the current counters
+func (s *ServiceStats) Snapshot() StatsSnapshot {
+	if s == nil {
+		return StatsSnapshot{}
+	}
+	return StatsSnapshot{
+		BytesIn:           s.bytesIn.Load(),
+		BytesOut:          s.bytesOut.Load(),
+		ActiveConnections: s.activeConnections.Load(),
+		TotalConnections:  s.totalConnections.Load(),
+		Rejected:          s.rejected.Load(),
+		Errors:            s.errors.Load(),
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// udpRoundTrip sends msg from client to addr and waits for the echo
+func udpRoundTrip(t *testing.T, client *net.UDPConn, addr *net.UDPAddr, msg string) {
+	t.Helper()
+	if _, err := client.WriteToUDP([]byte(msg), addr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no response through the UDP listener: %v", err)
+	}
+	if string(buf[:n]) != msg {
+		t.Fatalf("expected %q, got %q", msg, buf[:n])
+	}
+	if !from.IP.Equal(addr.IP) || from.Port != addr.Port {
+		t.Fatalf("response came from %s instead of %s", from, addr)
+	}
+}
+
+func TestUDPBindAddress(t *testing.T) {
+	registry, _ := newTestRegistryWithConfig(t, ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.2"})
+	backend := startUDPEcho(t)
+	port := freePort(t)
+
+	if _, err := registry.Update("agent", []types.ExposedService{testService("dns", port, backend, "udp")}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	udpRoundTrip(t, client, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: int(port)}, "bound")
+
+	// Nothing listens on the TCP bind address for the UDP port
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatalf("UDP listener bound to 127.0.0.1 instead of 127.0.0.2: %v", err)
+	}
+	other.Close()
+}
+
+func TestUDPBuffers(t *testing.T) {
+	const buffer = 1 << 20
+	registry, forwarder := newTestRegistryWithConfig(t, ListenerConfig{
+		TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1",
+		UDPReadBuffer: buffer, UDPWriteBuffer: buffer,
+	})
+	forwarder.SetUDPBuffers(buffer, buffer)
+	backend := startUDPEcho(t)
+	port := freePort(t)
+	if _, err := registry.Update("agent", []types.ExposedService{testService("dns", port, backend, "udp")}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	udpRoundTrip(t, client, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)}, "buffered")
+}
+
+func TestUDPDroppedPackets(t *testing.T) {
+	forwarder := NewForwarder("wg-test", testLogger())
+	defer forwarder.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A target that cannot be resolved drops the packet
+	dropped := testutil.ToFloat64(udpPacketsDropped.WithLabelValues("dial"))
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	target := ForwardTarget{IP: "127.0.0.1", Port: 70000}
+	if err := forwarder.ForwardUDP(conn, client, []byte("lost"), target, forwarder.StatsFor("dns")); err == nil {
+		t.Fatal("expected forwarding to an invalid port to fail")
+	}
+	if got := testutil.ToFloat64(udpPacketsDropped.WithLabelValues("dial")) - dropped; got != 1 {
+		t.Errorf("expected one dropped packet, got %v", got)
+	}
+}
+
+func TestCombinedMappingPicksTargetPerProtocol(t *testing.T) {
+	registry, forwarder := newTestRegistry(t)
+	tcpBackend := startTCPBackend(t, "127.0.0.1", echo)
+	udpBackend := startUDPEcho(t)
+	port := freePort(t)
+
+	game := testService("game", port, tcpBackend, "tcp+udp")
+	game.Ports[0].UDPTargetPort = udpBackend
+	if _, err := registry.Update("agent", []types.ExposedService{game}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each backend only listens on its own protocol, so a round trip only
+	// succeeds if the sub-listener picked its own target
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "over tcp")
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	udpRoundTrip(t, client, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)}, "over udp")
+
+	// Without a separate UDP target both halves use the target port
+	mapping := types.PortMapping{Port: port, TargetPort: 27015, Protocol: "tcp+udp"}
+	listener := NewPortListener(port, mapping, game, ListenerConfig{}, nil, nil, forwarder, testLogger())
+	if tcp, udp := listener.forwardTarget("tcp").Port, listener.forwardTarget("udp").Port; tcp != 27015 || udp != 27015 {
+		t.Errorf("expected both protocols to target 27015, got tcp %d and udp %d", tcp, udp)
+	}
+}
+
+// udpSessions returns the number of open UDP sessions of a forwarder
+func udpSessions(f *Forwarder) int {
+	f.udpMu.RLock()
+	defer f.udpMu.RUnlock()
+	return len(f.udpSessions)
+}
+
+// TestUDPRoundTrip registers a UDP service and sends datagrams through its
+// listener to an echo backend. The echoes return through the listener socket
+// via forwardUDPResponses, and the sessions end when the forwarder stops.
+func TestUDPRoundTrip(t *testing.T) {
+	forwarder := NewForwarder("wg-test", testLogger())
+	registry := NewServiceRegistry(30000, 30100, ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1"}, forwarder, testLogger())
+	defer registry.Close()
+
+	backend := startUDPEcho(t)
+	port := freePort(t)
+	if _, err := registry.Update("agent", []types.ExposedService{testService("dns", port, backend, "udp")}); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	udpRoundTrip(t, client, addr, "query")
+	udpRoundTrip(t, client, addr, "again")
+
+	// Datagrams of one client share a session, other clients get their own
+	if n := udpSessions(forwarder); n != 1 {
+		t.Fatalf("expected one session for the client, got %d", n)
+	}
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	udpRoundTrip(t, other, addr, "other")
+	if n := udpSessions(forwarder); n != 2 {
+		t.Fatalf("expected a session per client, got %d", n)
+	}
+
+	if stats := forwarder.StatsFor("dns").Snapshot(); stats.ActiveConnections != 2 || stats.TotalConnections != 2 {
+		t.Errorf("expected 2 active sessions, got %+v", stats)
+	}
+	// Bytes are counted right after a datagram was passed on
+	want := int64(len("query") + len("again") + len("other"))
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		stats := forwarder.StatsFor("dns").Snapshot()
+		if stats.BytesIn == want && stats.BytesOut == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d bytes each way, got %+v", want, stats)
+		}
+	}
+
+	// Stopping the forwarder closes the sessions and their backend sockets
+	forwarder.Close()
+	if n := udpSessions(forwarder); n != 0 {
+		t.Errorf("%d sessions left after the forwarder stopped", n)
+	}
+	if stats := forwarder.StatsFor("dns").Snapshot(); stats.ActiveConnections != 0 {
+		t.Errorf("expected no active sessions, got %d", stats.ActiveConnections)
+	}
+}
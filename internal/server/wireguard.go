@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// interfaceCheckInterval is how often the WireGuard interface state is refreshed
+const interfaceCheckInterval = 15 * time.Second
+
+var wireguardUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "k8s_exposer_wireguard_up",
+	Help: "Whether the WireGuard interface exists and is up (1) or not (0)",
+}, []string{"interface"})
+
+// InterfaceStatus describes the state of a network interface
+type InterfaceStatus struct {
+	Name      string    `json:"name"`
+	Exists    bool      `json:"exists"`
+	Up        bool      `json:"up"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// interfaceMonitor periodically checks that an interface exists and is up
+type interfaceMonitor struct {
+	name string
+
+	mu     sync.RWMutex
+	status InterfaceStatus
+}
+
+// newInterfaceMonitor creates a monitor and performs an initial check
+func newInterfaceMonitor(name string) *interfaceMonitor {
+	m := &interfaceMonitor{name: name}
+	m.check()
+	return m
+}
+
+// check refreshes the interface status and its gauge
+func (m *interfaceMonitor) check() InterfaceStatus {
+	status := InterfaceStatus{Name: m.name, CheckedAt: time.Now()}
+
+	iface, err := net.InterfaceByName(m.name)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Exists = true
+		status.Up = iface.Flags&net.FlagUp != 0
+		if !status.Up {
+			status.Error = "interface is down"
+		}
+	}
+
+	if status.Up {
+		wireguardUp.WithLabelValues(m.name).Set(1)
+	} else {
+		wireguardUp.WithLabelValues(m.name).Set(0)
+	}
+
+	m.mu.Lock()
+	m.status = status
+	m.mu.Unlock()
+	return status
+}
+
+// run refreshes the status until stopCh is closed
+func (m *interfaceMonitor) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interfaceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// Status returns the last observed interface status
+func (m *interfaceMonitor) Status() InterfaceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
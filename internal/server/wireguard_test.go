@@ -0,0 +1,25 @@
+package server
+
+import "testing"
+
+func TestInterfaceMonitor(t *testing.T) {
+	lo := loopbackInterface(t)
+	if status := newInterfaceMonitor(lo).Status(); !status.Exists || !status.Up || status.Error != "" {
+		t.Errorf("expected %s to be up, got %+v", lo, status)
+	}
+
+	status := newInterfaceMonitor("wg-missing").Status()
+	if status.Exists || status.Up || status.Error == "" {
+		t.Errorf("expected a missing interface to be reported down, got %+v", status)
+	}
+	if status.Name != "wg-missing" || status.CheckedAt.IsZero() {
+		t.Errorf("expected the name and check time to be set, got %+v", status)
+	}
+
+	// The forwarder reports the state of its interface
+	forwarder := NewForwarder(lo, testLogger())
+	defer forwarder.Close()
+	if !forwarder.WireguardStatus().Up {
+		t.Errorf("expected the forwarder interface %s to be up", lo)
+	}
+}
@@ -0,0 +1,256 @@
+// Package agent runs a complete k8s-exposer agent (service discovery,
+// watcher, periodic sync and the connection to the server) inside another
+// Go program. cmd/agent is a thin shell around it that reads the settings
+// from an optional config file and environment variables.
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	core "github.com/noahjeana/k8s-exposer/internal/agent"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Settings are the agent settings, as read by cmd/agent from AGENT_CONFIG
+// and the environment
+type Settings = core.Config
+
+// DefaultSettings returns the settings of an agent without configuration
+func DefaultSettings() Settings {
+	return core.DefaultConfig()
+}
+
+// LoadSettings reads the YAML config file at path (empty = none) and applies
+// the environment variables returned by lookup on top of it
+func LoadSettings(path string, lookup func(string) (string, bool)) (Settings, error) {
+	return core.LoadConfig(path, lookup)
+}
+
+// Config configures an agent
+type Config struct {
+	Settings  Settings             // Start from DefaultSettings
+	Clientset kubernetes.Interface // Cluster to discover services in (nil = in-cluster config)
+	Logger    *slog.Logger         // Default slog.Default()
+}
+
+// Agent is an embeddable k8s-exposer agent
+type Agent struct {
+	settings      Settings
+	clientset     kubernetes.Interface
+	logger        *slog.Logger
+	discoveryOpts core.DiscoveryOptions
+}
+
+// New validates cfg and connects to the cluster. Nothing is discovered or
+// sent until Run is called.
+func New(cfg Config) (*Agent, error) {
+	if err := cfg.Settings.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	clientset := cfg.Clientset
+	if clientset == nil {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get in-cluster config: %w", err)
+		}
+		clientset, err = kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
+	}
+
+	// Already validated with the settings
+	defaultTarget, _ := core.ParseTargetStrategy(cfg.Settings.TargetStrategy)
+
+	discoveryOpts := core.DiscoveryOptions{
+		DefaultTarget: defaultTarget,
+		Namespaces:    cfg.Settings.WatchNamespaces,
+		MaxPorts:      cfg.Settings.MaxPorts,
+		Concurrency:   cfg.Settings.DiscoveryConcurrency,
+	}
+
+	// Optionally surface discovery failures as events and status annotations
+	if cfg.Settings.ReportFailures {
+		discoveryOpts.Reporter = core.NewFailureReporter(clientset, logger)
+	}
+
+	return &Agent{
+		settings:      cfg.Settings,
+		clientset:     clientset,
+		logger:        logger,
+		discoveryOpts: discoveryOpts,
+	}, nil
+}
+
+// Run watches services and keeps the server up to date until ctx is
+// canceled, then sends a final update and disconnects. It returns nil after
+// a shutdown through ctx and the error that stopped the agent otherwise. An
+// agent can only be run once.
+func (a *Agent) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	logger := a.logger
+	clientset := a.clientset
+	discoveryOpts := a.discoveryOpts
+
+	// Latest discovered service list waiting to be sent
+	serviceUpdates := core.NewSnapshotBox()
+
+	// Create server client
+	serverClient := core.NewServerClient(a.settings.ServerAddr, logger)
+	serverClient.SetMaxMessageSize(a.settings.MaxMessageSize)
+	serverClient.SetPing(a.settings.PingInterval.Duration, a.settings.PingTimeout.Duration)
+
+	// Identify the agent by the cluster unless configured, the server falls
+	// back to the remote IP without an ID
+	agentID := a.settings.AgentID
+	if agentID == "" {
+		clusterID, err := core.ClusterID(ctx, clientset)
+		if err != nil {
+			logger.Warn("Failed to determine the cluster ID, set AGENT_ID to identify the agent", "error", err)
+		}
+		agentID = clusterID
+	}
+	serverClient.SetAgentID(agentID)
+
+	// Re-discover and send the complete service list when the server asks for it
+	serverClient.SetResyncHandler(func() {
+		go func() {
+			services, err := core.DiscoverServices(ctx, clientset, discoveryOpts, logger)
+			if err != nil {
+				logger.Error("Resync discovery failed", "error", err)
+				return
+			}
+			serviceUpdates.Put(services)
+		}()
+	})
+
+	// Surface services the server rejected on the Kubernetes objects
+	if discoveryOpts.Reporter != nil {
+		serverClient.SetRejectionHandler(func(rejections []types.ServiceError) {
+			discoveryOpts.Reporter.SetRejected(ctx, rejections)
+		})
+	}
+
+	// Optionally report allocated ports back as service annotations
+	if a.settings.WriteAllocatedPorts {
+		serverClient.SetStatusHandler(func(allocations []types.PortAllocation) {
+			core.WriteAllocatedPorts(ctx, clientset, allocations, logger)
+		})
+	}
+
+	// Start server client in background
+	go func() {
+		if err := serverClient.Run(ctx, serviceUpdates); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Error("Server client stopped with error", "error", err)
+			cancel(fmt.Errorf("server client stopped: %w", err))
+		}
+	}()
+
+	// Create service watcher
+	watcher := core.NewServiceWatcher(clientset, func(services []types.ExposedService) {
+		logger.Info("Service change detected", "count", len(services))
+		serviceUpdates.Put(services)
+	}, logger)
+	watcher.SetDiscoveryOptions(discoveryOpts)
+
+	// Serve probes and metrics
+	var healthServer *http.Server
+	if a.settings.MetricsAddr != "" {
+		healthServer = newHealthServer(a.settings.MetricsAddr, serverClient, watcher)
+		go func() {
+			logger.Info("Starting health server", "addr", a.settings.MetricsAddr)
+			if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Health server failed", "error", err)
+			}
+		}()
+	}
+
+	// Start periodic sync, applying intervals pushed by the server without
+	// reconnecting
+	periodicSync := core.NewPeriodicSync(a.settings.SyncInterval.Duration, func(ctx context.Context) {
+		logger.Debug("Performing periodic service discovery")
+		services, err := core.DiscoverServices(ctx, clientset, discoveryOpts, logger)
+		if err != nil {
+			logger.Error("Periodic discovery failed", "error", err)
+			return
+		}
+		serviceUpdates.Put(services)
+	}, logger)
+	serverClient.SetConfigHandler(periodicSync.ApplyConfig)
+	go periodicSync.Run(ctx)
+
+	// Start service watcher (blocks until context is canceled)
+	logger.Info("Starting service watcher")
+	var runErr error
+	if err := watcher.StartWithRetry(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		runErr = fmt.Errorf("service watcher failed: %w", err)
+	} else if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) && !errors.Is(cause, context.DeadlineExceeded) {
+		runErr = cause
+	}
+
+	// Cleanup
+	logger.Info("Shutting down gracefully")
+
+	// Send changes made just before the shutdown that the stopped watcher
+	// may have missed
+	flushTimeout := a.settings.ShutdownFlushTimeout.Duration
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), flushTimeout)
+	services, err := core.DiscoverServices(flushCtx, clientset, discoveryOpts, logger)
+	flushCancel()
+	if err != nil {
+		logger.Warn("Final discovery failed", "error", err)
+	} else if err := serverClient.Flush(services, flushTimeout); err != nil {
+		logger.Warn("Failed to send final service update", "error", err)
+	}
+
+	serverClient.Close()
+	if healthServer != nil {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		healthServer.Shutdown(shutdownCtx)
+	}
+	logger.Info("Agent stopped")
+	return runErr
+}
+
+// newHealthServer serves liveness and readiness probes and Prometheus metrics.
+// The agent is ready once it is connected to the server and its informer
+// caches are synced.
+func newHealthServer(addr string, serverClient *core.ServerClient, watcher *core.ServiceWatcher) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !serverClient.IsConnected():
+			http.Error(w, "not connected to server", http.StatusServiceUnavailable)
+		case !watcher.HasSynced():
+			http.Error(w, "informer cache not synced", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
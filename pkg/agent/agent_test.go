@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/noahjeana/k8s-exposer/internal/agent"
+	"github.com/noahjeana/k8s-exposer/pkg/server"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// freeAddr returns a loopback address with a currently unused TCP port
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// exposedService returns an exposed service with a ready endpoint
+func exposedService(name string, port int32) (*corev1.Service, *corev1.Endpoints) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Annotations: map[string]string{
+				core.SubdomainAnnotation: name,
+				core.PortsAnnotation:     fmt.Sprintf("%d/tcp", port),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeClusterIP,
+			Ports: []corev1.ServicePort{{Port: port, TargetPort: intstr.FromInt32(80)}},
+		},
+	}
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.244.0.5"}},
+			Ports:     []corev1.EndpointPort{{Port: 80}},
+		}},
+	}
+	return svc, endpoints
+}
+
+func TestRunAgainstServer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	agentAddr := freeAddr(t)
+	apiAddr := freeAddr(t)
+
+	srv, err := server.New(server.Config{
+		ListenAddr:          agentAddr,
+		APIListenAddr:       apiAddr,
+		WireGuardInterface:  "wg-test",
+		PortRangeStart:      40000,
+		PortRangeEnd:        40100,
+		Listener:            server.ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1"},
+		ShutdownGracePeriod: time.Second,
+		Automation: server.AutomationConfig{
+			HAProxySocket: filepath.Join(dir, "haproxy.sock"),
+			HAProxyMap:    filepath.Join(dir, "domains.map"),
+			HAProxyConfig: filepath.Join(dir, "haproxy.cfg"),
+			HAProxyWait:   server.ReadinessWait{Attempts: 1, Delay: time.Millisecond},
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- srv.Run(serverCtx) }()
+	defer func() {
+		stopServer()
+		<-serverDone
+	}()
+
+	_, exposedPort, _ := net.SplitHostPort(freeAddr(t))
+	var port int32
+	fmt.Sscan(exposedPort, &port)
+	svc, endpoints := exposedService("web", port)
+	clientset := fake.NewSimpleClientset(svc, endpoints)
+
+	settings := DefaultSettings()
+	settings.ServerAddr = agentAddr
+	settings.MetricsAddr = ""
+	a, err := New(Config{Settings: settings, Clientset: clientset, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentCtx, stopAgent := context.WithCancel(context.Background())
+	agentDone := make(chan error, 1)
+	go func() { agentDone <- a.Run(agentCtx) }()
+
+	// The discovered service shows up on the server
+	services := func() []types.ExposedService {
+		resp, err := http.Get("http://" + apiAddr + "/api/v1/services")
+		if err != nil {
+			return nil
+		}
+		defer resp.Body.Close()
+		var list struct {
+			Services []types.ExposedService `json:"services"`
+		}
+		json.NewDecoder(resp.Body).Decode(&list)
+		return list.Services
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		list := services()
+		if len(list) == 1 && list[0].Subdomain == "web" && list[0].TargetIP == "10.244.0.5" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("service never registered, got %+v", list)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	stopAgent()
+	select {
+	case err := <-agentDone:
+		if err != nil {
+			t.Fatalf("Run returned %v after shutdown", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+}
+
+func TestHealthServer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	serverClient := core.NewServerClient(ln.Addr().String(), logger)
+	defer serverClient.Close()
+	watcher := core.NewServiceWatcher(fake.NewSimpleClientset(), func([]types.ExposedService) {}, logger)
+	srv := httptest.NewServer(newHealthServer("", serverClient, watcher).Handler)
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz returned %d", code)
+	}
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "not connected") {
+		t.Errorf("/readyz before connecting returned %d %q", code, body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := serverClient.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "not synced") {
+		t.Errorf("/readyz before sync returned %d %q", code, body)
+	}
+
+	go watcher.Start(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for !watcher.HasSynced() {
+		if time.Now().After(deadline) {
+			t.Fatal("watcher never synced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz when ready returned %d", code)
+	}
+	if code, body := get("/metrics"); code != http.StatusOK || !strings.Contains(body, "k8s_exposer_agent_") {
+		t.Errorf("/metrics returned %d without agent metrics", code)
+	}
+}
@@ -1,29 +1,72 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
+// ErrStatsNotAvailable is returned when the server does not provide per-service stats
+var ErrStatsNotAvailable = errors.New("service stats not available")
+
+// ErrNotModified is returned by ListServicesIfChanged when the service list
+// still matches the given ETag
+var ErrNotModified = errors.New("not modified")
+
+// APIError is returned for non-200 API responses
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error (%d): %s", e.StatusCode, e.Message)
+}
+
+// Default timeouts of the methods without context. Sync waits for the
+// reconcile, which the server bounds to 25s.
+const (
+	DefaultTimeout     = 10 * time.Second
+	DefaultSyncTimeout = 30 * time.Second
+)
+
+// syncDeadlineMargin is left between the server giving up waiting for a sync
+// and the request's deadline, for the response to arrive
+const syncDeadlineMargin = time.Second
+
 // Client for k8s-exposer API
 type Client struct {
 	baseURL    string
+	token      string
+	timeout    time.Duration // 0 = the method's default
 	httpClient *http.Client
 }
 
 // NewClient creates a new API client
 func NewClient(baseURL string) *Client {
 	return &Client{
-		baseURL: baseURL,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		baseURL:    baseURL,
+		httpClient: &http.Client{},
 	}
 }
 
+// SetTimeout sets the timeout of all methods without context, replacing
+// DefaultTimeout and DefaultSyncTimeout (0 restores them)
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetToken sets the API token sent with requests to protected endpoints
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
 // Service represents an exposed service
 type Service struct {
 	Name      string        `json:"name"`
@@ -33,13 +76,80 @@ type Service struct {
 	NodeIP    string        `json:"node_ip,omitempty"`
 	FQDN      string        `json:"fqdn,omitempty"`
 	Ports     []PortMapping `json:"ports"`
+
+	// Only returned for a single service
+	Interface       string       `json:"interface,omitempty"`
+	Aliases         []string     `json:"aliases,omitempty"`
+	SourceRanges    []string     `json:"source_ranges,omitempty"`
+	TargetIPs       []string     `json:"target_ips,omitempty"`
+	SessionAffinity string       `json:"session_affinity,omitempty"`
+	MaxConnections  int32        `json:"max_connections,omitempty"`
+	MaxConn         int32        `json:"maxconn,omitempty"`
+	ServerFirst     bool         `json:"server_first,omitempty"`
+	TLS             bool         `json:"tls,omitempty"`
+	AllowHTTP       bool         `json:"allow_http,omitempty"`
+	StrictPort      bool         `json:"strict_port,omitempty"`
+	MaintenancePage bool         `json:"maintenance_page,omitempty"`
+	Drained         bool         `json:"drained,omitempty"`
+	AgentID         string       `json:"agent_id,omitempty"`
+	HealthCheck     *HealthCheck `json:"health_check,omitempty"`
+	Allocations     []Allocation `json:"allocations,omitempty"`
+}
+
+// HealthCheck represents a service's HAProxy health check
+type HealthCheck struct {
+	Path         string `json:"path"`
+	ExpectStatus int32  `json:"expect_status,omitempty"`
+}
+
+// Allocation represents the external port allocated for a requested port
+type Allocation struct {
+	RequestedPort int32  `json:"requested_port"`
+	AllocatedPort int32  `json:"allocated_port"`
+	Protocol      string `json:"protocol"`
+}
+
+// ServiceStats represents the forwarding counters of a service
+type ServiceStats struct {
+	Name              string    `json:"name"`
+	Namespace         string    `json:"namespace"`
+	Subdomain         string    `json:"subdomain"`
+	BytesIn           int64     `json:"bytes_in"`
+	BytesOut          int64     `json:"bytes_out"`
+	ActiveConnections int64     `json:"active_connections"`
+	TotalConnections  int64     `json:"total_connections"`
+	Rejected          int64     `json:"rejected"`
+	Errors            int64     `json:"errors"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// BackendStatus represents the HAProxy backend state of a service
+type BackendStatus struct {
+	Backend string `json:"backend"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
 }
 
 // PortMapping represents a port mapping
 type PortMapping struct {
-	Port       int32  `json:"port"`
-	TargetPort int32  `json:"target_port"`
-	Protocol   string `json:"protocol"`
+	Port          int32  `json:"port"`
+	TargetPort    int32  `json:"target_port"`
+	UDPTargetPort int32  `json:"udp_target_port,omitempty"`
+	Protocol      string `json:"protocol"`
+}
+
+// ReconcileStatus is the outcome of the last reconciliation
+type ReconcileStatus struct {
+	Time          time.Time     `json:"time"`
+	Duration      time.Duration `json:"duration_ns"`
+	Success       bool          `json:"success"`
+	Services      int           `json:"services"`
+	Domains       int           `json:"domains"`
+	Ports         int           `json:"ports"`
+	Stage         string        `json:"stage,omitempty"`
+	Error         string        `json:"error,omitempty"`
+	FirewallError string        `json:"firewall_error,omitempty"`
+	DNSError      string        `json:"dns_error,omitempty"`
 }
 
 // Health represents health status
@@ -50,6 +160,42 @@ type Health struct {
 	Version      string `json:"version"`
 }
 
+// Readiness represents the server's readiness to forward traffic
+type Readiness struct {
+	Status    string          `json:"status"`
+	WireGuard InterfaceStatus `json:"wireguard"`
+	Timestamp string          `json:"timestamp"`
+}
+
+// InterfaceStatus represents the state of the WireGuard interface
+type InterfaceStatus struct {
+	Name   string `json:"name"`
+	Exists bool   `json:"exists"`
+	Up     bool   `json:"up"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Ready reports whether the server can forward traffic
+func (r *Readiness) Ready() bool {
+	return r.Status == "ready"
+}
+
+// Version represents server build information
+type Version struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Agent represents a connected agent
+type Agent struct {
+	ID          string `json:"id"`
+	RemoteAddr  string `json:"remote_addr"`
+	Interface   string `json:"interface"`
+	ConnectedAt string `json:"connected_at"`
+}
+
 // Metrics represents system metrics
 type Metrics struct {
 	Timestamp string                 `json:"timestamp"`
@@ -58,19 +204,93 @@ type Metrics struct {
 	Runtime   map[string]interface{} `json:"runtime"`
 }
 
+// HAProxyConfig represents the HAProxy config served by the server
+type HAProxyConfig struct {
+	Config string `json:"config"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// withTimeout returns a context bounded by the timeout set with SetTimeout,
+// or by fallback if none is set
+func (c *Client) withTimeout(fallback time.Duration) (context.Context, context.CancelFunc) {
+	timeout := fallback
+	if c.timeout > 0 {
+		timeout = c.timeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
 // GetHealth returns health status
 func (c *Client) GetHealth() (*Health, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetHealthWithContext(ctx)
+}
+
+// GetHealthWithContext is GetHealth bounded by ctx instead of the client's timeout
+func (c *Client) GetHealthWithContext(ctx context.Context) (*Health, error) {
 	var health Health
-	if err := c.get("/api/v1/health", &health); err != nil {
+	if err := c.get(ctx, "/api/v1/health", &health); err != nil {
 		return nil, err
 	}
 	return &health, nil
 }
 
+// GetReadiness returns the server's readiness, which is also reported if
+// the server is not ready
+func (c *Client) GetReadiness() (*Readiness, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetReadinessWithContext(ctx)
+}
+
+// GetReadinessWithContext is GetReadiness bounded by ctx instead of the client's timeout
+func (c *Client) GetReadinessWithContext(ctx context.Context) (*Readiness, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/readyz", nil)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, newAPIError(resp.StatusCode, body)
+	}
+
+	var readiness Readiness
+	if err := json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &readiness, nil
+}
+
+// GetVersion returns server build information
+func (c *Client) GetVersion() (*Version, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetVersionWithContext(ctx)
+}
+
+// GetVersionWithContext is GetVersion bounded by ctx instead of the client's timeout
+func (c *Client) GetVersionWithContext(ctx context.Context) (*Version, error) {
+	var version Version
+	if err := c.get(ctx, "/api/v1/version", &version); err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
 // GetMetrics returns system metrics
 func (c *Client) GetMetrics() (*Metrics, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetMetricsWithContext(ctx)
+}
+
+// GetMetricsWithContext is GetMetrics bounded by ctx instead of the client's timeout
+func (c *Client) GetMetricsWithContext(ctx context.Context) (*Metrics, error) {
 	var metrics Metrics
-	if err := c.get("/api/v1/metrics", &metrics); err != nil {
+	if err := c.get(ctx, "/api/v1/metrics", &metrics); err != nil {
 		return nil, err
 	}
 	return &metrics, nil
@@ -78,57 +298,356 @@ func (c *Client) GetMetrics() (*Metrics, error) {
 
 // ListServices returns all services
 func (c *Client) ListServices() ([]Service, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.ListServicesWithContext(ctx)
+}
+
+// ListServicesWithContext is ListServices bounded by ctx instead of the client's timeout
+func (c *Client) ListServicesWithContext(ctx context.Context) ([]Service, error) {
 	var response struct {
 		Services []Service `json:"services"`
 		Count    int       `json:"count"`
 	}
-	if err := c.get("/api/v1/services", &response); err != nil {
+	if err := c.get(ctx, "/api/v1/services", &response); err != nil {
 		return nil, err
 	}
 	return response.Services, nil
 }
 
+// ListServicesIfChanged returns the services and the ETag of the list, or
+// ErrNotModified if the list still matches etag (from a previous call).
+// Pollers use it to skip unchanged lists.
+func (c *Client) ListServicesIfChanged(etag string) ([]Service, string, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.ListServicesIfChangedWithContext(ctx, etag)
+}
+
+// ListServicesIfChangedWithContext is ListServicesIfChanged bounded by ctx
+// instead of the client's timeout
+func (c *Client) ListServicesIfChangedWithContext(ctx context.Context, etag string) ([]Service, string, error) {
+	var response struct {
+		Services []Service `json:"services"`
+		Count    int       `json:"count"`
+	}
+	newETag, err := c.getIfNoneMatch(ctx, "/api/v1/services", etag, &response)
+	if err != nil {
+		return nil, etag, err
+	}
+	return response.Services, newETag, nil
+}
+
 // GetService returns a specific service
 func (c *Client) GetService(name string) (*Service, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetServiceWithContext(ctx, name)
+}
+
+// GetServiceWithContext is GetService bounded by ctx instead of the client's timeout
+func (c *Client) GetServiceWithContext(ctx context.Context, name string) (*Service, error) {
 	var service Service
-	if err := c.get(fmt.Sprintf("/api/v1/services/%s", name), &service); err != nil {
+	if err := c.get(ctx, fmt.Sprintf("/api/v1/services/%s", name), &service); err != nil {
 		return nil, err
 	}
 	return &service, nil
 }
 
-// Sync triggers reconciliation
-func (c *Client) Sync() error {
-	resp, err := c.httpClient.Post(c.baseURL+"/api/v1/sync", "application/json", nil)
+// GetServiceStats returns the forwarding counters of a specific service. It
+// returns ErrStatsNotAvailable if the server does not expose them.
+func (c *Client) GetServiceStats(name string) (*ServiceStats, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetServiceStatsWithContext(ctx, name)
+}
+
+// GetServiceStatsWithContext is GetServiceStats bounded by ctx instead of the
+// client's timeout
+func (c *Client) GetServiceStatsWithContext(ctx context.Context, name string) (*ServiceStats, error) {
+	var stats ServiceStats
+	err := c.get(ctx, fmt.Sprintf("/api/v1/services/%s/metrics", url.PathEscape(name)), &stats)
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusNotFound && apiErr.Message == "service not found":
+			return nil, err
+		case apiErr.StatusCode == http.StatusNotFound,
+			apiErr.StatusCode == http.StatusNotImplemented,
+			apiErr.StatusCode == http.StatusServiceUnavailable:
+			// Older servers have no stats route at all
+			return nil, ErrStatsNotAvailable
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// GetServiceBackend returns the HAProxy backend state of a specific service
+func (c *Client) GetServiceBackend(name string) (*BackendStatus, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetServiceBackendWithContext(ctx, name)
+}
+
+// GetServiceBackendWithContext is GetServiceBackend bounded by ctx instead of
+// the client's timeout
+func (c *Client) GetServiceBackendWithContext(ctx context.Context, name string) (*BackendStatus, error) {
+	var status BackendStatus
+	if err := c.get(ctx, fmt.Sprintf("/api/v1/services/%s/backend", name), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// GetReconcileStatus returns the outcome of the last reconciliation
+func (c *Client) GetReconcileStatus() (*ReconcileStatus, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetReconcileStatusWithContext(ctx)
+}
+
+// GetReconcileStatusWithContext is GetReconcileStatus bounded by ctx instead
+// of the client's timeout
+func (c *Client) GetReconcileStatusWithContext(ctx context.Context) (*ReconcileStatus, error) {
+	var status ReconcileStatus
+	if err := c.get(ctx, "/api/v1/reconcile/status", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ListAgents returns all connected agents
+func (c *Client) ListAgents() ([]Agent, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.ListAgentsWithContext(ctx)
+}
+
+// ListAgentsWithContext is ListAgents bounded by ctx instead of the client's timeout
+func (c *Client) ListAgentsWithContext(ctx context.Context) ([]Agent, error) {
+	var response struct {
+		Agents []Agent `json:"agents"`
+		Count  int     `json:"count"`
+	}
+	if err := c.get(ctx, "/api/v1/agents", &response); err != nil {
+		return nil, err
+	}
+	return response.Agents, nil
+}
+
+// Resync asks an agent to re-send its complete service list
+func (c *Client) Resync(agentID string) error {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.ResyncWithContext(ctx, agentID)
+}
+
+// ResyncWithContext is Resync bounded by ctx instead of the client's timeout
+func (c *Client) ResyncWithContext(ctx context.Context, agentID string) error {
+	resp, err := c.do(ctx, http.MethodPost, "/api/v1/agents/"+url.PathEscape(agentID)+"/resync", nil)
 	if err != nil {
-		return fmt.Errorf("failed to sync: %w", err)
+		return fmt.Errorf("failed to request resync: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("sync failed: %s", string(body))
+		return fmt.Errorf("resync failed: %s", string(body))
 	}
 
 	return nil
 }
 
+// DrainService stops a service from accepting new connections, keeping its ports bound
+func (c *Client) DrainService(name string) error {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.DrainServiceWithContext(ctx, name)
+}
+
+// DrainServiceWithContext is DrainService bounded by ctx instead of the
+// client's timeout
+func (c *Client) DrainServiceWithContext(ctx context.Context, name string) error {
+	return c.serviceAction(ctx, name, "drain")
+}
+
+// UndrainService lets a drained service accept new connections again
+func (c *Client) UndrainService(name string) error {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.UndrainServiceWithContext(ctx, name)
+}
+
+// UndrainServiceWithContext is UndrainService bounded by ctx instead of the
+// client's timeout
+func (c *Client) UndrainServiceWithContext(ctx context.Context, name string) error {
+	return c.serviceAction(ctx, name, "undrain")
+}
+
+// serviceAction posts an action on a service
+func (c *Client) serviceAction(ctx context.Context, name, action string) error {
+	resp, err := c.do(ctx, http.MethodPost, "/api/v1/services/"+url.PathEscape(name)+"/"+action, nil)
+	if err != nil {
+		return fmt.Errorf("failed to %s service: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, body)
+	}
+
+	return nil
+}
+
+// Sync triggers reconciliation and waits for it on the server for a bounded
+// time. It reports whether the reconcile completed; otherwise it continues in
+// the background and its result shows up in GetReconcileStatus.
+func (c *Client) Sync() (bool, error) {
+	ctx, cancel := c.withTimeout(DefaultSyncTimeout)
+	defer cancel()
+	return c.SyncWithContext(ctx)
+}
+
+// SyncWithContext is Sync bounded by ctx instead of the client's timeout. The
+// server stops waiting for the reconcile shortly before ctx's deadline, so
+// the call reports an unfinished reconcile instead of timing out.
+func (c *Client) SyncWithContext(ctx context.Context) (bool, error) {
+	query := ""
+	if deadline, ok := ctx.Deadline(); ok {
+		if wait := time.Until(deadline) - syncDeadlineMargin; wait > 0 {
+			query = "?timeout=" + url.QueryEscape(wait.Round(time.Millisecond).String())
+		}
+	}
+	status, err := c.sync(ctx, query)
+	return status == http.StatusOK, err
+}
+
+// SyncAsync triggers reconciliation without waiting for it
+func (c *Client) SyncAsync() error {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.SyncAsyncWithContext(ctx)
+}
+
+// SyncAsyncWithContext is SyncAsync bounded by ctx instead of the client's timeout
+func (c *Client) SyncAsyncWithContext(ctx context.Context) error {
+	_, err := c.sync(ctx, "?async=true")
+	return err
+}
+
+// sync posts a sync request and returns the response status
+func (c *Client) sync(ctx context.Context, query string) (int, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/api/v1/sync"+query, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sync: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("sync failed: %s", string(body))
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Dump returns a JSON snapshot of the server state for support bundles
+func (c *Client) Dump() (json.RawMessage, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.DumpWithContext(ctx)
+}
+
+// DumpWithContext is Dump bounded by ctx instead of the client's timeout
+func (c *Client) DumpWithContext(ctx context.Context) (json.RawMessage, error) {
+	var dump json.RawMessage
+	if err := c.get(ctx, "/api/v1/debug/dump", &dump); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// GetHAProxyConfig returns the HAProxy config file, or with dryRun the config
+// the server would generate from the current services. Requires the API token.
+func (c *Client) GetHAProxyConfig(dryRun bool) (*HAProxyConfig, error) {
+	ctx, cancel := c.withTimeout(DefaultTimeout)
+	defer cancel()
+	return c.GetHAProxyConfigWithContext(ctx, dryRun)
+}
+
+// GetHAProxyConfigWithContext is GetHAProxyConfig bounded by ctx instead of
+// the client's timeout
+func (c *Client) GetHAProxyConfigWithContext(ctx context.Context, dryRun bool) (*HAProxyConfig, error) {
+	var config HAProxyConfig
+	if err := c.get(ctx, fmt.Sprintf("/api/v1/haproxy/config?dry_run=%t", dryRun), &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// do sends a request without body, with the API token if one is set
+func (c *Client) do(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.httpClient.Do(req)
+}
+
 // get performs a GET request
-func (c *Client) get(path string, target interface{}) error {
-	resp, err := c.httpClient.Get(c.baseURL + path)
+func (c *Client) get(ctx context.Context, path string, target interface{}) error {
+	_, err := c.getIfNoneMatch(ctx, path, "", target)
+	return err
+}
+
+// getIfNoneMatch performs a GET request, sending etag as If-None-Match if it
+// is not empty. It returns the response's ETag, or ErrNotModified if the
+// server answered 304.
+func (c *Client) getIfNoneMatch(ctx context.Context, path, etag string, target interface{}) (string, error) {
+	header := make(http.Header)
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, path, header)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return "", fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return etag, ErrNotModified
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API error (%d): %s", resp.StatusCode, string(body))
+		return "", newAPIError(resp.StatusCode, body)
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+		return "", fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return nil
+	return resp.Header.Get("ETag"), nil
+}
+
+// newAPIError builds an APIError, preferring the message of a JSON error body
+func newAPIError(statusCode int, body []byte) *APIError {
+	var response struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err == nil && response.Error != "" {
+		return &APIError{StatusCode: statusCode, Message: response.Error}
+	}
+	return &APIError{StatusCode: statusCode, Message: strings.TrimSpace(string(body))}
 }
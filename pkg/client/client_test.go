@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetServiceStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/services/web/metrics":
+			w.Write([]byte(`{"name":"web","namespace":"default","subdomain":"web","bytes_in":10,"bytes_out":20,"total_connections":3}`))
+		case "/api/v1/services/missing/metrics":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"service not found"}`))
+		case "/api/v1/services/disabled/metrics":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"stats disabled"}`))
+		default:
+			// Older servers have no stats route
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL)
+
+	stats, err := c.GetServiceStats("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Subdomain != "web" || stats.BytesIn != 10 || stats.BytesOut != 20 || stats.TotalConnections != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// An unknown service is an API error, not missing stats support
+	_, err = c.GetServiceStats("missing")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "service not found" {
+		t.Errorf("expected a not found API error, got %v", err)
+	}
+	if errors.Is(err, ErrStatsNotAvailable) {
+		t.Error("an unknown service must not be reported as missing stats support")
+	}
+
+	for _, name := range []string{"disabled", "legacy"} {
+		if _, err := c.GetServiceStats(name); !errors.Is(err, ErrStatsNotAvailable) {
+			t.Errorf("%s: expected ErrStatsNotAvailable, got %v", name, err)
+		}
+	}
+}
+
+func TestDrainServiceSendsToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/services/web/drain" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid or missing API token"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL)
+
+	var apiErr *APIError
+	if err := c.DrainService("web"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %v", err)
+	}
+	c.SetToken("secret")
+	if err := c.DrainService("web"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hangingServer answers requests only once the test ends
+func hangingServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.Close()
+	})
+	return srv
+}
+
+func TestCanceledContextAbortsRequest(t *testing.T) {
+	c := NewClient(hangingServer(t).URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := c.ListServicesWithContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request returned after %s", elapsed)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.SyncWithContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestSetTimeout(t *testing.T) {
+	c := NewClient(hangingServer(t).URL)
+	c.SetTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := c.GetHealth(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request returned after %s, want the 50ms timeout", elapsed)
+	}
+}
+
+func TestSyncPassesDeadline(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done, err := c.SyncWithContext(ctx)
+	if err != nil || !done {
+		t.Fatalf("unexpected result %v, %v", done, err)
+	}
+	if !strings.HasPrefix(query, "timeout=") {
+		t.Errorf("expected the server wait bounded by the deadline, got query %q", query)
+	}
+
+	if err := c.SyncAsyncWithContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if query != "async=true" {
+		t.Errorf("unexpected async query %q", query)
+	}
+}
@@ -0,0 +1,381 @@
+// Package server runs a complete k8s-exposer server (agent listener,
+// forwarding, HAProxy/firewall automation and the REST API) inside another
+// Go program. cmd/server is a thin shell around it that reads the
+// configuration from environment variables.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/api"
+	"github.com/noahjeana/k8s-exposer/internal/automation"
+	"github.com/noahjeana/k8s-exposer/internal/automation/dns"
+	"github.com/noahjeana/k8s-exposer/internal/automation/firewall"
+	"github.com/noahjeana/k8s-exposer/internal/automation/haproxy"
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	core "github.com/noahjeana/k8s-exposer/internal/server"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+// Configuration types of the server's components
+type (
+	ListenerConfig   = core.ListenerConfig
+	AutomationConfig = automation.Config
+	BuildInfo        = api.BuildInfo
+
+	// Fields of AutomationConfig
+	ReadinessWait      = automation.ReadinessWait
+	HAProxyStats       = haproxy.StatsConfig
+	FirewallTimeouts   = firewall.Timeouts
+	FirewallStaticRule = firewall.StaticRule
+	DNSProvider        = dns.Provider
+	DNSConfig          = dns.Config
+)
+
+// Backoff strategies of ReadinessWait
+const (
+	BackoffConstant    = automation.BackoffConstant
+	BackoffLinear      = automation.BackoffLinear
+	BackoffExponential = automation.BackoffExponential
+)
+
+// ParseFirewallStaticRules parses static firewall rules in the format of
+// FIREWALL_STATIC_RULES, e.g. "51820/udp=WireGuard;9100/tcp@10.0.0.0/8"
+func ParseFirewallStaticRules(spec string) ([]FirewallStaticRule, error) {
+	return firewall.ParseStaticRules(spec)
+}
+
+// NewDNSProvider creates the DNS provider selected by cfg, a no-op provider
+// for DNS managed elsewhere
+func NewDNSProvider(cfg DNSConfig) (DNSProvider, error) {
+	return dns.NewProvider(cfg)
+}
+
+// finalReconcileTimeout bounds the reconcile flushed on shutdown
+const finalReconcileTimeout = 10 * time.Second
+
+// Defaults of the forwarding, agent connection, service limit and automation settings
+const (
+	DefaultDialAttempts       = core.DefaultDialAttempts
+	DefaultDialRetryDelay     = core.DefaultDialRetryDelay
+	DefaultDialDeadline       = core.DefaultDialDeadline
+	DefaultMaxAgentConns      = core.DefaultMaxAgentConns
+	DefaultMaxAgentConnsPerIP = core.DefaultMaxAgentConnsPerIP
+	DefaultAgentConnRate      = core.DefaultAgentConnRate
+	DefaultMaxServices        = core.DefaultMaxServices
+
+	DefaultReconcileDebounce        = automation.DefaultReconcileDebounce
+	DefaultHistorySize              = automation.DefaultHistorySize
+	DefaultHAProxyReloadInterval    = automation.DefaultHAProxyReloadInterval
+	DefaultFirewallBreakerThreshold = automation.DefaultFirewallBreakerThreshold
+	DefaultFirewallBreakerCooldown  = automation.DefaultFirewallBreakerCooldown
+)
+
+// Config configures a server. Zero addresses, paths, port ranges and
+// durations select the defaults of the corresponding environment variables
+// of cmd/server. The exception are Automation.ReconcileDebounce,
+// HistorySize, HAProxyReloadInterval and FirewallBreakerThreshold, where 0
+// turns the feature off as in the environment; set them to the Default*
+// constants for the defaults.
+type Config struct {
+	ListenAddr         string // Agent connections (default 10.0.0.1:9090)
+	APIListenAddr      string // REST API (default 0.0.0.0:8090)
+	WireGuardInterface string // Interface forwarded traffic leaves through (default wg0)
+
+	// Fallback range for ports already in use (default 30000-32767) and a
+	// separate range for UDP (default: the same range)
+	PortRangeStart    int32
+	PortRangeEnd      int32
+	UDPPortRangeStart int32
+	UDPPortRangeEnd   int32
+
+	Listener       ListenerConfig
+	DialAttempts   int           // Default DefaultDialAttempts
+	DialRetryDelay time.Duration // Default DefaultDialRetryDelay
+	DialDeadline   time.Duration // Default DefaultDialDeadline
+
+	ShutdownGracePeriod time.Duration // Drain time of client connections on shutdown (default 30s)
+	MaxMessageSize      int           // Max agent protocol message size (default protocol.DefaultMaxMessageSize)
+	AgentSyncInterval   string        // Sync interval pushed to agents (empty = agent's own)
+	APIToken            string        // Bearer token of the debug routes (empty = disabled)
+
+	// Agent connection limits (0 = unlimited)
+	MaxAgentConns      int
+	MaxAgentConnsPerIP int
+	AgentConnRate      int
+
+	// Max registered services, new ones above it are rejected (0 = unlimited)
+	MaxServices int
+
+	Automation AutomationConfig
+	// StopOnHAProxyNotReady makes Run fail when HAProxy does not become ready
+	// instead of continuing without automation
+	StopOnHAProxyNotReady bool
+
+	BuildInfo BuildInfo
+	Logger    *slog.Logger // Default slog.Default()
+}
+
+// withDefaults returns the config with zero values replaced by defaults
+func (c Config) withDefaults() Config {
+	if c.ListenAddr == "" {
+		c.ListenAddr = "10.0.0.1:9090"
+	}
+	if c.APIListenAddr == "" {
+		c.APIListenAddr = "0.0.0.0:8090"
+	}
+	if c.WireGuardInterface == "" {
+		c.WireGuardInterface = "wg0"
+	}
+	if c.PortRangeStart == 0 && c.PortRangeEnd == 0 {
+		c.PortRangeStart, c.PortRangeEnd = 30000, 32767
+	}
+	if c.UDPPortRangeStart == 0 && c.UDPPortRangeEnd == 0 {
+		c.UDPPortRangeStart, c.UDPPortRangeEnd = c.PortRangeStart, c.PortRangeEnd
+	}
+	if c.DialAttempts == 0 {
+		c.DialAttempts = DefaultDialAttempts
+	}
+	if c.DialRetryDelay == 0 {
+		c.DialRetryDelay = DefaultDialRetryDelay
+	}
+	if c.DialDeadline == 0 {
+		c.DialDeadline = DefaultDialDeadline
+	}
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = 30 * time.Second
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = protocol.DefaultMaxMessageSize
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+
+	a := &c.Automation
+	if a.Domain == "" {
+		a.Domain = "neverup.at"
+	}
+	if a.HAProxySocket == "" {
+		a.HAProxySocket = "/var/run/haproxy.sock"
+	}
+	if a.HAProxyMap == "" {
+		a.HAProxyMap = "/etc/haproxy/domains.map"
+	}
+	if a.HAProxyConfig == "" {
+		a.HAProxyConfig = "/etc/haproxy/haproxy.cfg"
+	}
+	if a.ReconcileInterval == 0 {
+		a.ReconcileInterval = 30 * time.Second
+	}
+	if a.AgentWait == 0 {
+		a.AgentWait = 30 * time.Second
+	}
+	if a.FirewallBreakerCooldown == 0 {
+		a.FirewallBreakerCooldown = DefaultFirewallBreakerCooldown
+	}
+	// A zero ReconcileDebounce, HistorySize, HAProxyReloadInterval and
+	// FirewallBreakerThreshold is kept, it turns the feature off
+	return c
+}
+
+// Server is an embeddable k8s-exposer server
+type Server struct {
+	config       Config
+	logger       *slog.Logger
+	forwarder    *core.Forwarder
+	registry     *core.ServiceRegistry
+	agents       *core.AgentRegistry
+	automation   *automation.Controller
+	api          *api.Server
+	agentLimiter *core.AgentConnLimiter
+}
+
+// New validates cfg and creates the server's components. Nothing listens
+// until Run is called.
+func New(cfg Config) (*Server, error) {
+	cfg = cfg.withDefaults()
+	logger := cfg.Logger
+
+	if err := cfg.Automation.HAProxyWait.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid HAProxy readiness wait: %w", err)
+	}
+
+	agents := core.NewAgentRegistry(cfg.MaxMessageSize)
+	if cfg.AgentSyncInterval != "" {
+		if err := agents.SetAgentConfig(&types.AgentConfig{SyncInterval: cfg.AgentSyncInterval}); err != nil {
+			return nil, fmt.Errorf("invalid agent sync interval: %w", err)
+		}
+	}
+
+	// Verify the automation environment before accepting agents
+	controller := automation.NewController(cfg.Automation, logger)
+	if err := controller.Preflight(); err != nil {
+		return nil, fmt.Errorf("preflight failed: %w", err)
+	}
+
+	forwarder := core.NewForwarder(cfg.WireGuardInterface, logger)
+	forwarder.SetUDPBuffers(cfg.Listener.UDPReadBuffer, cfg.Listener.UDPWriteBuffer)
+	forwarder.SetDialRetry(cfg.DialAttempts, cfg.DialRetryDelay, cfg.DialDeadline)
+
+	registry := core.NewServiceRegistry(cfg.PortRangeStart, cfg.PortRangeEnd, cfg.Listener, forwarder, logger)
+	registry.SetUDPPortRange(cfg.UDPPortRangeStart, cfg.UDPPortRangeEnd)
+	registry.SetMaxServices(cfg.MaxServices)
+	registry.SetAgentRegistry(agents)
+	controller.SetAllocationSource(registry.GetAllocations)
+
+	apiServer := api.NewServer(registry, agents, controller, cfg.BuildInfo, logger)
+	apiServer.SetAPIToken(cfg.APIToken)
+
+	return &Server{
+		config:       cfg,
+		logger:       logger,
+		forwarder:    forwarder,
+		registry:     registry,
+		agents:       agents,
+		automation:   controller,
+		api:          apiServer,
+		agentLimiter: core.NewAgentConnLimiter(cfg.MaxAgentConns, cfg.MaxAgentConnsPerIP, cfg.AgentConnRate),
+	}, nil
+}
+
+// Run serves agents, forwarded traffic and the API until ctx is canceled,
+// then drains client connections and releases all resources. It returns nil
+// after a shutdown through ctx and the error that stopped the server
+// otherwise. A server can only be run once.
+func (s *Server) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Forwarder is closed last
+	defer s.forwarder.Close()
+	defer s.registry.Close()
+
+	// Start listening for agent connections
+	listener, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start listener: %w", err)
+	}
+	defer listener.Close()
+
+	// Reconcile promptly whenever the registry changes instead of waiting
+	// for the next interval
+	registryEvents, unsubscribe := s.registry.Subscribe()
+	defer unsubscribe()
+	go func() {
+		for range registryEvents {
+			s.automation.Trigger()
+		}
+	}()
+
+	// Start automation controller in background
+	automationDone := make(chan struct{})
+	go func() {
+		defer close(automationDone)
+		s.logger.Info("Starting automation controller")
+		if err := s.automation.Run(ctx, s.registry.GetServices, s.registry.FirstUpdate()); err != nil && !errors.Is(err, context.Canceled) {
+			if errors.Is(err, automation.ErrHAProxyNotReady) && s.config.StopOnHAProxyNotReady {
+				s.logger.Error("HAProxy not ready, stopping server", "error", err)
+				cancel(err) // Stop the whole server instead of running without automation
+				return
+			}
+			s.logger.Error("Automation controller failed, continuing without automation", "error", err)
+		}
+	}()
+
+	// Start API server in background
+	go func() {
+		if err := s.api.Start(s.config.APIListenAddr); err != nil {
+			s.logger.Error("API server failed", "error", err)
+			cancel(fmt.Errorf("API server failed: %w", err)) // Stop the whole server if API fails
+		}
+	}()
+
+	s.logger.Info("Server listening for agent connections", "addr", listener.Addr())
+
+	// Accept connections in a goroutine
+	connCh := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.logger.Error("Failed to accept connection", "error", err)
+				continue
+			}
+			select {
+			case connCh <- conn:
+			case <-ctx.Done():
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.shutdown(listener, automationDone)
+			if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) && !errors.Is(cause, context.DeadlineExceeded) {
+				return cause
+			}
+			return nil
+
+		case conn := <-connCh:
+			// Refuse connection floods before spending a goroutine on them
+			release, err := s.agentLimiter.Acquire(conn.RemoteAddr())
+			if err != nil {
+				s.logger.Warn("Refusing agent connection", "remote", conn.RemoteAddr(), "error", err)
+				conn.Close()
+				continue
+			}
+			s.logger.Info("Agent connected", "remote", conn.RemoteAddr())
+			go func() {
+				defer release()
+				core.HandleAgentConnection(ctx, conn, s.registry, s.agents, s.logger)
+			}()
+		}
+	}
+}
+
+// shutdown stops accepting agents, drains client connections, stops the API
+// and applies a pending reconcile once the automation loop stopped
+func (s *Server) shutdown(listener net.Listener, automationDone <-chan struct{}) {
+	s.logger.Info("Shutting down gracefully", "grace_period", s.config.ShutdownGracePeriod)
+
+	// Stop accepting new agent connections
+	listener.Close()
+
+	// Stop accepting client connections and drain in-flight ones. The
+	// services are read first, the registry is empty once drained.
+	services := s.registry.GetServices()
+	s.registry.Shutdown(s.config.ShutdownGracePeriod)
+
+	// Stop the API server
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := s.api.Shutdown(shutdownCtx); err != nil {
+		s.logger.Warn("API server shutdown failed", "error", err)
+	}
+
+	// Apply changes the automation loop had not reconciled yet, once it
+	// stopped so the final reconciliation runs alone
+	<-automationDone
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), finalReconcileTimeout)
+	defer flushCancel()
+	if err := s.automation.Flush(flushCtx, services); err != nil {
+		s.logger.Warn("Final reconciliation failed", "error", err)
+	}
+}
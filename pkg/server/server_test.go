@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/noahjeana/k8s-exposer/internal/protocol"
+	"github.com/noahjeana/k8s-exposer/pkg/types"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	c := Config{}.withDefaults()
+	if c.ListenAddr != "10.0.0.1:9090" || c.PortRangeStart != 30000 || c.UDPPortRangeEnd != 32767 ||
+		c.DialAttempts != DefaultDialAttempts || c.Automation.FirewallBreakerCooldown != DefaultFirewallBreakerCooldown {
+		t.Errorf("defaults not applied: %+v", c)
+	}
+
+	// A zero value turns these features off, as in the environment
+	a := c.Automation
+	if a.ReconcileDebounce != 0 || a.HistorySize != 0 || a.HAProxyReloadInterval != 0 || a.FirewallBreakerThreshold != 0 {
+		t.Errorf("disabled settings replaced by defaults: %+v", a)
+	}
+	c = Config{Automation: AutomationConfig{ReconcileDebounce: DefaultReconcileDebounce, HistorySize: DefaultHistorySize}}.withDefaults()
+	if c.Automation.ReconcileDebounce != DefaultReconcileDebounce || c.Automation.HistorySize != DefaultHistorySize {
+		t.Errorf("explicit settings not kept: %+v", c.Automation)
+	}
+}
+
+// freeAddr returns a loopback address with a currently unused TCP port
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// dialRetry dials addr until the server listens or the timeout expires
+func dialRetry(t *testing.T, addr string, timeout time.Duration) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not listening on %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRunAndShutdown(t *testing.T) {
+	dir := t.TempDir()
+	agentAddr := freeAddr(t)
+	apiAddr := freeAddr(t)
+	exposed := freeAddr(t)
+	_, exposedPort, _ := net.SplitHostPort(exposed)
+
+	srv, err := New(Config{
+		ListenAddr:          agentAddr,
+		APIListenAddr:       apiAddr,
+		WireGuardInterface:  "wg-test",
+		PortRangeStart:      40000,
+		PortRangeEnd:        40100,
+		Listener:            ListenerConfig{TCPBindIP: "127.0.0.1", UDPBindIP: "127.0.0.1"},
+		ShutdownGracePeriod: time.Second,
+		Automation: AutomationConfig{
+			HAProxySocket: filepath.Join(dir, "haproxy.sock"),
+			HAProxyMap:    filepath.Join(dir, "domains.map"),
+			HAProxyConfig: filepath.Join(dir, "haproxy.cfg"),
+			HAProxyWait:   ReadinessWait{Attempts: 1, Delay: time.Millisecond},
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	// An agent registers a service and gets its allocation back
+	agent := dialRetry(t, agentAddr, 2*time.Second)
+	defer agent.Close()
+	var port int32
+	fmt.Sscan(exposedPort, &port)
+	update := &types.Message{
+		Type: types.MessageTypeServiceUpdate,
+		Services: []types.ExposedService{{
+			Name:      "web",
+			Namespace: "default",
+			Subdomain: "web",
+			Ports:     []types.PortMapping{{Port: port, TargetPort: 8080, Protocol: "tcp"}},
+			TargetIP:  "127.0.0.1",
+		}},
+	}
+	if err := protocol.SendMessage(agent, update); err != nil {
+		t.Fatal(err)
+	}
+	agent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	status, err := protocol.ReceiveMessage(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Allocations) != 1 || len(status.Errors) != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	dialRetry(t, apiAddr, 2*time.Second).Close()
+	resp, err := http.Get("http://" + apiAddr + "/api/v1/services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Count int `json:"count"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || list.Count != 1 {
+		t.Fatalf("expected the registered service from the API, got %d (%v)", list.Count, err)
+	}
+	dialRetry(t, exposed, time.Second).Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v after shutdown", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+
+	for _, addr := range []string{agentAddr, apiAddr, exposed} {
+		if conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after shutdown", addr)
+		}
+	}
+}
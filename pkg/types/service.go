@@ -2,26 +2,78 @@ package types
 
 import (
 	"fmt"
+	"net"
 	"regexp"
+	"strings"
+	"time"
 )
 
 // ExposedService represents a Kubernetes service that should be exposed externally
 type ExposedService struct {
-	Name      string        `json:"name"`
-	Namespace string        `json:"namespace"`
-	Subdomain string        `json:"subdomain"`  // From annotation: expose.neverup.at/subdomain
-	Ports     []PortMapping `json:"ports"`      // From annotation: expose.neverup.at/ports
-	TargetIP  string        `json:"target_ip"`  // K8s ClusterIP or Node IP
-	NodeIP    string        `json:"node_ip"`    // For NodePort fallback
+	Name            string        `json:"name"`
+	Namespace       string        `json:"namespace"`
+	Subdomain       string        `json:"subdomain"`                  // From annotation: expose.neverup.at/subdomain
+	Ports           []PortMapping `json:"ports"`                      // From annotation: expose.neverup.at/ports
+	TargetIP        string        `json:"target_ip"`                  // K8s ClusterIP or Node IP
+	NodeIP          string        `json:"node_ip"`                    // For NodePort fallback
+	Interface       string        `json:"interface,omitempty"`        // Server-side WireGuard interface (set from agent connection)
+	MaxConnections  int32         `json:"max_connections,omitempty"`  // From annotation: expose.neverup.at/max-connections (0 = unlimited)
+	ServerFirst     bool          `json:"server_first,omitempty"`     // From annotation: expose.neverup.at/server-first (backend speaks first)
+	HealthCheck     *HealthCheck  `json:"health_check,omitempty"`     // From annotation: expose.neverup.at/healthcheck
+	MaxConn         int32         `json:"maxconn,omitempty"`          // From annotation: expose.neverup.at/maxconn (HAProxy per-server limit, 0 = unlimited)
+	NodeFallback    bool          `json:"node_fallback,omitempty"`    // From annotation: expose.neverup.at/node-fallback (retry via NodeIP:NodePort)
+	TLS             bool          `json:"tls,omitempty"`              // From annotation: expose.neverup.at/tls (needs a certificate for its domain)
+	AllowHTTP       bool          `json:"allow_http,omitempty"`       // From annotation: expose.neverup.at/force-https=false (no redirect to HTTPS)
+	StrictPort      bool          `json:"strict_port,omitempty"`      // From annotation: expose.neverup.at/strict-port (reject instead of moving to a fallback port)
+	MaintenancePage bool          `json:"maintenance_page,omitempty"` // From annotation: expose.neverup.at/maintenance-page (served while the health check fails)
+	Aliases         []string      `json:"aliases,omitempty"`          // From annotation: expose.neverup.at/aliases (additional subdomains routed to the service)
+	SourceRanges    []string      `json:"source_ranges,omitempty"`    // From annotation: expose.neverup.at/source-ranges (CIDRs the firewall opens the ports to, default everywhere)
+	TargetIPs       []string      `json:"target_ips,omitempty"`       // All ready pod IPs connections are balanced across (pod target with several ready pods)
+	SessionAffinity string        `json:"session_affinity,omitempty"` // From annotation: expose.neverup.at/session-affinity (TTL pinning a client IP to one backend, e.g. "3h")
+}
+
+// Hostnames returns the subdomain and all aliases of the service
+func (s *ExposedService) Hostnames() []string {
+	return append([]string{s.Subdomain}, s.Aliases...)
+}
+
+// AffinityTTL returns how long a client IP stays pinned to its backend,
+// 0 if session affinity is disabled
+func (s *ExposedService) AffinityTTL() time.Duration {
+	ttl, _ := time.ParseDuration(s.SessionAffinity)
+	return ttl
+}
+
+// HealthCheck defines an active HTTP health check for a service's HAProxy backend
+type HealthCheck struct {
+	Path         string `json:"path"`                    // Request path, e.g. /healthz
+	ExpectStatus int32  `json:"expect_status,omitempty"` // Expected status code (0 = HAProxy default, 2xx/3xx)
 }
 
 // PortMapping defines a port and protocol to expose
 type PortMapping struct {
-	Port       int32  `json:"port"`        // Port to expose externally
-	TargetPort int32  `json:"target_port"` // Internal target port
-	Protocol   string `json:"protocol"`    // "tcp", "udp", or "tcp+udp"
+	Port          int32  `json:"port"`                      // Port to expose externally
+	TargetPort    int32  `json:"target_port"`               // Internal target port
+	UDPTargetPort int32  `json:"udp_target_port,omitempty"` // Target port of the UDP half of a tcp+udp mapping (0 = TargetPort)
+	NodePort      int32  `json:"node_port,omitempty"`       // NodePort used for the node fallback
+	Protocol      string `json:"protocol"`                  // "tcp", "udp", or "tcp+udp"
 }
 
+// TargetPortFor returns the target port for traffic of protocol ("tcp" or
+// "udp") received on the mapping, the exposed port if no target is set
+func (p PortMapping) TargetPortFor(protocol string) int32 {
+	if protocol == "udp" && p.Protocol == "tcp+udp" && p.UDPTargetPort != 0 {
+		return p.UDPTargetPort
+	}
+	if p.TargetPort != 0 {
+		return p.TargetPort
+	}
+	return p.Port
+}
+
+// WildcardSubdomain marks a catch-all service receiving all unmatched hosts
+const WildcardSubdomain = "*"
+
 // MessageType defines the type of message sent between agent and server
 type MessageType string
 
@@ -29,12 +81,84 @@ const (
 	MessageTypeServiceUpdate MessageType = "service_update"
 	MessageTypeServiceDelete MessageType = "service_delete"
 	MessageTypeHeartbeat     MessageType = "heartbeat"
+	MessageTypeServiceStatus MessageType = "service_status" // Server -> agent
+	MessageTypeResync        MessageType = "resync"         // Server -> agent: re-send all services
+	MessageTypeConfig        MessageType = "config"         // Server -> agent: update runtime settings
+	MessageTypePing          MessageType = "ping"           // Agent -> server: link check, answered with a pong
+	MessageTypePong          MessageType = "pong"           // Server -> agent: answer to a ping with its sequence number
 )
 
+// MinSyncInterval is the shortest periodic discovery interval the server may push
+const MinSyncInterval = time.Second
+
+// AgentConfig holds the agent settings the server can change at runtime.
+// Unset fields keep the agent's current value.
+type AgentConfig struct {
+	SyncInterval string `json:"sync_interval,omitempty"` // Periodic discovery interval, e.g. "1m"
+}
+
+// Validate validates an AgentConfig
+func (c *AgentConfig) Validate() error {
+	if c.SyncInterval != "" {
+		interval, err := time.ParseDuration(c.SyncInterval)
+		if err != nil {
+			return fmt.Errorf("invalid sync interval %q: %w", c.SyncInterval, err)
+		}
+		if interval < MinSyncInterval {
+			return fmt.Errorf("sync interval must be at least %s, got %s", MinSyncInterval, interval)
+		}
+	}
+	return nil
+}
+
+// PortAllocation reports the external port the server allocated for a requested port
+type PortAllocation struct {
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace"`
+	Subdomain     string `json:"subdomain"`
+	RequestedPort int32  `json:"requested_port"`
+	AllocatedPort int32  `json:"allocated_port"`
+	Protocol      string `json:"protocol"`
+}
+
+// ServiceError reports a service the server rejected from an update
+type ServiceError struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Subdomain string `json:"subdomain"`
+	Reason    string `json:"reason"`
+}
+
 // Message is the wrapper for all communications between agent and server
 type Message struct {
-	Type     MessageType      `json:"type"`
-	Services []ExposedService `json:"services,omitempty"`
+	Type        MessageType      `json:"type"`
+	Services    []ExposedService `json:"services,omitempty"`
+	Allocations []PortAllocation `json:"allocations,omitempty"`
+	Errors      []ServiceError   `json:"errors,omitempty"` // Services rejected from the last update
+	Config      *AgentConfig     `json:"config,omitempty"` // Runtime settings pushed to the agent
+
+	// Full marks whether a service update is the agent's complete service
+	// list. Services missing from a full update are removed, a partial update
+	// (false) only adds or changes the services it contains. Updates without
+	// the flag are full, as sent by agents predating partial updates.
+	Full *bool `json:"full,omitempty"`
+
+	// AgentID identifies the sending agent across reconnects and agents
+	// sharing an IP, set on all agent messages (empty = the remote IP)
+	AgentID string `json:"agent_id,omitempty"`
+
+	// Seq numbers pings, pongs echo the sequence number of their ping
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Ping is set on service status messages of servers answering pings.
+	// Agents only check the link once the server advertised it, older
+	// servers would drop connections sending pings.
+	Ping bool `json:"ping,omitempty"`
+}
+
+// IsFull reports whether a service update is the agent's complete service list
+func (m *Message) IsFull() bool {
+	return m.Full == nil || *m.Full
 }
 
 // Validate validates an ExposedService
@@ -59,6 +183,62 @@ func (s *ExposedService) Validate() error {
 	if s.TargetIP == "" {
 		return fmt.Errorf("target IP cannot be empty")
 	}
+	if s.MaxConnections < 0 {
+		return fmt.Errorf("max connections cannot be negative, got %d", s.MaxConnections)
+	}
+	if s.MaxConn < 0 {
+		return fmt.Errorf("maxconn cannot be negative, got %d", s.MaxConn)
+	}
+	if s.HealthCheck != nil {
+		if err := s.HealthCheck.Validate(); err != nil {
+			return fmt.Errorf("invalid health check: %w", err)
+		}
+	}
+	if s.MaintenancePage && s.HealthCheck == nil {
+		return fmt.Errorf("maintenance page requires a health check")
+	}
+	if len(s.Aliases) > 0 && s.Subdomain == WildcardSubdomain {
+		return fmt.Errorf("the wildcard service cannot have aliases")
+	}
+	seen := map[string]bool{s.Subdomain: true}
+	for _, alias := range s.Aliases {
+		if err := ValidateAlias(alias); err != nil {
+			return fmt.Errorf("invalid alias: %w", err)
+		}
+		if seen[alias] {
+			return fmt.Errorf("alias %q is used more than once", alias)
+		}
+		seen[alias] = true
+	}
+	for _, cidr := range s.SourceRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid source range %q", cidr)
+		}
+	}
+	for _, ip := range s.TargetIPs {
+		if ip == "" {
+			return fmt.Errorf("target IPs cannot contain an empty entry")
+		}
+	}
+	if s.SessionAffinity != "" {
+		ttl, err := time.ParseDuration(s.SessionAffinity)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("session affinity must be a positive duration, got %q", s.SessionAffinity)
+		}
+	}
+	return nil
+}
+
+// Validate validates a HealthCheck. The path ends up in the HAProxy config,
+// so only printable characters without whitespace are accepted.
+func (h *HealthCheck) Validate() error {
+	validPath := regexp.MustCompile(`^/[\x21-\x7e]*$`)
+	if !validPath.MatchString(h.Path) {
+		return fmt.Errorf("path must start with '/' and contain no whitespace, got %q", h.Path)
+	}
+	if h.ExpectStatus != 0 && (h.ExpectStatus < 100 || h.ExpectStatus > 599) {
+		return fmt.Errorf("expected status must be between 100 and 599, got %d", h.ExpectStatus)
+	}
 	return nil
 }
 
@@ -67,9 +247,21 @@ func (p *PortMapping) Validate() error {
 	if p.Port < 1 || p.Port > 65535 {
 		return fmt.Errorf("port must be between 1 and 65535, got %d", p.Port)
 	}
+	if p.TargetPort < 0 || p.TargetPort > 65535 {
+		return fmt.Errorf("target port must be between 1 and 65535, got %d", p.TargetPort)
+	}
+	if p.UDPTargetPort < 0 || p.UDPTargetPort > 65535 {
+		return fmt.Errorf("UDP target port must be between 1 and 65535, got %d", p.UDPTargetPort)
+	}
+	if p.NodePort < 0 || p.NodePort > 65535 {
+		return fmt.Errorf("node port must be between 1 and 65535, got %d", p.NodePort)
+	}
 	if p.Protocol != "tcp" && p.Protocol != "udp" && p.Protocol != "tcp+udp" {
 		return fmt.Errorf("protocol must be 'tcp', 'udp', or 'tcp+udp', got %q", p.Protocol)
 	}
+	if p.UDPTargetPort != 0 && p.Protocol != "tcp+udp" {
+		return fmt.Errorf("a separate UDP target port requires protocol 'tcp+udp', got %q", p.Protocol)
+	}
 	return nil
 }
 
@@ -78,6 +270,9 @@ func ValidateSubdomain(subdomain string) error {
 	if subdomain == "" {
 		return fmt.Errorf("subdomain cannot be empty")
 	}
+	if subdomain == WildcardSubdomain {
+		return nil
+	}
 	// DNS label validation: alphanumeric and hyphens, cannot start/end with hyphen
 	validSubdomain := regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
 	if !validSubdomain.MatchString(subdomain) {
@@ -86,14 +281,46 @@ func ValidateSubdomain(subdomain string) error {
 	return nil
 }
 
+// ValidateAlias validates an alias, which unlike a subdomain may consist of
+// several DNS labels, e.g. "www.app"
+func ValidateAlias(alias string) error {
+	if alias == "" {
+		return fmt.Errorf("alias cannot be empty")
+	}
+	if len(alias) > 253 {
+		return fmt.Errorf("alias %q is too long", alias)
+	}
+	for _, label := range strings.Split(alias, ".") {
+		if err := ValidateSubdomain(label); err != nil || label == WildcardSubdomain {
+			return fmt.Errorf("alias %q is not a valid DNS name", alias)
+		}
+	}
+	return nil
+}
+
 // Validate validates a Message
 func (m *Message) Validate() error {
 	if m.Type != MessageTypeServiceUpdate &&
-	   m.Type != MessageTypeServiceDelete &&
-	   m.Type != MessageTypeHeartbeat {
+		m.Type != MessageTypeServiceDelete &&
+		m.Type != MessageTypeHeartbeat &&
+		m.Type != MessageTypeServiceStatus &&
+		m.Type != MessageTypeResync &&
+		m.Type != MessageTypeConfig &&
+		m.Type != MessageTypePing &&
+		m.Type != MessageTypePong {
 		return fmt.Errorf("invalid message type: %q", m.Type)
 	}
-	if m.Type == MessageTypeServiceUpdate || m.Type == MessageTypeServiceDelete {
+	if m.Type == MessageTypeConfig {
+		if m.Config == nil {
+			return fmt.Errorf("config message without config")
+		}
+		if err := m.Config.Validate(); err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	// Services of updates are validated individually by the server, so one
+	// invalid service does not reject the whole update
+	if m.Type == MessageTypeServiceDelete {
 		for i, svc := range m.Services {
 			if err := svc.Validate(); err != nil {
 				return fmt.Errorf("invalid service at index %d: %w", i, err)